@@ -0,0 +1,386 @@
+// pipe - Unix-like pipelines for Go
+//
+// Copyright (c) 2013 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package agent runs pipes on remote hosts.
+//
+// An Agent serves connections from other processes, each of which
+// carries the Spec of a pipe to run on the agent's host, and tunnels
+// the pipe's stdin, stdout, and stderr over the connection. The Remote
+// function returns a pipe that runs another pipe through an agent,
+// so a single Line may span several machines.
+//
+// For example:
+//
+//    remote := agent.Dial("tcp", "build.example.com:7070")
+//    p := pipe.Line(
+//        pipe.ReadFile("input.txt"),
+//        agent.Remote(remote, pipe.Exec("heavy-job")),
+//        pipe.WriteFile("output.txt", 0644),
+//    )
+//
+// Agents run any pipe they're asked to, so they must only be reachable
+// by trusted peers, and their CommandPolicy should restrict commands
+// where appropriate.
+//
+package agent
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"gopkg.in/pipe.v2"
+)
+
+// Agent serves requests to run pipes on the local host.
+type Agent struct {
+	// Dir, if set, is the directory relative to which remote
+	// pipes run. It defaults to the agent's working directory.
+	Dir string
+
+	// CommandPolicy, if set, is used as the CommandPolicy of the
+	// state in which remote pipes run. See pipe.State for details.
+	CommandPolicy func(spec pipe.CommandSpec) error
+}
+
+// Serve accepts connections on l and serves each of them concurrently
+// with ServeConn. It returns when l fails to accept a connection.
+func (a *Agent) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go a.ServeConn(conn)
+	}
+}
+
+// ServeConn runs the pipe requested over conn and closes conn once
+// the pipe terminates. The error returned is about the connection
+// itself; errors from the pipe are reported to the peer instead.
+func (a *Agent) ServeConn(conn net.Conn) error {
+	// The goroutines serving the connection terminate once it's closed.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	kind, data, err := readFrame(r)
+	if err != nil {
+		return err
+	}
+	if kind != frameSpec {
+		return fmt.Errorf("expected pipe specification from agent peer, got frame %q", kind)
+	}
+	w := &frameWriter{w: conn}
+	p, err := pipe.FromSpec(data)
+	if err == nil {
+		err = a.run(p, r, w, &wg)
+	}
+	if errs, ok := err.(pipe.Errors); ok && len(errs) == 1 {
+		// The error will be aggregated again by the peer.
+		err = errs[0]
+	}
+	var payload []byte
+	if err != nil {
+		payload, err = json.Marshal(pipe.NewErrorReport(err))
+		if err != nil {
+			return err
+		}
+	}
+	return w.writeFrame(frameExit, payload)
+}
+
+// run runs p with its stdin read from the stdin frames in r and its
+// stdout and stderr written as frames to w. The goroutines forwarding
+// stdin are added to wg, and terminate once the connection is closed.
+func (a *Agent) run(p pipe.Pipe, r *bufio.Reader, w *frameWriter, wg *sync.WaitGroup) error {
+	stdinr, stdinw := io.Pipe()
+	s := pipe.NewState(&streamWriter{w, frameStdout}, &streamWriter{w, frameStderr})
+	s.Stdin = stdinr
+	s.Dir = a.Dir
+	s.CommandPolicy = a.CommandPolicy
+
+	// The peer only sends a stdin frame after the previous one was
+	// acknowledged, so the connection is always read and a peer going
+	// away is noticed even when the pipe isn't reading its stdin.
+	stdin := make(chan []byte, 1)
+	var m sync.Mutex
+	var done bool
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer close(stdin)
+		for {
+			kind, data, err := readFrame(r)
+			if err != nil {
+				// The peer went away or killed the pipe.
+				stdinw.CloseWithError(err)
+				m.Lock()
+				if !done {
+					s.Kill()
+				}
+				m.Unlock()
+				return
+			}
+			if kind == frameStdin {
+				stdin <- data
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for data := range stdin {
+			if len(data) == 0 {
+				stdinw.Close()
+			} else if _, err := stdinw.Write(data); err == nil {
+				w.writeFrame(frameStdinAck, nil)
+			}
+		}
+	}()
+
+	err := p(s)
+	if err == nil {
+		err = s.RunTasks()
+	}
+	m.Lock()
+	done = true
+	m.Unlock()
+	stdinr.Close()
+	return err
+}
+
+// A Dialer opens connections to an agent.
+type Dialer func() (net.Conn, error)
+
+// Dial returns a Dialer that connects to the agent at address
+// on the named network. See net.Dial for details.
+func Dial(network, address string) Dialer {
+	return func() (net.Conn, error) {
+		return net.Dial(network, address)
+	}
+}
+
+// Remote returns a pipe that runs p through the agent reached via d.
+// The stdin of the returned pipe is streamed to p, and the stdout and
+// stderr of p are streamed back, so Remote may be used as any stage of
+// a Line. The directory and environment changes made within p are
+// carried to the agent, but the directory and environment in which
+// Remote itself runs are not.
+//
+// Only pipes that can be described by a pipe.Spec may run remotely.
+// If the remote pipe fails, the error returned is a *pipe.ErrorReport
+// describing the failure.
+func Remote(d Dialer, p pipe.Pipe) pipe.Pipe {
+	spec, err := pipe.ToSpec(p)
+	return func(s *pipe.State) error {
+		if err != nil {
+			return fmt.Errorf("cannot run pipe remotely: %v", err)
+		}
+		return s.AddTask(&remoteTask{dial: d, spec: spec})
+	}
+}
+
+type remoteTask struct {
+	dial Dialer
+	spec []byte
+
+	m      sync.Mutex
+	conn   net.Conn
+	killed bool
+}
+
+func (t *remoteTask) Run(s *pipe.State) error {
+	conn, err := t.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	t.m.Lock()
+	t.conn = conn
+	killed := t.killed
+	t.m.Unlock()
+	if killed {
+		return pipe.ErrKilled
+	}
+
+	w := &frameWriter{w: conn}
+	if err := w.writeFrame(frameSpec, t.spec); err != nil {
+		return err
+	}
+	acks := make(chan bool, 1)
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := s.Stdin.Read(buf)
+			if n > 0 {
+				if w.writeFrame(frameStdin, buf[:n]) != nil {
+					return
+				}
+				select {
+				case <-acks:
+				case <-done:
+					return
+				}
+			}
+			if err != nil {
+				w.writeFrame(frameStdin, nil)
+				return
+			}
+		}
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		kind, data, err := readFrame(r)
+		if err != nil {
+			t.m.Lock()
+			killed := t.killed
+			t.m.Unlock()
+			if killed {
+				return pipe.ErrKilled
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("connection to agent failed: %v", err)
+		}
+		switch kind {
+		case frameStdinAck:
+			select {
+			case acks <- true:
+			default:
+			}
+		case frameStdout:
+			if _, err := s.Stdout.Write(data); err != nil {
+				return err
+			}
+		case frameStderr:
+			if _, err := s.Stderr.Write(data); err != nil {
+				return err
+			}
+		case frameExit:
+			if len(data) == 0 {
+				return nil
+			}
+			var report pipe.ErrorReport
+			if err := json.Unmarshal(data, &report); err != nil {
+				return fmt.Errorf("invalid error report from agent: %v", err)
+			}
+			return &report
+		}
+	}
+}
+
+func (t *remoteTask) Kill() {
+	t.m.Lock()
+	t.killed = true
+	conn := t.conn
+	t.m.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// Each frame sent over an agent connection holds a one byte kind,
+// a four byte big-endian length, and length bytes of payload.
+// An empty stdin frame notes the end of the stdin stream, and an
+// exit frame holds the JSON pipe.ErrorReport of a failed pipe. Each
+// non-empty stdin frame must be acknowledged by the agent with an
+// empty stdin ack frame before the peer sends the next one.
+const (
+	frameSpec     = 'p'
+	frameStdin    = '0'
+	frameStdinAck = 'a'
+	frameStdout   = '1'
+	frameStderr   = '2'
+	frameExit     = 'x'
+)
+
+const maxFrameSize = 16 << 20
+
+func readFrame(r *bufio.Reader) (kind byte, data []byte, err error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFrameSize {
+		return 0, nil, errors.New("agent frame too large")
+	}
+	data = make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return header[0], data, nil
+}
+
+type frameWriter struct {
+	m sync.Mutex
+	w io.Writer
+}
+
+func (w *frameWriter) writeFrame(kind byte, data []byte) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	var header [5]byte
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[1:], uint32(len(data)))
+	if _, err := w.w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.w.Write(data)
+	return err
+}
+
+type streamWriter struct {
+	w    *frameWriter
+	kind byte
+}
+
+func (w *streamWriter) Write(data []byte) (n int, err error) {
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > 32*1024 {
+			chunk = chunk[:32*1024]
+		}
+		if err := w.w.writeFrame(w.kind, chunk); err != nil {
+			return n, err
+		}
+		data = data[len(chunk):]
+		n += len(chunk)
+	}
+	return n, nil
+}
@@ -0,0 +1,155 @@
+// pipe - Unix-like pipelines for Go
+//
+// Copyright (c) 2013 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/pipe.v2"
+	"gopkg.in/pipe.v2/agent"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type S struct{}
+
+var _ = Suite(S{})
+
+func startAgent(c *C, a *agent.Agent) agent.Dialer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go a.Serve(l)
+	return agent.Dial("tcp", l.Addr().String())
+}
+
+func (S) TestRemote(c *C) {
+	remote := startAgent(c, &agent.Agent{})
+	p := pipe.Line(
+		pipe.Print("hello\n"),
+		agent.Remote(remote, pipe.Line(
+			pipe.Exec("tr", "a-z", "A-Z"),
+			pipe.System("cat; echo remote 1>&2"),
+		)),
+		pipe.Exec("sed", "s/H/J/"),
+	)
+	stdout, stderr, err := pipe.DividedOutput(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(stdout), Equals, "JELLO\n")
+	c.Assert(string(stderr), Equals, "remote\n")
+}
+
+func (S) TestRemoteDir(c *C) {
+	dir := c.MkDir()
+	remote := startAgent(c, &agent.Agent{Dir: dir})
+	output, err := pipe.Output(agent.Remote(remote, pipe.Exec("pwd")))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, dir+"\n")
+}
+
+func (S) TestRemoteError(c *C) {
+	remote := startAgent(c, &agent.Agent{})
+	err := pipe.Run(agent.Remote(remote, pipe.System("echo oops 1>&2; exit 3")))
+	c.Assert(err, ErrorMatches, `command "/bin/sh" .*: exit status 3: oops`)
+	report := pipe.NewErrorReport(err)
+	c.Assert(report.Errors, HasLen, 1)
+	report = report.Errors[0]
+	c.Assert(report.Command, Equals, "/bin/sh")
+	c.Assert(report.ExitCode, Equals, 3)
+}
+
+func (S) TestRemoteCommandPolicy(c *C) {
+	remote := startAgent(c, &agent.Agent{CommandPolicy: pipe.AllowCommands("echo")})
+	output, err := pipe.Output(agent.Remote(remote, pipe.Exec("echo", "ok")))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "ok\n")
+	err = pipe.Run(agent.Remote(remote, pipe.Exec("rm", "-rf", "/")))
+	c.Assert(err, ErrorMatches, `.*command not allowed`)
+}
+
+func (S) TestRemoteUnsupported(c *C) {
+	remote := startAgent(c, &agent.Agent{})
+	err := pipe.Run(agent.Remote(remote, pipe.Print("hello")))
+	c.Assert(err, ErrorMatches, "cannot run pipe remotely: cannot describe pipe .*")
+}
+
+func (S) TestRemoteKill(c *C) {
+	remote := startAgent(c, &agent.Agent{})
+	s := pipe.NewState(nil, nil)
+	s.Timeout = 100 * time.Millisecond
+	p := agent.Remote(remote, pipe.Exec("sleep", "10"))
+	c.Assert(p(s), IsNil)
+	start := time.Now()
+	c.Assert(s.RunTasks(), ErrorMatches, "timeout")
+	c.Assert(time.Since(start) < 5*time.Second, Equals, true)
+}
+
+func (S) TestRemoteKillUnreadStdin(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+	served := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			err = (&agent.Agent{}).ServeConn(conn)
+		}
+		served <- err
+	}()
+	remote := agent.Dial("tcp", l.Addr().String())
+	s := pipe.NewState(nil, nil)
+	s.Timeout = 100 * time.Millisecond
+	p := pipe.Line(
+		pipe.Exec("yes"),
+		agent.Remote(remote, pipe.Exec("sleep", "10")),
+	)
+	c.Assert(p(s), IsNil)
+	c.Assert(s.RunTasks(), ErrorMatches, "timeout")
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("agent did not notice the killed pipe")
+	}
+}
+
+func (S) TestRemoteLargeStream(c *C) {
+	remote := startAgent(c, &agent.Agent{})
+	data := bytes.Repeat([]byte("0123456789abcdef\n"), 1<<16)
+	s := pipe.NewState(nil, nil)
+	var out bytes.Buffer
+	s.Stdin = bytes.NewReader(data)
+	s.Stdout = &out
+	p := agent.Remote(remote, pipe.Exec("cat"))
+	c.Assert(p(s), IsNil)
+	c.Assert(s.RunTasks(), IsNil)
+	c.Assert(bytes.Equal(out.Bytes(), data), Equals, true)
+}
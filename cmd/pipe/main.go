@@ -0,0 +1,180 @@
+// pipe - Unix-like pipelines for Go
+//
+// Copyright (c) 2013 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// The pipe command runs pipes described by JSON specification files.
+//
+// Usage:
+//
+//	pipe [flags] <spec file>
+//
+// The specification format is documented by the Spec type in the
+// gopkg.in/pipe.v2 package. The pipe reads from the standard input of
+// the command and writes to its standard output and error, and the
+// command exits with the status of the failed command in the pipe, or
+// with status 1 for other errors.
+//
+// The flags are:
+//
+//	-dry-run    print the pipe in shell syntax instead of running it
+//	-trace      print commands to standard error before running them
+//	-timeout    abort the pipe if it runs for longer than the duration
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/pipe.v2"
+)
+
+var (
+	dryRun  = flag.Bool("dry-run", false, "print the pipe in shell syntax instead of running it")
+	trace   = flag.Bool("trace", false, "print commands to standard error before running them")
+	timeout = flag.Duration("timeout", 0, "abort the pipe if it runs for longer than the duration")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: pipe [flags] <spec file>\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	os.Exit(run(flag.Arg(0)))
+}
+
+func run(path string) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	var spec pipe.Spec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s: invalid pipe specification: %v\n", path, err)
+		return 1
+	}
+	p, err := spec.Pipe()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s: %v\n", path, err)
+		return 1
+	}
+	if *dryRun {
+		fmt.Println(formatSpec(&spec))
+		return 0
+	}
+
+	s := pipe.NewState(os.Stdout, os.Stderr)
+	s.Stdin = os.Stdin
+	s.Timeout = *timeout
+	if *trace {
+		s.BeforeExec = func(spec *pipe.CommandSpec) error {
+			fmt.Fprintf(os.Stderr, "+ %s\n", formatCommand(spec.Name, spec.Args))
+			return nil
+		}
+	}
+	err = p(s)
+	if err == nil {
+		err = s.RunTasks()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return pipe.ExitCode(err)
+	}
+	return 0
+}
+
+// formatSpec returns the shell syntax equivalent to spec.
+func formatSpec(spec *pipe.Spec) string {
+	var cmd string
+	switch {
+	case spec.Line != nil:
+		var entries []string
+		for _, entry := range spec.Line {
+			entries = append(entries, formatSpec(entry))
+		}
+		cmd = strings.Join(entries, " | ")
+	case spec.Script != nil:
+		var entries []string
+		for _, entry := range spec.Script {
+			entries = append(entries, formatSpec(entry)+";")
+		}
+		cmd = "{ " + strings.Join(entries, " ") + " }"
+	case spec.Stage != "":
+		cmd = formatCommand("pipe:"+spec.Stage, spec.Args)
+	default:
+		cmd = formatCommand(spec.Exec, spec.Args)
+	}
+	if spec.Stdin != "" {
+		cmd += " < " + shellQuote(spec.Stdin)
+	}
+	if spec.Stdout != "" {
+		cmd += " > " + shellQuote(spec.Stdout)
+	}
+	if len(spec.Env) > 0 {
+		var names []string
+		for name := range spec.Env {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var vars []string
+		for _, name := range names {
+			vars = append(vars, name+"="+shellQuote(spec.Env[name]))
+		}
+		if spec.Line != nil || spec.Script != nil {
+			cmd = "(export " + strings.Join(vars, " ") + "; " + cmd + ")"
+		} else {
+			cmd = strings.Join(vars, " ") + " " + cmd
+		}
+	}
+	if spec.Dir != "" {
+		cmd = "(cd " + shellQuote(spec.Dir) + " && " + cmd + ")"
+	}
+	return cmd
+}
+
+func formatCommand(name string, args []string) string {
+	words := []string{shellQuote(name)}
+	for _, arg := range args {
+		words = append(words, shellQuote(arg))
+	}
+	return strings.Join(words, " ")
+}
+
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:,+@%") == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
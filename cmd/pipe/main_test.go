@@ -0,0 +1,72 @@
+// pipe - Unix-like pipelines for Go
+//
+// Copyright (c) 2013 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/pipe.v2"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type S struct{}
+
+var _ = Suite(S{})
+
+func (S) TestFormatSpec(c *C) {
+	tests := []struct {
+		spec   string
+		result string
+	}{
+		{`{"exec": "echo", "args": ["hello world"]}`, `echo 'hello world'`},
+		{`{"exec": "echo", "args": ["it's"]}`, `echo 'it'\''s'`},
+		{`{"line": [{"exec": "cat", "stdin": "in"}, {"exec": "sort", "stdout": "out"}]}`, `cat < in | sort > out`},
+		{`{"script": [{"exec": "true"}, {"exec": "false"}], "dir": "/tmp"}`, `(cd /tmp && { true; false; })`},
+		{`{"exec": "env", "env": {"B": "2", "A": "1 2"}}`, `A='1 2' B=2 env`},
+		{`{"line": [{"exec": "env"}, {"exec": "cat"}], "env": {"A": "1"}}`, `(export A=1; env | cat)`},
+		{`{"stage": "s3get", "args": ["bucket", "key"]}`, `pipe:s3get bucket key`},
+	}
+	for _, test := range tests {
+		var spec pipe.Spec
+		c.Assert(json.Unmarshal([]byte(test.spec), &spec), IsNil)
+		c.Assert(formatSpec(&spec), Equals, test.result, Commentf("spec: %s", test.spec))
+	}
+}
+
+func (S) TestExitCode(c *C) {
+	err := pipe.Run(pipe.Exec("sh", "-c", "exit 3"))
+	c.Assert(pipe.ExitCode(err), Equals, 3)
+	err = pipe.Run(pipe.Line(pipe.Exec("sh", "-c", "exit 4"), pipe.Exec("true")))
+	c.Assert(pipe.ExitCode(err), Equals, 4)
+	err = pipe.Run(pipe.ReadFile("/non-existent"))
+	c.Assert(pipe.ExitCode(err), Equals, 1)
+}
@@ -0,0 +1,149 @@
+// pipe - Unix-like pipelines for Go
+//
+// Copyright (c) 2013 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package otelpipe traces pipes with OpenTelemetry, creating a span
+// for every task run by a pipe, parented to the span in the context
+// provided by the caller. The spans of tasks run by nested pipes, such
+// as the ones within a Timeout, are children of the span of the task
+// running them.
+//
+// For example:
+//
+//    ctx, span := tracer.Start(ctx, "deploy")
+//    defer span.End()
+//    err := pipe.Run(otelpipe.Trace(ctx, pipe.Script(
+//        pipe.Exec("make"),
+//        pipe.Exec("make", "install"),
+//    )))
+//
+package otelpipe
+
+import (
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"gopkg.in/pipe.v2"
+)
+
+// instrumentationName is the name of the tracer used by default.
+const instrumentationName = "gopkg.in/pipe.v2/otelpipe"
+
+// Trace returns a pipe that runs p with its tasks traced by
+// an Observer created with NewObserver(ctx, nil). The entries
+// following p in the enclosing pipe are not traced.
+func Trace(ctx context.Context, p pipe.Pipe) pipe.Pipe {
+	return pipe.Observe(NewObserver(ctx, nil), p)
+}
+
+// Observer is a pipe.Observer that creates a span for every task
+// it observes. Spans are named after the command run by the task,
+// or after the task description for tasks that don't run commands,
+// and carry the command name and arguments, the exit status of failed
+// commands, and the number of bytes the task read and wrote.
+type Observer struct {
+	ctx    context.Context
+	tracer trace.Tracer
+
+	m     sync.Mutex
+	spans map[*pipe.ObservedTask]trace.Span
+}
+
+// NewObserver returns an Observer creating spans with tracer, parented
+// to the span in ctx, if any. If tracer is nil, the tracer is obtained
+// from the global tracer provider.
+func NewObserver(ctx context.Context, tracer trace.Tracer) *Observer {
+	if tracer == nil {
+		tracer = otel.Tracer(instrumentationName)
+	}
+	return &Observer{
+		ctx:    ctx,
+		tracer: tracer,
+		spans:  make(map[*pipe.ObservedTask]trace.Span),
+	}
+}
+
+// TaskStarted starts the span for t.
+func (o *Observer) TaskStarted(t *pipe.ObservedTask) {
+	name := t.Name
+	if name == "" {
+		name = t.Task
+	}
+	attrs := []attribute.KeyValue{attribute.String("pipe.task", t.Task)}
+	if t.Name != "" {
+		attrs = append(attrs,
+			attribute.String("pipe.command.name", t.Name),
+			attribute.StringSlice("pipe.command.args", t.Args),
+		)
+	}
+	if t.Dir != "" {
+		attrs = append(attrs, attribute.String("pipe.dir", t.Dir))
+	}
+	ctx := o.ctx
+	o.m.Lock()
+	if parent, ok := o.spans[t.Parent]; ok {
+		ctx = trace.ContextWithSpan(ctx, parent)
+	}
+	o.m.Unlock()
+	_, span := o.tracer.Start(ctx, name,
+		trace.WithTimestamp(t.Started),
+		trace.WithAttributes(attrs...),
+	)
+	o.m.Lock()
+	o.spans[t] = span
+	o.m.Unlock()
+}
+
+// TaskTransferred does nothing, as the number of bytes
+// transferred is recorded once the task ends.
+func (o *Observer) TaskTransferred(t *pipe.ObservedTask, read, written int) {}
+
+// TaskEnded records the outcome of t and ends its span.
+func (o *Observer) TaskEnded(t *pipe.ObservedTask, err error) {
+	o.m.Lock()
+	span, ok := o.spans[t]
+	delete(o.spans, t)
+	o.m.Unlock()
+	if !ok {
+		return
+	}
+	span.SetAttributes(
+		attribute.Int64("pipe.bytes_read", t.BytesRead),
+		attribute.Int64("pipe.bytes_written", t.BytesWritten),
+	)
+	if status, ok := pipe.ExitStatus(err); ok {
+		span.SetAttributes(attribute.Int("pipe.command.exit_status", status))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End(trace.WithTimestamp(t.Started.Add(t.Duration)))
+}
@@ -0,0 +1,136 @@
+// pipe - Unix-like pipelines for Go
+//
+// Copyright (c) 2013 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package otelpipe_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"gopkg.in/pipe.v2"
+	"gopkg.in/pipe.v2/otelpipe"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type S struct{}
+
+var _ = Suite(S{})
+
+func attrs(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	m := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		m[kv.Key] = kv.Value
+	}
+	return m
+}
+
+func (S) TestTrace(c *C) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer := provider.Tracer("test")
+	ctx, parent := tracer.Start(context.Background(), "deploy")
+
+	p := pipe.Script(
+		pipe.Line(
+			pipe.Exec("echo", "hello"),
+			pipe.Exec("cat"),
+		),
+		pipe.Exec("sh", "-c", "exit 3"),
+	)
+	s := pipe.NewState(nil, nil)
+	s.AddObserver(otelpipe.NewObserver(ctx, tracer))
+	c.Assert(p(s), IsNil)
+	c.Assert(s.RunTasks(), ErrorMatches, `script\[1\]: command "sh" .*: exit status 3`)
+	parent.End()
+
+	spans := recorder.Ended()
+	c.Assert(spans, HasLen, 4)
+	byName := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range spans {
+		byName[span.Name()] = span
+	}
+
+	echo := byName["echo"]
+	c.Assert(echo, NotNil)
+	c.Assert(echo.Parent().SpanID(), Equals, parent.SpanContext().SpanID())
+	c.Assert(attrs(echo)["pipe.command.args"].AsStringSlice(), DeepEquals, []string{"hello"})
+	c.Assert(attrs(echo)["pipe.bytes_written"].AsInt64(), Equals, int64(6))
+	c.Assert(echo.Status().Code, Equals, codes.Unset)
+
+	cat := byName["cat"]
+	c.Assert(cat, NotNil)
+	c.Assert(attrs(cat)["pipe.bytes_read"].AsInt64(), Equals, int64(6))
+
+	sh := byName["sh"]
+	c.Assert(sh, NotNil)
+	c.Assert(attrs(sh)["pipe.command.exit_status"].AsInt64(), Equals, int64(3))
+	c.Assert(sh.Status().Code, Equals, codes.Error)
+}
+
+func (S) TestTraceGlobal(c *C) {
+	err := pipe.Run(otelpipe.Trace(context.Background(), pipe.Exec("true")))
+	c.Assert(err, IsNil)
+}
+
+func (S) TestTraceScope(c *C) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	saved := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(saved)
+	otel.SetTracerProvider(provider)
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "deploy")
+
+	p := pipe.Script(
+		otelpipe.Trace(ctx, pipe.Timeout(pipe.Exec("echo", "traced"), time.Minute)),
+		pipe.Exec("true"),
+	)
+	c.Assert(pipe.Run(p), IsNil)
+	parent.End()
+
+	spans := recorder.Ended()
+	c.Assert(spans, HasLen, 3)
+	byName := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range spans {
+		byName[span.Name()] = span
+	}
+	c.Assert(byName["true"], IsNil)
+	timeout := byName["task *pipe.subTask"]
+	c.Assert(timeout, NotNil)
+	c.Assert(timeout.Parent().SpanID(), Equals, parent.SpanContext().SpanID())
+	echo := byName["echo"]
+	c.Assert(echo, NotNil)
+	c.Assert(echo.Parent().SpanID(), Equals, timeout.SpanContext().SpanID())
+}
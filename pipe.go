@@ -35,18 +35,41 @@ package pipe
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/transform"
 )
 
 // Pipe functions implement arbitrary functionality that may be
@@ -102,11 +125,145 @@ type State struct {
 	// If set to zero, the pipe will not be aborted.
 	Timeout time.Duration
 
+	// Executor starts the commands run by Exec and System.
+	// If nil, commands are run as local processes via LocalExecutor.
+	Executor Executor
+
+	// KillSignal, if set, is sent to commands when the pipe is killed,
+	// instead of killing them immediately, so that they may terminate
+	// gracefully. Commands still running after KillGrace are killed.
+	// KillGrace defaults to 10 seconds. Processes of executors that
+	// cannot deliver signals are always killed immediately.
+	// See GracefulKill.
+	KillSignal syscall.Signal
+	KillGrace  time.Duration
+
+	// CommandPolicy, if set, is called with the details of every command
+	// about to be run by the pipe, and the command is not run if it
+	// returns an error. See AllowCommands.
+	CommandPolicy func(spec CommandSpec) error
+
+	// BeforeExec, if set, is called with the details of every command
+	// about to be run by Exec, System, and SourceScript, before
+	// CommandPolicy, and may change them. For example, it may prefix
+	// all commands with "nice". The command is not run if it returns
+	// an error.
+	BeforeExec func(spec *CommandSpec) error
+
+	// AfterExec, if set, is called with the details of every command
+	// run by Exec, System, and SourceScript once it terminates, along
+	// with the error reported by its Executor and the time it took
+	// to run.
+	AfterExec func(spec CommandSpec, err error, duration time.Duration)
+
+	// ObjectStore is the object storage that ReadObject and
+	// WriteObject operate on.
+	ObjectStore ObjectStore
+
+	// CheckpointFile, if set, is the path of the file where the names
+	// of the Checkpoint entries that completed are recorded, and the
+	// entries already recorded in it are skipped. A relative path is
+	// relative to the working directory of the process rather than to
+	// Dir, so that every entry uses the same file. See Checkpoint.
+	CheckpointFile string
+
+	// StallTimeout enables the detection of stalled pipes. If set, and
+	// the running tasks neither transfer any data through their streams
+	// nor terminate for that long, a report describing the running tasks
+	// is provided to StallHandler, or written to Stderr if StallHandler
+	// is nil. Streams are monitored only while detection is enabled.
+	StallTimeout time.Duration
+	StallHandler func(r *StallReport)
+
+	// StderrTail is the maximum amount of data from the end of the stderr
+	// output of a failed command that is reported in its error, which is
+	// 4KB if zero. If negative, no output is kept, and commands are given
+	// the Stderr stream as is, which lets exec pass a file to them
+	// directly. Output is never kept when Stdout and Stderr are the same
+	// writer, other than ioutil.Discard, as it would then hold stdout
+	// output as well.
+	StderrTail int
+
+	// StatsHandler, if set, is called once the tasks terminate with
+	// statistics on how long each of them spent blocked reading from
+	// and writing to its streams, which shows which entries of a line
+	// are its bottleneck. Streams are measured only while it is set,
+	// and files handed to commands directly, such as an *os.File
+	// stdin, are not measured.
+	StatsHandler func(r *StatsReport)
+
+	// NoPipefail causes lines created via Line to fail only when their
+	// last entry fails, as shells do when the pipefail option is unset.
+	// In that case the returned error also reports the failures of the
+	// preceding entries that terminated before the last one; entries
+	// still running when it fails are killed and their errors dropped.
+	// It defaults to false, so that a line fails when any of its
+	// entries fail.
+	NoPipefail bool
+
+	// WriteQuota, if positive, limits the total number of bytes the
+	// pipe may write to files via WriteFile, AppendFile, TeeWriteFile,
+	// TeeAppendFile, WriteFileWithInfo, CopyFile, MoveFile, SplitFile,
+	// SplitFileBytes, DD, and Download, including the temporary files
+	// of Cached, Buffer, and ReverseLines. Once the limit is exceeded,
+	// the entry writing fails with ErrQuotaExceeded. Files written by
+	// commands themselves, such as the output files of Detach, are not
+	// accounted.
+	WriteQuota int64
+
+	// quotaUsed holds the number of bytes accounted against
+	// WriteQuota, shared by all the tasks of the pipe.
+	quotaUsed *int64
+
+	// nested reports whether the state runs a pipe within a task
+	// of another state. See newSubState.
+	nested bool
+
 	killedMutex sync.Mutex
 	killedNoted bool
 	killed      chan bool
 
 	pendingTasks []*pendingTask
+
+	// stdinSet reports whether the last entry added changed the
+	// stdin of the following entries. See SetStdin.
+	stdinSet bool
+
+	// wrappers holds the middleware applied to the streams of
+	// the tasks added. See WrapStdout.
+	wrappers streamWrappers
+
+	// observers holds the observers notified of the progress
+	// of the tasks run. See AddObserver.
+	observers []Observer
+
+	// scopedObservers holds the observers notified of the progress
+	// of the tasks added while they're set. See Observe.
+	scopedObservers []Observer
+
+	// observed describes the task run with the state, or the one
+	// running the nested pipe the state is for, if it's observed.
+	observed *ObservedTask
+
+	// input and output, if set, link the task to the previous and
+	// following entries of the line it's part of. See stopReading.
+	input, output *lineLink
+
+	// position describes where the entry being added sits within
+	// the enclosing Line or Script, such as "line[2]". See Named.
+	position string
+
+	// spec collects the structure of the pipe while it is introspected.
+	spec *specCollector
+
+	// procs tracks the commands running within the pipe, including
+	// the ones in nested pipes, so that they may be signaled.
+	procs *processSet
+
+	// keptEnv holds the names of the variables kept by the ClearEnv
+	// and KeepEnv entries added, or is nil if there were none, so that
+	// they may be described in a Spec.
+	keptEnv []string
 }
 
 // NewState returns a new state for running pipes with.
@@ -126,7 +283,47 @@ func NewState(stdout, stderr io.Writer) *State {
 		Stderr: stderr,
 		Env:    os.Environ(),
 		killed: make(chan bool, 1),
+
+		quotaUsed: new(int64),
+		procs:     &processSet{},
+	}
+}
+
+// ErrQuotaExceeded is returned when a pipe exceeds the WriteQuota
+// set in its State.
+var ErrQuotaExceeded = errors.New("write quota exceeded")
+
+// quotaWriter returns a writer that writes to w while accounting
+// the data written against the state's WriteQuota.
+func (s *State) quotaWriter(w io.Writer) io.Writer {
+	if s.WriteQuota <= 0 {
+		return w
+	}
+	if s.quotaUsed == nil {
+		s.quotaUsed = new(int64)
+	}
+	return &quotaWriter{w, s.WriteQuota, s.quotaUsed}
+}
+
+type quotaWriter struct {
+	w     io.Writer
+	quota int64
+	used  *int64
+}
+
+func (w *quotaWriter) Write(b []byte) (int, error) {
+	if err := w.charge(len(b)); err != nil {
+		return 0, err
 	}
+	return w.w.Write(b)
+}
+
+// charge accounts n bytes against the quota, failing if that exceeds it.
+func (w *quotaWriter) charge(n int) error {
+	if atomic.AddInt64(w.used, int64(n)) > w.quota {
+		return ErrQuotaExceeded
+	}
+	return nil
 }
 
 type pendingTask struct {
@@ -137,7 +334,16 @@ type pendingTask struct {
 	wg sync.WaitGroup
 	wt []*pendingTask
 
-	cancel int32
+	cancel   int32
+	finished int32
+
+	mon      *taskMonitor
+	stats    *TaskStats
+	observed *ObservedTask
+
+	// stages holds the stages wrapped with Named or Timed that
+	// the task is part of, from the innermost to the outermost.
+	stages []taskStage
 }
 
 func (pt *pendingTask) closeWhenDone(c io.Closer) {
@@ -153,6 +359,32 @@ func (pt *pendingTask) wait() {
 	pt.wg.Wait()
 }
 
+// run runs the task, converting a panic into a PanicError.
+func (pt *pendingTask) run() (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+	flush := pt.s.wrappers.apply(&pt.s)
+	err = pt.t.Run(&pt.s)
+	err = firstErr(err, flush())
+	if err != nil && pt.s.output.stopped() && isBrokenPipe(err) {
+		err = nil
+	}
+	return err
+}
+
+// assemble adds the tasks of p to s, converting a panic into a PanicError.
+func assemble(s *State, p Pipe) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+	return p(s)
+}
+
 func (pt *pendingTask) done(err error) {
 	for _, c := range pt.c {
 		c.Close()
@@ -170,6 +402,22 @@ var (
 	ErrKilled  = errors.New("explicitly killed")
 )
 
+// PanicError is returned when a task panics while running, or a pipe
+// panics while its tasks are added by Run and similar functions. The
+// panic is recovered so that other tasks may be killed and the pipe
+// terminates normally.
+type PanicError struct {
+	// Value holds the value provided to panic.
+	Value interface{}
+
+	// Stack holds the stack trace of the panicking goroutine.
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
 type Errors []error
 
 func (e Errors) Error() string {
@@ -180,11 +428,190 @@ func (e Errors) Error() string {
 	return strings.Join(errors, "; ")
 }
 
+// Unwrap returns the aggregated errors, so that errors.Is and
+// errors.As consider each of them.
+func (e Errors) Unwrap() []error {
+	return e
+}
+
+// ErrorReport is a machine-readable description of an error returned
+// when running a pipe, suitable for being marshaled as JSON.
+// Use NewErrorReport to obtain one.
+type ErrorReport struct {
+	// Message holds the error message.
+	Message string `json:"message"`
+
+	// Command, Args, and Dir describe the failed command,
+	// if the error was caused by one.
+	Command string   `json:"command,omitempty"`
+	Args    []string `json:"args,omitempty"`
+	Dir     string   `json:"dir,omitempty"`
+
+	// ExitCode holds the exit status of the failed command, or -1 if
+	// it was terminated by the signal named in Signal.
+	ExitCode int    `json:"exit_code,omitempty"`
+	Signal   string `json:"signal,omitempty"`
+
+	// Duration holds for how long the failed command ran,
+	// marshaled as a number of nanoseconds.
+	Duration time.Duration `json:"duration,omitempty"`
+
+	// Stderr holds the last lines the failed command wrote to stderr.
+	Stderr string `json:"stderr,omitempty"`
+
+	// Errors holds reports for each of the errors aggregated
+	// into the reported error, if any.
+	Errors []*ErrorReport `json:"errors,omitempty"`
+
+	// Stage and Position identify the stage wrapped with Named
+	// that failed, if any. See StageError.
+	Stage    string `json:"stage,omitempty"`
+	Position string `json:"position,omitempty"`
+}
+
+// Error returns the message of the reported error.
+func (r *ErrorReport) Error() string {
+	return r.Message
+}
+
+// NewErrorReport returns a report describing err, or nil if err is nil.
+func NewErrorReport(err error) *ErrorReport {
+	if err == nil {
+		return nil
+	}
+	if r, ok := err.(*ErrorReport); ok {
+		return r
+	}
+	r := &ErrorReport{Message: err.Error()}
+	switch e := err.(type) {
+	case Errors:
+		for _, err := range e {
+			r.Errors = append(r.Errors, NewErrorReport(err))
+		}
+	case *StageError:
+		*r = *NewErrorReport(e.Err)
+		r.Message = e.Error()
+		r.Stage = e.Name
+		r.Position = e.Position
+	case *execError:
+		r.Command = e.name
+		r.Args = e.args
+		r.Dir = e.dir
+		r.Duration = e.duration
+		r.Stderr = e.stderr
+		if ee, ok := e.err.(*ExitError); ok {
+			r.ExitCode = ee.Code
+			if ee.Signal != 0 {
+				r.Signal = ee.Signal.String()
+			}
+		}
+	}
+	return r
+}
+
+// ExitCode returns the exit status a command-line tool running a pipe
+// should exit with to faithfully report err. It returns 0 if err is nil,
+// 124 if the pipe timed out, 130 if it was explicitly killed, the exit
+// status of the first failed command in err, 128 plus the signal number
+// if that command was terminated by a signal, or 1 otherwise.
+//
+// For example:
+//
+//     err := pipe.Run(p)
+//     if err != nil {
+//         fmt.Fprintf(os.Stderr, "error: %v\n", err)
+//     }
+//     os.Exit(pipe.ExitCode(err))
+//
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if code := interruptCode(err); code != 0 {
+		return code
+	}
+	if code := commandCode(err); code > 0 {
+		return code
+	}
+	return 1
+}
+
+// interruptCode returns the exit status reporting that err was
+// caused by a timeout or an explicit kill, or 0 if it wasn't.
+func interruptCode(err error) int {
+	switch e := err.(type) {
+	case Errors:
+		for _, err := range e {
+			if code := interruptCode(err); code != 0 {
+				return code
+			}
+		}
+		return 0
+	case *StageError:
+		return interruptCode(e.Err)
+	case *ErrorReport:
+		for _, r := range e.Errors {
+			if code := interruptCode(r); code != 0 {
+				return code
+			}
+		}
+		switch e.Message {
+		case ErrTimeout.Error():
+			return 124
+		case ErrKilled.Error():
+			return 130
+		}
+		return 0
+	}
+	switch {
+	case errors.Is(err, ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return 124
+	case err == ErrKilled, errors.Is(err, context.Canceled):
+		return 130
+	}
+	return 0
+}
+
+// commandCode returns the exit status of the first failed command
+// reported in err, or 0 if there's none.
+func commandCode(err error) int {
+	switch e := err.(type) {
+	case Errors:
+		for _, err := range e {
+			if code := commandCode(err); code > 0 {
+				return code
+			}
+		}
+	case *StageError:
+		return commandCode(e.Err)
+	case *ErrorReport:
+		if e.ExitCode > 0 {
+			return e.ExitCode
+		}
+		for _, r := range e.Errors {
+			if code := commandCode(r); code > 0 {
+				return code
+			}
+		}
+	case *execError:
+		if ee, ok := e.err.(*ExitError); ok {
+			if ee.Signal != 0 {
+				return 128 + int(ee.Signal)
+			}
+			return ee.Code
+		}
+	}
+	return 0
+}
+
 // AddTask adds t to be run concurrently with other tasks
 // as appropriate for the pipe.
 func (s *State) AddTask(t Task) error {
+	if s.spec != nil {
+		return s.spec.addTask(s, t)
+	}
 	pt := &pendingTask{s: *s, t: t}
-	pt.s.Env = append([]string(nil), s.Env...)
+	pt.s.Env = copyEnv(s.Env)
 	s.pendingTasks = append(s.pendingTasks, pt)
 	return nil
 }
@@ -194,14 +621,47 @@ func (s *State) AddTask(t Task) error {
 // This is called by the pipe running functions and generally
 // there's no reason to call it directly.
 func (s *State) RunTasks() error {
+	if s.StallTimeout > 0 {
+		stop := s.watchStalls()
+		defer stop()
+	}
+	if s.StatsHandler != nil {
+		report := s.measureTasks()
+		defer s.StatsHandler(report)
+	}
+	s.observeTasks()
+	s.instrumentTasks()
+
 	done := make(chan error, len(s.pendingTasks))
 	for _, f := range s.pendingTasks {
 		go func(pt *pendingTask) {
 			pt.wait()
 			var err error
 			if pt.cancel == 0 {
-				err = pt.t.Run(&pt.s)
+				for _, stage := range pt.stages {
+					stage.started()
+				}
+				if pt.observed != nil {
+					s.observeStart(pt)
+				}
+				pt.mon.start()
+				started := time.Now()
+				err = pt.run()
+				if pt.stats != nil {
+					pt.stats.Duration = time.Since(started)
+				}
+				pt.mon.stop()
+				if pt.observed != nil {
+					s.observeEnd(pt, err)
+				}
+				if err != nil && pt.s.position != "" {
+					err = &StageError{Position: pt.s.position, Err: err}
+				}
 			}
+			for _, stage := range pt.stages {
+				err = stage.ended(err)
+			}
+			atomic.StoreInt32(&pt.finished, 1)
 			pt.done(err)
 			done <- err
 		}(f)
@@ -249,6 +709,12 @@ func (s *State) RunTasks() error {
 	s.pendingTasks = nil
 
 	if errs == nil {
+		if s.CheckpointFile != "" && !s.nested {
+			// The run completed, so the next one starts from scratch.
+			if err := os.Remove(s.CheckpointFile); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
 		return nil
 	}
 
@@ -265,14 +731,496 @@ func (s *State) RunTasks() error {
 	return errs
 }
 
+// StallReport describes the tasks running when a stalled pipe
+// was detected. See the StallTimeout field of State.
+type StallReport struct {
+	// Idle holds for how long the tasks made no progress.
+	Idle time.Duration
+
+	// Tasks describes each of the tasks still running.
+	Tasks []StalledTask
+}
+
+// StalledTask describes a task running when a stalled pipe was detected.
+type StalledTask struct {
+	// Task describes the task, including the command name
+	// and arguments for tasks that execute commands.
+	Task string
+
+	// PID holds the process id of the executed command, if any.
+	PID int
+
+	// Blocked holds the name of the stream the task is blocked on,
+	// which is "stdin", "stdout", or "stderr", or is empty if the task
+	// is not blocked reading from or writing to its streams.
+	Blocked string
+}
+
+func (r *StallReport) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "pipe stalled for %v with %d running tasks:\n", r.Idle, len(r.Tasks))
+	for _, t := range r.Tasks {
+		fmt.Fprintf(&buf, "  %s", t.Task)
+		if t.PID != 0 {
+			fmt.Fprintf(&buf, " (pid %d)", t.PID)
+		}
+		if t.Blocked != "" {
+			fmt.Fprintf(&buf, " blocked on %s", t.Blocked)
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+const (
+	streamNone int32 = iota
+	streamStdin
+	streamStdout
+	streamStderr
+)
+
+var streamNames = []string{"", "stdin", "stdout", "stderr"}
+
+// taskMonitor tracks the progress of a running task for
+// the detection of stalled pipes.
+type taskMonitor struct {
+	progress *int64
+	running  int32
+	blocked  int32
+}
+
+func (m *taskMonitor) start() {
+	if m != nil {
+		atomic.StoreInt32(&m.running, 1)
+	}
+}
+
+func (m *taskMonitor) stop() {
+	if m != nil {
+		atomic.StoreInt32(&m.running, 0)
+		atomic.AddInt64(m.progress, 1)
+	}
+}
+
+// watchStalls monitors the pending tasks and reports when they stall,
+// until the returned function is called.
+func (s *State) watchStalls() (stop func()) {
+	var progress int64
+	for _, pt := range s.pendingTasks {
+		pt.mon = &taskMonitor{progress: &progress}
+	}
+
+	tasks := s.pendingTasks
+	handler := s.StallHandler
+	if handler == nil {
+		stderr := s.Stderr
+		handler = func(r *StallReport) { io.WriteString(stderr, r.String()) }
+	}
+	interval := s.StallTimeout / 4
+	if interval <= 0 {
+		interval = s.StallTimeout
+	}
+	ticker := time.NewTicker(interval)
+	quit := make(chan bool)
+	go func() {
+		last := atomic.LoadInt64(&progress)
+		lastTime := time.Now()
+		reported := false
+		for {
+			select {
+			case <-quit:
+				return
+			case now := <-ticker.C:
+				if current := atomic.LoadInt64(&progress); current != last {
+					last, lastTime, reported = current, now, false
+					continue
+				}
+				if reported || now.Sub(lastTime) < s.StallTimeout {
+					continue
+				}
+				reported = true
+				r := &StallReport{Idle: now.Sub(lastTime)}
+				for _, pt := range tasks {
+					if atomic.LoadInt32(&pt.mon.running) == 0 {
+						continue
+					}
+					desc, pid := describeTask(pt.t)
+					r.Tasks = append(r.Tasks, StalledTask{
+						Task:    desc,
+						PID:     pid,
+						Blocked: streamNames[atomic.LoadInt32(&pt.mon.blocked)],
+					})
+				}
+				handler(r)
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(quit)
+	}
+}
+
+// StatsReport holds the statistics of the tasks run by a pipe.
+// See the StatsHandler field of State.
+type StatsReport struct {
+	Tasks []*TaskStats
+}
+
+// TaskStats holds the statistics of a task run by a pipe. The time the
+// task spent running but not blocked on its streams is its busy time,
+// and the entry of a line with the longest busy time is the one
+// limiting its throughput.
+type TaskStats struct {
+	// Task describes the task, including the command name
+	// and arguments for tasks that execute commands.
+	Task string
+
+	// Duration holds for how long the task ran.
+	Duration time.Duration
+
+	// ReadBlocked and WriteBlocked hold for how long the task was
+	// blocked reading from its stdin and writing to its stdout and
+	// stderr, respectively.
+	ReadBlocked  time.Duration
+	WriteBlocked time.Duration
+
+	// BytesRead and BytesWritten hold the amount of data read from
+	// stdin and written to stdout and stderr, respectively.
+	BytesRead    int64
+	BytesWritten int64
+}
+
+// Busy returns for how long the task ran while not blocked
+// reading from or writing to its streams.
+func (t *TaskStats) Busy() time.Duration {
+	busy := t.Duration - t.ReadBlocked - t.WriteBlocked
+	if busy < 0 {
+		busy = 0
+	}
+	return busy
+}
+
+// Bottleneck returns the statistics of the task with the longest
+// busy time, or nil if there are no tasks.
+func (r *StatsReport) Bottleneck() *TaskStats {
+	var max *TaskStats
+	for _, t := range r.Tasks {
+		if max == nil || t.Busy() > max.Busy() {
+			max = t
+		}
+	}
+	return max
+}
+
+func (r *StatsReport) String() string {
+	var buf bytes.Buffer
+	for _, t := range r.Tasks {
+		fmt.Fprintf(&buf, "%s: ran %v, busy %v, blocked reading %v (%d bytes), blocked writing %v (%d bytes)\n",
+			t.Task, t.Duration, t.Busy(), t.ReadBlocked, t.BytesRead, t.WriteBlocked, t.BytesWritten)
+	}
+	return buf.String()
+}
+
+// measureTasks sets up the statistics of the pending tasks, and
+// returns the report that holds them once the tasks terminate.
+func (s *State) measureTasks() *StatsReport {
+	r := &StatsReport{}
+	for _, pt := range s.pendingTasks {
+		desc, _ := describeTask(pt.t)
+		pt.stats = &TaskStats{Task: desc}
+		r.Tasks = append(r.Tasks, pt.stats)
+	}
+	return r
+}
+
+// Observer is notified of the progress of the tasks run by a pipe,
+// for example to trace what a pipe ran and how long each step took.
+// Its methods may be called concurrently for different tasks.
+// See the AddObserver method of State.
+type Observer interface {
+	// TaskStarted is called when a task starts running.
+	TaskStarted(t *ObservedTask)
+
+	// TaskTransferred is called whenever a task reads from its stdin or
+	// writes to its stdout or stderr, with the number of bytes read and
+	// written by that operation. Transfers through files handed to
+	// commands directly, such as an *os.File stdin, are not reported.
+	TaskTransferred(t *ObservedTask, read, written int)
+
+	// TaskEnded is called when a task terminates, with the error
+	// it failed with, if any.
+	TaskEnded(t *ObservedTask, err error)
+}
+
+// ObservedTask describes a task reported to an Observer.
+type ObservedTask struct {
+	// Task describes the task, including the command name
+	// and arguments for tasks that execute commands.
+	Task string
+
+	// Name and Args hold the command name and arguments
+	// for tasks that execute commands.
+	Name string
+	Args []string
+
+	// Dir holds the pipe's current directory for the task.
+	Dir string
+
+	// Parent describes the task running the nested pipe the task
+	// is part of, such as a Timeout entry, if that one is observed
+	// as well. It's nil for tasks not run by nested pipes.
+	Parent *ObservedTask
+
+	// Started holds when the task started running.
+	Started time.Time
+
+	// Duration, BytesRead, and BytesWritten hold for how long the
+	// task ran and how much data it transferred via its streams.
+	// They are only set when the task ends.
+	Duration     time.Duration
+	BytesRead    int64
+	BytesWritten int64
+
+	read, written int64
+}
+
+// AddObserver registers o to be notified of the progress of the tasks
+// run by s, including tasks run by pipes nested within them.
+//
+// For example, this logs every task run by the pipe:
+//
+//    s := pipe.NewState(os.Stdout, os.Stderr)
+//    s.AddObserver(logger)
+//    err := p(s)
+//    if err == nil {
+//        err = s.RunTasks()
+//    }
+//
+func (s *State) AddObserver(o Observer) {
+	// Copy the slice so that states sharing it are unaffected.
+	s.observers = append(s.observers[:len(s.observers):len(s.observers)], o)
+}
+
+// Observe returns a pipe that runs p with o notified of the progress
+// of the tasks p adds, including tasks run by pipes nested within them.
+// Unlike with AddObserver, the entries following p are not observed.
+//
+// For example, this logs the tasks of the build only:
+//
+//    p := pipe.Script(
+//        pipe.Observe(logger, pipe.Exec("make")),
+//        pipe.Exec("make", "install"),
+//    )
+//
+func Observe(o Observer, p Pipe) Pipe {
+	return func(s *State) error {
+		saved := s.scopedObservers
+		defer func() { s.scopedObservers = saved }()
+		s.scopedObservers = append(saved[:len(saved):len(saved)], o)
+		return p(s)
+	}
+}
+
+// observeTasks sets up the pending tasks to be reported to the
+// registered observers and to the ones set when they were added.
+func (s *State) observeTasks() {
+	for _, pt := range s.pendingTasks {
+		observers := s.observers
+		if len(pt.s.scopedObservers) > 0 {
+			observers = append(observers[:len(observers):len(observers)], pt.s.scopedObservers...)
+		}
+		// Pipes nested within the task inherit all of them.
+		pt.s.observers, pt.s.scopedObservers = observers, nil
+		if len(observers) == 0 {
+			continue
+		}
+		desc, _ := describeTask(pt.t)
+		t := &ObservedTask{Task: desc, Dir: pt.s.Dir, Parent: s.observed}
+		if f, ok := innerTask(pt.t).(*execTask); ok {
+			t.Name = f.name
+			t.Args = f.args
+			if f.dir != "" {
+				t.Dir = pt.s.Path(f.dir)
+			}
+		}
+		pt.observed = t
+		pt.s.observed = t
+	}
+}
+
+// observeStart notifies the observers that pt started running.
+func (s *State) observeStart(pt *pendingTask) {
+	pt.observed.Started = time.Now()
+	for _, o := range pt.s.observers {
+		o.TaskStarted(pt.observed)
+	}
+}
+
+// observeEnd notifies the observers that pt terminated with err.
+func (s *State) observeEnd(pt *pendingTask, err error) {
+	t := pt.observed
+	t.Duration = time.Since(t.Started)
+	t.BytesRead = atomic.LoadInt64(&t.read)
+	t.BytesWritten = atomic.LoadInt64(&t.written)
+	for _, o := range pt.s.observers {
+		o.TaskEnded(t, err)
+	}
+}
+
+// instrumentTasks wraps the streams of the pending tasks that have a
+// stall monitor, statistics, or observers set up, so that their
+// transfers are accounted for all of them at once. Files given to
+// commands are left alone so that exec hands them to the command
+// directly, rather than copying through them in goroutines that may
+// block on a never-ending stdin, so transfers through them are not
+// accounted.
+func (s *State) instrumentTasks() {
+	for _, pt := range s.pendingTasks {
+		if pt.mon == nil && pt.stats == nil && pt.observed == nil {
+			continue
+		}
+		probe := &taskProbe{pt.mon, pt.stats, pt.observed, pt.s.observers}
+		_, direct := innerTask(pt.t).(*execTask)
+		wrap := func(w io.Writer, stream int32) io.Writer {
+			if _, ok := w.(*os.File); ok && direct {
+				return w
+			}
+			return &probeWriter{w, probe, stream}
+		}
+		stdout := wrap(pt.s.Stdout, streamStdout)
+		if sameWriter(pt.s.Stdout, pt.s.Stderr) {
+			pt.s.Stderr = stdout
+		} else {
+			pt.s.Stderr = wrap(pt.s.Stderr, streamStderr)
+		}
+		pt.s.Stdout = stdout
+		if _, ok := pt.s.Stdin.(*os.File); !ok || !direct {
+			pt.s.Stdin = &probeReader{pt.s.Stdin, probe}
+		}
+	}
+}
+
+// taskProbe accounts the transfers of a task for its stall monitor,
+// statistics, and observers, whichever are set.
+type taskProbe struct {
+	mon       *taskMonitor
+	stats     *TaskStats
+	observed  *ObservedTask
+	observers []Observer
+}
+
+// blocking records that the task is blocked on stream.
+func (p *taskProbe) blocking(stream int32) {
+	if p.mon != nil {
+		atomic.StoreInt32(&p.mon.blocked, stream)
+	}
+}
+
+// transferred records that the task transferred n bytes via stream
+// after being blocked on it for the given duration.
+func (p *taskProbe) transferred(stream int32, n int, blocked time.Duration) {
+	if m := p.mon; m != nil {
+		atomic.StoreInt32(&m.blocked, streamNone)
+		atomic.AddInt64(m.progress, 1)
+	}
+	if st := p.stats; st != nil {
+		if stream == streamStdin {
+			atomic.AddInt64((*int64)(&st.ReadBlocked), int64(blocked))
+			atomic.AddInt64(&st.BytesRead, int64(n))
+		} else {
+			atomic.AddInt64((*int64)(&st.WriteBlocked), int64(blocked))
+			atomic.AddInt64(&st.BytesWritten, int64(n))
+		}
+	}
+	if t := p.observed; t != nil && n > 0 {
+		read, written := 0, n
+		if stream == streamStdin {
+			read, written = n, 0
+			atomic.AddInt64(&t.read, int64(n))
+		} else {
+			atomic.AddInt64(&t.written, int64(n))
+		}
+		for _, o := range p.observers {
+			o.TaskTransferred(t, read, written)
+		}
+	}
+}
+
+type probeReader struct {
+	r     io.Reader
+	probe *taskProbe
+}
+
+func (r *probeReader) Read(b []byte) (n int, err error) {
+	r.probe.blocking(streamStdin)
+	started := time.Now()
+	n, err = r.r.Read(b)
+	r.probe.transferred(streamStdin, n, time.Since(started))
+	return n, err
+}
+
+type probeWriter struct {
+	w      io.Writer
+	probe  *taskProbe
+	stream int32
+}
+
+func (w *probeWriter) Write(b []byte) (n int, err error) {
+	w.probe.blocking(w.stream)
+	started := time.Now()
+	n, err = w.w.Write(b)
+	w.probe.transferred(w.stream, n, time.Since(started))
+	return n, err
+}
+
+// describeTask returns a description of t and
+// the process id of the command it runs, if any.
+func describeTask(t Task) (desc string, pid int) {
+	switch tt := innerTask(t).(type) {
+	case *execTask:
+		tt.m.Lock()
+		if p, ok := tt.p.(interface{ Pid() int }); ok {
+			pid = p.Pid()
+		}
+		tt.m.Unlock()
+		return fmt.Sprintf("command %q %q", tt.name, tt.args), pid
+	default:
+		return fmt.Sprintf("task %T", tt), 0
+	}
+}
+
+// innerTask returns the task wrapped by t to adapt
+// it to the pipe it was added to, if any.
+func innerTask(t Task) Task {
+	for {
+		switch tt := t.(type) {
+		case brokenPipeTask:
+			t = tt.Task
+		case *lineStageTask:
+			t = tt.Task
+		default:
+			return t
+		}
+	}
+}
+
 func discardErr(err error) bool {
-	if err == io.ErrClosedPipe {
+	// Tasks that support being killed, such as the file pipes and the
+	// ones running nested pipes, report ErrKilled when they're killed
+	// because another task failed, and that error must not be reported
+	// alongside the failure that caused it. Explicit kills and timeouts
+	// are still reported, as RunTasks records them before killing the
+	// tasks and then ignores the errors of the killed tasks.
+	if err == io.ErrClosedPipe || err == ErrKilled {
 		return true
 	}
+	if err1, ok := err.(*StageError); ok {
+		return discardErr(err1.Err)
+	}
 	if err1, ok := err.(*execError); ok {
-		if err2, ok := err1.err.(*exec.ExitError); ok {
-			status, ok := err2.Sys().(syscall.WaitStatus)
-			return ok && status.Signaled() && status.Signal() == 9
+		if err2, ok := err1.err.(*ExitError); ok {
+			return err2.Signal == 9 || err1.killed && err2.Signal != 0
 		}
 	}
 	return false
@@ -311,9 +1259,103 @@ func (s *State) SetEnvVar(name, value string) {
 	s.Env = append(s.Env, prefix+value)
 }
 
-// Path returns the provided path relative to the state's current directory.
-// If multiple arguments are provided, they're joined via filepath.Join.
-// If path is absolute, it is taken by itself.
+// copyEnv returns a copy of env that is only nil if env is nil,
+// as commands run with a nil environment inherit the environment
+// of the current process, while an empty one is kept empty.
+func copyEnv(env []string) []string {
+	if env == nil {
+		return nil
+	}
+	return append([]string{}, env...)
+}
+
+// WrapStdout registers f to wrap the stdout of every task added to s
+// afterwards, so that concerns such as redacting secrets or measuring
+// the output may be handled once for all entries of a pipe. Only tasks
+// writing to the stdout s has when f is registered are affected, so
+// the data flowing between the entries of a Line is left alone. The
+// wrapper is created when the task starts, and if it implements a
+// Flush() error method, that method is called when the task finishes.
+// Wrappers registered later wrap the ones registered earlier.
+func (s *State) WrapStdout(f func(w io.Writer) io.Writer) {
+	// Copy the slice so that tasks already added are unaffected.
+	w := s.wrappers.stdout
+	s.wrappers.stdout = append(w[:len(w):len(w)], writerWrapper{s.Stdout, f})
+}
+
+// WrapStderr registers f to wrap the stderr of every task added to s
+// afterwards that writes to the stderr s has when f is registered.
+// See WrapStdout for details.
+func (s *State) WrapStderr(f func(w io.Writer) io.Writer) {
+	w := s.wrappers.stderr
+	s.wrappers.stderr = append(w[:len(w):len(w)], writerWrapper{s.Stderr, f})
+}
+
+// WrapStdin registers f to wrap the stdin of every task added to s
+// afterwards that reads from the stdin s has when f is registered.
+func (s *State) WrapStdin(f func(r io.Reader) io.Reader) {
+	w := s.wrappers.stdin
+	s.wrappers.stdin = append(w[:len(w):len(w)], readerWrapper{s.Stdin, f})
+}
+
+type streamWrappers struct {
+	stdin  []readerWrapper
+	stdout []writerWrapper
+	stderr []writerWrapper
+}
+
+// readerWrapper wraps the streams reading from r with f.
+type readerWrapper struct {
+	r io.Reader
+	f func(r io.Reader) io.Reader
+}
+
+// writerWrapper wraps the streams writing to w with f.
+type writerWrapper struct {
+	w io.Writer
+	f func(w io.Writer) io.Writer
+}
+
+// apply wraps the streams of s and returns a function that flushes
+// the wrappers, starting from the outermost ones.
+func (sw *streamWrappers) apply(s *State) (flush func() error) {
+	var flushers []interface{ Flush() error }
+	stdin, stdout, stderr := s.Stdin, s.Stdout, s.Stderr
+	for _, w := range sw.stdin {
+		if sameReader(stdin, w.r) {
+			s.Stdin = w.f(s.Stdin)
+		}
+	}
+	for _, w := range sw.stdout {
+		if !sameWriter(stdout, w.w) {
+			continue
+		}
+		s.Stdout = w.f(s.Stdout)
+		if fl, ok := s.Stdout.(interface{ Flush() error }); ok {
+			flushers = append(flushers, fl)
+		}
+	}
+	for _, w := range sw.stderr {
+		if !sameWriter(stderr, w.w) {
+			continue
+		}
+		s.Stderr = w.f(s.Stderr)
+		if fl, ok := s.Stderr.(interface{ Flush() error }); ok {
+			flushers = append(flushers, fl)
+		}
+	}
+	return func() error {
+		var err error
+		for i := len(flushers) - 1; i >= 0; i-- {
+			err = firstErr(err, flushers[i].Flush())
+		}
+		return err
+	}
+}
+
+// Path returns the provided path relative to the state's current directory.
+// If multiple arguments are provided, they're joined via filepath.Join.
+// If path is absolute, it is taken by itself.
 func (s *State) Path(path ...string) string {
 	if len(path) == 0 {
 		return s.Dir
@@ -339,7 +1381,7 @@ func firstErr(err1, err2 error) error {
 // See functions Output, CombinedOutput, and DividedOutput.
 func Run(p Pipe) error {
 	s := NewState(nil, nil)
-	err := p(s)
+	err := assemble(s, p)
 	if err == nil {
 		err = s.RunTasks()
 	}
@@ -354,7 +1396,7 @@ func Run(p Pipe) error {
 func RunTimeout(p Pipe, timeout time.Duration) error {
 	s := NewState(nil, nil)
 	s.Timeout = timeout
-	err := p(s)
+	err := assemble(s, p)
 	if err == nil {
 		err = s.RunTasks()
 	}
@@ -367,7 +1409,7 @@ func RunTimeout(p Pipe, timeout time.Duration) error {
 func Output(p Pipe) ([]byte, error) {
 	outb := &OutputBuffer{}
 	s := NewState(outb, nil)
-	err := p(s)
+	err := assemble(s, p)
 	if err == nil {
 		err = s.RunTasks()
 	}
@@ -383,7 +1425,7 @@ func OutputTimeout(p Pipe, timeout time.Duration) ([]byte, error) {
 	outb := &OutputBuffer{}
 	s := NewState(outb, nil)
 	s.Timeout = timeout
-	err := p(s)
+	err := assemble(s, p)
 	if err == nil {
 		err = s.RunTasks()
 	}
@@ -397,7 +1439,7 @@ func OutputTimeout(p Pipe, timeout time.Duration) ([]byte, error) {
 func CombinedOutput(p Pipe) ([]byte, error) {
 	outb := &OutputBuffer{}
 	s := NewState(outb, outb)
-	err := p(s)
+	err := assemble(s, p)
 	if err == nil {
 		err = s.RunTasks()
 	}
@@ -414,7 +1456,7 @@ func CombinedOutputTimeout(p Pipe, timeout time.Duration) ([]byte, error) {
 	outb := &OutputBuffer{}
 	s := NewState(outb, outb)
 	s.Timeout = timeout
-	err := p(s)
+	err := assemble(s, p)
 	if err == nil {
 		err = s.RunTasks()
 	}
@@ -428,7 +1470,7 @@ func DividedOutput(p Pipe) (stdout []byte, stderr []byte, err error) {
 	outb := &OutputBuffer{}
 	errb := &OutputBuffer{}
 	s := NewState(outb, errb)
-	err = p(s)
+	err = assemble(s, p)
 	if err == nil {
 		err = s.RunTasks()
 	}
@@ -445,13 +1487,323 @@ func DividedOutputTimeout(p Pipe, timeout time.Duration) (stdout []byte, stderr
 	errb := &OutputBuffer{}
 	s := NewState(outb, errb)
 	s.Timeout = timeout
-	err = p(s)
+	err = assemble(s, p)
 	if err == nil {
 		err = s.RunTasks()
 	}
 	return outb.Bytes(), errb.Bytes(), err
 }
 
+// Job is a pipe running in the background. See Start.
+type Job struct {
+	s    *State
+	done chan struct{}
+	err  error
+}
+
+// Start starts running the p pipe in the background, discarding its
+// output, and returns a handle for supervising it from other goroutines.
+//
+// For example:
+//
+//    job, err := pipe.Start(pipe.Exec("server"))
+//    if err != nil {
+//        return err
+//    }
+//    select {
+//    case <-job.Done():
+//        return job.Wait()
+//    case <-shutdown:
+//        job.Signal(syscall.SIGTERM)
+//        return job.Wait()
+//    }
+//
+func Start(p Pipe) (*Job, error) {
+	s := NewState(nil, nil)
+	if err := assemble(s, p); err != nil {
+		return nil, err
+	}
+	j := &Job{s: s, done: make(chan struct{})}
+	go func() {
+		j.err = s.RunTasks()
+		close(j.done)
+	}()
+	return j, nil
+}
+
+// Wait waits for the job to terminate and returns
+// the error the pipe failed with, if any.
+func (j *Job) Wait() error {
+	<-j.done
+	return j.err
+}
+
+// Done returns a channel that is closed once the job terminates.
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// Kill kills the job, including any commands it started.
+// Wait reports ErrKilled afterwards unless the job had
+// already terminated.
+func (j *Job) Kill() {
+	j.s.Kill()
+}
+
+// Signal sends sig to the commands being run by the job, including
+// the ones run by nested pipes such as the ones in a Group or under
+// a Timeout. Unlike Kill, it leaves it up to the commands to decide
+// how to handle the signal, and the job terminates only once they do.
+// It returns the first error found, for example if the executor of a
+// command cannot deliver signals.
+func (j *Job) Signal(sig os.Signal) error {
+	return j.s.procs.signal(sig)
+}
+
+// processSet holds the commands running within a pipe and
+// the pipes nested in it. See Job.Signal.
+type processSet struct {
+	m     sync.Mutex
+	tasks []*execTask
+}
+
+func (ps *processSet) add(f *execTask) {
+	if ps == nil {
+		return
+	}
+	ps.m.Lock()
+	ps.tasks = append(ps.tasks, f)
+	ps.m.Unlock()
+}
+
+func (ps *processSet) remove(f *execTask) {
+	if ps == nil {
+		return
+	}
+	ps.m.Lock()
+	for i, t := range ps.tasks {
+		if t == f {
+			ps.tasks = append(ps.tasks[:i], ps.tasks[i+1:]...)
+			break
+		}
+	}
+	ps.m.Unlock()
+}
+
+func (ps *processSet) signal(sig os.Signal) error {
+	if ps == nil {
+		return nil
+	}
+	ps.m.Lock()
+	tasks := append([]*execTask(nil), ps.tasks...)
+	ps.m.Unlock()
+	var first error
+	for _, f := range tasks {
+		f.m.Lock()
+		p := f.p
+		f.m.Unlock()
+		var err error
+		if sp, ok := p.(interface{ Signal(sig os.Signal) error }); ok {
+			err = sp.Signal(sig)
+		} else {
+			err = fmt.Errorf("cannot signal command %q: executor does not support signals", f.name)
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// ContextError is returned by the context-aware running functions
+// when the pipe is killed because its context is done.
+type ContextError struct {
+	// Err holds the error reported by the context.
+	Err error
+
+	// Tasks describes each of the tasks still running when
+	// the context was done, including the command name and
+	// arguments for tasks that execute commands.
+	Tasks []string
+}
+
+func (e *ContextError) Error() string {
+	if len(e.Tasks) == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v while running %s", e.Err, strings.Join(e.Tasks, ", "))
+}
+
+// Unwrap returns the error reported by the context.
+func (e *ContextError) Unwrap() error {
+	return e.Err
+}
+
+// RunContext runs the p pipe discarding its output.
+//
+// The pipe is killed, including any commands it started, once ctx is done.
+// The returned error is then a *ContextError wrapping ctx.Err().
+//
+// See functions OutputContext, CombinedOutputContext, and DividedOutputContext.
+func RunContext(ctx context.Context, p Pipe) error {
+	s := NewState(nil, nil)
+	return runContext(ctx, s, p)
+}
+
+// OutputContext runs the p pipe and returns its stdout output.
+//
+// The pipe is killed, including any commands it started, once ctx is done.
+// The returned error is then a *ContextError wrapping ctx.Err().
+//
+// See functions RunContext, CombinedOutputContext, and DividedOutputContext.
+func OutputContext(ctx context.Context, p Pipe) ([]byte, error) {
+	outb := &OutputBuffer{}
+	s := NewState(outb, nil)
+	err := runContext(ctx, s, p)
+	return outb.Bytes(), err
+}
+
+// CombinedOutputContext runs the p pipe and returns its stdout and stderr
+// outputs merged together.
+//
+// The pipe is killed, including any commands it started, once ctx is done.
+// The returned error is then a *ContextError wrapping ctx.Err().
+//
+// See functions RunContext, OutputContext, and DividedOutputContext.
+func CombinedOutputContext(ctx context.Context, p Pipe) ([]byte, error) {
+	outb := &OutputBuffer{}
+	s := NewState(outb, outb)
+	err := runContext(ctx, s, p)
+	return outb.Bytes(), err
+}
+
+// DividedOutputContext runs the p pipe and returns its stdout and stderr outputs.
+//
+// The pipe is killed, including any commands it started, once ctx is done.
+// The returned error is then a *ContextError wrapping ctx.Err().
+//
+// See functions RunContext, OutputContext, and CombinedOutputContext.
+func DividedOutputContext(ctx context.Context, p Pipe) (stdout []byte, stderr []byte, err error) {
+	outb := &OutputBuffer{}
+	errb := &OutputBuffer{}
+	s := NewState(outb, errb)
+	err = runContext(ctx, s, p)
+	return outb.Bytes(), errb.Bytes(), err
+}
+
+// runContext runs the p pipe on s, killing it once ctx is done.
+func runContext(ctx context.Context, s *State, p Pipe) error {
+	if err := ctx.Err(); err != nil {
+		return &ContextError{Err: err}
+	}
+	if err := assemble(s, p); err != nil {
+		return err
+	}
+	tasks := s.pendingTasks
+	stop := make(chan bool)
+	done := make(chan *ContextError, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cerr := &ContextError{Err: ctx.Err()}
+			for _, pt := range tasks {
+				if atomic.LoadInt32(&pt.finished) == 0 {
+					desc, _ := describeTask(pt.t)
+					cerr.Tasks = append(cerr.Tasks, desc)
+				}
+			}
+			s.Kill()
+			done <- cerr
+		case <-stop:
+			done <- nil
+		}
+	}()
+	err := s.RunTasks()
+	close(stop)
+	if cerr := <-done; cerr != nil && err != nil {
+		return cerr
+	}
+	return err
+}
+
+// AsFilter starts running the p pipe in the background and returns a
+// stream transformer backed by it. Data written to the returned value
+// is provided to the pipe as its stdin, and data read from it is the
+// pipe's stdout.
+//
+// Close closes the pipe's stdin, and the remaining output must still
+// be read until io.EOF is returned, at which point the pipe has finished.
+// If the pipe fails, the error is returned by Read instead of io.EOF.
+// A caller that stops reading before then must call Kill instead, so
+// that the pipe and its processes are terminated.
+//
+// For example:
+//
+//     f := pipe.AsFilter(pipe.Line(pipe.Exec("gunzip"), pipe.Exec("grep", "ERROR")))
+//     go func() {
+//         io.Copy(f, compressedLog)
+//         f.Close()
+//     }()
+//     io.Copy(os.Stdout, f)
+//
+func AsFilter(p Pipe) *FilterStream {
+	inr, inw := io.Pipe()
+	outr, outw := io.Pipe()
+	s := NewState(outw, nil)
+	s.Stdin = inr
+	f := &FilterStream{r: outr, w: inw, s: s, done: make(chan struct{})}
+	if err := assemble(s, p); err != nil {
+		inr.CloseWithError(err)
+		outw.CloseWithError(err)
+		close(f.done)
+	} else {
+		go func() {
+			err := s.RunTasks()
+			if err == nil {
+				inr.CloseWithError(io.ErrClosedPipe)
+			} else {
+				inr.CloseWithError(err)
+			}
+			outw.CloseWithError(err)
+			close(f.done)
+		}()
+	}
+	return f
+}
+
+// FilterStream is the stream transformer returned by AsFilter.
+type FilterStream struct {
+	r    *io.PipeReader
+	w    *io.PipeWriter
+	s    *State
+	done chan struct{}
+}
+
+// Read reads output of the pipe from f.
+func (f *FilterStream) Read(b []byte) (n int, err error) {
+	return f.r.Read(b)
+}
+
+// Write writes b to the pipe's stdin.
+func (f *FilterStream) Write(b []byte) (n int, err error) {
+	return f.w.Write(b)
+}
+
+// Close closes the pipe's stdin.
+func (f *FilterStream) Close() error {
+	return f.w.Close()
+}
+
+// Kill closes the pipe's stdin, kills the pipe, and waits for it to
+// terminate. Output not read yet is discarded, and further reads
+// return io.ErrClosedPipe.
+func (f *FilterStream) Kill() {
+	f.w.Close()
+	f.s.Kill()
+	f.r.Close()
+	<-f.done
+}
+
 // OutputBuffer is a concurrency safe writer that buffers all input.
 //
 // It is used in the implementation of the output functions.
@@ -476,27 +1828,89 @@ func (out *OutputBuffer) Bytes() []byte {
 	return buf
 }
 
-// Exec returns a pipe that runs the named program with the given arguments.
-func Exec(name string, args ...string) Pipe {
-	return func(s *State) error {
-		s.AddTask(&execTask{name: name, args: args})
+// CommandSpec describes a command to be started by an Executor.
+type CommandSpec struct {
+	Name string
+	Args []string
+	Dir  string
+	Env  []string
+}
+
+// Streams holds the streams a command started by an Executor must be
+// connected to. If Stdout and Stderr are the same writer, the ordering
+// of the data written to them must be preserved.
+type Streams struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Process represents a command started by an Executor.
+//
+// Processes that also implement a Signal(sig os.Signal) error method
+// may be terminated gracefully. See the KillSignal field of State.
+type Process interface {
+	// Wait blocks until the command terminates and all of its
+	// streams are flushed, and returns an error if it failed.
+	// Errors reporting an unsuccessful exit status should have
+	// an ExitCode() int method, as *exec.ExitError does.
+	Wait() error
+
+	// Kill abruptly interrupts the command.
+	Kill() error
+}
+
+// An Executor starts commands on behalf of the Exec and System pipes.
+// Assigning an Executor to a State changes how its commands are run,
+// for example to run them remotely or to fake them in tests.
+//
+// See WithExecutor.
+type Executor interface {
+	// Start starts the command described by spec connected to
+	// the provided streams, without waiting for it to terminate.
+	Start(spec CommandSpec, streams Streams) (Process, error)
+}
+
+// AllowCommands returns a function suitable for the CommandPolicy field
+// of State that only allows running the named commands.
+func AllowCommands(names ...string) func(spec CommandSpec) error {
+	allowed := make(map[string]bool)
+	for _, name := range names {
+		allowed[name] = true
+	}
+	return func(spec CommandSpec) error {
+		if !allowed[spec.Name] {
+			return errCommandNotAllowed
+		}
 		return nil
 	}
 }
 
-// System returns a pipe that runs cmd via a system shell.
-// It is equivalent to the pipe Exec("/bin/sh", "-c", cmd).
-func System(cmd string) Pipe {
-	return Exec("/bin/sh", "-c", cmd)
-}
+var errCommandNotAllowed = errors.New("command not allowed")
 
 type execTask struct {
 	name string
 	args []string
 
+	// dir, if set, is the directory the command runs in,
+	// relative to the pipe's current directory.
+	dir string
+
+	// stdinPath, if set, is the file used as the command's stdin.
+	stdinPath string
+
+	// pidFile, if set, is the file the command's PID is written to.
+	pidFile string
+
 	m      sync.Mutex
-	p      *os.Process
+	p      Process
 	cancel bool
+
+	// killSignal and killGrace define how the command is killed,
+	// and exited is closed once it terminates. See State.KillSignal.
+	killSignal syscall.Signal
+	killGrace  time.Duration
+	exited     chan bool
 }
 
 func (f *execTask) Run(s *State) error {
@@ -505,41 +1919,308 @@ func (f *execTask) Run(s *State) error {
 		f.m.Unlock()
 		return nil
 	}
-	cmd := exec.Command(f.name, f.args...)
-	cmd.Dir = s.Dir
-	cmd.Env = s.Env
-	cmd.Stdin = s.Stdin
-	cmd.Stdout = s.Stdout
-	cmd.Stderr = s.Stderr
-	err := cmd.Start()
-	f.p = cmd.Process
+	var stderr *tailWriter
+	if s.StderrTail >= 0 && !combinedOutput(s) {
+		stderr = &tailWriter{max: s.StderrTail}
+		if stderr.max == 0 {
+			stderr.max = stderrTailSize
+		}
+	}
+	dir := s.Dir
+	if f.dir != "" {
+		dir = s.Path(f.dir)
+	}
+	spec := CommandSpec{Name: f.name, Args: f.args, Dir: dir, Env: s.Env}
+	streams := Streams{
+		Stdin:  s.Stdin,
+		Stdout: s.Stdout,
+		Stderr: s.Stderr,
+	}
+	if stderr != nil {
+		streams.Stderr = io.MultiWriter(s.Stderr, stderr)
+	}
+	if err := s.checkCommand(&spec); err != nil {
+		f.m.Unlock()
+		return &execError{name: f.name, args: f.args, dir: dir, err: err}
+	}
+	if f.stdinPath != "" {
+		file, err := os.Open(s.Path(f.stdinPath))
+		if err != nil {
+			f.m.Unlock()
+			return err
+		}
+		defer file.Close()
+		streams.Stdin = file
+	}
+	started := time.Now()
+	p, err := s.executor().Start(spec, streams)
+	f.p = p
+	f.killSignal = s.KillSignal
+	f.killGrace = s.KillGrace
+	f.exited = make(chan bool)
 	f.m.Unlock()
 	if err != nil {
-		return err
+		if s.AfterExec != nil {
+			s.AfterExec(spec, err, time.Since(started))
+		}
+		return &startError{err}
+	}
+	s.procs.add(f)
+	defer s.procs.remove(f)
+	if f.pidFile != "" {
+		path := s.Path(f.pidFile)
+		pid, err := writePIDFile(path, p)
+		if err != nil {
+			p.Kill()
+			p.Wait()
+			return &startError{err}
+		}
+		defer removePIDFile(path, pid)
 	}
-	if err := cmd.Wait(); err != nil {
-		return &execError{f.name, err}
+	err = p.Wait()
+	close(f.exited)
+	if s.AfterExec != nil {
+		s.AfterExec(spec, err, time.Since(started))
+	}
+	if err != nil {
+		f.m.Lock()
+		killed := f.cancel
+		f.m.Unlock()
+		return &execError{
+			name:     f.name,
+			args:     f.args,
+			dir:      dir,
+			err:      newExitError(f.name, f.args, err),
+			stderr:   stderr.tail(),
+			duration: time.Since(started),
+			killed:   killed,
+		}
+	}
+	return nil
+}
+
+// checkCommand runs the command described by spec through the BeforeExec
+// and CommandPolicy hooks of s, returning the error of the first one that
+// refuses it.
+func (s *State) checkCommand(spec *CommandSpec) error {
+	if s.BeforeExec != nil {
+		if err := s.BeforeExec(spec); err != nil {
+			return err
+		}
+	}
+	if s.CommandPolicy != nil {
+		return s.CommandPolicy(*spec)
 	}
 	return nil
 }
 
+// executor returns the Executor commands are started with.
+func (s *State) executor() Executor {
+	if s.Executor == nil {
+		return DefaultExecutor()
+	}
+	return s.Executor
+}
+
+// DefaultExecutor returns the Executor used when the State has none.
+// It is a LocalExecutor on platforms that support processes, and an
+// Executor that fails to start any command on the others, such as wasm.
+func DefaultExecutor() Executor {
+	return localExecutor()
+}
+
+// combinedOutput reports whether the stdout and stderr output of the
+// tasks added to s are combined into a single stream that's not discarded.
+func combinedOutput(s *State) bool {
+	return s.Stderr != ioutil.Discard && sameWriter(s.Stdout, s.Stderr)
+}
+
+func sameWriter(a, b io.Writer) (same bool) {
+	defer func() {
+		if recover() != nil {
+			same = false
+		}
+	}()
+	return a == b
+}
+
+func sameReader(a, b io.Reader) (same bool) {
+	defer func() {
+		if recover() != nil {
+			same = false
+		}
+	}()
+	return a == b
+}
+
+// stderrTailSize is the maximum amount of data from the end of
+// the stderr output of a failed command reported in its error.
+const stderrTailSize = 4 * 1024
+
+// tailWriter holds the last max bytes written to it.
+type tailWriter struct {
+	buf       []byte
+	max       int
+	truncated bool
+}
+
+func (w *tailWriter) Write(b []byte) (n int, err error) {
+	w.buf = append(w.buf, b...)
+	if len(w.buf) > w.max {
+		w.buf = append(w.buf[:0], w.buf[len(w.buf)-w.max:]...)
+		w.truncated = true
+	}
+	return len(b), nil
+}
+
+// tail returns the complete lines held by w with surrounding
+// whitespace trimmed.
+func (w *tailWriter) tail() string {
+	if w == nil {
+		return ""
+	}
+	buf := w.buf
+	if i := bytes.IndexByte(buf, '\n'); w.truncated && i >= 0 {
+		buf = buf[i+1:]
+	}
+	return string(bytes.TrimSpace(buf))
+}
+
 func (f *execTask) Kill() {
 	f.m.Lock()
 	p := f.p
 	f.cancel = true
+	sig, grace, exited := f.killSignal, f.killGrace, f.exited
 	f.m.Unlock()
-	if p != nil {
-		p.Kill()
+	if p == nil {
+		return
+	}
+	if sp, ok := p.(interface{ Signal(sig os.Signal) error }); ok && sig != 0 {
+		if grace == 0 {
+			grace = 10 * time.Second
+		}
+		if sp.Signal(sig) == nil {
+			go func() {
+				select {
+				case <-exited:
+				case <-time.After(grace):
+					p.Kill()
+				}
+			}()
+			return
+		}
 	}
+	p.Kill()
 }
 
 type execError struct {
-	name string
-	err  error
+	name     string
+	args     []string
+	dir      string
+	err      error
+	stderr   string
+	duration time.Duration
+
+	// killed reports whether the command failed after being killed.
+	killed bool
 }
 
 func (e *execError) Error() string {
-	return fmt.Sprintf("command %q: %v", e.name, e.err)
+	msg := fmt.Sprintf("command %q", e.name)
+	if len(e.args) > 0 {
+		msg += fmt.Sprintf(" %q", e.args)
+	}
+	if e.dir != "" {
+		msg += fmt.Sprintf(" in %q", e.dir)
+	}
+	msg += fmt.Sprintf(": %v", e.err)
+	if e.stderr != "" {
+		msg += ": " + e.stderr
+	}
+	return msg
+}
+
+func (e *execError) Unwrap() error {
+	return e.err
+}
+
+// startError is returned by Exec tasks when their command
+// couldn't be started, so that Not doesn't invert it.
+type startError struct {
+	err error
+}
+
+func (e *startError) Error() string {
+	return e.err.Error()
+}
+
+func (e *startError) Unwrap() error {
+	return e.err
+}
+
+// ExitError is the error reported, wrapped with further details about
+// the failed command, when a command executed by a pipe terminates
+// unsuccessfully. Use errors.As to obtain it from errors returned when
+// running pipes, or ExitStatus to obtain just the exit status.
+type ExitError struct {
+	// Name and Args describe the command that failed.
+	Name string
+	Args []string
+
+	// Code holds the exit status of the command,
+	// or -1 if it was terminated by a signal.
+	Code int
+
+	// Signal holds the signal that terminated the command, if any.
+	Signal syscall.Signal
+
+	// Err holds the error reported when waiting for the command.
+	Err error
+}
+
+func (e *ExitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// newExitError returns an *ExitError describing err if it reports
+// that the name command exited unsuccessfully, or err otherwise.
+func newExitError(name string, args []string, err error) error {
+	switch ee := err.(type) {
+	case *exec.ExitError:
+		e := &ExitError{Name: name, Args: args, Code: ee.ExitCode(), Err: err}
+		if status, ok := ee.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			e.Signal = status.Signal()
+		}
+		return e
+	case interface{ ExitCode() int }:
+		return &ExitError{Name: name, Args: args, Code: ee.ExitCode(), Err: err}
+	}
+	return err
+}
+
+// ExitStatus returns the exit status of the first command reported in
+// err as terminated unsuccessfully, and whether there was such a command.
+// The status is -1 if the command was terminated by a signal.
+//
+// For example, this tells apart grep finding no lines from it failing:
+//
+//    err := pipe.Run(pipe.Exec("grep", "-q", "TODO", "main.go"))
+//    if status, ok := pipe.ExitStatus(err); ok && status == 1 {
+//        fmt.Println("nothing to do")
+//    } else if err != nil {
+//        return err
+//    }
+//
+func ExitStatus(err error) (status int, ok bool) {
+	var ee *ExitError
+	if errors.As(err, &ee) {
+		return ee.Code, true
+	}
+	return 0, false
 }
 
 // ChDir changes the pipe's current directory. If dir is relative,
@@ -572,17 +2253,482 @@ func MkDirAll(dir string, perm os.FileMode) Pipe {
 	}
 }
 
-// SetEnvVar sets the value of the named environment variable in the pipe.
+// SetStdin returns a pipe that makes r the stdin of the following
+// entries of the enclosing Script, until the Script ends.
 //
-// Other than it being the default for new pipes, the environment of the
-// running process isn't consulted or changed.
-func SetEnvVar(name string, value string) Pipe {
-	return func(s *State) error {
-		s.SetEnvVar(name, value)
+// For example, this feeds the same configuration to two commands:
+//
+//    p := pipe.Script(
+//        pipe.SetStdin(strings.NewReader(config)),
+//        pipe.Exec("validate"),
+//        pipe.Exec("apply"),
+//    )
+//
+// As usual, the data read by the first entry is not available to the
+// second one. See BroadcastStdin for feeding the same data to both.
+func SetStdin(r io.Reader) Pipe {
+	return func(s *State) error {
+		s.Stdin = r
+		s.stdinSet = true
+		return nil
+	}
+}
+
+// StdinFromFile returns a pipe that makes the file at path the stdin of
+// the following entries of the enclosing Script, until the Script ends.
+// The file is opened when first read, and closed once fully read.
+func StdinFromFile(path string) Pipe {
+	return func(s *State) error {
+		s.Stdin = &fileReader{path: s.Path(path)}
+		s.stdinSet = true
+		return nil
+	}
+}
+
+// fileReader reads from the file at path, opened on the first read.
+type fileReader struct {
+	path string
+
+	m    sync.Mutex
+	file *os.File
+	err  error
+}
+
+func (r *fileReader) Read(b []byte) (int, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.file == nil {
+		r.file, r.err = os.Open(r.path)
+		if r.err != nil {
+			return 0, r.err
+		}
+	}
+	n, err := r.file.Read(b)
+	if err != nil {
+		r.file.Close()
+		r.err = err
+	}
+	return n, err
+}
+
+// WithDir runs the provided entries as a Script with the pipe's current
+// directory set to dir. If dir is relative, it is taken relative to the
+// pipe's current directory. The previous directory is restored once the
+// entries have been added, whether they succeed or not.
+//
+// For example, the equivalent of "(cd build && make); echo done" is:
+//
+//    p := pipe.Script(
+//        pipe.WithDir("build", pipe.Exec("make")),
+//        pipe.Println("done"),
+//    )
+//
+func WithDir(dir string, p ...Pipe) Pipe {
+	return func(s *State) error {
+		saved := s.Dir
+		defer func() { s.Dir = saved }()
+		s.Dir = s.Path(dir)
+		return Script(p...)(s)
+	}
+}
+
+// WithExecutor runs the provided entries as a Script with the commands
+// they run started by e, rather than by the pipe's Executor, so that
+// how commands are launched may be changed without building the State
+// by hand. The previous Executor is restored once the entries have
+// been added, whether they succeed or not.
+//
+// For example, this runs the tests remotely and reports locally:
+//
+//    p := pipe.Script(
+//        pipe.WithExecutor(sshExecutor, pipe.Exec("make", "test")),
+//        pipe.Println("tests passed"),
+//    )
+//
+func WithExecutor(e Executor, p ...Pipe) Pipe {
+	return func(s *State) error {
+		saved := s.Executor
+		defer func() { s.Executor = saved }()
+		s.Executor = e
+		return Script(p...)(s)
+	}
+}
+
+// SetEnvVar sets the value of the named environment variable in the pipe.
+//
+// Other than it being the default for new pipes, the environment of the
+// running process isn't consulted or changed.
+func SetEnvVar(name string, value string) Pipe {
+	return func(s *State) error {
+		s.SetEnvVar(name, value)
+		return nil
+	}
+}
+
+// ClearEnv returns a pipe that removes all variables from the pipe's
+// environment, so that the commands run afterwards only see variables
+// set explicitly, rather than inheriting the environment of the
+// running process. Like other environment changes, it holds until the
+// enclosing Script ends.
+//
+// For example, this runs a build without leaking the host environment
+// into it:
+//
+//    p := pipe.Script(
+//        pipe.ClearEnv(),
+//        pipe.SetEnvVar("PATH", "/usr/bin:/bin"),
+//        pipe.Exec("make"),
+//    )
+//
+func ClearEnv() Pipe {
+	return func(s *State) error {
+		s.Env = []string{}
+		s.keptEnv = []string{}
+		return nil
+	}
+}
+
+// KeepEnv returns a pipe that removes from the pipe's environment all
+// variables but the named ones. Like other environment changes, it
+// holds until the enclosing Script ends.
+func KeepEnv(names ...string) Pipe {
+	return func(s *State) error {
+		keep := make(map[string]bool)
+		for _, name := range names {
+			keep[name] = true
+		}
+		env := []string{}
+		for _, kv := range s.Env {
+			if i := strings.Index(kv, "="); i > 0 && keep[kv[:i]] {
+				env = append(env, kv)
+			}
+		}
+		s.Env = env
+		// Variables removed before remain removed.
+		kept := []string{}
+		if s.keptEnv == nil {
+			kept = append(kept, names...)
+		} else {
+			for _, name := range s.keptEnv {
+				if keep[name] {
+					kept = append(kept, name)
+				}
+			}
+		}
+		s.keptEnv = kept
+		return nil
+	}
+}
+
+// WrapStdout returns a pipe that registers f to wrap the stdout of
+// every entry added after it in the enclosing Script, leaving out the
+// streams connecting the entries of a Line. See State.WrapStdout for
+// details.
+//
+// For example, this redacts a token from the output of all commands:
+//
+//    p := pipe.Script(
+//        pipe.WrapStdout(redact(token)),
+//        pipe.Exec("deploy"),
+//        pipe.Exec("status"),
+//    )
+//
+func WrapStdout(f func(w io.Writer) io.Writer) Pipe {
+	return func(s *State) error {
+		s.WrapStdout(f)
+		return nil
+	}
+}
+
+// WrapStderr returns a pipe that registers f to wrap the stderr of
+// every entry added after it in the enclosing Script.
+func WrapStderr(f func(w io.Writer) io.Writer) Pipe {
+	return func(s *State) error {
+		s.WrapStderr(f)
+		return nil
+	}
+}
+
+// WrapStdin returns a pipe that registers f to wrap the stdin of
+// every entry added after it in the enclosing Script.
+func WrapStdin(f func(r io.Reader) io.Reader) Pipe {
+	return func(s *State) error {
+		s.WrapStdin(f)
+		return nil
+	}
+}
+
+// WithEnv runs the provided entries as a Script with the given
+// environment variables set in the pipe. The previous environment is
+// restored once the entries have been added, whether they succeed or not.
+//
+// For example, the equivalent of "LANG=C sort data.txt" is:
+//
+//    p := pipe.WithEnv(map[string]string{"LANG": "C"},
+//        pipe.Exec("sort", "data.txt"),
+//    )
+//
+func WithEnv(env map[string]string, p ...Pipe) Pipe {
+	return func(s *State) error {
+		saved := s.Env
+		defer func() { s.Env = saved }()
+		s.Env = copyEnv(s.Env)
+		for name, value := range env {
+			s.SetEnvVar(name, value)
+		}
+		return Script(p...)(s)
+	}
+}
+
+// SourceScript runs script via a system shell and changes the pipe's
+// environment to match the one the script ended with, similar to the
+// "." command of shells. This allows activation scripts that only set
+// environment variables to affect the following entries.
+//
+// The script is run immediately while the pipe is being assembled,
+// rather than as a task, so it runs before any of the entries that
+// precede it. Its output is discarded, and is reported in the error
+// if the script fails. The shell is started via the state's Executor,
+// and is subject to BeforeExec, CommandPolicy, and AfterExec as the
+// commands run by Exec are. The pipe fails if the script exits the
+// shell, such as via the exit command, as its environment is lost.
+//
+// See SourceFile.
+func SourceScript(script string) Pipe {
+	return func(s *State) error {
+		args := []string{"-c", "{\n" + script + "\n} >&2 && printf '%s\\n' " + sourceMarker + " && export -p"}
+		spec := CommandSpec{Name: "/bin/sh", Args: args, Dir: s.Dir, Env: s.Env}
+		if err := s.checkCommand(&spec); err != nil {
+			return &execError{name: "/bin/sh", args: args, dir: s.Dir, err: err}
+		}
+		var stdout, stderr bytes.Buffer
+		streams := Streams{Stdin: strings.NewReader(""), Stdout: &stdout, Stderr: &stderr}
+		started := time.Now()
+		p, err := s.executor().Start(spec, streams)
+		if err == nil {
+			err = p.Wait()
+		}
+		if s.AfterExec != nil {
+			s.AfterExec(spec, err, time.Since(started))
+		}
+		if err != nil {
+			return &execError{name: "/bin/sh", args: args, dir: s.Dir, err: newExitError("/bin/sh", args, err), stderr: strings.TrimSpace(stderr.String())}
+		}
+		output := stdout.String()
+		if !strings.HasPrefix(output, sourceMarker+"\n") {
+			return &execError{name: "/bin/sh", args: args, dir: s.Dir, err: fmt.Errorf("script exited before its environment was read")}
+		}
+		exported, err := parseExports(output[len(sourceMarker)+1:])
+		if err != nil {
+			return &execError{name: "/bin/sh", args: args, dir: s.Dir, err: err}
+		}
+		before := make(map[string]string)
+		for _, kv := range s.Env {
+			if i := strings.Index(kv, "="); i >= 0 {
+				before[kv[:i]] = kv[i+1:]
+			}
+		}
+		// The environment may be shared with other states, so it's
+		// copied before being changed.
+		s.Env = copyEnv(s.Env)
+		after := make(map[string]bool)
+		for _, kv := range exported {
+			i := strings.Index(kv, "=")
+			if sourceIgnoredVars[kv[:i]] {
+				continue
+			}
+			name, value := kv[:i], kv[i+1:]
+			after[name] = true
+			if old, ok := before[name]; !ok || old != value {
+				s.SetEnvVar(name, value)
+			}
+		}
+		env := make([]string, 0, len(s.Env))
+		for _, kv := range s.Env {
+			i := strings.Index(kv, "=")
+			if i < 0 || after[kv[:i]] || sourceIgnoredVars[kv[:i]] {
+				env = append(env, kv)
+			}
+		}
+		s.Env = env
 		return nil
 	}
 }
 
+// SourceFile works like SourceScript, but runs the shell script at path.
+// If path is relative, it is taken relative to the pipe's current
+// directory.
+func SourceFile(path string) Pipe {
+	return func(s *State) error {
+		return SourceScript(". '" + strings.Replace(s.Path(path), "'", `'\''`, -1) + "'")(s)
+	}
+}
+
+// sourceMarker is printed by the shell run by SourceScript right before
+// its environment, so that a script exiting the shell early is noticed.
+const sourceMarker = "--pipe-source-env--"
+
+// parseExports parses the output of the "export -p" shell command into
+// NAME=value entries. The values are quoted in the ways used by common
+// shells: with single quotes, double quotes, or $'...' escapes.
+// Variables exported without a value are left out.
+func parseExports(data string) ([]string, error) {
+	var env []string
+	for {
+		data = strings.TrimLeft(data, " \t\n")
+		if data == "" {
+			return env, nil
+		}
+		switch {
+		case strings.HasPrefix(data, "export "):
+			data = data[len("export "):]
+		case strings.HasPrefix(data, "declare -x "):
+			data = data[len("declare -x "):]
+		default:
+			return nil, fmt.Errorf("cannot parse exported variables at %q", strings.SplitN(data, "\n", 2)[0])
+		}
+		i := strings.IndexAny(data, "=\n")
+		if i < 0 {
+			return env, nil
+		}
+		if data[i] == '\n' {
+			// Exported but unset.
+			data = data[i:]
+			continue
+		}
+		name := data[:i]
+		value, rest, err := parseShellWord(data[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse value of exported variable %s: %v", name, err)
+		}
+		env = append(env, name+"="+value)
+		data = rest
+	}
+}
+
+// parseShellWord parses the shell word at the start of data, up to the
+// first unquoted blank or newline, and returns its value and the rest
+// of data.
+func parseShellWord(data string) (value, rest string, err error) {
+	var buf bytes.Buffer
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			return buf.String(), data[i:], nil
+		case c == '\'':
+			end := strings.IndexByte(data[i+1:], '\'')
+			if end < 0 {
+				return "", "", fmt.Errorf("unterminated single quote")
+			}
+			buf.WriteString(data[i+1 : i+1+end])
+			i += end + 2
+		case c == '"':
+			i++
+			for ; i < len(data) && data[i] != '"'; i++ {
+				if data[i] == '\\' && i+1 < len(data) && strings.IndexByte("$`\"\\\n", data[i+1]) >= 0 {
+					i++
+					if data[i] == '\n' {
+						continue
+					}
+				}
+				buf.WriteByte(data[i])
+			}
+			if i == len(data) {
+				return "", "", fmt.Errorf("unterminated double quote")
+			}
+			i++
+		case c == '$' && i+1 < len(data) && data[i+1] == '\'':
+			n, err := parseANSIQuote(&buf, data[i+2:])
+			if err != nil {
+				return "", "", err
+			}
+			i += n + 2
+		case c == '\\' && i+1 < len(data):
+			if data[i+1] != '\n' {
+				buf.WriteByte(data[i+1])
+			}
+			i += 2
+		default:
+			buf.WriteByte(c)
+			i++
+		}
+	}
+	return buf.String(), "", nil
+}
+
+// parseANSIQuote writes to buf the value of the $'...' quoted string
+// that data starts with, right after the opening quote, and returns
+// how many bytes of data it took, including the closing quote.
+func parseANSIQuote(buf *bytes.Buffer, data string) (int, error) {
+	for i := 0; i < len(data); {
+		c := data[i]
+		if c == '\'' {
+			return i + 1, nil
+		}
+		if c != '\\' || i+1 == len(data) {
+			buf.WriteByte(c)
+			i++
+			continue
+		}
+		c = data[i+1]
+		i += 2
+		switch c {
+		case 'a':
+			buf.WriteByte('\a')
+		case 'b':
+			buf.WriteByte('\b')
+		case 'e', 'E':
+			buf.WriteByte(0x1b)
+		case 'f':
+			buf.WriteByte('\f')
+		case 'n':
+			buf.WriteByte('\n')
+		case 'r':
+			buf.WriteByte('\r')
+		case 't':
+			buf.WriteByte('\t')
+		case 'v':
+			buf.WriteByte('\v')
+		case 'x':
+			j := i
+			for j < len(data) && j < i+2 && strings.IndexByte("0123456789abcdefABCDEF", data[j]) >= 0 {
+				j++
+			}
+			if j == i {
+				buf.WriteString(`\x`)
+				continue
+			}
+			n, _ := strconv.ParseUint(data[i:j], 16, 8)
+			buf.WriteByte(byte(n))
+			i = j
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			n, j := 0, i-1
+			for ; j < len(data) && j < i+2 && data[j] >= '0' && data[j] <= '7'; j++ {
+				n = n*8 + int(data[j]-'0')
+			}
+			buf.WriteByte(byte(n))
+			i = j
+		default:
+			// Covers \\, \', \" and \?.
+			buf.WriteByte(c)
+		}
+	}
+	return 0, fmt.Errorf("unterminated $' quote")
+}
+
+// sourceIgnoredVars holds the variables that shells maintain on their own,
+// which must not leak into the environment changed by SourceScript.
+var sourceIgnoredVars = map[string]bool{
+	"_":      true,
+	"PWD":    true,
+	"OLDPWD": true,
+	"SHLVL":  true,
+}
+
 // Line creates a pipeline with the provided entries, where the stdout
 // of entry N in the pipeline is connected to the stdin of entry N+1.
 //
@@ -596,16 +2742,26 @@ func SetEnvVar(name string, value string) Pipe {
 //
 func Line(p ...Pipe) Pipe {
 	return func(s *State) error {
+		if s.spec != nil {
+			return s.spec.addSequence(s, "line", p)
+		}
 		dir := s.Dir
 		env := s.Env
-		s.Env = append([]string(nil), s.Env...)
+		wrappers := s.wrappers
+		position := s.position
+		input, output := s.input, s.output
+		s.Env = copyEnv(s.Env)
 		defer func() {
 			s.Dir = dir
 			s.Env = env
+			s.wrappers = wrappers
+			s.position = position
+			s.input, s.output = input, output
 		}()
 
 		end := len(p) - 1
 		endStdout := s.Stdout
+		status := &lineStatus{}
 		var r *io.PipeReader
 		var w *io.PipeWriter
 		for i, p := range p {
@@ -616,12 +2772,15 @@ func Line(p ...Pipe) Pipe {
 			if i == end {
 				r, w = nil, nil
 				s.Stdout = endStdout
+				s.output = output
 			} else {
 				r, w = io.Pipe()
 				s.Stdout = w
 				closeOut = &refCloser{w, 1}
+				s.output = &lineLink{}
 			}
 
+			s.position = fmt.Sprintf("line[%d]", i)
 			oldLen := len(s.pendingTasks)
 			if err := p(s); err != nil {
 				closeIn.Close()
@@ -631,6 +2790,12 @@ func Line(p ...Pipe) Pipe {
 
 			for fi := oldLen; fi < newLen; fi++ {
 				pt := s.pendingTasks[fi]
+				if s.NoPipefail {
+					// The line stage reports the positions of the errors
+					// it collects on its own.
+					pt.t = &lineStageTask{pt.t, status, i == end, pt.s.position}
+					pt.s.position = ""
+				}
 				if c, ok := pt.s.Stdin.(io.Closer); ok && closeIn.uses(c) {
 					closeIn.refs++
 					pt.closeWhenDone(closeIn)
@@ -649,12 +2814,155 @@ func Line(p ...Pipe) Pipe {
 
 			if i < end {
 				s.Stdin = r
+				s.input = s.output
 			}
 		}
 		return nil
 	}
 }
 
+// lineLink connects two consecutive entries of a line.
+type lineLink struct {
+	closed int32
+}
+
+// stopped reports whether the entry reading from the link
+// terminated without reading all of its input.
+func (l *lineLink) stopped() bool {
+	return l != nil && atomic.LoadInt32(&l.closed) == 1
+}
+
+// stopReading records that the task is terminating without reading
+// the rest of its input, so that the preceding entry of the line, if
+// any, isn't failed for writing to the closed pipe, similar to how the
+// head tool makes the commands it follows in shell pipelines stop.
+func (s *State) stopReading() {
+	if s.input != nil {
+		atomic.StoreInt32(&s.input.closed, 1)
+	}
+}
+
+// IgnoreBrokenPipe runs p so that its tasks succeed rather than fail
+// when they are interrupted because the reading end of their output was
+// closed, similar to how shells handle the SIGPIPE signal. It may wrap
+// a single entry of a Line or a whole Line.
+//
+// For example, the equivalent of "yes | head -n 3" is:
+//
+//    p := pipe.IgnoreBrokenPipe(pipe.Line(
+//        pipe.Exec("yes"),
+//        pipe.Exec("head", "-n", "3"),
+//    ))
+//
+func IgnoreBrokenPipe(p Pipe) Pipe {
+	return func(s *State) error {
+		oldLen := len(s.pendingTasks)
+		err := p(s)
+		for _, pt := range s.pendingTasks[oldLen:] {
+			pt.t = brokenPipeTask{pt.t}
+		}
+		return err
+	}
+}
+
+type brokenPipeTask struct {
+	Task
+}
+
+func (t brokenPipeTask) Run(s *State) error {
+	err := t.Task.Run(s)
+	if isBrokenPipe(err) {
+		return nil
+	}
+	return err
+}
+
+func isBrokenPipe(err error) bool {
+	if e, ok := err.(*execError); ok {
+		if e, ok := e.err.(*ExitError); ok {
+			return e.Signal == sigPIPE
+		}
+		err = e.err
+	}
+	return err == io.ErrClosedPipe || errors.Is(err, syscall.EPIPE)
+}
+
+// NoPipefail runs p with the NoPipefail option of the state enabled,
+// so that lines created within it fail only when their last entry fails.
+// The failures of entries that terminate after the last one, as when
+// they are killed because it failed, are not reported.
+//
+// For example, the equivalent of "grep -l foo *.txt | head -n 1" without
+// pipefail, where grep fails due to the early termination of head, is:
+//
+//    p := pipe.NoPipefail(pipe.Line(
+//        pipe.System("grep -l foo *.txt"),
+//        pipe.Exec("head", "-n", "1"),
+//    ))
+//
+func NoPipefail(p Pipe) Pipe {
+	return func(s *State) error {
+		saved := s.NoPipefail
+		defer func() { s.NoPipefail = saved }()
+		s.NoPipefail = true
+		return p(s)
+	}
+}
+
+// GracefulKill runs p with the KillSignal and KillGrace options of the
+// state set, so that commands run within it are sent sig when the pipe
+// is killed, and are only killed if they are still running after grace.
+//
+// For example, this gives the server a minute to shut down cleanly
+// once the pipe times out:
+//
+//    p := pipe.GracefulKill(syscall.SIGTERM, time.Minute, pipe.Exec("server"))
+//    err := pipe.RunTimeout(p, time.Hour)
+//
+func GracefulKill(sig syscall.Signal, grace time.Duration, p Pipe) Pipe {
+	return func(s *State) error {
+		savedSig, savedGrace := s.KillSignal, s.KillGrace
+		defer func() { s.KillSignal, s.KillGrace = savedSig, savedGrace }()
+		s.KillSignal, s.KillGrace = sig, grace
+		return p(s)
+	}
+}
+
+// lineStatus holds the errors of the entries in a line
+// that precede its last entry, when NoPipefail is set.
+type lineStatus struct {
+	m    sync.Mutex
+	errs Errors
+}
+
+type lineStageTask struct {
+	Task
+	status   *lineStatus
+	last     bool
+	position string
+}
+
+func (t *lineStageTask) Run(s *State) error {
+	err := t.Task.Run(s)
+	if err != nil && t.position != "" {
+		err = &StageError{Position: t.position, Err: err}
+	}
+	t.status.m.Lock()
+	defer t.status.m.Unlock()
+	if !t.last {
+		if err != nil {
+			t.status.errs = append(t.status.errs, err)
+		}
+		return nil
+	}
+	if err != nil && len(t.status.errs) > 0 {
+		errs := append(t.status.errs, err)
+		t.status.errs = nil
+		return errs
+	}
+	return err
+}
+
 type refCloser struct {
 	c    io.Closer
 	refs int32
@@ -686,22 +2994,35 @@ func (rc *refCloser) Close() error {
 //
 func Script(p ...Pipe) Pipe {
 	return func(s *State) error {
+		if s.spec != nil {
+			return s.spec.addSequence(s, "script", p)
+		}
 		saved := *s
-		s.Env = append([]string(nil), s.Env...)
+		s.Env = copyEnv(s.Env)
 		defer func() {
 			s.Dir = saved.Dir
 			s.Env = saved.Env
+			s.Stdin = saved.Stdin
+			s.wrappers = saved.wrappers
+			s.position = saved.position
 		}()
 
+		stdin := saved.Stdin
 		startLen := len(s.pendingTasks)
-		for _, p := range p {
+		for i, p := range p {
+			s.position = fmt.Sprintf("script[%d]", i)
 			oldLen := len(s.pendingTasks)
+			s.stdinSet = false
 			if err := p(s); err != nil {
 				return err
 			}
 			newLen := len(s.pendingTasks)
 
-			s.Stdin = saved.Stdin
+			if s.stdinSet {
+				stdin = s.Stdin
+				s.stdinSet = false
+			}
+			s.Stdin = stdin
 			s.Stdout = saved.Stdout
 			s.Stderr = saved.Stderr
 
@@ -715,190 +3036,5204 @@ func Script(p ...Pipe) Pipe {
 	}
 }
 
-type taskFunc func(s *State) error
+// Subshell creates a pipe sequence with the provided entries, similar to
+// Script, that fully isolates the state changes made by them. Unlike
+// Script, changes made by an entry to the Stdin, Stdout, and Stderr
+// streams hold for the following entries within the subshell. Once the
+// entries have been added, even if one of them fails, the streams,
+// the current directory, and the environment in use when Subshell
+// started are all restored, so redirections made within the subshell
+// never affect subsequent entries.
+//
+// For example, the equivalent of "(exec 2>&1; make); echo done" is:
+//
+//    p := pipe.Script(
+//        pipe.Subshell(
+//            func(s *pipe.State) error {
+//                s.Stderr = s.Stdout
+//                return nil
+//            },
+//            pipe.Exec("make"),
+//        ),
+//        pipe.Println("done"),
+//    )
+//
+func Subshell(p ...Pipe) Pipe {
+	return func(s *State) error {
+		dir, env := s.Dir, s.Env
+		stdin, stdout, stderr := s.Stdin, s.Stdout, s.Stderr
+		defer func() {
+			s.Dir, s.Env = dir, env
+			s.Stdin, s.Stdout, s.Stderr = stdin, stdout, stderr
+		}()
+		s.Env = copyEnv(s.Env)
 
-func (f taskFunc) Run(s *State) error { return f(s) }
-func (f taskFunc) Kill()              {}
+		startLen := len(s.pendingTasks)
+		for _, p := range p {
+			oldLen := len(s.pendingTasks)
+			if err := p(s); err != nil {
+				return err
+			}
+			newLen := len(s.pendingTasks)
 
-// TaskFunc is a helper to define a Pipe that adds a Task
-// with f as its Run method.
-func TaskFunc(f func(s *State) error) Pipe {
-	return func(s *State) error {
-		s.AddTask(taskFunc(f))
+			for fi := oldLen; fi < newLen; fi++ {
+				for wi := startLen; wi < oldLen; wi++ {
+					s.pendingTasks[fi].waitFor(s.pendingTasks[wi])
+				}
+			}
+		}
 		return nil
 	}
 }
 
-// Print provides args to fmt.Sprint and writes the resuling
-// string to the pipe's stdout.
-func Print(args ...interface{}) Pipe {
-	return TaskFunc(func(s *State) error {
-		_, err := s.Stdout.Write([]byte(fmt.Sprint(args...)))
+// Not runs p and inverts its result, succeeding if p fails and failing
+// if p succeeds, similar to the "!" operator of shells. Errors that say
+// nothing about the outcome of p are returned as they are rather than
+// inverted: a command that cannot be started or that is denied by
+// CommandPolicy, p being killed or timing out, and a panic.
+//
+// For example, the equivalent of "! grep -q TODO main.go" is:
+//
+//    p := pipe.Not(pipe.Exec("grep", "-q", "TODO", "main.go"))
+//
+func Not(p Pipe) Pipe {
+	return func(s *State) error {
+		return s.AddTask(&subTask{p: p, done: func(err error) error {
+			if err == nil {
+				return errNotFailed
+			}
+			if negatable(err) {
+				return nil
+			}
+			return err
+		}})
+	}
+}
+
+var errNotFailed = errors.New("negated pipe succeeded")
+
+// negatable reports whether err is only made of failures that Not
+// inverts, as opposed to errors that prevented p from running to
+// completion.
+func negatable(err error) bool {
+	switch e := err.(type) {
+	case Errors:
+		for _, err := range e {
+			if !negatable(err) {
+				return false
+			}
+		}
+		return len(e) > 0
+	case *StageError:
+		return negatable(e.Err)
+	case *execError:
+		// Commands that couldn't be started or were denied report
+		// errors other than an *ExitError.
+		_, ok := e.err.(*ExitError)
+		return ok && !discardErr(e)
+	case *startError, *PanicError:
+		return false
+	}
+	return !discardErr(err) && !errors.Is(err, ErrTimeout) &&
+		!errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// TimeoutError is returned by pipes wrapped with Timeout
+// when they are killed for taking too long to run.
+type TimeoutError struct {
+	// Timeout holds for how long the pipe was allowed to run.
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timeout after %v", e.Timeout)
+}
+
+// Is reports whether target is ErrTimeout, so that errors.Is
+// handles timeouts of wrapped pipes and whole pipes alike.
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+// Timeout runs p and kills it, including any commands it started,
+// if it takes longer than d to run. The returned error is then a
+// *TimeoutError. Unlike the Timeout field of State, which applies
+// to a whole pipe, the other entries of a Script or stages of a
+// Line are unaffected by the limit.
+//
+// For example, this fails if the tests take longer than ten minutes,
+// without limiting how long the build itself may take:
+//
+//    p := pipe.Script(
+//        pipe.Exec("make"),
+//        pipe.Timeout(pipe.Exec("make", "test"), 10*time.Minute),
+//    )
+//
+func Timeout(p Pipe, d time.Duration) Pipe {
+	return func(s *State) error {
+		return s.AddTask(&subTask{p: p, timeout: d, done: func(err error) error {
+			if errs, ok := err.(Errors); ok {
+				for _, err := range errs {
+					if err == ErrTimeout {
+						return &TimeoutError{d}
+					}
+				}
+			}
+			return err
+		}})
+	}
+}
+
+// StageError is returned when an entry of a Line or Script fails, or
+// a pipe wrapped with Named fails, identifying the failed stage within
+// the pipe.
+type StageError struct {
+	// Name holds the name provided to Named, or is empty
+	// for entries that weren't named.
+	Name string
+
+	// Position describes where the stage sits within its enclosing
+	// Line or Script, such as "line[2]" for the third entry of a
+	// Line, or is empty if the stage isn't within one.
+	Position string
+
+	// Err holds the error the stage failed with.
+	Err error
+}
+
+func (e *StageError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("%s: %v", e.Position, e.Err)
+	}
+	if e.Position == "" {
+		return fmt.Sprintf("stage %q: %v", e.Name, e.Err)
+	}
+	return fmt.Sprintf("stage %q (%s): %v", e.Name, e.Position, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// Named runs p and wraps the errors of the tasks it adds into a
+// *StageError holding name and the position of p within the enclosing
+// Line or Script, so that the failed stage of a long pipe is easy to
+// tell. Entries of a Line or Script report their position when they
+// fail even if not named, but naming them makes the report clearer.
+// Changes p makes to the pipe's state, such as via ChDir or SetEnvVar,
+// hold as if p wasn't wrapped.
+//
+// For example:
+//
+//    p := pipe.Line(
+//        pipe.Named("fetch", pipe.Exec("curl", "-sf", url)),
+//        pipe.Named("unpack", pipe.Exec("tar", "xz")),
+//    )
+//
+// may fail with:
+//
+//    stage "fetch" (line[0]): command "curl" ["-sf" ...]: exit status 22
+//
+func Named(name string, p Pipe) Pipe {
+	return func(s *State) error {
+		if s.spec != nil {
+			return fmt.Errorf("cannot describe pipe with named stages")
+		}
+		// The stage error replaces the position of the tasks of p.
+		position := s.position
+		defer func() { s.position = position }()
+		s.position = ""
+		_, err := addStage(s, p, &namedStage{name: name, position: position})
+		return err
+	}
+}
+
+// taskStage is notified as the tasks added by a pipe wrapped with
+// Named or Timed run. See addStage.
+type taskStage interface {
+	// started is called before each task of the stage runs.
+	started()
+
+	// ended is called after each task of the stage terminated or
+	// was skipped, and returns the error to report for the task.
+	ended(err error) error
+}
+
+// addStage runs p and sets up the tasks it adds to s to be part of
+// stage, returning how many tasks were added.
+func addStage(s *State, p Pipe, stage taskStage) (n int, err error) {
+	oldLen := len(s.pendingTasks)
+	if err := p(s); err != nil {
+		return 0, err
+	}
+	tasks := s.pendingTasks[oldLen:]
+	for _, pt := range tasks {
+		pt.stages = append(pt.stages, stage)
+	}
+	return len(tasks), nil
+}
+
+type namedStage struct {
+	name     string
+	position string
+}
+
+func (st *namedStage) started() {}
+
+func (st *namedStage) ended(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &StageError{st.name, st.position, err}
+}
+
+// Timed runs p and calls report with the provided name, the time the
+// tasks p adds took to run, and the error they failed with, once they
+// all terminate. Nothing is reported if none of them ran. A *Timings
+// value may be used to collect the reports of several stages and print
+// a timing breakdown after the pipe is run. Changes p makes to the
+// pipe's state, such as via ChDir or SetEnvVar, hold as if p wasn't
+// wrapped.
+//
+// For example:
+//
+//    var timings pipe.Timings
+//    p := pipe.Script(
+//        pipe.Timed("build", pipe.Exec("make"), timings.Report),
+//        pipe.Timed("test", pipe.Exec("make", "test"), timings.Report),
+//    )
+//    err := pipe.Run(p)
+//    fmt.Print(timings.String())
+//
+func Timed(name string, p Pipe, report func(name string, d time.Duration, err error)) Pipe {
+	return func(s *State) error {
+		if s.spec != nil {
+			return fmt.Errorf("cannot describe pipe with timed stages")
+		}
+		stage := &timedStage{name: name, report: report}
+		n, err := addStage(s, p, stage)
+		stage.pending = n
+		return err
+	}
+}
+
+type timedStage struct {
+	name   string
+	report func(name string, d time.Duration, err error)
+
+	m       sync.Mutex
+	pending int
+	start   time.Time
+	errs    Errors
+}
+
+func (st *timedStage) started() {
+	st.m.Lock()
+	if st.start.IsZero() {
+		st.start = time.Now()
+	}
+	st.m.Unlock()
+}
+
+func (st *timedStage) ended(err error) error {
+	st.m.Lock()
+	st.pending--
+	if err != nil {
+		st.errs = append(st.errs, err)
+	}
+	last := st.pending == 0
+	st.m.Unlock()
+	if last && !st.start.IsZero() {
+		st.report(st.name, time.Since(st.start), stageErr(st.errs))
+	}
+	return err
+}
+
+// stageErr returns the error to report for a stage whose tasks failed
+// with errs, leaving out the errors of tasks killed due to a failure.
+func stageErr(errs Errors) error {
+	var good Errors
+	for _, err := range errs {
+		if !discardErr(err) {
+			good = append(good, err)
+		}
+	}
+	if len(good) == 0 {
+		good = errs
+	}
+	switch len(good) {
+	case 0:
+		return nil
+	case 1:
+		return good[0]
+	}
+	return good
+}
+
+// Timing holds the time a stage wrapped with Timed took to run.
+type Timing struct {
+	Name     string
+	Duration time.Duration
+	Err      error
+}
+
+// Timings collects the timing of stages wrapped with Timed.
+// Its zero value is ready for use.
+type Timings struct {
+	m       sync.Mutex
+	entries []Timing
+}
+
+// Report records the timing of the named stage. Its method
+// value may be provided to Timed as the report function.
+func (t *Timings) Report(name string, d time.Duration, err error) {
+	t.m.Lock()
+	t.entries = append(t.entries, Timing{name, d, err})
+	t.m.Unlock()
+}
+
+// Entries returns the timings recorded so far, in the
+// order in which their stages terminated.
+func (t *Timings) Entries() []Timing {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return append([]Timing(nil), t.entries...)
+}
+
+// Total returns the sum of the durations recorded so far.
+func (t *Timings) Total() time.Duration {
+	var total time.Duration
+	for _, e := range t.Entries() {
+		total += e.Duration
+	}
+	return total
+}
+
+// String returns a breakdown of the recorded timings, one stage per
+// line, with failed stages followed by the error they returned.
+func (t *Timings) String() string {
+	entries := t.Entries()
+	width := 0
+	for _, e := range entries {
+		if len(e.Name) > width {
+			width = len(e.Name)
+		}
+	}
+	var buf bytes.Buffer
+	for _, e := range entries {
+		fmt.Fprintf(&buf, "%-*s %v", width, e.Name, e.Duration)
+		if e.Err != nil {
+			fmt.Fprintf(&buf, " (%v)", e.Err)
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+// And runs the provided pipes in sequence, stopping at the first one
+// that fails, similar to the "&&" operator of shells. Unlike Script,
+// the pipes are run as independent pipelines within a single entry,
+// so that And may be combined with Or for branching on failures.
+//
+// For example, the equivalent of "make && make install || echo failed" is:
+//
+//    p := pipe.Or(
+//        pipe.And(pipe.Exec("make"), pipe.Exec("make", "install")),
+//        pipe.Println("failed"),
+//    )
+//
+func And(p ...Pipe) Pipe {
+	return func(s *State) error {
+		return s.AddTask(newSeqTask(p, false))
+	}
+}
+
+// Or runs the provided pipes in sequence until one of them succeeds,
+// similar to the "||" operator of shells. If all of them fail, Or
+// fails with the error of the last one.
+//
+// For example, the equivalent of "curl -sf $URL || wget -q -O- $URL" is:
+//
+//    p := pipe.Or(
+//        pipe.Exec("curl", "-sf", url),
+//        pipe.Exec("wget", "-q", "-O-", url),
+//    )
+//
+func Or(p ...Pipe) Pipe {
+	return func(s *State) error {
+		return s.AddTask(newSeqTask(p, true))
+	}
+}
+
+// seqTask runs subs in sequence until one of them fails,
+// or until one of them succeeds if untilSuccess is set.
+type seqTask struct {
+	subs         []*subTask
+	untilSuccess bool
+
+	m      sync.Mutex
+	cur    *subTask
+	cancel bool
+}
+
+func newSeqTask(p []Pipe, untilSuccess bool) *seqTask {
+	t := &seqTask{untilSuccess: untilSuccess}
+	for _, p := range p {
+		t.subs = append(t.subs, &subTask{p: p, done: func(err error) error { return err }})
+	}
+	return t
+}
+
+func (t *seqTask) Run(s *State) error {
+	var err error
+	for _, sub := range t.subs {
+		t.m.Lock()
+		if t.cancel {
+			t.m.Unlock()
+			return ErrKilled
+		}
+		t.cur = sub
+		t.m.Unlock()
+		err = sub.Run(s)
+		if (err == nil) == t.untilSuccess {
+			break
+		}
+	}
+	return err
+}
+
+func (t *seqTask) Kill() {
+	t.m.Lock()
+	cur := t.cur
+	t.cancel = true
+	t.m.Unlock()
+	if cur != nil {
+		cur.Kill()
+	}
+}
+
+// If runs then if cond returns true, and otherwise runs els, unless it's
+// nil. The condition is checked when the pipe runs, so within scripts it
+// considers the changes made by the preceding entries.
+//
+// For example:
+//
+//    p := pipe.Script(
+//        pipe.If(func(s *pipe.State) bool { return runtime.GOOS == "linux" },
+//            pipe.Exec("make", "linux"),
+//            pipe.Exec("make", "other"),
+//        ),
+//    )
+//
+func If(cond func(s *State) bool, then Pipe, els Pipe) Pipe {
+	return func(s *State) error {
+		return s.AddTask(&subTask{
+			p: func(s *State) error {
+				if cond(s) {
+					return then(s)
+				}
+				if els != nil {
+					return els(s)
+				}
+				return nil
+			},
+			done: func(err error) error { return err },
+		})
+	}
+}
+
+// Unless runs p only if cond returns false. The condition is checked
+// when the pipe runs, so within scripts it considers the changes made
+// by the preceding entries.
+func Unless(cond func(s *State) bool, p Pipe) Pipe {
+	return func(s *State) error {
+		return s.AddTask(&condTask{
+			cond: func(s *State) (bool, error) { return !cond(s), nil },
+			sub:  &subTask{p: p, done: func(err error) error { return err }},
+		})
+	}
+}
+
+// IfExists runs then only if a file or directory exists at path. The
+// check happens when the pipe runs, so within scripts it considers the
+// changes made by the preceding entries.
+//
+// For example:
+//
+//    p := pipe.Script(
+//        pipe.IfExists("go.mod", pipe.Exec("go", "mod", "download")),
+//        pipe.Exec("go", "build"),
+//    )
+//
+func IfExists(path string, then Pipe) Pipe {
+	return func(s *State) error {
+		return s.AddTask(&condTask{
+			cond: func(s *State) (bool, error) {
+				_, err := os.Stat(s.Path(path))
+				if os.IsNotExist(err) {
+					return false, nil
+				}
+				return err == nil, err
+			},
+			sub: &subTask{p: then, done: func(err error) error { return err }},
+		})
+	}
+}
+
+// IfStale runs p only if the file at target doesn't exist or is older
+// than any of the files at the sources paths, as done by make to decide
+// whether a target must be rebuilt. The check happens when the pipe
+// runs, so within scripts it considers the changes made by the
+// preceding entries. It fails if any of the sources doesn't exist.
+//
+// For example:
+//
+//    p := pipe.Script(
+//        pipe.IfStale("parser.go", []string{"parser.y"}, pipe.Exec("goyacc", "-o", "parser.go", "parser.y")),
+//        pipe.Exec("go", "build"),
+//    )
+//
+func IfStale(target string, sources []string, p Pipe) Pipe {
+	return func(s *State) error {
+		return s.AddTask(&condTask{
+			cond: func(s *State) (bool, error) {
+				info, err := os.Stat(s.Path(target))
+				if os.IsNotExist(err) {
+					return true, nil
+				}
+				if err != nil {
+					return false, err
+				}
+				stale := false
+				for _, source := range sources {
+					sinfo, err := os.Stat(s.Path(source))
+					if err != nil {
+						return false, err
+					}
+					if sinfo.ModTime().After(info.ModTime()) {
+						stale = true
+					}
+				}
+				return stale, nil
+			},
+			sub: &subTask{p: p, done: func(err error) error { return err }},
+		})
+	}
+}
+
+// Cached runs p and stores its stdout in a file within dir named after
+// the key computed by the key function, and on subsequent runs with
+// the same key writes the stored output instead of running p again.
+// This is only appropriate when p's output depends entirely on the
+// information in the key. The key is computed when the pipe runs, so
+// within scripts it may consider the changes made by the preceding
+// entries. Output is only stored if p succeeds.
+//
+// For example, this caches the result of an expensive analysis of each
+// release:
+//
+//    key := func(s *pipe.State) string { return "analysis-" + s.EnvVar("RELEASE") }
+//    p := pipe.Cached(key, "/var/cache/analysis", pipe.System(`analyze --release "$RELEASE"`))
+//
+func Cached(key func(s *State) string, dir string, p Pipe) Pipe {
+	return func(s *State) error {
+		t := &cachedTask{key: key, dir: dir}
+		t.sub = &subTask{
+			p: func(s *State) error {
+				if sameWriter(s.Stdout, s.Stderr) {
+					s.Stderr = s.Stdout
+				}
+				s.Stdout = io.MultiWriter(s.Stdout, s.quotaWriter(t.tmp))
+				return p(s)
+			},
+			done: func(err error) error { return err },
+		}
+		return s.AddTask(t)
+	}
+}
+
+type cachedTask struct {
+	key    func(s *State) string
+	dir    string
+	sub    *subTask
+	tmp    *os.File
+	killed int32
+}
+
+func (t *cachedTask) Run(s *State) error {
+	sum := sha256.Sum256([]byte(t.key(s)))
+	dir := s.Path(t.dir)
+	path := filepath.Join(dir, hex.EncodeToString(sum[:]))
+	if file, err := os.Open(path); err == nil {
+		_, err = io.Copy(s.Stdout, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		// Drain stdin so the preceding entries don't fail.
+		_, err = io.Copy(ioutil.Discard, s.Stdin)
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	t.tmp = tmp
+	err = t.sub.Run(s)
+	if err == nil && atomic.LoadInt32(&t.killed) != 0 {
+		err = ErrKilled
+	}
+	err = firstErr(err, tmp.Close())
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (t *cachedTask) Kill() {
+	atomic.StoreInt32(&t.killed, 1)
+	t.sub.Kill()
+}
+
+// Checkpoint runs p as the entry identified by name, recording its
+// completion in the state's CheckpointFile, if set, so that subsequent
+// runs with the same file skip it. This allows a long script that failed
+// midway to be resumed from the entry that failed, by running it again
+// with the same CheckpointFile. The file is removed once a run succeeds,
+// so that the following run starts from scratch. Removing the file by
+// hand restarts from scratch as well.
+//
+// For example:
+//
+//    s := pipe.NewState(os.Stdout, os.Stderr)
+//    s.CheckpointFile = "deploy.checkpoint"
+//    p := pipe.Script(
+//        pipe.Checkpoint("build", pipe.Exec("make")),
+//        pipe.Checkpoint("upload", pipe.Exec("rsync", "-a", "dist/", "host:/srv/app")),
+//        pipe.Checkpoint("restart", pipe.Exec("ssh", "host", "systemctl restart app")),
+//    )
+//
+func Checkpoint(name string, p Pipe) Pipe {
+	return func(s *State) error {
+		if strings.ContainsAny(name, "\n\r") || name == "" {
+			return fmt.Errorf("invalid checkpoint name: %q", name)
+		}
+		return s.AddTask(&checkpointTask{name: name, sub: &subTask{p: p, done: func(err error) error { return err }}})
+	}
+}
+
+type checkpointTask struct {
+	name   string
+	sub    *subTask
+	killed int32
+}
+
+func (t *checkpointTask) Run(s *State) error {
+	if s.CheckpointFile == "" {
+		return t.sub.Run(s)
+	}
+	path := s.CheckpointFile
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == t.name {
+			return nil
+		}
+	}
+	err = t.sub.Run(s)
+	if err == nil && atomic.LoadInt32(&t.killed) != 0 {
+		err = ErrKilled
+	}
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write([]byte(t.name + "\n"))
+	if err == nil {
+		err = file.Sync()
+	}
+	return firstErr(err, file.Close())
+}
+
+func (t *checkpointTask) Kill() {
+	atomic.StoreInt32(&t.killed, 1)
+	t.sub.Kill()
+}
+
+// Step is an entry of a Transaction.
+type Step struct {
+	// Do applies the change made by the step.
+	Do Pipe
+
+	// Undo, if set, reverts the change made by Do.
+	Undo Pipe
+}
+
+// Transaction runs the Do pipe of each step in order, as Script does,
+// and if any of them fails, runs the Undo pipes of the steps that
+// completed in reverse order, so that the changes made are reverted
+// as much as possible. Rollbacks also happen if the pipe is killed,
+// and they run to completion. The error returned is the one from the
+// failed step, along with any errors from the rollbacks.
+//
+// For example:
+//
+//    p := pipe.Transaction(
+//        pipe.Step{
+//            Do:   pipe.RenameFile("/srv/app", "/srv/app.old"),
+//            Undo: pipe.RenameFile("/srv/app.old", "/srv/app"),
+//        },
+//        pipe.Step{
+//            Do:   pipe.Exec("tar", "-C", "/srv", "-xf", "app.tar"),
+//            Undo: pipe.Exec("rm", "-rf", "/srv/app"),
+//        },
+//        pipe.Step{Do: pipe.Exec("systemctl", "restart", "app")},
+//    )
+//
+func Transaction(steps ...Step) Pipe {
+	return func(s *State) error {
+		return s.AddTask(&transactionTask{steps: steps})
+	}
+}
+
+type transactionTask struct {
+	steps []Step
+
+	m       sync.Mutex
+	current *subTask
+	killed  bool
+}
+
+func (t *transactionTask) Run(s *State) error {
+	var err error
+	completed := 0
+	for _, step := range t.steps {
+		sub := &subTask{p: step.Do, done: func(err error) error { return err }}
+		t.m.Lock()
+		killed := t.killed
+		t.current = sub
+		t.m.Unlock()
+		if killed {
+			err = ErrKilled
+			break
+		}
+		err = sub.Run(s)
+		t.m.Lock()
+		killed = t.killed
+		t.m.Unlock()
+		if err == nil && killed {
+			// The step may not have run at all.
+			err = ErrKilled
+		}
+		if err != nil {
+			break
+		}
+		completed++
+	}
+	if err == nil {
+		return nil
+	}
+
+	errs := Errors{err}
+	for i := completed - 1; i >= 0; i-- {
+		if t.steps[i].Undo == nil {
+			continue
+		}
+		sub := &subTask{p: t.steps[i].Undo, done: func(err error) error { return err }}
+		if rerr := sub.Run(s); rerr != nil {
+			errs = append(errs, fmt.Errorf("cannot roll back step %d: %v", i+1, rerr))
+		}
+	}
+	if len(errs) == 1 {
+		return err
+	}
+	return errs
+}
+
+func (t *transactionTask) Kill() {
+	t.m.Lock()
+	t.killed = true
+	current := t.current
+	t.m.Unlock()
+	if current != nil {
+		current.Kill()
+	}
+}
+
+// WatchOptions holds the options for WatchAndRun.
+type WatchOptions struct {
+	// Interval is how often the watched paths are checked for
+	// changes. It defaults to half a second.
+	Interval time.Duration
+
+	// Debounce is how long changes must stop for before p is rerun,
+	// so that bursts of changes cause a single run. It defaults to
+	// 100 milliseconds.
+	Debounce time.Duration
+
+	// OnRun, if set, is called with the result of every run of p
+	// that wasn't interrupted. Otherwise failures are reported to
+	// the pipe's stderr.
+	OnRun func(err error)
+}
+
+// WatchAndRun runs p and then watches the files at paths, including
+// the files within directories, and reruns p whenever they change,
+// similar to the entr tool. A run in progress when a change is noticed
+// is killed before p is rerun. Runs of p don't terminate WatchAndRun
+// even if they fail; it runs until the pipe is killed. Changes are
+// detected by polling the modification time and size of files.
+//
+// For example, this rebuilds and restarts a server on every change:
+//
+//    p := pipe.WatchAndRun([]string{"src"}, pipe.Script(
+//        pipe.Exec("go", "build", "-o", "server", "./src"),
+//        pipe.Exec("./server"),
+//    ), pipe.WatchOptions{})
+//
+func WatchAndRun(paths []string, p Pipe, opts WatchOptions) Pipe {
+	return func(s *State) error {
+		if opts.Interval <= 0 {
+			opts.Interval = 500 * time.Millisecond
+		}
+		if opts.Debounce <= 0 {
+			opts.Debounce = 100 * time.Millisecond
+		}
+		return s.AddTask(&watchTask{paths: paths, p: p, opts: opts, killed: make(chan bool)})
+	}
+}
+
+type watchTask struct {
+	paths  []string
+	p      Pipe
+	opts   WatchOptions
+	killed chan bool
+	once   sync.Once
+}
+
+type fileSignature struct {
+	size    int64
+	modTime time.Time
+}
+
+func (t *watchTask) snapshot(s *State) map[string]fileSignature {
+	files := make(map[string]fileSignature)
+	for _, path := range t.paths {
+		filepath.Walk(s.Path(path), func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				files[path] = fileSignature{info.Size(), info.ModTime()}
+			}
+			return nil
+		})
+	}
+	return files
+}
+
+func (t *watchTask) Run(s *State) error {
+	var sub *subTask
+	var done chan error
+	start := func() {
+		sub = &subTask{
+			p: func(s *State) error {
+				s.Stdin = strings.NewReader("")
+				return t.p(s)
+			},
+			done: func(err error) error { return err },
+		}
+		done = make(chan error, 1)
+		go func(sub *subTask, done chan error) { done <- sub.Run(s) }(sub, done)
+	}
+	stop := func() {
+		if sub != nil {
+			sub.Kill()
+			<-done
+			sub, done = nil, nil
+		}
+	}
+
+	files := t.snapshot(s)
+	start()
+	ticker := time.NewTicker(t.opts.Interval)
+	defer ticker.Stop()
+	var changed time.Time
+	for {
+		select {
+		case <-t.killed:
+			stop()
+			return ErrKilled
+		case err := <-done:
+			sub, done = nil, nil
+			if t.opts.OnRun != nil {
+				t.opts.OnRun(err)
+			} else if err != nil {
+				fmt.Fprintf(s.Stderr, "pipe run failed: %v\n", err)
+			}
+		case now := <-ticker.C:
+			current := t.snapshot(s)
+			if !reflect.DeepEqual(current, files) {
+				files = current
+				changed = now
+			} else if !changed.IsZero() && now.Sub(changed) >= t.opts.Debounce {
+				changed = time.Time{}
+				stop()
+				start()
+			}
+		}
+	}
+}
+
+func (t *watchTask) Kill() {
+	t.once.Do(func() { close(t.killed) })
+}
+
+// RestartMode selects when Supervise restarts a pipe.
+type RestartMode int
+
+const (
+	RestartOnFailure RestartMode = iota // Restart only when the pipe fails.
+	RestartAlways                       // Restart whenever the pipe terminates.
+)
+
+// SupervisePolicy holds the restart policy for Supervise.
+type SupervisePolicy struct {
+	// RestartOn defines which terminations cause a restart.
+	RestartOn RestartMode
+
+	// MaxRestarts, if positive, limits the number of restarts.
+	MaxRestarts int
+
+	// Backoff is the delay before the first restart, doubled after
+	// each further restart up to MaxBackoff. It defaults to one
+	// second, and MaxBackoff defaults to one minute. The delay is
+	// reset to Backoff after a run that lasts longer than MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// OnRestart, if set, is called before every restart with the
+	// number of restarts so far, including this one, and the result
+	// of the run that terminated.
+	OnRestart func(restarts int, err error)
+}
+
+// Supervise runs p and restarts it when it terminates, as defined by
+// policy, so that long-running workers are kept running. Supervise
+// terminates when p terminates without requiring a restart, or when
+// the restarts are exhausted, in which case it returns the result of
+// the last run, or when the pipe is killed.
+//
+// For example, this keeps a worker running, restarting it if it fails
+// at most 10 times:
+//
+//    p := pipe.Supervise(pipe.Exec("worker"), pipe.SupervisePolicy{
+//        MaxRestarts: 10,
+//        OnRestart: func(n int, err error) {
+//            log.Printf("restarting worker (%d): %v", n, err)
+//        },
+//    })
+//
+func Supervise(p Pipe, policy SupervisePolicy) Pipe {
+	return func(s *State) error {
+		if policy.Backoff <= 0 {
+			policy.Backoff = time.Second
+		}
+		if policy.MaxBackoff <= 0 {
+			policy.MaxBackoff = time.Minute
+		}
+		return s.AddTask(&superviseTask{p: p, policy: policy, killed: make(chan bool)})
+	}
+}
+
+type superviseTask struct {
+	p      Pipe
+	policy SupervisePolicy
+
+	m       sync.Mutex
+	current *subTask
+	killed  chan bool
+	once    sync.Once
+}
+
+func (t *superviseTask) Run(s *State) error {
+	backoff := t.policy.Backoff
+	for restarts := 0; ; restarts++ {
+		sub := &subTask{p: t.p, done: func(err error) error { return err }}
+		t.m.Lock()
+		t.current = sub
+		t.m.Unlock()
+		select {
+		case <-t.killed:
+			return ErrKilled
+		default:
+		}
+		started := time.Now()
+		err := sub.Run(s)
+		select {
+		case <-t.killed:
+			return ErrKilled
+		default:
+		}
+		if err == nil && t.policy.RestartOn != RestartAlways {
+			return nil
+		}
+		if t.policy.MaxRestarts > 0 && restarts >= t.policy.MaxRestarts {
+			return err
+		}
+		if time.Since(started) > t.policy.MaxBackoff {
+			backoff = t.policy.Backoff
+		}
+		if t.policy.OnRestart != nil {
+			t.policy.OnRestart(restarts+1, err)
+		}
+		select {
+		case <-t.killed:
+			return ErrKilled
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > t.policy.MaxBackoff {
+			backoff = t.policy.MaxBackoff
+		}
+	}
+}
+
+func (t *superviseTask) Kill() {
+	t.once.Do(func() { close(t.killed) })
+	t.m.Lock()
+	current := t.current
+	t.m.Unlock()
+	if current != nil {
+		current.Kill()
+	}
+}
+
+func writePIDFile(path string, p Process) (pid int, err error) {
+	pp, ok := p.(interface{ Pid() int })
+	if !ok {
+		return 0, fmt.Errorf("cannot write PID file %s: process has no PID", path)
+	}
+	pid = pp.Pid()
+	if err := ioutil.WriteFile(path, []byte(strconv.Itoa(pid)+"\n"), 0644); err != nil {
+		return 0, err
+	}
+	return pid, nil
+}
+
+// removePIDFile removes the PID file at path if it still holds pid.
+func removePIDFile(path string, pid int) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil && strings.TrimSpace(string(data)) == strconv.Itoa(pid) {
+		os.Remove(path)
+	}
+}
+
+// ErrAlreadyRunning is returned by Exclusive when another instance
+// of the pipe holds its lock.
+var ErrAlreadyRunning = errors.New("already running")
+
+// Exclusive returns a pipe that runs p while holding an exclusive lock
+// on the file at lockPath, so that only one instance of p runs at a
+// time on the machine. If the lock is held by another process or pipe,
+// p is not run and ErrAlreadyRunning is returned. The lock file is
+// created if necessary, and is released when p terminates, even if the
+// process crashes.
+//
+// For example, this prevents overlapping runs of a cron job:
+//
+//    p := pipe.Exclusive("/var/lock/backup.lock", pipe.Exec("backup"))
+//
+func Exclusive(lockPath string, p Pipe) Pipe {
+	return func(s *State) error {
+		return s.AddTask(&exclusiveTask{
+			path: lockPath,
+			sub:  &subTask{p: p, done: func(err error) error { return err }},
+		})
+	}
+}
+
+type exclusiveTask struct {
+	path string
+	sub  *subTask
+}
+
+func (t *exclusiveTask) Run(s *State) error {
+	file, err := os.OpenFile(s.Path(t.path), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	// Closing the file releases the lock.
+	defer file.Close()
+	err = lockFile(file)
+	if err == errLocked {
+		return ErrAlreadyRunning
+	}
+	if err != nil {
+		return fmt.Errorf("cannot lock %s: %v", t.path, err)
+	}
+	return t.sub.Run(s)
+}
+
+func (t *exclusiveTask) Kill() {
+	t.sub.Kill()
+}
+
+// Group returns a pipe that runs the provided pipes concurrently,
+// each as an independent pipeline with an empty stdin. Once any of
+// them fails, the others are killed, and Group returns the first
+// error after all of them terminated, including their processes.
+//
+// For example, this builds two targets concurrently, and stops
+// building the other one as soon as one of them fails:
+//
+//    p := pipe.Group(
+//        pipe.Exec("make", "-C", "server"),
+//        pipe.Exec("make", "-C", "client"),
+//    )
+//
+func Group(p ...Pipe) Pipe {
+	return func(s *State) error {
+		t := &groupTask{}
+		for _, p := range p {
+			t.subs = append(t.subs, &subTask{
+				p:     p,
+				stdin: strings.NewReader(""),
+				done:  func(err error) error { return err },
+			})
+		}
+		return s.AddTask(t)
+	}
+}
+
+type groupTask struct {
+	subs []*subTask
+}
+
+func (t *groupTask) Run(s *State) error {
+	var once sync.Once
+	var first error
+	var wg sync.WaitGroup
+	for _, sub := range t.subs {
+		wg.Add(1)
+		go func(sub *subTask) {
+			defer wg.Done()
+			if err := sub.Run(s); err != nil {
+				once.Do(func() {
+					first = err
+					t.Kill()
+				})
+			}
+		}(sub)
+	}
+	wg.Wait()
+	return first
+}
+
+func (t *groupTask) Kill() {
+	for _, sub := range t.subs {
+		sub.Kill()
+	}
+}
+
+// Parallel runs the provided pipes concurrently, at most n of them at
+// a time, each as an independent pipeline with an empty stdin. Their
+// stdout is merged, with each write kept whole. Unlike Group, failures
+// don't interrupt the other pipes, and Parallel returns the errors of
+// all the pipes that failed, in the order they were provided, once all
+// of them terminated. If n is not positive, the number of CPUs is used.
+//
+// For example, this deploys to all hosts, two at a time:
+//
+//    p := pipe.Parallel(2,
+//        pipe.Exec("deploy", "host1"),
+//        pipe.Exec("deploy", "host2"),
+//        pipe.Exec("deploy", "host3"),
+//    )
+//
+func Parallel(n int, p ...Pipe) Pipe {
+	return func(s *State) error {
+		t := &parallelTask{n: n}
+		for _, p := range p {
+			t.subs = append(t.subs, &subTask{
+				p:     p,
+				stdin: strings.NewReader(""),
+				done:  func(err error) error { return err },
+			})
+		}
+		return s.AddTask(t)
+	}
+}
+
+type parallelTask struct {
+	n    int
+	subs []*subTask
+}
+
+func (t *parallelTask) Run(s *State) error {
+	n := t.n
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	stdout := &lockedWriter{w: s.Stdout}
+	slots := make(chan bool, n)
+	errs := make([]error, len(t.subs))
+	var wg sync.WaitGroup
+	for i, sub := range t.subs {
+		sub.stdout = stdout
+		slots <- true
+		wg.Add(1)
+		go func(i int, sub *subTask) {
+			defer wg.Done()
+			errs[i] = sub.Run(s)
+			<-slots
+		}(i, sub)
+	}
+	wg.Wait()
+	var failed Errors
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if failed != nil {
+		return failed
+	}
+	return nil
+}
+
+func (t *parallelTask) Kill() {
+	for _, sub := range t.subs {
+		sub.Kill()
+	}
+}
+
+// BroadcastStdin runs the provided entries as a Script where each of
+// them reads the full data from the pipe's stdin, rather than the first
+// entry reading consuming it for the following ones. The data is held
+// in memory until the entries terminate.
+//
+// For example, this computes both the checksum and the size of the
+// data read from stdin:
+//
+//    p := pipe.BroadcastStdin(
+//        pipe.Exec("sha256sum"),
+//        pipe.Exec("wc", "-c"),
+//    )
+//
+func BroadcastStdin(p ...Pipe) Pipe {
+	return func(s *State) error {
+		t := &broadcastTask{}
+		entries := make([]Pipe, len(p))
+		for i, p := range p {
+			p := p
+			entries[i] = func(s *State) error {
+				s.Stdin = bytes.NewReader(t.data)
+				return p(s)
+			}
+		}
+		t.sub = &subTask{p: Script(entries...), done: func(err error) error { return err }}
+		return s.AddTask(t)
+	}
+}
+
+type broadcastTask struct {
+	sub  *subTask
+	data []byte
+
+	m      sync.Mutex
+	cancel func()
+	killed bool
+}
+
+func (t *broadcastTask) Run(s *State) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	t.m.Lock()
+	if t.killed {
+		t.m.Unlock()
+		return ErrKilled
+	}
+	t.cancel = cancel
+	t.m.Unlock()
+	var buf bytes.Buffer
+	if _, err := copyContext(ctx, &buf, s.Stdin); err != nil {
+		if ctx.Err() != nil {
+			return ErrKilled
+		}
+		return err
+	}
+	t.data = buf.Bytes()
+	return t.sub.Run(s)
+}
+
+func (t *broadcastTask) Kill() {
+	t.m.Lock()
+	t.killed = true
+	if t.cancel != nil {
+		t.cancel()
+	}
+	t.m.Unlock()
+	t.sub.Kill()
+}
+
+// condTask runs sub only if cond returns true when the task runs.
+type condTask struct {
+	cond func(s *State) (bool, error)
+	sub  *subTask
+}
+
+func (t *condTask) Run(s *State) error {
+	ok, err := t.cond(s)
+	if err != nil || !ok {
+		return err
+	}
+	return t.sub.Run(s)
+}
+
+func (t *condTask) Kill() {
+	t.sub.Kill()
+}
+
+// subTask runs the p pipe as an independent pipeline sharing the
+// task's streams, directory, and environment, and returns the result
+// of calling done with the resulting error.
+type subTask struct {
+	p    Pipe
+	done func(err error) error
+
+	// stdin and stdout, if set, replace the task's respective streams.
+	stdin  io.Reader
+	stdout io.Writer
+
+	// timeout, if set, limits for how long the task may run.
+	timeout time.Duration
+
+	m      sync.Mutex
+	sub    *State
+	cancel bool
+
+	// started holds when the tasks of p started running, if they did.
+	started time.Time
+}
+
+func (t *subTask) Run(s *State) error {
+	sub := s.newSubState(s.Stdout, s.Stderr)
+	if t.stdin != nil {
+		sub.Stdin = t.stdin
+	}
+	if t.stdout != nil {
+		sub.Stdout = t.stdout
+	}
+	sub.Timeout = t.timeout
+	err := t.p(sub)
+	if err == nil {
+		// The state is only made visible to Kill once p is done adding
+		// tasks to it, as killing a state races with adding tasks.
+		t.m.Lock()
+		if t.cancel {
+			t.m.Unlock()
+			return nil
+		}
+		t.sub = sub
+		t.started = time.Now()
+		t.m.Unlock()
+		err = sub.RunTasks()
+	}
+	t.m.Lock()
+	cancel := t.cancel
+	t.m.Unlock()
+	if cancel {
+		return err
+	}
+	return t.done(err)
+}
+
+// newSubState returns a new state for running a pipe within a task run
+// with s, writing its output to stdout and stderr. The new state shares
+// the stdin, directory, and environment of s, along with its options and
+// hooks, so that commands run by the pipe are subject to the same rules
+// as the ones run directly by s.
+func (s *State) newSubState(stdout, stderr io.Writer) *State {
+	sub := NewState(stdout, stderr)
+	sub.Stdin = s.Stdin
+	sub.Dir = s.Dir
+	sub.Env = s.Env
+	sub.Executor = s.Executor
+	sub.KillSignal = s.KillSignal
+	sub.KillGrace = s.KillGrace
+	sub.observers = append(s.observers[:len(s.observers):len(s.observers)], s.scopedObservers...)
+	sub.observed = s.observed
+	sub.CommandPolicy = s.CommandPolicy
+	sub.BeforeExec = s.BeforeExec
+	sub.AfterExec = s.AfterExec
+	sub.ObjectStore = s.ObjectStore
+	sub.CheckpointFile = s.CheckpointFile
+	sub.NoPipefail = s.NoPipefail
+	sub.StderrTail = s.StderrTail
+	sub.WriteQuota = s.WriteQuota
+	sub.quotaUsed = s.quotaUsed
+	sub.procs = s.procs
+	sub.nested = true
+	return sub
+}
+
+func (t *subTask) Kill() {
+	t.m.Lock()
+	sub := t.sub
+	t.cancel = true
+	t.m.Unlock()
+	if sub != nil {
+		sub.Kill()
+	}
+}
+
+// Summary describes the outcome of a pipe run with Notify.
+type Summary struct {
+	Success  bool          `json:"success"`
+	Duration time.Duration `json:"duration"`
+
+	// Output holds the last lines the pipe wrote to its
+	// stdout and stderr, interleaved as written.
+	Output string `json:"output,omitempty"`
+
+	// Error describes why the pipe failed, if it did.
+	Error *ErrorReport `json:"error,omitempty"`
+}
+
+// outputTailSize is the maximum amount of data from the end of
+// the output of a pipe reported in its Summary.
+const outputTailSize = 4 * 1024
+
+// Notify runs p and then calls notify with a summary of its outcome,
+// whether p succeeded, failed, or was killed, so that pipes running
+// unattended may alert operators. The pipe fails with p's error if p
+// fails, or with the error returned by notify otherwise.
+//
+// For example, this posts the outcome of a nightly backup to a webhook:
+//
+//    p := pipe.Notify(backup, pipe.Webhook("https://hooks.example.com/backup"))
+//    err := pipe.Run(p)
+//
+func Notify(p Pipe, notify func(*Summary) error) Pipe {
+	return func(s *State) error {
+		tail := &tailWriter{max: outputTailSize}
+		output := &lockedWriter{w: tail}
+		sub := &subTask{
+			p: func(s *State) error {
+				stdout := io.MultiWriter(s.Stdout, output)
+				if combinedOutput(s) {
+					s.Stdout, s.Stderr = stdout, stdout
+				} else {
+					s.Stdout, s.Stderr = stdout, io.MultiWriter(s.Stderr, output)
+				}
+				return p(s)
+			},
+			done: func(err error) error { return err },
+		}
+		return s.AddTask(&notifyTask{sub: sub, done: func(err error) error {
+			output.m.Lock()
+			defer output.m.Unlock()
+			// The duration is zero if p was killed before it started.
+			var duration time.Duration
+			if !sub.started.IsZero() {
+				duration = time.Since(sub.started)
+			}
+			return notify(&Summary{
+				Success:  err == nil,
+				Duration: duration,
+				Output:   tail.tail(),
+				Error:    NewErrorReport(err),
+			})
+		}})
+	}
+}
+
+type notifyTask struct {
+	sub    *subTask
+	done   func(err error) error
+	killed int32
+}
+
+func (t *notifyTask) Run(s *State) error {
+	err := t.sub.Run(s)
+	if err == nil && atomic.LoadInt32(&t.killed) != 0 {
+		err = ErrKilled
+	}
+	nerr := t.done(err)
+	if err != nil {
+		return err
+	}
+	return nerr
+}
+
+func (t *notifyTask) Kill() {
+	atomic.StoreInt32(&t.killed, 1)
+	t.sub.Kill()
+}
+
+// lockedWriter serializes writes to w.
+type lockedWriter struct {
+	m sync.Mutex
+	w io.Writer
+}
+
+func (w *lockedWriter) Write(b []byte) (n int, err error) {
+	w.m.Lock()
+	n, err = w.w.Write(b)
+	w.m.Unlock()
+	return n, err
+}
+
+// webhookClient is the client used by Webhook to deliver summaries.
+var webhookClient = &http.Client{Timeout: 30 * time.Second}
+
+// Webhook returns a function that posts summaries to url as JSON,
+// for use with Notify. It fails if the server doesn't respond with
+// a successful status.
+func Webhook(url string) func(*Summary) error {
+	return func(summary *Summary) error {
+		data, err := json.Marshal(summary)
+		if err != nil {
+			return err
+		}
+		resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("cannot notify webhook: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("cannot notify webhook %s: %s", url, resp.Status)
+		}
+		return nil
+	}
+}
+
+// Spec is a declarative description of a pipe, which may be marshaled
+// as JSON to be stored or transmitted, and turned back into a pipe.
+// Only the JSON encoding is supported; other formats such as YAML must
+// be converted to JSON before being handed to FromSpec.
+// Each Spec describes either a pipeline of entries in Line, a sequence
+// of entries in Script, a command to run named by Exec, or a stage
+// registered via Register named by Stage.
+//
+// For example, the pipe
+//
+//    pipe.Line(
+//        pipe.Exec("tar", "cz", "src"),
+//        pipe.Exec("ssh", "host", "cat > src.tgz"),
+//    )
+//
+// is described by the JSON specification
+//
+//    {"line": [{"exec": "tar", "args": ["cz", "src"]}, {"exec": "ssh", "args": ["host", "cat > src.tgz"]}]}
+//
+// See FromSpec and ToSpec.
+type Spec struct {
+	Line   []*Spec  `json:"line,omitempty"`
+	Script []*Spec  `json:"script,omitempty"`
+	Exec   string   `json:"exec,omitempty"`
+	Stage  string   `json:"stage,omitempty"`
+	Args   []string `json:"args,omitempty"`
+
+	// Dir and Env, if set, change the directory and environment
+	// variables in which the described pipe runs.
+	Dir string            `json:"dir,omitempty"`
+	Env map[string]string `json:"env,omitempty"`
+
+	// ClearEnv and KeepEnv, if set, remove all variables or all but
+	// the named ones from the environment before Env is applied,
+	// as done by the ClearEnv and KeepEnv pipes.
+	ClearEnv bool     `json:"clearenv,omitempty"`
+	KeepEnv  []string `json:"keepenv,omitempty"`
+
+	// Stdin and Stdout, if set, redirect the described pipe's streams
+	// from and to the files at the respective paths.
+	Stdin  string `json:"stdin,omitempty"`
+	Stdout string `json:"stdout,omitempty"`
+}
+
+// FromSpec returns the pipe described by the JSON specification in data.
+// See the Spec type for details.
+func FromSpec(data []byte) (Pipe, error) {
+	var spec Spec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("invalid pipe specification: %v", err)
+	}
+	return spec.Pipe()
+}
+
+// ToSpec returns the JSON specification describing p. Only pipes made
+// of Line, Script, Exec, ExecIn, ExecWithStdinFile, System, SystemIn,
+// ChDir, SetEnvVar, ClearEnv, KeepEnv, and Stage may be described, so
+// pipes built from a Spec are only described again if they use no
+// Stdout redirection and no Stdin redirection outside of an Exec
+// entry. ToSpec fails for any other pipe. See the Spec type for
+// details.
+func ToSpec(p Pipe) ([]byte, error) {
+	spec, err := Introspect(p)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(spec)
+}
+
+// Introspect returns the Spec describing p. See ToSpec for details.
+func Introspect(p Pipe) (*Spec, error) {
+	s := NewState(nil, nil)
+	s.spec = &specCollector{env: s.Env}
+	if err := s.spec.addSequence(s, "script", []Pipe{p}); err != nil {
+		return nil, err
+	}
+	spec := s.spec.entries[0].Script[0]
+	return spec, nil
+}
+
+// Pipe returns the pipe described by spec.
+func (spec *Spec) Pipe() (Pipe, error) {
+	var p Pipe
+	kinds := 0
+	if spec.Line != nil {
+		entries, err := specPipes(spec.Line)
+		if err != nil {
+			return nil, err
+		}
+		p = Line(entries...)
+		kinds++
+	}
+	if spec.Script != nil {
+		entries, err := specPipes(spec.Script)
+		if err != nil {
+			return nil, err
+		}
+		p = Script(entries...)
+		kinds++
+	}
+	if spec.Exec != "" {
+		// Exec itself is not available on all platforms, while commands
+		// described by a spec may still run via a custom Executor.
+		name, args, stdinPath := spec.Exec, spec.Args, spec.Stdin
+		p = func(s *State) error {
+			return s.AddTask(&execTask{name: name, args: args, stdinPath: stdinPath})
+		}
+		kinds++
+	}
+	if spec.Stage != "" {
+		if lookupStage(spec.Stage) == nil {
+			return nil, fmt.Errorf("unknown pipe stage %q", spec.Stage)
+		}
+		p = Stage(spec.Stage, spec.Args...)
+		kinds++
+	}
+	if kinds != 1 {
+		return nil, fmt.Errorf("pipe specification must have exactly one of line, script, exec, or stage")
+	}
+	if spec.Stdin != "" && spec.Exec == "" {
+		p = Line(ReadFile(spec.Stdin), p)
+	}
+	if spec.Stdout != "" {
+		p = Line(p, WriteFile(spec.Stdout, 0644))
+	}
+	if spec.Dir != "" || len(spec.Env) > 0 || spec.ClearEnv || spec.KeepEnv != nil {
+		inner := p
+		dir, env := spec.Dir, spec.Env
+		clear, keep := spec.ClearEnv, spec.KeepEnv
+		p = func(s *State) error {
+			saved, savedEnv, savedKept := s.Dir, s.Env, s.keptEnv
+			defer func() { s.Dir, s.Env, s.keptEnv = saved, savedEnv, savedKept }()
+			s.Dir = s.Path(dir)
+			s.Env = copyEnv(s.Env)
+			if clear {
+				ClearEnv()(s)
+			}
+			if keep != nil {
+				KeepEnv(keep...)(s)
+			}
+			for name, value := range env {
+				s.SetEnvVar(name, value)
+			}
+			return inner(s)
+		}
+	}
+	return p, nil
+}
+
+func specPipes(specs []*Spec) ([]Pipe, error) {
+	pipes := make([]Pipe, len(specs))
+	for i, spec := range specs {
+		if spec == nil {
+			return nil, fmt.Errorf("pipe specification has a null entry")
+		}
+		p, err := spec.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		pipes[i] = p
+	}
+	return pipes, nil
+}
+
+// specCollector accumulates the Spec entries describing a pipe
+// while it is introspected, relative to the initial environment.
+type specCollector struct {
+	env     []string
+	entries []*Spec
+}
+
+func (c *specCollector) addTask(s *State, t Task) error {
+	f, ok := t.(*execTask)
+	if !ok {
+		return fmt.Errorf("cannot describe pipe with task of type %T", t)
+	}
+	spec := &Spec{Exec: f.name, Args: f.args, Stdin: f.stdinPath}
+	c.addEntry(s, spec)
+	if f.dir != "" {
+		spec.Dir = s.Path(f.dir)
+	}
+	return nil
+}
+
+// addEntry adds spec to the collected entries with the directory and
+// environment changes from s.
+func (c *specCollector) addEntry(s *State, spec *Spec) {
+	spec.Dir = s.Dir
+	kept := make(map[string]bool)
+	for _, name := range s.keptEnv {
+		kept[name] = true
+	}
+	if s.keptEnv != nil {
+		if len(s.keptEnv) == 0 {
+			spec.ClearEnv = true
+		} else {
+			spec.KeepEnv = s.keptEnv
+		}
+	}
+	// Only the kept variables of the initial environment are inherited.
+	base := make(map[string]bool)
+	for _, kv := range c.env {
+		if i := strings.Index(kv, "="); i > 0 && (s.keptEnv == nil || kept[kv[:i]]) {
+			base[kv] = true
+		}
+	}
+	for _, kv := range s.Env {
+		if i := strings.Index(kv, "="); i > 0 && !base[kv] {
+			if spec.Env == nil {
+				spec.Env = make(map[string]string)
+			}
+			spec.Env[kv[:i]] = kv[i+1:]
+		}
+	}
+	c.entries = append(c.entries, spec)
+}
+
+func (c *specCollector) addSequence(s *State, kind string, p []Pipe) error {
+	dir, env, keptEnv := s.Dir, s.Env, s.keptEnv
+	s.Env = copyEnv(s.Env)
+	defer func() {
+		s.Dir, s.Env, s.keptEnv, s.spec = dir, env, keptEnv, c
+	}()
+	var entries []*Spec
+	for _, p := range p {
+		child := &specCollector{env: c.env}
+		s.spec = child
+		if err := p(s); err != nil {
+			return err
+		}
+		if len(child.entries) > 1 {
+			return fmt.Errorf("cannot describe pipe entry with %d concurrent tasks", len(child.entries))
+		}
+		entries = append(entries, child.entries...)
+	}
+	if entries == nil {
+		entries = []*Spec{}
+	}
+	if kind == "line" {
+		c.entries = append(c.entries, &Spec{Line: entries})
+	} else {
+		c.entries = append(c.entries, &Spec{Script: entries})
+	}
+	return nil
+}
+
+// StageFactory creates the pipe for a stage registered via Register
+// with the arguments provided to the stage.
+type StageFactory func(args ...string) (Pipe, error)
+
+var stages struct {
+	sync.Mutex
+	m map[string]StageFactory
+}
+
+// Register makes the stage created by factory available under name, so
+// that it may be referenced by Stage and by specifications via the
+// Stage field of Spec. It is meant to be called from the init function
+// of packages that contribute stages, and panics if name is empty or
+// is already registered.
+//
+// For example, a package may register a stage that downloads objects:
+//
+//    func init() {
+//        pipe.Register("s3get", func(args ...string) (pipe.Pipe, error) {
+//            if len(args) != 2 {
+//                return nil, fmt.Errorf("usage: s3get <bucket> <key>")
+//            }
+//            return pipe.ReadObject(args[0], args[1]), nil
+//        })
+//    }
+//
+func Register(name string, factory StageFactory) {
+	stages.Lock()
+	defer stages.Unlock()
+	if name == "" || factory == nil {
+		panic("pipe: Register called with empty name or nil factory")
+	}
+	if _, ok := stages.m[name]; ok {
+		panic("pipe: Register called twice for stage " + name)
+	}
+	if stages.m == nil {
+		stages.m = make(map[string]StageFactory)
+	}
+	stages.m[name] = factory
+}
+
+// Stages returns the sorted names of the stages registered via Register.
+func Stages() []string {
+	stages.Lock()
+	defer stages.Unlock()
+	var names []string
+	for name := range stages.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupStage(name string) StageFactory {
+	stages.Lock()
+	defer stages.Unlock()
+	return stages.m[name]
+}
+
+// Stage returns a pipe that runs the stage registered under name via
+// Register, created with the provided arguments. The pipe fails if no
+// such stage is registered or if its factory fails.
+func Stage(name string, args ...string) Pipe {
+	return func(s *State) error {
+		if s.spec != nil {
+			s.spec.addEntry(s, &Spec{Stage: name, Args: args})
+			return nil
+		}
+		factory := lookupStage(name)
+		if factory == nil {
+			return fmt.Errorf("unknown pipe stage %q", name)
+		}
+		p, err := factory(args...)
+		if err != nil {
+			return fmt.Errorf("cannot create pipe stage %q: %v", name, err)
+		}
+		return p(s)
+	}
+}
+
+type taskFunc func(s *State) error
+
+func (f taskFunc) Run(s *State) error { return f(s) }
+func (f taskFunc) Kill()              {}
+
+// TaskFunc is a helper to define a Pipe that adds a Task
+// with f as its Run method.
+func TaskFunc(f func(s *State) error) Pipe {
+	return func(s *State) error {
+		return s.AddTask(taskFunc(f))
+	}
+}
+
+// Print provides args to fmt.Sprint and writes the resuling
+// string to the pipe's stdout.
+func Print(args ...interface{}) Pipe {
+	return TaskFunc(func(s *State) error {
+		_, err := s.Stdout.Write([]byte(fmt.Sprint(args...)))
+		return err
+	})
+}
+
+// Println provides args to fmt.Sprintln and writes the resuling
+// string to the pipe's stdout.
+func Println(args ...interface{}) Pipe {
+	return TaskFunc(func(s *State) error {
+		_, err := s.Stdout.Write([]byte(fmt.Sprintln(args...)))
+		return err
+	})
+}
+
+// Printf provides format and args to fmt.Sprintf and writes
+// the resulting string to the pipe's stdout.
+func Printf(format string, args ...interface{}) Pipe {
+	return TaskFunc(func(s *State) error {
+		_, err := s.Stdout.Write([]byte(fmt.Sprintf(format, args...)))
+		return err
+	})
+}
+
+// Zeros writes n zero bytes to the pipe's stdout.
+func Zeros(n int64) Pipe {
+	return TaskFunc(func(s *State) error {
+		_, err := io.CopyN(s.Stdout, zeroReader{}, n)
+		return err
+	})
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// RandomBytes writes n pseudo-random bytes to the pipe's stdout.
+// The data is generated deterministically from seed, so the same
+// seed always produces the same data. It is not suitable for
+// cryptographic purposes.
+func RandomBytes(n int64, seed int64) Pipe {
+	return TaskFunc(func(s *State) error {
+		_, err := io.CopyN(s.Stdout, rand.New(rand.NewSource(seed)), n)
+		return err
+	})
+}
+
+// Yes writes s followed by a newline to the pipe's stdout repeatedly,
+// similar to the yes tool, until the pipe is killed or the following
+// entry of a line stops reading its stdin, in which case Yes
+// terminates successfully.
+//
+// For example, this answers every prompt of a command:
+//
+//    p := pipe.Line(
+//        pipe.Yes("y"),
+//        pipe.Exec("apt-get", "install", "golang"),
+//    )
+//
+func Yes(s string) Pipe {
+	return repeatString(s+"\n", -1)
+}
+
+// RepeatString writes s n times to the pipe's stdout.
+func RepeatString(s string, n int) Pipe {
+	return repeatString(s, n)
+}
+
+// repeatString writes s to the pipe's stdout n times,
+// or until the pipe is killed or stdout closed if n is negative.
+func repeatString(str string, n int) Pipe {
+	return contextTaskFunc(func(ctx context.Context, s *State) error {
+		if str == "" {
+			return nil
+		}
+		// Write multiple copies at once for efficiency.
+		per := 8192/len(str) + 1
+		chunk := []byte(strings.Repeat(str, per))
+		for n != 0 {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if n > 0 && n < per {
+				chunk = chunk[:n*len(str)]
+			}
+			if _, err := s.Stdout.Write(chunk); err != nil {
+				if n < 0 && isBrokenPipe(err) {
+					return nil
+				}
+				return err
+			}
+			if n > 0 {
+				n -= len(chunk) / len(str)
+			}
+		}
+		return nil
+	})
+}
+
+// Seq writes the numbers from first to last, in increments of step,
+// one per line to the pipe's stdout, similar to the seq tool. Nothing
+// is written if last can't be reached from first with step.
+func Seq(first, last, step int) Pipe {
+	return SeqFormat("%d", first, last, step)
+}
+
+// SeqFormat works like Seq, but formats each number with format as
+// defined by the fmt package.
+//
+// For example, this writes the lines "file-08", "file-09", and "file-10":
+//
+//    pipe.SeqFormat("file-%02d", 8, 10, 1)
+//
+func SeqFormat(format string, first, last, step int) Pipe {
+	return contextTaskFunc(func(ctx context.Context, s *State) error {
+		if step == 0 {
+			return fmt.Errorf("sequence step must not be zero")
+		}
+		w := bufio.NewWriter(s.Stdout)
+		for i := first; step > 0 && i <= last || step < 0 && i >= last; i += step {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			fmt.Fprintf(w, format, i)
+			if err := w.WriteByte('\n'); err != nil {
+				return err
+			}
+			if step > 0 && i > math.MaxInt-step || step < 0 && i < math.MinInt-step {
+				break
+			}
+		}
+		return w.Flush()
+	})
+}
+
+// PrintEnv writes the environment variables of the pipe to the pipe's
+// stdout in the form "name=value", one per line, similar to the env tool.
+func PrintEnv() Pipe {
+	return TaskFunc(func(s *State) error {
+		var buf bytes.Buffer
+		for _, kv := range s.Env {
+			buf.WriteString(kv)
+			buf.WriteByte('\n')
+		}
+		_, err := s.Stdout.Write(buf.Bytes())
+		return err
+	})
+}
+
+// PrintState writes the directory the pipe runs in and the values of
+// the named environment variables to the pipe's stderr, so that it may
+// be added anywhere within a script to debug the state seen at that
+// point without disturbing its output. Unset variables are reported
+// as such.
+//
+// For example:
+//
+//    p := pipe.Script(
+//        pipe.ChDir("build"),
+//        pipe.SetEnvVar("GOOS", "linux"),
+//        pipe.PrintState("GOOS", "GOARCH"),
+//        pipe.Exec("go", "build"),
+//    )
+//
+// writes to stderr something like:
+//
+//    dir: /home/user/project/build
+//    env: GOOS=linux
+//    env: GOARCH is unset
+//
+func PrintState(names ...string) Pipe {
+	return TaskFunc(func(s *State) error {
+		dir := s.Dir
+		if dir == "" {
+			dir, _ = os.Getwd()
+		}
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "dir: %s\n", dir)
+		for _, name := range names {
+			prefix := name + "="
+			set := false
+			for _, kv := range s.Env {
+				if strings.HasPrefix(kv, prefix) {
+					fmt.Fprintf(&buf, "env: %s\n", kv)
+					set = true
+					break
+				}
+			}
+			if !set {
+				fmt.Fprintf(&buf, "env: %s is unset\n", name)
+			}
+		}
+		_, err := s.Stderr.Write(buf.Bytes())
+		return err
+	})
+}
+
+// Read reads data from r and writes it to the pipe's stdout.
+func Read(r io.Reader) Pipe {
+	return contextTaskFunc(func(ctx context.Context, s *State) error {
+		_, err := copyContext(ctx, s.Stdout, r)
+		return err
+	})
+}
+
+// Write writes to w the data read from the pipe's stdin.
+func Write(w io.Writer) Pipe {
+	return contextTaskFunc(func(ctx context.Context, s *State) error {
+		_, err := copyContext(ctx, w, s.Stdin)
+		return err
+	})
+}
+
+// Discard reads data from the pipe's stdin and discards it.
+func Discard() Pipe {
+	return Write(ioutil.Discard)
+}
+
+// Tee reads data from the pipe's stdin and writes it both to
+// the pipe's stdout and to w.
+func Tee(w io.Writer) Pipe {
+	return contextTaskFunc(func(ctx context.Context, s *State) error {
+		_, err := copyContext(ctx, w, &teeReader{s.Stdin, s.Stdout})
+		return err
+	})
+}
+
+// Hash reads data from the pipe's stdin and writes it unchanged to the
+// pipe's stdout, storing in out the digest of the data computed with a
+// hash obtained from h once the input is over.
+//
+// For example:
+//
+//    var sum []byte
+//    p := pipe.Line(
+//        pipe.ReadFile("release.tar.gz"),
+//        pipe.Hash(sha256.New, &sum),
+//        pipe.WriteFile("/srv/release.tar.gz", 0644),
+//    )
+//
+func Hash(h func() hash.Hash, out *[]byte) Pipe {
+	return contextTaskFunc(func(ctx context.Context, s *State) error {
+		digest := h()
+		_, err := copyContext(ctx, digest, &teeReader{s.Stdin, s.Stdout})
+		if err != nil {
+			return err
+		}
+		*out = digest.Sum(nil)
+		return nil
+	})
+}
+
+// VerifyHash works like Hash, but rather than storing the digest it
+// fails once the input is over if the digest differs from expected.
+// As the data is passed along while being read, the following entries
+// of a line must not consider it valid unless the line succeeds.
+func VerifyHash(expected []byte, h func() hash.Hash) Pipe {
+	return contextTaskFunc(func(ctx context.Context, s *State) error {
+		digest := h()
+		_, err := copyContext(ctx, digest, &teeReader{s.Stdin, s.Stdout})
+		if err != nil {
+			return err
+		}
+		if sum := digest.Sum(nil); !bytes.Equal(sum, expected) {
+			return fmt.Errorf("data has checksum %x, expected %x", sum, expected)
+		}
+		return nil
+	})
+}
+
+// SkipBytes reads data from the pipe's stdin and writes it to the
+// pipe's stdout, except for the first n bytes which are dropped.
+func SkipBytes(n int64) Pipe {
+	return TaskFunc(func(s *State) error {
+		_, err := io.CopyN(ioutil.Discard, s.Stdin, n)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(s.Stdout, s.Stdin)
+		return err
+	})
+}
+
+// LimitBytes reads data from the pipe's stdin and writes at most
+// its first n bytes to the pipe's stdout. It terminates as soon as
+// the limit is reached, and the preceding entries of a line are then
+// stopped without failing, as if they had written all their output.
+func LimitBytes(n int64) Pipe {
+	return TaskFunc(func(s *State) error {
+		_, err := io.CopyN(s.Stdout, s.Stdin, n)
+		if err == io.EOF {
+			return nil
+		}
+		if err == nil {
+			s.stopReading()
+		}
+		return err
+	})
+}
+
+// SkipLines reads lines from the pipe's stdin and writes them to the
+// pipe's stdout, except for the first n lines which are dropped.
+func SkipLines(n int) Pipe {
+	return TaskFunc(func(s *State) error {
+		r := bufio.NewReader(s.Stdin)
+		for i := 0; i < n; i++ {
+			_, err := r.ReadBytes('\n')
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		_, err := io.Copy(s.Stdout, r)
+		return err
+	})
+}
+
+// LimitLines reads lines from the pipe's stdin and writes at most its
+// first n lines to the pipe's stdout. It terminates as soon as the limit
+// is reached, and the preceding entries of a line are then stopped
+// without failing, as if they had written all their output.
+func LimitLines(n int) Pipe {
+	return TaskFunc(func(s *State) error {
+		r := bufio.NewReader(s.Stdin)
+		for i := 0; i < n; i++ {
+			line, err := r.ReadBytes('\n')
+			if len(line) > 0 {
+				if _, err := s.Stdout.Write(line); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		s.stopReading()
+		return nil
+	})
+}
+
+// ReadFile reads data from the file at path and writes it to the
+// pipe's stdout.
+func ReadFile(path string) Pipe {
+	return contextTaskFunc(func(ctx context.Context, s *State) error {
+		file, err := os.Open(s.Path(path))
+		if err != nil {
+			return err
+		}
+		_, err = copyContext(ctx, s.Stdout, file)
+		file.Close()
+		return err
+	})
+}
+
+// ReadFileRange reads up to length bytes from the file at path starting
+// at offset, and writes them to the pipe's stdout. If length is negative,
+// the data from offset until the end of the file is written. The data
+// preceding offset is skipped without being read.
+func ReadFileRange(path string, offset, length int64) Pipe {
+	return TaskFunc(func(s *State) error {
+		file, err := os.Open(s.Path(path))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		var r io.Reader = io.NewSectionReader(file, offset, math.MaxInt64-offset)
+		if length >= 0 {
+			r = io.LimitReader(r, length)
+		}
+		_, err = io.Copy(s.Stdout, r)
+		return err
+	})
+}
+
+// ReadFileLines reads the lines numbered from fromLine to toLine,
+// inclusive and counting from 1, from the file at path and writes
+// them to the pipe's stdout. If toLine is zero, the lines from fromLine
+// until the end of the file are written. The file is not read past
+// toLine.
+func ReadFileLines(path string, fromLine, toLine int) Pipe {
+	return TaskFunc(func(s *State) error {
+		file, err := os.Open(s.Path(path))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r := bufio.NewReader(file)
+		for n := 1; toLine == 0 || n <= toLine; n++ {
+			line, err := r.ReadSlice('\n')
+			for err == bufio.ErrBufferFull {
+				// Long lines are handled in chunks.
+				if n >= fromLine {
+					if _, err := s.Stdout.Write(line); err != nil {
+						return err
+					}
+				}
+				line, err = r.ReadSlice('\n')
+			}
+			if n >= fromLine && len(line) > 0 {
+				if _, err := s.Stdout.Write(line); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DDOptions holds the options for DD.
+type DDOptions struct {
+	// Input and Output are the paths of the files copied from and
+	// to. The pipe's stdin and stdout are used if they're empty.
+	// Output is created with Perm if it doesn't exist.
+	Input  string
+	Output string
+	Perm   os.FileMode
+
+	// BlockSize is the size of the blocks copied.
+	// It defaults to 512 bytes.
+	BlockSize int
+
+	// Count, if positive, is the number of blocks copied.
+	// Otherwise all blocks until the end of the input are copied.
+	Count int64
+
+	// Skip is the number of blocks skipped at the start of the input.
+	Skip int64
+
+	// Seek is the number of blocks skipped at the start of Output,
+	// which is truncated at that point. It may only be used when
+	// Output is set.
+	Seek int64
+
+	// Progress, if set, is called after every block copied with
+	// the total number of bytes copied so far.
+	Progress func(copied int64)
+}
+
+// DD copies data block by block from the pipe's stdin or a file to the
+// pipe's stdout or a file, as defined by opts, similar to the dd tool.
+// Each block is filled completely before being written, unless the
+// input ends, so the last block copied may be shorter than BlockSize.
+//
+// For example, this copies the boot sector of a disk image:
+//
+//    pipe.DD(pipe.DDOptions{Input: "disk.img", Output: "mbr.bin", Count: 1, Perm: 0644})
+//
+func DD(opts DDOptions) Pipe {
+	return TaskFunc(func(s *State) error {
+		bs := opts.BlockSize
+		if bs <= 0 {
+			bs = 512
+		}
+		if opts.Seek > 0 && opts.Output == "" {
+			return fmt.Errorf("cannot seek in the pipe's stdout")
+		}
+
+		r := s.Stdin
+		if opts.Input != "" {
+			file, err := os.Open(s.Path(opts.Input))
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			if _, err := file.Seek(opts.Skip*int64(bs), io.SeekStart); err != nil {
+				return err
+			}
+			r = file
+		} else if opts.Skip > 0 {
+			if _, err := io.CopyN(ioutil.Discard, r, opts.Skip*int64(bs)); err != nil && err != io.EOF {
+				return err
+			}
+		}
+
+		w := s.Stdout
+		var out *os.File
+		if opts.Output != "" {
+			var err error
+			out, err = os.OpenFile(s.Path(opts.Output), os.O_WRONLY|os.O_CREATE, opts.Perm)
+			if err != nil {
+				return err
+			}
+			defer out.Close()
+			offset := opts.Seek * int64(bs)
+			if err := out.Truncate(offset); err != nil {
+				return err
+			}
+			if _, err := out.Seek(offset, io.SeekStart); err != nil {
+				return err
+			}
+			w = s.quotaWriter(out)
+		}
+
+		var copied int64
+		block := make([]byte, bs)
+		for n := int64(0); ; n++ {
+			if opts.Count > 0 && n == opts.Count {
+				if opts.Input == "" {
+					s.stopReading()
+				}
+				break
+			}
+			size, err := io.ReadFull(r, block)
+			if size > 0 {
+				if _, err := w.Write(block[:size]); err != nil {
+					return err
+				}
+				copied += int64(size)
+				if opts.Progress != nil {
+					opts.Progress(copied)
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if out != nil {
+			return out.Close()
+		}
+		return nil
+	})
+}
+
+// followInterval is how often FollowFile checks for changes
+// once it reaches the end of the followed file.
+const followInterval = 100 * time.Millisecond
+
+// FollowFile reads data from the file at path and writes it to the
+// pipe's stdout, and then keeps writing any data appended to the file
+// until the pipe is killed, similar to "tail -F". If the file is
+// truncated, reading restarts from its beginning, and if the file is
+// replaced, as done when logs are rotated, the new file is followed
+// from its beginning.
+//
+// For example, this reports errors from a live log until killed:
+//
+//    p := pipe.Line(
+//        pipe.FollowFile("/var/log/app.log"),
+//        pipe.Exec("grep", "--line-buffered", "ERROR"),
+//    )
+//
+func FollowFile(path string) Pipe {
+	return func(s *State) error {
+		return s.AddTask(&followTask{path: path, killed: make(chan bool)})
+	}
+}
+
+type followTask struct {
+	path   string
+	killed chan bool
+	once   sync.Once
+}
+
+func (t *followTask) Run(s *State) error {
+	path := s.Path(t.path)
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		file.Close()
+	}()
+	var offset int64
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			offset += int64(n)
+			if _, err := s.Stdout.Write(buf[:n]); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		select {
+		case <-t.killed:
+			return ErrKilled
+		case <-time.After(followInterval):
+		}
+
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		if info.Size() < offset {
+			// The file was truncated.
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			offset = 0
+			continue
+		}
+		if info.Size() > offset {
+			continue
+		}
+		pathInfo, err := os.Stat(path)
+		if err != nil || os.SameFile(info, pathInfo) {
+			// The file is unchanged or is being replaced.
+			continue
+		}
+		// The file was replaced. Reopen it and continue from the
+		// start once anything left in the old file is read.
+		newFile, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		file.Close()
+		file, offset = newFile, 0
+	}
+}
+
+func (t *followTask) Kill() {
+	t.once.Do(func() { close(t.killed) })
+}
+
+// WriteFile writes to the file at path the data read from the
+// pipe's stdin. If the file doesn't exist, it is created with perm.
+func WriteFile(path string, perm os.FileMode) Pipe {
+	return contextTaskFunc(func(ctx context.Context, s *State) error {
+		file, err := os.OpenFile(s.Path(path), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+		if err != nil {
+			return err
+		}
+		_, err = copyContext(ctx, s.quotaWriter(file), s.Stdin)
+		return firstErr(err, file.Close())
+	})
+}
+
+// Preserve selects the file metadata preserved by
+// WriteFileWithInfo and CopyFile.
+type Preserve int
+
+const (
+	PreserveMode  Preserve = 1 << iota // Permission bits, including setuid, setgid, and sticky.
+	PreserveOwner                      // User and group ownership.
+	PreserveTimes                      // Modification time.
+
+	PreserveAll = PreserveMode | PreserveOwner | PreserveTimes
+)
+
+// WriteFileWithInfo writes to the file at path the data read from the
+// pipe's stdin, and then applies to it the metadata from info selected
+// by preserve. If the file doesn't exist, it is created with the
+// permissions in info.
+//
+// For example, this installs a filtered configuration file with the
+// same permissions and ownership as the original:
+//
+//    info, err := os.Stat("app.conf")
+//    ...
+//    p := pipe.Line(
+//        pipe.ReadFile("app.conf"),
+//        pipe.Exec("envsubst"),
+//        pipe.WriteFileWithInfo("/etc/app.conf", info, pipe.PreserveMode|pipe.PreserveOwner),
+//    )
+//
+func WriteFileWithInfo(path string, info os.FileInfo, preserve Preserve) Pipe {
+	return contextTaskFunc(func(ctx context.Context, s *State) error {
+		return writeFileWithInfo(ctx, s, s.Path(path), s.Stdin, info, preserve)
+	})
+}
+
+// CopyFile copies the content of the file at fromPath to the file at
+// toPath, and applies to the latter the metadata of the former selected
+// by preserve. If toPath doesn't exist, it is created with the
+// permissions of fromPath.
+func CopyFile(fromPath, toPath string, preserve Preserve) Pipe {
+	return contextTaskFunc(func(ctx context.Context, s *State) error {
+		from, err := os.Open(s.Path(fromPath))
+		if err != nil {
+			return err
+		}
+		defer from.Close()
+		info, err := from.Stat()
+		if err != nil {
+			return err
+		}
+		return writeFileWithInfo(ctx, s, s.Path(toPath), from, info, preserve)
+	})
+}
+
+func writeFileWithInfo(ctx context.Context, s *State, path string, r io.Reader, info os.FileInfo, preserve Preserve) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = copyContext(ctx, s.quotaWriter(file), r)
+	if err = firstErr(err, file.Close()); err != nil {
+		return err
+	}
+	// Ownership goes first as changing it may reset the setuid bits.
+	if preserve&PreserveOwner != 0 {
+		uid, gid, ok := fileOwner(info)
+		if !ok {
+			return fmt.Errorf("cannot preserve ownership of %s: owner unknown", path)
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	if preserve&PreserveMode != 0 {
+		if err := os.Chmod(path, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+	}
+	if preserve&PreserveTimes != 0 {
+		if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AppendFile append to the end of the file at path the data read
+// from the pipe's stdin. If the file doesn't exist, it is created
+// with perm.
+func AppendFile(path string, perm os.FileMode) Pipe {
+	return contextTaskFunc(func(ctx context.Context, s *State) error {
+		file, err := os.OpenFile(s.Path(path), os.O_WRONLY|os.O_CREATE|os.O_APPEND, perm)
+		if err != nil {
+			return err
+		}
+		_, err = copyContext(ctx, s.quotaWriter(file), s.Stdin)
+		return firstErr(err, file.Close())
+	})
+}
+
+// TeeWriteFile reads data from the pipe's stdin and writes it both to
+// the pipe's stdout and to the file at path. If the file doesn't
+// exist, it is created with perm.
+func TeeWriteFile(path string, perm os.FileMode) Pipe {
+	return contextTaskFunc(func(ctx context.Context, s *State) error {
+		file, err := os.OpenFile(s.Path(path), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+		if err != nil {
+			return err
+		}
+		_, err = copyContext(ctx, s.quotaWriter(file), &teeReader{s.Stdin, s.Stdout})
+		return firstErr(err, file.Close())
+	})
+}
+
+// TeeAppendFile reads data from the pipe's stdin and writes it both to
+// the pipe's stdout and to the file at path. If the file doesn't
+// exist, it is created with perm.
+func TeeAppendFile(path string, perm os.FileMode) Pipe {
+	return contextTaskFunc(func(ctx context.Context, s *State) error {
+		file, err := os.OpenFile(s.Path(path), os.O_WRONLY|os.O_CREATE|os.O_APPEND, perm)
+		if err != nil {
+			return err
+		}
+		_, err = copyContext(ctx, s.quotaWriter(file), &teeReader{s.Stdin, s.Stdout})
+		return firstErr(err, file.Close())
+	})
+}
+
+// DownloadOptions holds the options for Download.
+type DownloadOptions struct {
+	// Path, if set, is the file the download is saved to instead of
+	// being written to the pipe's stdout. The data is first written
+	// to Path with a ".part" suffix, and a download into an existing
+	// partial file resumes where it stopped. The partial file is
+	// renamed to Path once the download completes and is validated.
+	Path string
+
+	// Retries is the number of times a failed request is retried.
+	// Retries resume from the last byte received when the server
+	// supports range requests.
+	Retries int
+
+	// Backoff is the delay before the first retry, doubled
+	// after each further retry. It defaults to one second.
+	Backoff time.Duration
+
+	// Checksum, if set, is the expected checksum of the whole
+	// download in the form "algorithm:hex", where algorithm is
+	// one of md5, sha1, sha256, or sha512.
+	Checksum string
+
+	// Progress, if set, is called as data is received with the
+	// number of bytes downloaded so far and the total size of the
+	// download, or -1 if the total size is unknown.
+	Progress func(done, total int64)
+
+	// Client is the HTTP client used for requests.
+	// It defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// Download fetches the content at url over HTTP and writes it to the
+// pipe's stdout, or to the file at opts.Path if set. Failed requests
+// are retried and resumed as defined by opts, and the downloaded data
+// is validated against opts.Checksum once complete.
+//
+// For example, this downloads a release and verifies its checksum,
+// resuming a previous partial download if there's one:
+//
+//    pipe.Download("https://example.com/release.tar.gz", pipe.DownloadOptions{
+//        Path:     "release.tar.gz",
+//        Retries:  5,
+//        Checksum: "sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+//    })
+//
+func Download(url string, opts DownloadOptions) Pipe {
+	return func(s *State) error {
+		t := &downloadTask{url: url, opts: opts, killed: make(chan bool)}
+		if opts.Checksum != "" {
+			i := strings.Index(opts.Checksum, ":")
+			if i < 0 {
+				return fmt.Errorf("invalid checksum %q: must be in the form algorithm:hex", opts.Checksum)
+			}
+			newHash := checksumHashes[opts.Checksum[:i]]
+			if newHash == nil {
+				return fmt.Errorf("invalid checksum %q: unsupported algorithm %q", opts.Checksum, opts.Checksum[:i])
+			}
+			t.hash = newHash()
+			t.sum = strings.ToLower(opts.Checksum[i+1:])
+		}
+		return s.AddTask(t)
+	}
+}
+
+var checksumHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+type downloadTask struct {
+	url  string
+	opts DownloadOptions
+	hash hash.Hash
+	sum  string
+
+	m      sync.Mutex
+	cancel func()
+	killed chan bool
+}
+
+// downloadError reports a failed request or an unexpected response.
+type downloadError struct {
+	url    string
+	err    error
+	status string
+	code   int
+}
+
+func (e *downloadError) Error() string {
+	if e.err != nil {
+		return fmt.Sprintf("cannot download %s: %v", e.url, e.err)
+	}
+	return fmt.Sprintf("cannot download %s: %s", e.url, e.status)
+}
+
+// temporary returns whether retrying the request may succeed.
+func (e *downloadError) temporary() bool {
+	return e.err != nil || e.code >= 500 || e.code == http.StatusTooManyRequests
+}
+
+func (t *downloadTask) Run(s *State) error {
+	var file *os.File
+	var offset int64
+	if t.opts.Path != "" {
+		var err error
+		file, err = os.OpenFile(s.Path(t.opts.Path+".part"), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if t.hash != nil {
+			offset, err = io.Copy(t.hash, file)
+		} else {
+			offset, err = file.Seek(0, io.SeekEnd)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	backoff := t.opts.Backoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	for retry := 0; ; retry++ {
+		var err error
+		offset, err = t.fetch(s, file, offset)
+		if err == nil {
+			break
+		}
+		if de, ok := err.(*downloadError); !ok || !de.temporary() || retry >= t.opts.Retries {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-t.killed:
+			return ErrKilled
+		}
+		backoff *= 2
+	}
+
+	if t.hash != nil {
+		if sum := hex.EncodeToString(t.hash.Sum(nil)); sum != t.sum {
+			if file != nil {
+				file.Close()
+				os.Remove(file.Name())
+			}
+			return fmt.Errorf("download of %s has checksum %s, expected %s", t.url, sum, t.sum)
+		}
+	}
+	if file != nil {
+		if err := file.Close(); err != nil {
+			return err
+		}
+		return os.Rename(file.Name(), s.Path(t.opts.Path))
+	}
+	return nil
+}
+
+// fetch requests the content at t.url from offset onwards and writes
+// it to file, or to the pipe's stdout if file is nil, returning the
+// offset reached.
+func (t *downloadTask) fetch(s *State, file *os.File, offset int64) (int64, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	t.m.Lock()
+	select {
+	case <-t.killed:
+		t.m.Unlock()
+		return offset, ErrKilled
+	default:
+	}
+	t.cancel = cancel
+	t.m.Unlock()
+
+	req, err := http.NewRequest("GET", t.url, nil)
+	if err != nil {
+		return offset, err
+	}
+	req = req.WithContext(ctx)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	client := t.opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return offset, t.fetchErr(err)
+	}
+	defer resp.Body.Close()
+
+	total := int64(-1)
+	var body io.Reader = resp.Body
+	switch {
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The partial file is already complete.
+		return offset, nil
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		if resp.ContentLength >= 0 {
+			total = offset + resp.ContentLength
+		}
+	case resp.StatusCode == http.StatusOK:
+		if resp.ContentLength >= 0 {
+			total = resp.ContentLength
+		}
+		if offset > 0 && file != nil {
+			// The server ignored the range, so start over.
+			if err := file.Truncate(0); err != nil {
+				return offset, err
+			}
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return offset, err
+			}
+			if t.hash != nil {
+				t.hash.Reset()
+			}
+			offset = 0
+		} else if offset > 0 {
+			// The server ignored the range, so skip what was
+			// already written to stdout.
+			if _, err := io.CopyN(ioutil.Discard, body, offset); err != nil {
+				return offset, t.fetchErr(err)
+			}
+		}
+	default:
+		return offset, &downloadError{url: t.url, status: resp.Status, code: resp.StatusCode}
+	}
+
+	var w io.Writer = s.Stdout
+	if file != nil {
+		w = s.quotaWriter(file)
+	}
+	if t.hash != nil {
+		w = io.MultiWriter(w, t.hash)
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return offset, err
+			}
+			offset += int64(n)
+			if t.opts.Progress != nil {
+				t.opts.Progress(offset, total)
+			}
+		}
+		if rerr == io.EOF {
+			return offset, nil
+		}
+		if rerr != nil {
+			return offset, t.fetchErr(rerr)
+		}
+	}
+}
+
+func (t *downloadTask) fetchErr(err error) error {
+	select {
+	case <-t.killed:
+		return ErrKilled
+	default:
+	}
+	return &downloadError{url: t.url, err: err}
+}
+
+func (t *downloadTask) Kill() {
+	t.m.Lock()
+	select {
+	case <-t.killed:
+	default:
+		close(t.killed)
+	}
+	if t.cancel != nil {
+		t.cancel()
+	}
+	t.m.Unlock()
+}
+
+// HTTPOptions holds the options for HTTPGet.
+type HTTPOptions struct {
+	// Header holds additional headers sent with the request.
+	Header http.Header
+
+	// Timeout, if positive, limits for how long the request may take,
+	// including the time spent transferring the response body.
+	Timeout time.Duration
+
+	// Client is the HTTP client used for the request.
+	// It defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// HTTPGet fetches the content at url over HTTP and streams it to the
+// pipe's stdout. It fails if the response status is not a 2xx one.
+//
+// For example, the equivalent of "curl -sf $URL | tar xz" is:
+//
+//    p := pipe.Line(
+//        pipe.HTTPGet(url, pipe.HTTPOptions{Timeout: time.Minute}),
+//        pipe.Exec("tar", "xz"),
+//    )
+//
+// See Download for retrying and resuming downloads.
+func HTTPGet(url string, opts HTTPOptions) Pipe {
+	return contextTaskFunc(func(ctx context.Context, s *State) error {
+		return httpRequest(ctx, s, "GET", url, nil, opts)
+	})
+}
+
+// HTTPPost reads data from the pipe's stdin and streams it over HTTP as
+// the body of a POST request to url with the provided content type. The
+// response body is written to the pipe's stdout, and HTTPPost fails if
+// the response status is not a 2xx one.
+//
+// For example:
+//
+//    p := pipe.Line(
+//        pipe.ReadFile("build/release.tar.gz"),
+//        pipe.HTTPPost("https://artifacts.example.com/upload", "application/gzip"),
+//    )
+//
+func HTTPPost(url, contentType string) Pipe {
+	return httpUpload("POST", url, contentType)
+}
+
+// HTTPPut works like HTTPPost, but sends a PUT request instead.
+func HTTPPut(url, contentType string) Pipe {
+	return httpUpload("PUT", url, contentType)
+}
+
+func httpUpload(method, url, contentType string) Pipe {
+	return contextTaskFunc(func(ctx context.Context, s *State) error {
+		opts := HTTPOptions{Header: http.Header{}}
+		opts.Header.Set("Content-Type", contentType)
+		return httpRequest(ctx, s, method, url, ioutil.NopCloser(s.Stdin), opts)
+	})
+}
+
+// httpError reports an unsuccessful response to an HTTP request.
+type httpError struct {
+	method string
+	url    string
+	status string
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.method, e.url, e.status)
+}
+
+// httpRequest sends an HTTP request with the provided body, if not nil,
+// and writes the response body to the pipe's stdout.
+func httpRequest(ctx context.Context, s *State, method, url string, body io.Reader, opts HTTPOptions) error {
+	if opts.Timeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range opts.Header {
+		req.Header[name] = values
+	}
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &httpError{method, url, resp.Status}
+	}
+	_, err = copyContext(ctx, s.Stdout, resp.Body)
+	if err != nil {
+		return fmt.Errorf("%s %s: %v", method, url, err)
+	}
+	return nil
+}
+
+// PublishSink is implemented by message queue clients
+// that PublishTo may publish messages to.
+type PublishSink interface {
+	// Publish sends msg to the queue. It must not retain msg.
+	Publish(msg []byte) error
+}
+
+// SubscribeSource is implemented by message queue subscriptions
+// that SubscribeFrom may receive messages from.
+type SubscribeSource interface {
+	// Next blocks until a message is received and returns it.
+	// It returns io.EOF once no further messages will arrive.
+	Next() ([]byte, error)
+
+	// Close terminates the subscription, interrupting any
+	// pending Next call.
+	Close() error
+}
+
+// PublishTo reads lines from the pipe's stdin and publishes each of
+// them as a message to sink, with '\n' and '\r' trimmed.
+//
+// Adapters for specific message queue clients only need to implement
+// PublishSink. For example:
+//
+//    type natsSink struct {
+//        conn    *nats.Conn
+//        subject string
+//    }
+//
+//    func (s natsSink) Publish(msg []byte) error {
+//        return s.conn.Publish(s.subject, msg)
+//    }
+//
+func PublishTo(sink PublishSink) Pipe {
+	return TaskFunc(func(s *State) error {
+		r := bufio.NewReader(s.Stdin)
+		for {
+			line, err := readLine(r)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := sink.Publish(line); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// SubscribeFrom writes each message received from source to the
+// pipe's stdout as a line, until source reports io.EOF. The source
+// is closed when the pipe terminates or is killed, so SubscribeFrom
+// may be used to process an endless stream of messages.
+func SubscribeFrom(source SubscribeSource) Pipe {
+	return func(s *State) error {
+		return s.AddTask(&subscribeTask{source: source})
+	}
+}
+
+type subscribeTask struct {
+	source SubscribeSource
+	close  sync.Once
+	killed int32
+}
+
+func (t *subscribeTask) Run(s *State) error {
+	defer t.close.Do(func() { t.source.Close() })
+	for {
+		msg, err := t.source.Next()
+		if atomic.LoadInt32(&t.killed) != 0 {
+			return ErrKilled
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(msg) == 0 || msg[len(msg)-1] != '\n' {
+			msg = append(msg[:len(msg):len(msg)], '\n')
+		}
+		if _, err := s.Stdout.Write(msg); err != nil {
+			return err
+		}
+	}
+}
+
+func (t *subscribeTask) Kill() {
+	atomic.StoreInt32(&t.killed, 1)
+	t.close.Do(func() { t.source.Close() })
+}
+
+// ObjectStore is implemented by object storage clients that ReadObject
+// and WriteObject may use via the ObjectStore field of State. The s3store
+// package offers an implementation for S3-compatible storage services.
+type ObjectStore interface {
+	// GetObject returns a reader for the content of the object
+	// at key in bucket.
+	GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, error)
+
+	// PutObject stores the data read from r until io.EOF
+	// as the content of the object at key in bucket.
+	PutObject(ctx context.Context, bucket, key string, r io.Reader) error
+}
+
+var errNoObjectStore = errors.New("no object store set in pipe state")
+
+// ReadObject reads the content of the object at key in bucket from the
+// state's ObjectStore and writes it to the pipe's stdout.
+//
+// For example, this restores a backup from object storage:
+//
+//    s := pipe.NewState(nil, os.Stderr)
+//    s.ObjectStore = &s3store.Store{...}
+//    p := pipe.Line(
+//        pipe.ReadObject("backups", "home.tar.gz"),
+//        pipe.Exec("tar", "xz"),
+//    )
+//
+func ReadObject(bucket, key string) Pipe {
+	return contextTaskFunc(func(ctx context.Context, s *State) error {
+		if s.ObjectStore == nil {
+			return errNoObjectStore
+		}
+		r, err := s.ObjectStore.GetObject(ctx, bucket, key)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(s.Stdout, r)
+		return firstErr(err, r.Close())
+	})
+}
+
+// WriteObject stores the data read from the pipe's stdin as the content
+// of the object at key in bucket in the state's ObjectStore.
+func WriteObject(bucket, key string) Pipe {
+	return contextTaskFunc(func(ctx context.Context, s *State) error {
+		if s.ObjectStore == nil {
+			return errNoObjectStore
+		}
+		return s.ObjectStore.PutObject(ctx, bucket, key, s.Stdin)
+	})
+}
+
+// contextTaskFunc returns a pipe that adds a task running f with
+// a context that is canceled when the task is killed.
+func contextTaskFunc(f func(ctx context.Context, s *State) error) Pipe {
+	return func(s *State) error {
+		return s.AddTask(&contextTask{run: f})
+	}
+}
+
+// copyContext copies from r to w as io.Copy does, except it stops as
+// soon as ctx is canceled, even if the copy is blocked reading or
+// writing. In that case the streams are interrupted via interruptCopy,
+// and copyContext waits for the blocked read or write to return, so
+// that neither stream is used after copyContext returns. Reads and
+// writes that can't be interrupted, such as those of regular files on
+// stalled network filesystems, are waited for.
+func copyContext(ctx context.Context, w io.Writer, r io.Reader) (int64, error) {
+	type result struct {
+		n   int64
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		n, err := io.Copy(&contextWriter{ctx, w}, r)
+		done <- result{n, err}
+	}()
+	select {
+	case res := <-done:
+		return res.n, res.err
+	case <-ctx.Done():
+	}
+	resume := interruptCopy(w, r)
+	res := <-done
+	resume()
+	return res.n, ctx.Err()
+}
+
+// interruptCopy unblocks the reads from r and writes to w in progress,
+// where possible, and returns a function that makes the streams usable
+// again once the copy is over. Files supporting deadlines are given
+// one in the past, pipes created by io.Pipe are closed, and readers
+// implementing io.Closer are closed as well.
+func interruptCopy(w io.Writer, r io.Reader) (resume func()) {
+	var files []*os.File
+	interrupt := func(v interface{}) bool {
+		switch v := v.(type) {
+		case *os.File:
+			if v.SetDeadline(time.Now()) == nil {
+				files = append(files, v)
+			}
+		case *io.PipeReader:
+			v.Close()
+		case *io.PipeWriter:
+			v.Close()
+		default:
+			return false
+		}
+		return true
+	}
+	if tr, ok := r.(*teeReader); ok {
+		r = tr.r
+		interrupt(tr.w)
+	}
+	interrupt(w)
+	if !interrupt(r) {
+		if c, ok := r.(io.Closer); ok {
+			c.Close()
+		}
+	}
+	return func() {
+		for _, f := range files {
+			f.SetDeadline(time.Time{})
+		}
+	}
+}
+
+// teeReader works like the reader returned by io.TeeReader, but
+// unlike it may be interrupted by copyContext.
+type teeReader struct {
+	r io.Reader
+	w io.Writer
+}
+
+func (t *teeReader) Read(b []byte) (n int, err error) {
+	n, err = t.r.Read(b)
+	if n > 0 {
+		if n, err := t.w.Write(b[:n]); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// contextWriter writes to w until ctx is canceled, so that a copy
+// that isn't blocked stops promptly as well.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w *contextWriter) Write(b []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(b)
+}
+
+type contextTask struct {
+	run func(ctx context.Context, s *State) error
+
+	m      sync.Mutex
+	cancel func()
+	killed bool
+}
+
+func (t *contextTask) Run(s *State) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	t.m.Lock()
+	if t.killed {
+		t.m.Unlock()
+		return ErrKilled
+	}
+	t.cancel = cancel
+	t.m.Unlock()
+	err := t.run(ctx, s)
+	if err != nil && ctx.Err() != nil {
+		return ErrKilled
+	}
+	return err
+}
+
+func (t *contextTask) Kill() {
+	t.m.Lock()
+	t.killed = true
+	if t.cancel != nil {
+		t.cancel()
+	}
+	t.m.Unlock()
+}
+
+// Grep reads lines from the pipe's stdin and writes to the pipe's stdout
+// those matching re, similar to grep(1) but succeeding even if no lines
+// match. The line matched against re has '\n' and '\r' trimmed.
+//
+// See MustMatch for failing when no lines match.
+func Grep(re *regexp.Regexp) Pipe {
+	return Filter(re.Match)
+}
+
+// GrepInvert works like Grep, but writes the lines not matching re,
+// similar to "grep -v".
+func GrepInvert(re *regexp.Regexp) Pipe {
+	return Filter(func(line []byte) bool { return !re.Match(line) })
+}
+
+// ErrNoMatch is returned by MustMatch when no input lines matched.
+var ErrNoMatch = errors.New("no lines matched")
+
+// Count copies the pipe's stdin to the pipe's stdout unchanged, storing
+// the number of lines, words, and bytes copied in the respective non-nil
+// arguments once the input is over. Lines are counted as newlines and
+// words as sequences of non-blank bytes, as done by wc(1).
+//
+// See WC.
+func Count(lines, words, size *int64) Pipe {
+	return TaskFunc(func(s *State) error {
+		var c wordCounter
+		_, err := io.Copy(s.Stdout, io.TeeReader(s.Stdin, &c))
+		if lines != nil {
+			*lines = c.lines
+		}
+		if words != nil {
+			*words = c.words
+		}
+		if size != nil {
+			*size = c.bytes
+		}
+		return err
+	})
+}
+
+// WC reads all data from the pipe's stdin and writes to the pipe's stdout
+// the number of lines, words, and bytes read, separated by spaces and
+// followed by a newline. It counts as Count does.
+func WC() Pipe {
+	return TaskFunc(func(s *State) error {
+		var c wordCounter
+		if _, err := io.Copy(&c, s.Stdin); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintf(s.Stdout, "%d %d %d\n", c.lines, c.words, c.bytes)
+		return err
+	})
+}
+
+// wordCounter counts the lines, words, and bytes written to it.
+type wordCounter struct {
+	lines, words, bytes int64
+	inWord              bool
+}
+
+func (c *wordCounter) Write(b []byte) (int, error) {
+	for _, ch := range b {
+		switch ch {
+		case '\n':
+			c.lines++
+			c.inWord = false
+		case ' ', '\t', '\r', '\v', '\f':
+			c.inWord = false
+		default:
+			if !c.inWord {
+				c.words++
+				c.inWord = true
+			}
+		}
+	}
+	c.bytes += int64(len(b))
+	return len(b), nil
+}
+
+// MatchCount reads lines from the pipe's stdin and writes to the pipe's
+// stdout those matching re, storing the number of matching lines in n
+// once the input is over. The line matched against re has '\n' and '\r'
+// trimmed.
+func MatchCount(re *regexp.Regexp, n *int) Pipe {
+	return TaskFunc(func(s *State) error {
+		count, err := matchLines(s, re)
+		*n = count
+		return err
+	})
+}
+
+// MustMatch works like MatchCount, but rather than counting the matching
+// lines it fails with ErrNoMatch if none matched, following the exit
+// status convention of grep(1).
+func MustMatch(re *regexp.Regexp) Pipe {
+	return TaskFunc(func(s *State) error {
+		count, err := matchLines(s, re)
+		if err == nil && count == 0 {
+			return ErrNoMatch
+		}
+		return err
+	})
+}
+
+func matchLines(s *State, re *regexp.Regexp) (count int, err error) {
+	r := bufio.NewReader(s.Stdin)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 && re.Match(bytes.TrimRight(line, "\r\n")) {
+			count++
+			if _, err := s.Stdout.Write(line); err != nil {
+				return count, err
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return count, nil
+			}
+			return count, err
+		}
+	}
+	panic("unreachable")
+}
+
+// GrepContext reads lines from the pipe's stdin and writes to the pipe's
+// stdout those matching re, along with up to before lines preceding
+// and up to after lines following each match, similar to "grep -B -A".
+// Groups of lines that are not contiguous in the input are separated
+// by a "--" line. The line matched against re has '\n' and '\r' trimmed.
+func GrepContext(re *regexp.Regexp, before, after int) Pipe {
+	return TaskFunc(func(s *State) error {
+		var prev [][]byte
+		var lineNo, lastNo, afterLeft int
+		write := func(line []byte) error {
+			_, err := s.Stdout.Write(line)
+			return err
+		}
+		r := bufio.NewReader(s.Stdin)
+		for {
+			line, err := r.ReadBytes('\n')
+			if len(line) > 0 {
+				lineNo++
+				switch {
+				case re.Match(bytes.TrimRight(line, "\r\n")):
+					if lastNo > 0 && lineNo-len(prev) > lastNo+1 {
+						if err := write([]byte("--\n")); err != nil {
+							return err
+						}
+					}
+					for _, line := range prev {
+						if err := write(line); err != nil {
+							return err
+						}
+					}
+					prev = prev[:0]
+					if err := write(line); err != nil {
+						return err
+					}
+					lastNo = lineNo
+					afterLeft = after
+				case afterLeft > 0:
+					if err := write(line); err != nil {
+						return err
+					}
+					lastNo = lineNo
+					afterLeft--
+				case before > 0:
+					if len(prev) == before {
+						prev = append(prev[:0], prev[1:]...)
+					}
+					prev = append(prev, line)
+				}
+			}
+			if err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+		}
+		panic("unreachable")
+	})
+}
+
+// Buffer reads data from the pipe's stdin and writes it to the pipe's
+// stdout, reading continuously regardless of how fast the data is
+// written, so that a slow following entry of a line never blocks the
+// preceding one. Up to maxMem bytes are held in memory, and the data
+// beyond that is spilled to a temporary file in spillDir, or in the
+// default temporary directory if spillDir is empty. The file is
+// removed once Buffer terminates.
+//
+// For example, this downloads data as fast as the network allows
+// while it is being slowly processed:
+//
+//    p := pipe.Line(
+//        pipe.Exec("curl", "-s", url),
+//        pipe.Buffer(64<<20, ""),
+//        pipe.Exec("slow-import"),
+//    )
+//
+func Buffer(maxMem int64, spillDir string) Pipe {
+	return contextTaskFunc(func(ctx context.Context, s *State) error {
+		b := &spillBuffer{max: maxMem, ready: make(chan bool, 1)}
+		b.quota, _ = s.quotaWriter(nil).(*quotaWriter)
+		if spillDir != "" {
+			b.dir = s.Path(spillDir)
+		}
+		defer b.close()
+		go b.fill(s.Stdin)
+		return b.drain(ctx, s.Stdout)
+	})
+}
+
+// spillBuffer holds data in memory up to max bytes, and in a spill
+// file beyond that. Once data is spilled, further data is appended
+// to the file until it is fully drained, so that ordering is kept.
+type spillBuffer struct {
+	max int64
+	dir string
+
+	// quota, if set, accounts the data spilled to disk.
+	quota *quotaWriter
+
+	m        sync.Mutex
+	mem      [][]byte
+	memSize  int64
+	file     *os.File
+	readOff  int64
+	writeOff int64
+	spilling bool
+	done     bool
+	closed   bool
+	err      error
+
+	ready chan bool
+}
+
+func (b *spillBuffer) fill(r io.Reader) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if werr := b.write(buf[:n]); werr != nil {
+				b.finish(werr)
+				return
+			}
+		}
+		if err == io.EOF {
+			b.finish(nil)
+			return
+		}
+		if err != nil {
+			b.finish(err)
+			return
+		}
+	}
+}
+
+func (b *spillBuffer) write(data []byte) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.closed {
+		return io.ErrClosedPipe
+	}
+	if !b.spilling && b.memSize+int64(len(data)) <= b.max {
+		b.mem = append(b.mem, append([]byte(nil), data...))
+		b.memSize += int64(len(data))
+	} else {
+		if b.file == nil {
+			file, err := ioutil.TempFile(b.dir, "pipe-buffer-")
+			if err != nil {
+				return err
+			}
+			b.file = file
+		}
+		if b.quota != nil {
+			if err := b.quota.charge(len(data)); err != nil {
+				return err
+			}
+		}
+		if _, err := b.file.WriteAt(data, b.writeOff); err != nil {
+			return err
+		}
+		b.writeOff += int64(len(data))
+		b.spilling = true
+	}
+	b.signal()
+	return nil
+}
+
+func (b *spillBuffer) finish(err error) {
+	b.m.Lock()
+	b.done = true
+	b.err = err
+	b.signal()
+	b.m.Unlock()
+}
+
+func (b *spillBuffer) signal() {
+	select {
+	case b.ready <- true:
+	default:
+	}
+}
+
+// next returns the next chunk of buffered data, if any, and otherwise
+// whether the input is over and the error that terminated it.
+func (b *spillBuffer) next(buf []byte) (chunk []byte, done bool, err error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if len(b.mem) > 0 {
+		chunk = b.mem[0]
+		b.mem[0] = nil
+		b.mem = b.mem[1:]
+		b.memSize -= int64(len(chunk))
+		return chunk, false, nil
+	}
+	if b.spilling {
+		if b.writeOff-b.readOff < int64(len(buf)) {
+			buf = buf[:b.writeOff-b.readOff]
+		}
+		n, err := b.file.ReadAt(buf, b.readOff)
+		if err != nil && err != io.EOF {
+			return nil, true, err
+		}
+		b.readOff += int64(n)
+		if b.readOff == b.writeOff {
+			b.readOff, b.writeOff = 0, 0
+			b.spilling = false
+			if err := b.file.Truncate(0); err != nil {
+				return nil, true, err
+			}
+		}
+		return buf[:n], false, nil
+	}
+	return nil, b.done, b.err
+}
+
+func (b *spillBuffer) drain(ctx context.Context, w io.Writer) error {
+	buf := make([]byte, 32*1024)
+	for {
+		chunk, done, err := b.next(buf)
+		if len(chunk) > 0 {
+			if _, err := w.Write(chunk); err != nil {
+				return err
+			}
+			continue
+		}
+		if done || err != nil {
+			return err
+		}
+		select {
+		case <-b.ready:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (b *spillBuffer) close() {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.closed = true
+	b.mem = nil
+	if b.file != nil {
+		b.file.Close()
+		os.Remove(b.file.Name())
+	}
+}
+
+// SplitFile writes the data read from the pipe's stdin across a sequence
+// of files holding at most maxLines lines each, similar to the split(1)
+// tool. The files are named after prefix followed by a three digit
+// sequence number starting at 000, and if they don't exist they are
+// created with perm. The pipe fails to be added if maxLines isn't
+// positive.
+func SplitFile(prefix string, maxLines int, perm os.FileMode) Pipe {
+	split := TaskFunc(func(s *State) error {
+		w := &splitWriter{s: s, prefix: prefix, perm: perm}
+		r := bufio.NewReader(s.Stdin)
+		lines := 0
+		for {
+			line, err := r.ReadBytes('\n')
+			if len(line) > 0 {
+				if w.file == nil || lines == maxLines {
+					if err := w.next(); err != nil {
+						return err
+					}
+					lines = 0
+				}
+				if _, err := w.w.Write(line); err != nil {
+					w.close()
+					return err
+				}
+				lines++
+			}
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				return firstErr(err, w.close())
+			}
+		}
+		panic("unreachable")
+	})
+	return func(s *State) error {
+		if maxLines <= 0 {
+			return fmt.Errorf("cannot split data into files of %d lines", maxLines)
+		}
+		return split(s)
+	}
+}
+
+// SplitFileBytes works like SplitFile, but splits the data read from
+// the pipe's stdin into files holding at most maxBytes bytes each.
+// The pipe fails to be added if maxBytes isn't positive.
+func SplitFileBytes(prefix string, maxBytes int64, perm os.FileMode) Pipe {
+	split := TaskFunc(func(s *State) error {
+		w := &splitWriter{s: s, prefix: prefix, perm: perm}
+		r := bufio.NewReader(s.Stdin)
+		for {
+			if _, err := r.Peek(1); err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				return firstErr(err, w.close())
+			}
+			if err := w.next(); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(w.w, r, maxBytes); err != nil && err != io.EOF {
+				w.close()
+				return err
+			}
+		}
+		panic("unreachable")
+	})
+	return func(s *State) error {
+		if maxBytes <= 0 {
+			return fmt.Errorf("cannot split data into files of %d bytes", maxBytes)
+		}
+		return split(s)
+	}
+}
+
+type splitWriter struct {
+	s      *State
+	prefix string
+	perm   os.FileMode
+	file   *os.File
+	w      io.Writer
+	count  int
+}
+
+func (w *splitWriter) next() error {
+	if err := w.close(); err != nil {
+		return err
+	}
+	path := w.s.Path(fmt.Sprintf("%s%03d", w.prefix, w.count))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, w.perm)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.w = w.s.quotaWriter(file)
+	w.count++
+	return nil
+}
+
+func (w *splitWriter) close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// Replace filters lines read from the pipe's stdin and writes
+// the returned values to stdout.
+func Replace(f func(line []byte) []byte) Pipe {
+	return TaskFunc(func(s *State) error {
+		r := bufio.NewReader(s.Stdin)
+		for {
+			line, err := r.ReadBytes('\n')
+			if len(line) > 0 {
+				line := f(line)
+				if len(line) > 0 {
+					_, err := s.Stdout.Write(line)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			if err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+		}
+		panic("unreachable")
+	})
+}
+
+// ReplaceRegexp reads lines from the pipe's stdin and writes them to the
+// pipe's stdout with all matches of re replaced by repl, similar to
+// "sed -E s/re/repl/g". Inside repl, $ signs are interpreted as in
+// regexp.Regexp.Expand, so that $1 or ${name} refer to the text of
+// capture groups. The line matched against re has '\n' and '\r'
+// trimmed, and the line terminator is preserved.
+//
+// For example:
+//
+//    p := pipe.ReplaceRegexp(regexp.MustCompile(`(\w+)@example\.com`), []byte("$1@example.org"))
+//
+func ReplaceRegexp(re *regexp.Regexp, repl []byte) Pipe {
+	return Replace(func(line []byte) []byte {
+		trimmed := bytes.TrimRight(line, "\r\n")
+		result := re.ReplaceAll(trimmed, repl)
+		return append(result, line[len(trimmed):]...)
+	})
+}
+
+// ParallelOptions holds the options for ParallelReplace and Xargs.
+type ParallelOptions struct {
+	// Workers is the number of lines processed concurrently.
+	// It defaults to the number of CPUs.
+	Workers int
+
+	// Ordered causes the output for each line to be written in the
+	// order the lines were read, rather than as soon as it's ready.
+	// At most twice as many lines as Workers are held pending.
+	Ordered bool
+}
+
+// ParallelReplace works like Replace, but calls f concurrently for
+// multiple lines as defined by opts.
+func ParallelReplace(opts ParallelOptions, f func(line []byte) []byte) Pipe {
+	return contextTaskFunc(func(ctx context.Context, s *State) error {
+		return parallelLines(ctx, s, opts, func(line []byte) ([]byte, error) {
+			return f(line), nil
+		})
+	})
+}
+
+// Xargs reads lines from the pipe's stdin and runs concurrently, as
+// defined by opts, the pipe returned by f for each of them, similar to
+// the xargs tool. The line provided to f has '\n' and '\r' trimmed,
+// and empty lines are skipped. The pipes run with an empty stdin, and
+// the stdout output of each one is written to the pipe's stdout once
+// it terminates, so the output of different lines is not interleaved.
+// Once a pipe fails, no further ones are started and Xargs fails.
+//
+// For example, this compresses the log files four at a time:
+//
+//    p := pipe.Line(
+//        pipe.Exec("find", ".", "-name", "*.log"),
+//        pipe.Xargs(pipe.ParallelOptions{Workers: 4}, func(path string) pipe.Pipe {
+//            return pipe.Exec("gzip", path)
+//        }),
+//    )
+//
+func Xargs(opts ParallelOptions, f func(line string) Pipe) Pipe {
+	return contextTaskFunc(func(ctx context.Context, s *State) error {
+		return parallelLines(ctx, s, opts, func(line []byte) ([]byte, error) {
+			arg := string(bytes.TrimRight(line, "\r\n"))
+			if arg == "" {
+				return nil, nil
+			}
+			var output OutputBuffer
+			sub := &subTask{
+				p:      f(arg),
+				stdin:  strings.NewReader(""),
+				stdout: &output,
+				done:   func(err error) error { return err },
+			}
+			stop := context.AfterFunc(ctx, sub.Kill)
+			defer stop()
+			err := sub.Run(s)
+			return output.Bytes(), err
+		})
+	})
+}
+
+// parallelLines reads lines from the pipe's stdin, processes them
+// concurrently with f, and writes the results to the pipe's stdout.
+func parallelLines(ctx context.Context, s *State, opts ParallelOptions, f func(line []byte) ([]byte, error)) error {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type record struct {
+		seq  int
+		data []byte
+		err  error
+	}
+	jobs := make(chan record)
+	results := make(chan record)
+	// Each slot is taken by a line until its result is written.
+	slots := make(chan bool, 2*workers)
+
+	var readErr error
+	go func() {
+		defer close(jobs)
+		r := bufio.NewReader(s.Stdin)
+		for seq := 0; ; seq++ {
+			line, err := r.ReadBytes('\n')
+			if len(line) > 0 {
+				select {
+				case slots <- true:
+				case <-ctx.Done():
+					return
+				}
+				select {
+				case jobs <- record{seq: seq, data: line}:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err != nil {
+				if err != io.EOF {
+					readErr = err
+				}
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				data, err := f(job.data)
+				select {
+				case results <- record{job.seq, data, err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	write := func(rec record) error {
+		<-slots
+		if rec.err != nil {
+			return rec.err
+		}
+		if len(rec.data) > 0 {
+			_, err := s.Stdout.Write(rec.data)
+			return err
+		}
+		return nil
+	}
+	pending := make(map[int]record)
+	next := 0
+	for rec := range results {
+		if !opts.Ordered {
+			if err := write(rec); err != nil {
+				return err
+			}
+			continue
+		}
+		pending[rec.seq] = rec
+		for {
+			rec, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			if err := write(rec); err != nil {
+				return err
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return readErr
+}
+
+// Filter filters lines read from the pipe's stdin so that only those
+// for which f is true are written to the pipe's stdout.
+// The line provided to f has '\n' and '\r' trimmed.
+func Filter(f func(line []byte) bool) Pipe {
+	return Replace(func(line []byte) []byte {
+		if f(bytes.TrimRight(line, "\r\n")) {
+			return line
+		}
+		return nil
+	})
+}
+
+// maxRecordSize is the maximum size of a record handled by ReplaceRecords.
+const maxRecordSize = 64 * 1024 * 1024
+
+// ReplaceRecords works like Replace, but on multi-line records read from
+// the pipe's stdin as delimited by the split function returned by split,
+// such as ScanParagraphs or the result of ScanLineRecords. Each run of the
+// pipe calls split once, so the split function may keep track of the data
+// it already scanned. The records provided to f hold all the data split
+// from the input, including delimiters.
+func ReplaceRecords(split func() bufio.SplitFunc, f func(record []byte) []byte) Pipe {
+	return TaskFunc(func(s *State) error {
+		scanner := bufio.NewScanner(s.Stdin)
+		scanner.Buffer(nil, maxRecordSize)
+		scanner.Split(split())
+		for scanner.Scan() {
+			record := f(scanner.Bytes())
+			if len(record) > 0 {
+				if _, err := s.Stdout.Write(record); err != nil {
+					return err
+				}
+			}
+		}
+		return scanner.Err()
+	})
+}
+
+// FilterRecords works like Filter, but on multi-line records read from
+// the pipe's stdin as delimited by the split function returned by split,
+// such as ScanParagraphs or the result of ScanLineRecords.
+// The record provided to f has trailing '\n' and '\r' trimmed.
+func FilterRecords(split func() bufio.SplitFunc, f func(record []byte) bool) Pipe {
+	return ReplaceRecords(split, func(record []byte) []byte {
+		if f(bytes.TrimRight(record, "\r\n")) {
+			return record
+		}
+		return nil
+	})
+}
+
+// ScanParagraphs returns a split function for ReplaceRecords and
+// FilterRecords that returns each paragraph of text, delimited by one or
+// more blank lines. The blank lines following a paragraph are part of
+// its record.
+func ScanParagraphs() bufio.SplitFunc {
+	return scanLineRecords(func() func(line []byte) bool {
+		text, gap := false, false
+		return func(line []byte) bool {
+			blank := len(bytes.TrimSpace(line)) == 0
+			if blank && text {
+				gap = true
+			}
+			text = text || !blank
+			return !blank && gap
+		}
+	})
+}
+
+// ScanLineRecords returns a function creating split functions for
+// ReplaceRecords and FilterRecords that return records starting at each
+// line that matches re. For example, ScanLineRecords(regexp.MustCompile("^commit "))
+// splits the output of "git log" into one record per commit.
+// The line matched against re has '\n' and '\r' trimmed.
+func ScanLineRecords(re *regexp.Regexp) func() bufio.SplitFunc {
+	return func() bufio.SplitFunc {
+		return scanLineRecords(func() func(line []byte) bool {
+			return func(line []byte) bool {
+				return re.Match(bytes.TrimRight(line, "\r\n"))
+			}
+		})
+	}
+}
+
+// scanLineRecords returns a split function that returns records starting
+// at each line other than the first one of a record for which the function
+// returned by start reports true. The lines of the record being read are
+// scanned only once, even if more data is needed to find its end.
+func scanLineRecords(start func() func(line []byte) bool) bufio.SplitFunc {
+	var starts func(line []byte) bool
+	var scanned int
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		if scanned == 0 {
+			starts = start()
+		}
+		for scanned < len(data) {
+			i := bytes.IndexByte(data[scanned:], '\n')
+			if i < 0 && !atEOF {
+				break
+			}
+			end := len(data)
+			if i >= 0 {
+				end = scanned + i + 1
+			}
+			if starts(data[scanned:end]) && scanned > 0 {
+				advance, scanned = scanned, 0
+				return advance, data[:advance], nil
+			}
+			scanned = end
+		}
+		if atEOF && len(data) > 0 {
+			scanned = 0
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+}
+
+// SortOptions defines how lines are ordered by SortLines.
+type SortOptions struct {
+	// Numeric compares lines by their leading numeric value, as "sort -n".
+	Numeric bool
+
+	// Human compares lines by their leading numeric value followed by
+	// an optional K, M, G, T, P, or E size suffix, as "sort -h".
+	Human bool
+
+	// Reverse reverses the result of comparisons, as "sort -r".
+	Reverse bool
+
+	// Key selects the 1-based field used for comparisons, as "sort -k".
+	// If zero, the whole line is compared.
+	Key int
+
+	// Separator defines the string separating fields when Key is set,
+	// as "sort -t". If empty, fields are separated by blanks.
+	Separator string
+}
+
+// SortLines reads all lines from the pipe's stdin and writes them
+// to the pipe's stdout ordered according to opts. Lines that compare
+// as equal are ordered by their whole content.
+func SortLines(opts SortOptions) Pipe {
+	return TaskFunc(func(s *State) error {
+		return sortLines(s, opts.less)
+	})
+}
+
+func (opts *SortOptions) less(a, b []byte) bool {
+	cmp := 0
+	ka, kb := opts.key(a), opts.key(b)
+	switch {
+	case opts.Numeric || opts.Human:
+		na, nb := parseSortNumber(ka, opts.Human), parseSortNumber(kb, opts.Human)
+		if na < nb {
+			cmp = -1
+		} else if na > nb {
+			cmp = 1
+		}
+	default:
+		cmp = bytes.Compare(ka, kb)
+	}
+	if cmp == 0 {
+		cmp = bytes.Compare(a, b)
+	}
+	if opts.Reverse {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func (opts *SortOptions) key(line []byte) []byte {
+	if opts.Key <= 0 {
+		return line
+	}
+	var fields [][]byte
+	if opts.Separator == "" {
+		fields = bytes.Fields(line)
+	} else {
+		fields = bytes.Split(line, []byte(opts.Separator))
+	}
+	if opts.Key > len(fields) {
+		return nil
+	}
+	return fields[opts.Key-1]
+}
+
+// parseSortNumber returns the numeric value at the start of b,
+// or zero if b does not start with a number.
+func parseSortNumber(b []byte, human bool) float64 {
+	b = bytes.TrimLeft(b, " \t")
+	i := 0
+	if i < len(b) && b[i] == '-' {
+		i++
+	}
+	for i < len(b) && (b[i] >= '0' && b[i] <= '9' || b[i] == '.') {
+		i++
+	}
+	n, err := strconv.ParseFloat(string(b[:i]), 64)
+	if err != nil {
+		return 0
+	}
+	if human && i < len(b) {
+		if exp := strings.IndexByte("KMGTPE", b[i]&^0x20); exp >= 0 {
+			n *= math.Pow(1024, float64(exp+1))
+		}
+	}
+	return n
+}
+
+// Sort reads all lines from the pipe's stdin and writes them to the
+// pipe's stdout ordered by less, keeping the relative order of lines
+// that compare as equal. If less is nil, lines are ordered bytewise.
+// The lines provided to less have '\n' and '\r' trimmed.
+//
+// See SortLines for sorting as done by sort(1).
+func Sort(less func(a, b []byte) bool) Pipe {
+	if less == nil {
+		less = func(a, b []byte) bool { return bytes.Compare(a, b) < 0 }
+	}
+	return TaskFunc(func(s *State) error {
+		return sortLines(s, less)
+	})
+}
+
+// Uniq reads lines from the pipe's stdin and writes them to the pipe's
+// stdout omitting lines equal to the one preceding them, as uniq(1).
+// Lines are compared with '\n' and '\r' trimmed, and streamed as read,
+// so that only adjacent duplicates are omitted.
+//
+// For example, the equivalent of "sort | uniq" is:
+//
+//    p := pipe.Line(
+//        pipe.Sort(nil),
+//        pipe.Uniq(),
+//    )
+//
+func Uniq() Pipe {
+	return TaskFunc(func(s *State) error {
+		var last []byte
+		first := true
+		r := bufio.NewReader(s.Stdin)
+		for {
+			line, err := r.ReadBytes('\n')
+			if len(line) > 0 {
+				trimmed := bytes.TrimRight(line, "\r\n")
+				if first || !bytes.Equal(trimmed, last) {
+					if _, err := s.Stdout.Write(line); err != nil {
+						return err
+					}
+				}
+				last = trimmed
+				first = false
+			}
+			if err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+		}
+	})
+}
+
+// sortLines reads all lines from the pipe's stdin and writes them
+// to the pipe's stdout ordered by less. The lines provided to less
+// have '\n' and '\r' trimmed.
+func sortLines(s *State, less func(a, b []byte) bool) error {
+	var lines [][]byte
+	r := bufio.NewReader(s.Stdin)
+	for {
+		line, err := readLine(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line)
+	}
+	sort.SliceStable(lines, func(i, j int) bool { return less(lines[i], lines[j]) })
+	w := bufio.NewWriter(s.Stdout)
+	for _, line := range lines {
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	return w.Flush()
+}
+
+// JoinLines reads lines from the pipe's stdin and writes them to the
+// pipe's stdout as a single line, with sep in between each of them,
+// similar to "paste -s -d".
+func JoinLines(sep string) Pipe {
+	return TaskFunc(func(s *State) error {
+		r := bufio.NewReader(s.Stdin)
+		first := true
+		for {
+			line, err := r.ReadBytes('\n')
+			if len(line) > 0 {
+				line = bytes.TrimRight(line, "\r\n")
+				if !first {
+					line = append([]byte(sep), line...)
+				}
+				first = false
+				if _, err := s.Stdout.Write(line); err != nil {
+					return err
+				}
+			}
+			if err != nil {
+				if err != io.EOF {
+					return err
+				}
+				if !first {
+					_, err := s.Stdout.Write([]byte{'\n'})
+					return err
+				}
+				return nil
+			}
+		}
+		panic("unreachable")
+	})
+}
+
+// SplitWords reads lines from the pipe's stdin and writes each of
+// their whitespace-separated words to the pipe's stdout in a line
+// of its own.
+func SplitWords() Pipe {
+	return Replace(func(line []byte) []byte {
+		var out []byte
+		for _, word := range bytes.Fields(line) {
+			out = append(out, word...)
+			out = append(out, '\n')
+		}
+		return out
+	})
+}
+
+// reverseLinesMemLimit is the amount of input ReverseLines holds in
+// memory before spilling it into a temporary file.
+const reverseLinesMemLimit = 32 * 1024 * 1024
+
+// ReverseLines reads lines from the pipe's stdin and writes them to
+// the pipe's stdout in reverse order, similar to the tac(1) tool.
+// Large inputs are buffered in a temporary file rather than in memory.
+func ReverseLines() Pipe {
+	return TaskFunc(func(s *State) error {
+		var buf []byte
+		var file *os.File
+		var fw io.Writer
+		defer func() {
+			if file != nil {
+				file.Close()
+				os.Remove(file.Name())
+			}
+		}()
+
+		var offsets []int64
+		var size int64
+		r := bufio.NewReader(s.Stdin)
+		for {
+			line, err := r.ReadBytes('\n')
+			if len(line) > 0 {
+				offsets = append(offsets, size)
+				size += int64(len(line))
+				if file == nil && len(buf)+len(line) > reverseLinesMemLimit {
+					var ferr error
+					file, ferr = ioutil.TempFile("", "pipe-reverse-")
+					if ferr != nil {
+						return ferr
+					}
+					fw = s.quotaWriter(file)
+					if _, ferr := fw.Write(buf); ferr != nil {
+						return ferr
+					}
+					buf = nil
+				}
+				if file != nil {
+					if _, err := fw.Write(line); err != nil {
+						return err
+					}
+				} else {
+					buf = append(buf, line...)
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		var ra io.ReaderAt = bytes.NewReader(buf)
+		if file != nil {
+			ra = file
+		}
+		var line []byte
+		end := size
+		for i := len(offsets) - 1; i >= 0; i-- {
+			if n := int(end - offsets[i]); cap(line) > n {
+				line = line[:n]
+			} else {
+				line = make([]byte, n, n+1)
+			}
+			if _, err := ra.ReadAt(line, offsets[i]); err != nil {
+				return err
+			}
+			if line[len(line)-1] != '\n' {
+				line = append(line, '\n')
+			}
+			if _, err := s.Stdout.Write(line); err != nil {
+				return err
+			}
+			end = offsets[i]
+		}
+		return nil
+	})
+}
+
+// ReverseEachLine reads lines from the pipe's stdin and writes them to
+// the pipe's stdout with the characters in each line reversed, similar
+// to the rev(1) tool.
+func ReverseEachLine() Pipe {
+	return Replace(func(line []byte) []byte {
+		body := bytes.TrimRight(line, "\r\n")
+		out := make([]byte, len(line))
+		pos := len(body)
+		for i := 0; i < len(body); {
+			_, size := utf8.DecodeRune(body[i:])
+			pos -= size
+			copy(out[pos:], body[i:i+size])
+			i += size
+		}
+		copy(out[len(body):], line[len(body):])
+		return out
+	})
+}
+
+// CommMode selects which lines are written by Comm.
+type CommMode int
+
+const (
+	CommOnlyStdin CommMode = 1 << iota // Lines found only in the pipe's stdin.
+	CommOnlyOther                      // Lines found only in the output of the other pipe.
+	CommBoth                           // Lines found in both.
+)
+
+// Comm compares the sorted lines read from the pipe's stdin with the
+// sorted lines output by the other pipe, and writes to the pipe's stdout
+// the lines selected by mode, similar to the comm(1) tool.
+//
+// For example, the equivalent of "comm -23 <(sort a.txt) <(sort b.txt)" is:
+//
+//    p := pipe.Line(
+//        pipe.Exec("sort", "a.txt"),
+//        pipe.Comm(pipe.Exec("sort", "b.txt"), pipe.CommOnlyStdin),
+//    )
+//
+func Comm(other Pipe, mode CommMode) Pipe {
+	return func(s *State) error {
+		return s.AddTask(&otherTask{p: other, run: func(s *State, other io.Reader) error {
+			r1 := bufio.NewReader(s.Stdin)
+			r2 := bufio.NewReader(other)
+			line1, err1 := readLine(r1)
+			line2, err2 := readLine(r2)
+			for {
+				if err1 != nil && err1 != io.EOF {
+					return err1
+				}
+				if err2 != nil && err2 != io.EOF {
+					return err2
+				}
+				if line1 == nil && line2 == nil {
+					return nil
+				}
+				var line []byte
+				var sel CommMode
+				cmp := bytes.Compare(line1, line2)
+				switch {
+				case line2 == nil || line1 != nil && cmp < 0:
+					line, sel = line1, CommOnlyStdin
+					line1, err1 = readLine(r1)
+				case line1 == nil || cmp > 0:
+					line, sel = line2, CommOnlyOther
+					line2, err2 = readLine(r2)
+				default:
+					line, sel = line1, CommBoth
+					line1, err1 = readLine(r1)
+					line2, err2 = readLine(r2)
+				}
+				if mode&sel != 0 {
+					if _, err := s.Stdout.Write(append(line, '\n')); err != nil {
+						return err
+					}
+				}
+			}
+		}})
+	}
+}
+
+// Paste reads lines from the pipe's stdin and from the output of the
+// other pipe, and writes to the pipe's stdout each pair of lines joined
+// by sep, similar to the paste(1) tool. When one of the inputs has
+// fewer lines than the other, its missing lines are taken as empty.
+//
+// For example, the equivalent of "paste -d: <(cut -d: -f1 /etc/passwd) <(cut -d: -f7 /etc/passwd)" is:
+//
+//    p := pipe.Line(
+//        pipe.Exec("cut", "-d:", "-f1", "/etc/passwd"),
+//        pipe.Paste(pipe.Exec("cut", "-d:", "-f7", "/etc/passwd"), ":"),
+//    )
+//
+func Paste(other Pipe, sep string) Pipe {
+	return func(s *State) error {
+		return s.AddTask(&otherTask{p: other, run: func(s *State, other io.Reader) error {
+			r1 := bufio.NewReader(s.Stdin)
+			r2 := bufio.NewReader(other)
+			for {
+				line1, err1 := readLine(r1)
+				if err1 != nil && err1 != io.EOF {
+					return err1
+				}
+				line2, err2 := readLine(r2)
+				if err2 != nil && err2 != io.EOF {
+					return err2
+				}
+				if line1 == nil && line2 == nil {
+					return nil
+				}
+				line := make([]byte, 0, len(line1)+len(sep)+len(line2)+1)
+				line = append(line, line1...)
+				line = append(line, sep...)
+				line = append(line, line2...)
+				line = append(line, '\n')
+				if _, err := s.Stdout.Write(line); err != nil {
+					return err
+				}
+			}
+		}})
+	}
+}
+
+// readLine returns the next line in r with '\n' and '\r' trimmed,
+// or nil if there are no more lines.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadBytes('\n')
+	if len(line) == 0 {
+		return nil, err
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return bytes.TrimRight(line, "\r\n"), err
+}
+
+// otherTask runs the p pipe concurrently with the run function,
+// which is provided with a reader for p's stdout.
+type otherTask struct {
+	p   Pipe
+	run func(s *State, other io.Reader) error
+
+	m      sync.Mutex
+	sub    *State
+	cancel bool
+}
+
+func (t *otherTask) Run(s *State) error {
+	r, w := io.Pipe()
+	sub := s.newSubState(w, s.Stderr)
+	sub.Stdin = strings.NewReader("")
+	if err := t.p(sub); err != nil {
 		return err
+	}
+	t.m.Lock()
+	if t.cancel {
+		t.m.Unlock()
+		return nil
+	}
+	t.sub = sub
+	t.m.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		err := sub.RunTasks()
+		w.Close()
+		done <- err
+	}()
+	err := t.run(s, r)
+	if err != nil {
+		r.Close()
+		<-done
+		return err
+	}
+	_, err = io.Copy(ioutil.Discard, r)
+	return firstErr(<-done, err)
+}
+
+func (t *otherTask) Kill() {
+	t.m.Lock()
+	sub := t.sub
+	t.cancel = true
+	t.m.Unlock()
+	if sub != nil {
+		sub.Kill()
+	}
+}
+
+// Wrap reads lines from the pipe's stdin and writes them to the pipe's
+// stdout folded so that no line is longer than width characters,
+// similar to the fold(1) tool. See WrapWords for folding at word boundaries.
+func Wrap(width int) Pipe {
+	return Replace(func(line []byte) []byte {
+		return wrapLine(line, width, false)
 	})
 }
 
-// Println provides args to fmt.Sprintln and writes the resuling
-// string to the pipe's stdout.
-func Println(args ...interface{}) Pipe {
-	return TaskFunc(func(s *State) error {
-		_, err := s.Stdout.Write([]byte(fmt.Sprintln(args...)))
-		return err
+// WrapWords works like Wrap, but breaks long lines after the last blank
+// that fits within width whenever there is one, similar to "fold -s".
+// Words longer than width are broken at the column boundary.
+func WrapWords(width int) Pipe {
+	return Replace(func(line []byte) []byte {
+		return wrapLine(line, width, true)
 	})
 }
 
-// Printf provides format and args to fmt.Sprintf and writes
-// the resulting string to the pipe's stdout.
-func Printf(format string, args ...interface{}) Pipe {
+func wrapLine(line []byte, width int, words bool) []byte {
+	if width <= 0 {
+		return line
+	}
+	body := bytes.TrimRight(line, "\r\n")
+	eol := line[len(body):]
+	var out []byte
+	for utf8.RuneCount(body) > width {
+		cut, blank := 0, 0
+		for n := 0; n < width; n++ {
+			r, size := utf8.DecodeRune(body[cut:])
+			cut += size
+			if r == ' ' || r == '\t' {
+				blank = cut
+			}
+		}
+		if words && blank > 0 {
+			cut = blank
+		}
+		out = append(out, body[:cut]...)
+		out = append(out, '\n')
+		body = body[cut:]
+	}
+	out = append(out, body...)
+	return append(out, eol...)
+}
+
+// ToLF reads data from the pipe's stdin and writes it to the pipe's
+// stdout with all "\r\n" line endings converted to "\n".
+// Carriage returns not followed by a line feed are preserved.
+func ToLF() Pipe {
 	return TaskFunc(func(s *State) error {
-		_, err := s.Stdout.Write([]byte(fmt.Sprintf(format, args...)))
-		return err
+		buf := make([]byte, 32*1024)
+		out := make([]byte, 0, len(buf)+1)
+		cr := false
+		for {
+			n, err := s.Stdin.Read(buf)
+			out = out[:0]
+			for _, b := range buf[:n] {
+				if cr && b != '\n' {
+					out = append(out, '\r')
+				}
+				cr = b == '\r'
+				if !cr {
+					out = append(out, b)
+				}
+			}
+			if err != nil && cr {
+				out = append(out, '\r')
+			}
+			if len(out) > 0 {
+				if _, err := s.Stdout.Write(out); err != nil {
+					return err
+				}
+			}
+			if err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+		}
 	})
 }
 
-// Read reads data from r and writes it to the pipe's stdout.
-func Read(r io.Reader) Pipe {
+// ToCRLF reads data from the pipe's stdin and writes it to the pipe's
+// stdout with all "\n" line endings converted to "\r\n".
+// Line endings that already are "\r\n" are preserved.
+func ToCRLF() Pipe {
 	return TaskFunc(func(s *State) error {
-		_, err := io.Copy(s.Stdout, r)
-		return err
+		buf := make([]byte, 32*1024)
+		out := make([]byte, 0, 2*len(buf))
+		cr := false
+		for {
+			n, err := s.Stdin.Read(buf)
+			out = out[:0]
+			for _, b := range buf[:n] {
+				if b == '\n' && !cr {
+					out = append(out, '\r')
+				}
+				out = append(out, b)
+				cr = b == '\r'
+			}
+			if len(out) > 0 {
+				if _, err := s.Stdout.Write(out); err != nil {
+					return err
+				}
+			}
+			if err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+		}
 	})
 }
 
-// Write writes to w the data read from the pipe's stdin.
-func Write(w io.Writer) Pipe {
-	return TaskFunc(func(s *State) error {
-		_, err := io.Copy(w, s.Stdin)
-		return err
+// ConvertCharset reads data from the pipe's stdin encoded in the from
+// character set and writes it to the pipe's stdout encoded in the to
+// character set. Character sets are named as registered with IANA
+// (e.g. "ISO-8859-1", "UTF-16LE", "UTF-8") or per the WHATWG encoding
+// standard (e.g. "latin1", "windows-1252").
+func ConvertCharset(from, to string) Pipe {
+	return func(s *State) error {
+		fromEnc, err := lookupCharset(from)
+		if err != nil {
+			return err
+		}
+		toEnc, err := lookupCharset(to)
+		if err != nil {
+			return err
+		}
+		return TaskFunc(func(s *State) error {
+			r := transform.NewReader(s.Stdin, fromEnc.NewDecoder())
+			w := transform.NewWriter(s.Stdout, toEnc.NewEncoder())
+			_, err := io.Copy(w, r)
+			return firstErr(err, w.Close())
+		})(s)
+	}
+}
+
+func lookupCharset(name string) (encoding.Encoding, error) {
+	enc, err := ianaindex.IANA.Encoding(name)
+	if err == nil && enc != nil {
+		return enc, nil
+	}
+	enc, err = htmlindex.Get(name)
+	if err == nil && enc != nil {
+		return enc, nil
+	}
+	return nil, fmt.Errorf("unsupported character set: %q", name)
+}
+
+// Assert fails with the message formatted from format and args if cond
+// returns false. The condition is verified when the pipe is assembled,
+// so a failed assertion prevents every entry of the pipe from running,
+// including entries that precede the assertion.
+//
+// For example:
+//
+//    p := pipe.Script(
+//        pipe.ChDir(dir),
+//        pipe.Assert(func(s *pipe.State) bool { return s.Dir != "/" }, "refusing to clean up /"),
+//        pipe.Exec("rm", "-rf", "build"),
+//    )
+//
+func Assert(cond func(s *State) bool, format string, args ...interface{}) Pipe {
+	return func(s *State) error {
+		if !cond(s) {
+			return fmt.Errorf(format, args...)
+		}
+		return nil
+	}
+}
+
+// Test runs f as a task, so that within scripts it only runs after all
+// the preceding entries are done, and succeeds or fails as f does.
+// It is the general form of FileExists, DirExists, and EnvSet.
+func Test(f func(s *State) error) Pipe {
+	return TaskFunc(f)
+}
+
+// FileExists succeeds if a regular file exists at path, and fails
+// otherwise, similar to "test -f".
+func FileExists(path string) Pipe {
+	return Test(func(s *State) error {
+		info, err := os.Stat(s.Path(path))
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("not a regular file: %s", s.Path(path))
+		}
+		return nil
 	})
 }
 
-// Discard reads data from the pipe's stdin and discards it.
-func Discard() Pipe {
-	return Write(ioutil.Discard)
+// DirExists succeeds if a directory exists at path, and fails
+// otherwise, similar to "test -d".
+func DirExists(path string) Pipe {
+	return Test(func(s *State) error {
+		info, err := os.Stat(s.Path(path))
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("not a directory: %s", s.Path(path))
+		}
+		return nil
+	})
 }
 
-// Tee reads data from the pipe's stdin and writes it both to
-// the pipe's stdout and to w.
-func Tee(w io.Writer) Pipe {
+// EnvSet succeeds if the named environment variable is set in the
+// pipe, even if to an empty value, and fails otherwise.
+func EnvSet(name string) Pipe {
+	return Test(func(s *State) error {
+		prefix := name + "="
+		for _, kv := range s.Env {
+			if strings.HasPrefix(kv, prefix) {
+				return nil
+			}
+		}
+		return fmt.Errorf("environment variable %s is not set", name)
+	})
+}
+
+// RenameFile renames the file fromPath as toPath.
+func RenameFile(fromPath, toPath string) Pipe {
+	// Register it as a task function so that within scripts
+	// it holds until all the preceding flushing is done.
 	return TaskFunc(func(s *State) error {
-		_, err := io.Copy(w, io.TeeReader(s.Stdin, s.Stdout))
-		return err
+		return os.Rename(s.Path(fromPath), s.Path(toPath))
 	})
 }
 
-// ReadFile reads data from the file at path and writes it to the
-// pipe's stdout.
-func ReadFile(path string) Pipe {
+// MoveFile moves the file at fromPath to toPath. Unlike RenameFile, it
+// also works when both paths are on different filesystems, in which
+// case the file is copied with its permissions and modification time,
+// synced to disk, atomically renamed into place, and only then removed
+// from fromPath.
+func MoveFile(fromPath, toPath string) Pipe {
 	return TaskFunc(func(s *State) error {
-		file, err := os.Open(s.Path(path))
-		if err != nil {
-			return err
+		from, to := s.Path(fromPath), s.Path(toPath)
+		err := os.Rename(from, to)
+		if le, ok := err.(*os.LinkError); ok && le.Err == syscall.EXDEV {
+			return moveAcrossDevices(s, from, to)
 		}
-		_, err = io.Copy(s.Stdout, file)
-		file.Close()
 		return err
 	})
 }
 
-// WriteFile writes to the file at path the data read from the
-// pipe's stdin. If the file doesn't exist, it is created with perm.
-func WriteFile(path string, perm os.FileMode) Pipe {
+func moveAcrossDevices(s *State, from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("cannot move %s across devices: not a regular file", from)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(to), "."+filepath.Base(to)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(s.quotaWriter(tmp), src)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err = firstErr(err, tmp.Close()); err == nil {
+		err = os.Chmod(tmp.Name(), info.Mode().Perm())
+	}
+	if err == nil {
+		err = os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), to)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(to)); err == nil {
+		// Persist the rename before removing the original.
+		dir.Sync()
+		dir.Close()
+	}
+	return os.Remove(from)
+}
+
+// ListOrder selects the order of the entries written by List.
+type ListOrder int
+
+const (
+	ListByName ListOrder = iota // Ascending by name.
+	ListBySize                  // Largest first.
+	ListByTime                  // Most recently modified first.
+)
+
+// ListOptions holds the options for List.
+type ListOptions struct {
+	// All includes entries with names starting with a dot.
+	All bool
+
+	// Long writes the mode, size, and modification time of each
+	// entry before its name, separated by tabs.
+	Long bool
+
+	// Order defines the order of entries, and Reverse inverts it.
+	Order   ListOrder
+	Reverse bool
+}
+
+// List writes the names of the entries in the directory at dir to the
+// pipe's stdout, one per line, similar to the ls tool. With the Long
+// option each line holds the entry's mode, size, modification time in
+// RFC 3339 format, and name, separated by tabs, as in:
+//
+//    -rw-r--r--	1204	2021-03-04T10:20:30Z	README.md
+//
+func List(dir string, opts ListOptions) Pipe {
 	return TaskFunc(func(s *State) error {
-		file, err := os.OpenFile(s.Path(path), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+		infos, err := ioutil.ReadDir(s.Path(dir))
 		if err != nil {
 			return err
 		}
-		_, err = io.Copy(file, s.Stdin)
-		return firstErr(err, file.Close())
+		if !opts.All {
+			n := 0
+			for _, info := range infos {
+				if !strings.HasPrefix(info.Name(), ".") {
+					infos[n] = info
+					n++
+				}
+			}
+			infos = infos[:n]
+		}
+		less := func(a, b os.FileInfo) bool { return a.Name() < b.Name() }
+		switch opts.Order {
+		case ListBySize:
+			less = func(a, b os.FileInfo) bool { return a.Size() > b.Size() }
+		case ListByTime:
+			less = func(a, b os.FileInfo) bool { return a.ModTime().After(b.ModTime()) }
+		}
+		// ReadDir sorts by name, so ties are kept in that order.
+		sort.SliceStable(infos, func(i, j int) bool {
+			if opts.Reverse {
+				return less(infos[j], infos[i])
+			}
+			return less(infos[i], infos[j])
+		})
+		var buf bytes.Buffer
+		for _, info := range infos {
+			if opts.Long {
+				fmt.Fprintf(&buf, "%s\t%d\t%s\t", info.Mode(), info.Size(), info.ModTime().UTC().Format(time.RFC3339))
+			}
+			buf.WriteString(info.Name())
+			buf.WriteByte('\n')
+		}
+		_, err = s.Stdout.Write(buf.Bytes())
+		return err
 	})
 }
 
-// AppendFile append to the end of the file at path the data read
-// from the pipe's stdin. If the file doesn't exist, it is created
-// with perm.
-func AppendFile(path string, perm os.FileMode) Pipe {
+// FileStat holds the metadata of a file as recorded by StatTo
+// and written by Stat and StatJSON.
+type FileStat struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"mod_time"`
+	IsDir   bool      `json:"is_dir"`
+	IsLink  bool      `json:"is_link"`
+
+	// Perm holds the permission bits of the file.
+	Perm os.FileMode `json:"perm"`
+}
+
+func statFile(s *State, path string) (*FileStat, error) {
+	path = s.Path(path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	linfo, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStat{
+		Path:    path,
+		Size:    info.Size(),
+		Mode:    info.Mode().String(),
+		ModTime: info.ModTime(),
+		IsDir:   info.IsDir(),
+		IsLink:  linfo.Mode()&os.ModeSymlink != 0,
+		Perm:    info.Mode().Perm(),
+	}, nil
+}
+
+// StatTo records into st the metadata of the file at path, following
+// symbolic links. Within scripts, subsequent entries such as Test may
+// then inspect st to decide how to proceed.
+//
+// For example:
+//
+//    var st pipe.FileStat
+//    p := pipe.Script(
+//        pipe.StatTo("app.log", &st),
+//        pipe.Test(func(s *pipe.State) error {
+//            if st.Size < 100<<20 {
+//                return fmt.Errorf("log is small enough")
+//            }
+//            return nil
+//        }),
+//        pipe.Exec("logrotate", "app.conf"),
+//    )
+//
+func StatTo(path string, st *FileStat) Pipe {
 	return TaskFunc(func(s *State) error {
-		file, err := os.OpenFile(s.Path(path), os.O_WRONLY|os.O_CREATE|os.O_APPEND, perm)
+		stat, err := statFile(s, path)
 		if err != nil {
 			return err
 		}
-		_, err = io.Copy(file, s.Stdin)
-		return firstErr(err, file.Close())
+		*st = *stat
+		return nil
 	})
 }
 
-// TeeWriteFile reads data from the pipe's stdin and writes it both to
-// the pipe's stdout and to the file at path. If the file doesn't
-// exist, it is created with perm.
-func TeeWriteFile(path string, perm os.FileMode) Pipe {
+// Stat writes the metadata of the file at path to the pipe's stdout,
+// following symbolic links, with one "field: value" line per field of
+// FileStat in the same order, as in:
+//
+//    path: /home/user/notes.txt
+//    size: 1204
+//    mode: -rw-r--r--
+//    mod_time: 2021-03-04T10:20:30Z
+//    is_dir: false
+//    is_link: false
+//    perm: 644
+//
+func Stat(path string) Pipe {
 	return TaskFunc(func(s *State) error {
-		file, err := os.OpenFile(s.Path(path), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+		st, err := statFile(s, path)
 		if err != nil {
 			return err
 		}
-		_, err = io.Copy(file, io.TeeReader(s.Stdin, s.Stdout))
-		return firstErr(err, file.Close())
+		_, err = fmt.Fprintf(s.Stdout, "path: %s\nsize: %d\nmode: %s\nmod_time: %s\nis_dir: %t\nis_link: %t\nperm: %o\n",
+			st.Path, st.Size, st.Mode, st.ModTime.UTC().Format(time.RFC3339Nano), st.IsDir, st.IsLink, st.Perm)
+		return err
 	})
 }
 
-// TeeAppendFile reads data from the pipe's stdin and writes it both to
-// the pipe's stdout and to the file at path. If the file doesn't
-// exist, it is created with perm.
-func TeeAppendFile(path string, perm os.FileMode) Pipe {
+// StatJSON writes the metadata of the file at path to the pipe's
+// stdout as a FileStat encoded in JSON, followed by a newline.
+func StatJSON(path string) Pipe {
 	return TaskFunc(func(s *State) error {
-		file, err := os.OpenFile(s.Path(path), os.O_WRONLY|os.O_CREATE|os.O_APPEND, perm)
+		st, err := statFile(s, path)
 		if err != nil {
 			return err
 		}
-		_, err = io.Copy(file, io.TeeReader(s.Stdin, s.Stdout))
-		return firstErr(err, file.Close())
+		return json.NewEncoder(s.Stdout).Encode(st)
 	})
 }
 
-// Replace filters lines read from the pipe's stdin and writes
-// the returned values to stdout.
-func Replace(f func(line []byte) []byte) Pipe {
+// DiskUsage walks the directory tree at path and writes to the pipe's
+// stdout the total size in bytes of the files within each directory,
+// including its subdirectories, in the form "size\tpath", similar to
+// the du tool with apparent sizes. Directories are reported after
+// their subdirectories, and only up to depth levels below path,
+// or all levels if depth is negative. Files with multiple hard links
+// are counted once, and symbolic links are not followed.
+//
+// For example, this writes the ten largest directories under /var:
+//
+//    p := pipe.Line(
+//        pipe.DiskUsage("/var", -1),
+//        pipe.SortLines(pipe.SortOptions{Numeric: true, Reverse: true}),
+//        pipe.LimitLines(10),
+//    )
+//
+func DiskUsage(path string, depth int) Pipe {
 	return TaskFunc(func(s *State) error {
-		r := bufio.NewReader(s.Stdin)
-		for {
-			line, err := r.ReadBytes('\n')
-			if len(line) > 0 {
-				line := f(line)
-				if len(line) > 0 {
-					_, err := s.Stdout.Write(line)
-					if err != nil {
-						return err
-					}
-				}
-			}
-			if err != nil {
-				if err == io.EOF {
-					return nil
-				}
-				return err
-			}
+		w := bufio.NewWriter(s.Stdout)
+		seen := make(map[[2]uint64]bool)
+		if _, err := diskUsage(w, s.Path(path), path, 0, depth, seen); err != nil {
+			return err
 		}
-		panic("unreachable")
+		return w.Flush()
 	})
 }
 
-// Filter filters lines read from the pipe's stdin so that only those
-// for which f is true are written to the pipe's stdout.
-// The line provided to f has '\n' and '\r' trimmed.
-func Filter(f func(line []byte) bool) Pipe {
-	return Replace(func(line []byte) []byte {
-		if f(bytes.TrimRight(line, "\r\n")) {
-			return line
+func diskUsage(w io.Writer, fullPath, path string, level, depth int, seen map[[2]uint64]bool) (int64, error) {
+	infos, err := ioutil.ReadDir(fullPath)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, info := range infos {
+		if info.IsDir() {
+			size, err := diskUsage(w, filepath.Join(fullPath, info.Name()), filepath.Join(path, info.Name()), level+1, depth, seen)
+			if err != nil {
+				return 0, err
+			}
+			total += size
+			continue
 		}
-		return nil
-	})
-}
-
-// RenameFile renames the file fromPath as toPath.
-func RenameFile(fromPath, toPath string) Pipe {
-	// Register it as a task function so that within scripts
-	// it holds until all the preceding flushing is done.
-	return TaskFunc(func(s *State) error {
-		return os.Rename(s.Path(fromPath), s.Path(toPath))
-	})
+		if id, ok := hardLinkID(info); ok {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+		}
+		total += info.Size()
+	}
+	if depth >= 0 && level > depth {
+		return total, nil
+	}
+	_, err = fmt.Fprintf(w, "%d\t%s\n", total, path)
+	return total, err
 }
@@ -0,0 +1,398 @@
+// pipe - Unix-like pipelines for Go
+//
+// Copyright (c) 2013 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build !wasm
+// +build !wasm
+
+package pipe
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// The pipes in this file run commands as local processes, so they
+// are not available on platforms without processes, such as wasm.
+
+// Exec returns a pipe that runs the named program with the given arguments.
+// If the pipe's stdin is an *os.File, it is provided directly to the
+// program instead of being copied. See also ExecWithStdinFile.
+func Exec(name string, args ...string) Pipe {
+	return func(s *State) error {
+		return s.AddTask(&execTask{name: name, args: args})
+	}
+}
+
+// ExecWithStdinFile returns a pipe that runs the named program with the
+// given arguments and the file at path as its stdin, similar to the
+// "name args < path" shell redirection. The file is provided directly
+// to the program instead of being copied through the pipe, so it's
+// more efficient than feeding the program via ReadFile within a Line.
+func ExecWithStdinFile(path string, name string, args ...string) Pipe {
+	return func(s *State) error {
+		return s.AddTask(&execTask{name: name, args: args, stdinPath: path})
+	}
+}
+
+// System returns a pipe that runs cmd via a system shell.
+// It is equivalent to the pipe Exec("/bin/sh", "-c", cmd).
+func System(cmd string) Pipe {
+	return Exec("/bin/sh", "-c", cmd)
+}
+
+// ExecIn returns a pipe that runs the named program with the given
+// arguments in dir, without changing the pipe's current directory for
+// the following entries. If dir is relative, it is taken relative to
+// the pipe's current directory.
+//
+// For example, the equivalent of "(cd build && make); make install" is:
+//
+//    p := pipe.Script(
+//        pipe.ExecIn("build", "make"),
+//        pipe.Exec("make", "install"),
+//    )
+//
+func ExecIn(dir string, name string, args ...string) Pipe {
+	return func(s *State) error {
+		return s.AddTask(&execTask{name: name, args: args, dir: dir})
+	}
+}
+
+// SystemIn returns a pipe that runs cmd via a system shell in dir.
+// It is equivalent to the pipe ExecIn(dir, "/bin/sh", "-c", cmd).
+func SystemIn(dir string, cmd string) Pipe {
+	return ExecIn(dir, "/bin/sh", "-c", cmd)
+}
+
+// LocalExecutor is the Executor that runs commands as processes in the
+// local machine. It is used when the Executor in the State is nil.
+type LocalExecutor struct{}
+
+// Start starts the command described by spec as a local process
+// connected to the provided streams.
+func (LocalExecutor) Start(spec CommandSpec, streams Streams) (Process, error) {
+	cmd := exec.Command(spec.Name, spec.Args...)
+	cmd.Dir = spec.Dir
+	cmd.Env = spec.Env
+	cmd.Stdin = streams.Stdin
+	cmd.Stdout = streams.Stdout
+	cmd.Stderr = streams.Stderr
+	p := &localProcess{cmd: cmd}
+	if err := p.start(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *localProcess) Pid() int { return p.cmd.Process.Pid }
+
+// DockerExecutor is an Executor that runs commands inside a running
+// container, as done by "docker exec -i", with their streams attached.
+//
+// Environment variables the pipe set or changed relative to the
+// current process, such as via SetEnvVar, are set for the command.
+// Their values are handed to the docker client via its environment
+// rather than its arguments, so they're not exposed in the process
+// list. The pipe's current directory is a local path, and so is not
+// used within the container. See DockerExec.
+type DockerExecutor struct {
+	// Container is the name or ID of the container.
+	Container string
+
+	// Command is the docker client run to execute commands,
+	// such as "podman". It defaults to "docker".
+	Command string
+
+	// Dir, if set, is the working directory of the commands
+	// within the container.
+	Dir string
+}
+
+// Start starts the command described by spec in the container,
+// connected to the provided streams.
+func (e *DockerExecutor) Start(spec CommandSpec, streams Streams) (Process, error) {
+	command := e.Command
+	if command == "" {
+		command = "docker"
+	}
+	args := []string{"exec", "-i"}
+	if e.Dir != "" {
+		args = append(args, "-w", e.Dir)
+	}
+	env := os.Environ()
+	inherited := make(map[string]bool)
+	for _, kv := range env {
+		inherited[kv] = true
+	}
+	for _, kv := range spec.Env {
+		if i := strings.Index(kv, "="); i > 0 && !inherited[kv] {
+			// With no value, docker takes it from its own environment.
+			args = append(args, "-e", kv[:i])
+			env = append(env, kv)
+		}
+	}
+	args = append(args, e.Container, spec.Name)
+	args = append(args, spec.Args...)
+	return LocalExecutor{}.Start(CommandSpec{Name: command, Args: args, Env: env}, streams)
+}
+
+// DockerExec runs the named command with the provided arguments inside
+// the running container, as done by "docker exec -i", with the pipe's
+// streams attached. See DockerExecutor for how the pipe's environment
+// is handled.
+//
+// For example, this dumps a database running in a container:
+//
+//    p := pipe.Line(
+//        pipe.DockerExec("db", "pg_dump", "app"),
+//        pipe.WriteFile("app.sql", 0644),
+//    )
+//
+func DockerExec(container string, name string, args ...string) Pipe {
+	return func(s *State) error {
+		saved := s.Executor
+		defer func() { s.Executor = saved }()
+		s.Executor = &DockerExecutor{Container: container}
+		return Exec(name, args...)(s)
+	}
+}
+
+// Detach starts the commands run by p as processes in new sessions,
+// detached from the pipe, and does not wait for them to terminate.
+// Their stdin is read from the null device, and their stdout and
+// stderr are appended to the files at outPath and errPath, or
+// discarded if the respective path is empty. Once p is done, the
+// PIDs of the started processes are written to the pipe's stdout,
+// one per line.
+//
+// The detached commands must not be connected to other entries of p,
+// as the data transferred between pipe entries is handled by the
+// current process. Use System to start pipelines of commands instead.
+//
+// For example, this starts a server in the background and records
+// its PID before moving on:
+//
+//    p := pipe.Script(
+//        pipe.Line(
+//            pipe.Detach(pipe.Exec("server"), "server.log", "server.log"),
+//            pipe.WriteFile("server.pid", 0644),
+//        ),
+//        pipe.Exec("client"),
+//    )
+//
+func Detach(p Pipe, outPath, errPath string) Pipe {
+	return func(s *State) error {
+		return s.AddTask(&detachTask{p: p, outPath: outPath, errPath: errPath})
+	}
+}
+
+type detachTask struct {
+	p       Pipe
+	outPath string
+	errPath string
+
+	m      sync.Mutex
+	sub    *State
+	cancel bool
+}
+
+func (t *detachTask) Run(s *State) error {
+	stdin, err := os.Open(os.DevNull)
+	if err != nil {
+		return err
+	}
+	defer stdin.Close()
+	stdout, err := openDetachFile(s, t.outPath)
+	if err != nil {
+		return err
+	}
+	defer stdout.Close()
+	stderr := stdout
+	if t.errPath != t.outPath {
+		stderr, err = openDetachFile(s, t.errPath)
+		if err != nil {
+			return err
+		}
+		defer stderr.Close()
+	}
+
+	executor := &detachExecutor{stdin: stdin, stdout: stdout, stderr: stderr}
+	sub := s.newSubState(stdout, stderr)
+	sub.Stdin = stdin
+	sub.Executor = executor
+	// Detached commands outlive the pipe and are not signaled with it.
+	sub.procs = nil
+	err = t.p(sub)
+	if err == nil {
+		t.m.Lock()
+		if t.cancel {
+			t.m.Unlock()
+			return ErrKilled
+		}
+		t.sub = sub
+		t.m.Unlock()
+		err = sub.RunTasks()
+	}
+	for _, pid := range executor.pids {
+		if _, werr := fmt.Fprintf(s.Stdout, "%d\n", pid); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+func (t *detachTask) Kill() {
+	t.m.Lock()
+	sub := t.sub
+	t.cancel = true
+	t.m.Unlock()
+	if sub != nil {
+		sub.Kill()
+	}
+}
+
+func openDetachFile(s *State, path string) (*os.File, error) {
+	if path == "" {
+		return os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	}
+	return os.OpenFile(s.Path(path), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+}
+
+// detachExecutor starts local processes in new sessions and
+// considers them done as soon as they are started. The processes
+// are connected to the given files rather than to the provided
+// streams, so that no data is copied by the current process.
+type detachExecutor struct {
+	stdin  *os.File
+	stdout *os.File
+	stderr *os.File
+
+	m    sync.Mutex
+	pids []int
+}
+
+func (e *detachExecutor) Start(spec CommandSpec, streams Streams) (Process, error) {
+	cmd := exec.Command(spec.Name, spec.Args...)
+	cmd.Dir = spec.Dir
+	cmd.Env = spec.Env
+	cmd.Stdin = e.stdin
+	cmd.Stdout = e.stdout
+	cmd.Stderr = e.stderr
+	cmd.SysProcAttr = detachedAttr()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	// Reap the process whenever it terminates.
+	go cmd.Wait()
+	e.m.Lock()
+	e.pids = append(e.pids, cmd.Process.Pid)
+	e.m.Unlock()
+	return detachedProcess{}, nil
+}
+
+type detachedProcess struct{}
+
+func (detachedProcess) Wait() error { return nil }
+func (detachedProcess) Kill() error { return nil }
+
+// WritePIDFile returns a pipe that runs p, which must be a single
+// Exec or System entry, and records the PID of its process in the
+// file at path. The file is removed when the process terminates.
+// The entry fails if its process has no local PID, as is the case
+// for commands run by some executors.
+//
+// For example, this runs a server with its PID recorded so that
+// it may be stopped via KillFromPIDFile:
+//
+//    p := pipe.WritePIDFile("/run/server.pid", pipe.Exec("server"))
+//
+func WritePIDFile(path string, p Pipe) Pipe {
+	return func(s *State) error {
+		if s.spec != nil {
+			return fmt.Errorf("cannot describe pipe that writes a PID file")
+		}
+		oldLen := len(s.pendingTasks)
+		if err := p(s); err != nil {
+			return err
+		}
+		tasks := s.pendingTasks[oldLen:]
+		if len(tasks) != 1 {
+			return fmt.Errorf("cannot write PID file of pipe with %d tasks", len(tasks))
+		}
+		f, ok := innerTask(tasks[0].t).(*execTask)
+		if !ok {
+			return fmt.Errorf("cannot write PID file of task of type %T", tasks[0].t)
+		}
+		f.pidFile = path
+		return nil
+	}
+}
+
+// KillFromPIDFile returns a pipe that sends sig to the process with
+// the PID recorded in the file at path. Nothing is done if the file
+// does not exist, and the file is removed if it is stale, meaning the
+// process no longer exists. Other failures, such as not having
+// permission to signal the process, are reported. On Windows the
+// process is terminated regardless of sig.
+func KillFromPIDFile(path string, sig syscall.Signal) Pipe {
+	return TaskFunc(func(s *State) error {
+		path := s.Path(path)
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil || pid <= 0 {
+			return fmt.Errorf("invalid PID file %s: %q", path, data)
+		}
+		err = signalPID(pid, sig)
+		if err == errNoProcess {
+			err = os.Remove(path)
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("cannot signal process %d from PID file %s: %v", pid, path, err)
+		}
+		return nil
+	})
+}
+
+// localExecutor returns the Executor used when the State has none.
+func localExecutor() Executor {
+	return LocalExecutor{}
+}
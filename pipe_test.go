@@ -1,12 +1,32 @@
 package pipe_test
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"io"
 	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -130,685 +150,4232 @@ func (S) TestExecDividedOutputTimeout(c *C) {
 	c.Assert(string(stderr), Equals, "err1\nerr2\n")
 }
 
-func (S) TestStateKill(c *C) {
-	started := time.Now()
-	p := pipe.Exec("sleep", "1")
-	s := pipe.NewState(nil, nil)
+func (S) TestExecErrorStderr(c *C) {
+	p := pipe.System("echo out; echo err1 1>&2; echo err2 1>&2; exit 2")
+	stdout, stderr, err := pipe.DividedOutput(p)
+	c.Assert(err, ErrorMatches, `command "/bin/sh" \["-c" ".*"\]: exit status 2: err1\nerr2`)
+	c.Assert(string(stdout), Equals, "out\n")
+	c.Assert(string(stderr), Equals, "err1\nerr2\n")
+}
+
+func (S) TestExecErrorStderrTail(c *C) {
+	p := pipe.System("for i in $(seq 1 2000); do echo line$i 1>&2; done; exit 1")
+	_, err := pipe.Output(p)
+	c.Assert(err, NotNil)
+	msg := err.Error()
+	c.Assert(strings.HasPrefix(msg, `command "/bin/sh" ["-c" "for i in $(seq 1 2000); do echo line$i 1>&2; done; exit 1"]: exit status 1: line`), Equals, true)
+	c.Assert(strings.HasSuffix(msg, "\nline1999\nline2000"), Equals, true)
+	c.Assert(len(msg) < 4200, Equals, true)
+	c.Assert(strings.Contains(msg, "\nline1\n"), Equals, false)
+}
+
+func (S) TestExecErrorStderrTailOptions(c *C) {
+	p := pipe.System("echo out; echo err1 1>&2; echo err2 1>&2; exit 2")
+	var stderr bytes.Buffer
+	s := pipe.NewState(nil, &stderr)
+	s.StderrTail = 7
 	c.Assert(p(s), IsNil)
-	ch := make(chan error)
+	c.Assert(s.RunTasks(), ErrorMatches, `command "/bin/sh" .*: exit status 2: err2`)
+
+	// Negative values disable the tail.
+	s = pipe.NewState(nil, &stderr)
+	s.StderrTail = -1
+	c.Assert(p(s), IsNil)
+	c.Assert(s.RunTasks(), ErrorMatches, `command "/bin/sh" .*: exit status 2`)
+
+	// Combined output isn't captured, as it holds stdout as well.
+	output, err := pipe.CombinedOutput(p)
+	c.Assert(err, ErrorMatches, `command "/bin/sh" .*: exit status 2`)
+	c.Assert(string(output), Equals, "out\nerr1\nerr2\n")
+}
+
+func (S) TestExecErrorArgsAndDir(c *C) {
+	dir := c.MkDir()
+	p := pipe.Script(
+		pipe.ChDir(dir),
+		pipe.Exec("ls", "-d", "missing file"),
+	)
+	_, err := pipe.Output(p)
+	c.Assert(err, ErrorMatches, `script\[1\]: command "ls" \["-d" "missing file"\] in "`+regexp.QuoteMeta(dir)+`": exit status 2: .*missing file.*`)
+}
+
+func (S) TestExecWithStdinFile(c *C) {
+	dir := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "input"), []byte("hello\n"), 0644), IsNil)
+	p := pipe.Script(
+		pipe.ChDir(dir),
+		pipe.ExecWithStdinFile("input", "sh", "-c", "test -f /dev/stdin && cat"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "hello\n")
+
+	data, err := pipe.ToSpec(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, `{"script":[{"exec":"sh","args":["-c","test -f /dev/stdin \u0026\u0026 cat"],"dir":"`+dir+`","stdin":"input"}]}`)
+	p, err = pipe.FromSpec(data)
+	c.Assert(err, IsNil)
+	output, err = pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "hello\n")
+
+	_, err = pipe.Output(pipe.ExecWithStdinFile(filepath.Join(dir, "missing"), "cat"))
+	c.Assert(err, ErrorMatches, "open .*/missing: no such file or directory")
+}
+
+func (S) TestErrorReport(c *C) {
+	c.Assert(pipe.NewErrorReport(nil), IsNil)
+
+	dir := c.MkDir()
+	p := pipe.Script(
+		pipe.ChDir(dir),
+		pipe.Line(
+			pipe.System("echo oops 1>&2; exit 3"),
+			pipe.TaskFunc(func(s *pipe.State) error {
+				ioutil.ReadAll(s.Stdin)
+				return fmt.Errorf("boom")
+			}),
+		),
+	)
+	_, err := pipe.Output(p)
+	c.Assert(err, NotNil)
+
+	r := pipe.NewErrorReport(err)
+	c.Assert(r.Error(), Equals, err.Error())
+	c.Assert(r.Errors, HasLen, 2)
+	for _, e := range r.Errors {
+		if e.Message == "line[1]: boom" {
+			c.Assert(e.Command, Equals, "")
+			continue
+		}
+		c.Assert(e.Command, Equals, "/bin/sh")
+		c.Assert(e.Args, DeepEquals, []string{"-c", "echo oops 1>&2; exit 3"})
+		c.Assert(e.Dir, Equals, dir)
+		c.Assert(e.ExitCode, Equals, 3)
+		c.Assert(e.Signal, Equals, "")
+		c.Assert(e.Stderr, Equals, "oops")
+		c.Assert(e.Duration > 0, Equals, true)
+	}
+
+	data, err := json.Marshal(pipe.NewErrorReport(fmt.Errorf("boom")))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, `{"message":"boom"}`)
+}
+
+func (S) TestErrorReportSignal(c *C) {
+	_, err := pipe.Output(pipe.System("kill -TERM $$"))
+	r := pipe.NewErrorReport(err)
+	c.Assert(r.Errors, HasLen, 1)
+	c.Assert(r.Errors[0].ExitCode, Equals, -1)
+	c.Assert(r.Errors[0].Signal, Equals, "terminated")
+}
+
+func (S) TestExitCode(c *C) {
+	c.Assert(pipe.ExitCode(nil), Equals, 0)
+	err := pipe.Run(pipe.Line(pipe.Exec("true"), pipe.Exec("sh", "-c", "exit 3")))
+	c.Assert(pipe.ExitCode(err), Equals, 3)
+	c.Assert(pipe.ExitCode(pipe.NewErrorReport(err)), Equals, 3)
+	err = pipe.Run(pipe.System("kill -TERM $$"))
+	c.Assert(pipe.ExitCode(err), Equals, 128+15)
+	err = pipe.RunTimeout(pipe.Exec("sleep", "10"), 50*time.Millisecond)
+	c.Assert(pipe.ExitCode(err), Equals, 124)
+	c.Assert(pipe.ExitCode(pipe.NewErrorReport(err)), Equals, 124)
+	err = pipe.Run(pipe.ReadFile("/non-existent"))
+	c.Assert(pipe.ExitCode(err), Equals, 1)
+}
+
+func (S) TestAsFilter(c *C) {
+	f := pipe.AsFilter(pipe.Line(pipe.Exec("tr", "a-z", "A-Z"), pipe.Exec("sed", "s/^/> /")))
 	go func() {
-		ch <- s.RunTasks()
+		io.WriteString(f, "hello\n")
+		io.WriteString(f, "world\n")
+		f.Close()
 	}()
+	data, err := ioutil.ReadAll(f)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "> HELLO\n> WORLD\n")
+}
+
+func (S) TestAsFilterError(c *C) {
+	f := pipe.AsFilter(pipe.Exec("sh", "-c", "echo out; exit 3"))
+	c.Assert(f.Close(), IsNil)
+	data, err := ioutil.ReadAll(f)
+	c.Assert(err, ErrorMatches, `command "sh" .*: exit status 3`)
+	c.Assert(string(data), Equals, "out\n")
+
+	f = pipe.AsFilter(func(s *pipe.State) error { return fmt.Errorf("bad pipe") })
+	_, err = f.Write([]byte("data"))
+	c.Assert(err, ErrorMatches, "bad pipe")
+	_, err = f.Read(make([]byte, 10))
+	c.Assert(err, ErrorMatches, "bad pipe")
+}
+
+func (S) TestAsFilterKill(c *C) {
+	f := pipe.AsFilter(pipe.Exec("sh", "-c", "echo $$; exec yes"))
+	line, err := bufio.NewReader(f).ReadString('\n')
+	c.Assert(err, IsNil)
+	pid, err := strconv.Atoi(strings.TrimSpace(line))
+	c.Assert(err, IsNil)
+
+	// The caller abandons reading the output.
+	f.Kill()
+	_, err = f.Read(make([]byte, 10))
+	c.Assert(err, Equals, io.ErrClosedPipe)
+	proc, err := os.FindProcess(pid)
+	if err == nil {
+		err = proc.Signal(syscall.Signal(0))
+	}
+	c.Assert(err, NotNil)
+}
+
+func (S) TestRunContext(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Assert(pipe.RunContext(ctx, pipe.Exec("true")), IsNil)
+	time.AfterFunc(50*time.Millisecond, cancel)
+	started := time.Now()
+	err := pipe.RunContext(ctx, pipe.Line(pipe.Exec("sleep", "10"), pipe.Exec("cat")))
+	c.Assert(time.Since(started) < 5*time.Second, Equals, true)
+	c.Assert(err, ErrorMatches, `context canceled while running command "sleep" \["10"\], command "cat" \[\]`)
+	c.Assert(errors.Is(err, context.Canceled), Equals, true)
+	c.Assert(pipe.ExitCode(err), Equals, 130)
+
+	err = pipe.RunContext(ctx, pipe.Exec("true"))
+	c.Assert(err, ErrorMatches, "context canceled")
+}
+
+func (S) TestOutputContext(c *C) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	output, err := pipe.OutputContext(ctx, pipe.Script(pipe.Exec("echo", "hello"), pipe.Exec("sleep", "10")))
+	c.Assert(err, ErrorMatches, `context deadline exceeded while running command "sleep" \["10"\]`)
+	c.Assert(pipe.ExitCode(err), Equals, 124)
+	c.Assert(string(output), Equals, "hello\n")
+
+	output, err = pipe.CombinedOutputContext(context.Background(), pipe.System("echo out; echo err >&2"))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "out\nerr\n")
+}
+
+func (S) TestTimeout(c *C) {
+	started := time.Now()
+	output, err := pipe.Output(pipe.Script(
+		pipe.Exec("echo", "before"),
+		pipe.Timeout(pipe.Line(pipe.Exec("sleep", "10"), pipe.Exec("cat")), 50*time.Millisecond),
+		pipe.Exec("echo", "after"),
+	))
+	c.Assert(time.Since(started) < 5*time.Second, Equals, true)
+	c.Assert(err, ErrorMatches, "script\\[1\\]: timeout after 50ms")
+	c.Assert(pipe.ExitCode(err), Equals, 124)
+	c.Assert(string(output), Equals, "before\n")
+
+	var terr *pipe.TimeoutError
+	c.Assert(errors.As(err, &terr), Equals, true)
+	c.Assert(errors.Is(err, pipe.ErrTimeout), Equals, true)
+
+	output, err = pipe.Output(pipe.Timeout(pipe.Exec("echo", "fast"), 5*time.Second))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "fast\n")
+
+	err = pipe.Run(pipe.Timeout(pipe.Exec("false"), 5*time.Second))
+	c.Assert(err, ErrorMatches, `command "false": exit status 1`)
+}
+
+func (S) TestTimed(c *C) {
+	var timings pipe.Timings
+	var names []string
+	report := func(name string, d time.Duration, err error) {
+		names = append(names, name)
+		timings.Report(name, d, err)
+	}
+	output, err := pipe.Output(pipe.Script(
+		pipe.Timed("sleep", pipe.Exec("sleep", "0.1"), report),
+		pipe.Timed("echo", pipe.Line(pipe.Print("hello"), pipe.Exec("cat")), report),
+		pipe.Timed("fail", pipe.Exec("false"), report),
+		pipe.Timed("skipped", pipe.Exec("true"), report),
+	))
+	c.Assert(err, ErrorMatches, `script\[2\]: command "false": exit status 1`)
+	c.Assert(string(output), Equals, "hello")
+
+	// Timed stages run in the current state.
+	var timed []string
+	output, err = pipe.Output(pipe.Script(
+		pipe.Timed("set", pipe.SetEnvVar("PIPE_TIMED_VAR", "1"), func(name string, d time.Duration, err error) {
+			timed = append(timed, name)
+		}),
+		pipe.Exec("sh", "-c", "echo $PIPE_TIMED_VAR"),
+	))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "1\n")
+	c.Assert(timed, HasLen, 0)
+	c.Assert(names, DeepEquals, []string{"sleep", "echo", "fail"})
+
+	entries := timings.Entries()
+	c.Assert(entries, HasLen, 3)
+	c.Assert(entries[0].Duration >= 100*time.Millisecond, Equals, true)
+	c.Assert(entries[0].Err, IsNil)
+	c.Assert(entries[2].Err, ErrorMatches, `script\[2\]: command "false": exit status 1`)
+	c.Assert(timings.Total() >= entries[0].Duration, Equals, true)
+
+	lines := strings.Split(timings.String(), "\n")
+	c.Assert(lines, HasLen, 4)
+	c.Assert(lines[0], Matches, `sleep [0-9.]+m?s`)
+	c.Assert(lines[1], Matches, `echo  [0-9.]+[mµn]?s`)
+	c.Assert(lines[2], Matches, `fail  [0-9.]+[mµn]?s \(script\[2\]: command "false": exit status 1\)`)
+}
+
+func (S) TestNamed(c *C) {
+	err := pipe.Run(pipe.Line(
+		pipe.Print("hello"),
+		pipe.Named("upper", pipe.Exec("tr", "a-z", "A-Z")),
+		pipe.Named("fetch", pipe.Exec("sh", "-c", "cat >/dev/null; exit 3")),
+	))
+	c.Assert(err, ErrorMatches, `stage "fetch" \(line\[2\]\): command "sh" \["-c" "cat >/dev/null; exit 3"\]: exit status 3`)
+	c.Assert(pipe.ExitCode(err), Equals, 3)
+
+	var se *pipe.StageError
+	c.Assert(errors.As(err, &se), Equals, true)
+	c.Assert(se.Name, Equals, "fetch")
+	c.Assert(se.Position, Equals, "line[2]")
+	var ee *pipe.ExitError
+	c.Assert(errors.As(err, &ee), Equals, true)
+	c.Assert(ee.Code, Equals, 3)
+
+	r := pipe.NewErrorReport(err)
+	c.Assert(r.Errors, HasLen, 1)
+	c.Assert(r.Errors[0].Stage, Equals, "fetch")
+	c.Assert(r.Errors[0].Position, Equals, "line[2]")
+	c.Assert(r.Errors[0].Command, Equals, "sh")
+	c.Assert(r.Errors[0].ExitCode, Equals, 3)
+
+	output, err := pipe.Output(pipe.Script(
+		pipe.Named("greet", pipe.Println("hello")),
+		pipe.Line(
+			pipe.Exec("echo", "ignored"),
+			pipe.Named("check", pipe.Exec("false")),
+		),
+		pipe.Println("skipped"),
+	))
+	c.Assert(err, ErrorMatches, `stage "check" \(line\[1\]\): command "false": exit status 1`)
+	c.Assert(string(output), Equals, "hello\n")
+
+	err = pipe.Run(pipe.Script(
+		pipe.Exec("true"),
+		pipe.Named("build", pipe.Script(pipe.Exec("true"), pipe.Exec("false"))),
+	))
+	c.Assert(err, ErrorMatches, `stage "build" \(script\[1\]\): script\[1\]: command "false": exit status 1`)
+
+	err = pipe.Run(pipe.Named("top", pipe.Exec("false")))
+	c.Assert(err, ErrorMatches, `stage "top": command "false": exit status 1`)
+
+	output, err = pipe.Output(pipe.Named("ok", pipe.Exec("echo", "fine")))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "fine\n")
+
+	err = pipe.Run(pipe.Line(
+		pipe.Named("print", pipe.Print(strings.Repeat("x", 1<<20))),
+		pipe.Exec("false"),
+	))
+	c.Assert(err, ErrorMatches, `line\[1\]: command "false": exit status 1`)
+
+	// Unnamed entries report their position too.
+	err = pipe.Run(pipe.Line(pipe.Exec("true"), pipe.Exec("false")))
+	c.Assert(err, ErrorMatches, `line\[1\]: command "false": exit status 1`)
+
+	// Named stages run in the current state.
+	dir := c.MkDir()
+	output, err = pipe.Output(pipe.Script(
+		pipe.Named("set", pipe.SetEnvVar("PIPE_NAMED_VAR", "1")),
+		pipe.Named("cd", pipe.ChDir(dir)),
+		pipe.Exec("sh", "-c", "echo $PIPE_NAMED_VAR; pwd"),
+	))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "1\n"+dir+"\n")
+
+	_, err = pipe.ToSpec(pipe.Named("build", pipe.Exec("make")))
+	c.Assert(err, ErrorMatches, "cannot describe pipe with named stages")
+}
+
+func (S) TestExitError(c *C) {
+	err := pipe.Run(pipe.Line(pipe.Exec("true"), pipe.Exec("sh", "-c", "exit 3")))
+	c.Assert(err, ErrorMatches, `line\[1\]: command "sh" \["-c" "exit 3"\]: exit status 3`)
+	var ee *pipe.ExitError
+	c.Assert(errors.As(err, &ee), Equals, true)
+	c.Assert(ee.Name, Equals, "sh")
+	c.Assert(ee.Args, DeepEquals, []string{"-c", "exit 3"})
+	c.Assert(ee.Code, Equals, 3)
+	c.Assert(ee.Signal, Equals, syscall.Signal(0))
+	status, ok := pipe.ExitStatus(err)
+	c.Assert(ok, Equals, true)
+	c.Assert(status, Equals, 3)
+
+	err = pipe.Run(pipe.System("kill -TERM $$"))
+	c.Assert(errors.As(err, &ee), Equals, true)
+	c.Assert(ee.Code, Equals, -1)
+	c.Assert(ee.Signal, Equals, syscall.SIGTERM)
+
+	status, ok = pipe.ExitStatus(pipe.Run(pipe.ReadFile("/non-existent")))
+	c.Assert(ok, Equals, false)
+	status, ok = pipe.ExitStatus(nil)
+	c.Assert(ok, Equals, false)
+}
+
+func (S) TestGracefulKill(c *C) {
+	p := pipe.GracefulKill(syscall.SIGTERM, 5*time.Second, pipe.System("trap 'kill $!; echo cleanup; exit 0' TERM; echo started; sleep 10 & wait"))
+	started := time.Now()
+	output, err := pipe.OutputTimeout(p, 200*time.Millisecond)
+	c.Assert(time.Since(started) < 3*time.Second, Equals, true)
+	c.Assert(err, ErrorMatches, "timeout")
+	c.Assert(string(output), Equals, "started\ncleanup\n")
+
+	p = pipe.GracefulKill(syscall.SIGTERM, 100*time.Millisecond, pipe.System("trap '' TERM; exec sleep 10"))
+	started = time.Now()
+	err = pipe.RunTimeout(p, 100*time.Millisecond)
+	c.Assert(time.Since(started) < 3*time.Second, Equals, true)
+	c.Assert(err, ErrorMatches, "timeout")
+}
+
+func (S) TestStart(c *C) {
+	job, err := pipe.Start(pipe.Line(pipe.Exec("echo", "hello"), pipe.Exec("cat")))
+	c.Assert(err, IsNil)
+	<-job.Done()
+	c.Assert(job.Wait(), IsNil)
+
+	job, err = pipe.Start(pipe.Exec("sleep", "10"))
+	c.Assert(err, IsNil)
+	select {
+	case <-job.Done():
+		c.Fatalf("job terminated early")
+	case <-time.After(50 * time.Millisecond):
+	}
+	job.Kill()
+	c.Assert(job.Wait(), ErrorMatches, "explicitly killed")
+
+	_, err = pipe.Start(func(s *pipe.State) error { return fmt.Errorf("bad pipe") })
+	c.Assert(err, ErrorMatches, "bad pipe")
+}
+
+func (S) TestStartSignal(c *C) {
+	path := filepath.Join(c.MkDir(), "out")
+	job, err := pipe.Start(pipe.Line(
+		pipe.Script(
+			pipe.System("trap 'echo terminated; exit 0' TERM; while true; do sleep 0.01; done"),
+			pipe.Exec("echo", "after"),
+		),
+		pipe.WriteFile(path, 0644),
+	))
+	c.Assert(err, IsNil)
 	time.Sleep(100 * time.Millisecond)
-	s.Kill()
-	c.Assert(<-ch, ErrorMatches, "explicitly killed")
-	c.Assert(time.Since(started) < 2*time.Second, Equals, true)
+	c.Assert(job.Signal(syscall.SIGTERM), IsNil)
+	c.Assert(job.Wait(), IsNil)
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "terminated\nafter\n")
+
+	// Commands within nested pipes are signaled as well.
+	job, err = pipe.Start(pipe.Line(
+		pipe.Group(
+			pipe.Timeout(pipe.System("trap 'echo terminated; exit 0' TERM; while true; do sleep 0.01; done"), 10*time.Second),
+		),
+		pipe.WriteFile(path, 0644),
+	))
+	c.Assert(err, IsNil)
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(job.Signal(syscall.SIGTERM), IsNil)
+	c.Assert(job.Wait(), IsNil)
+	data, err = ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "terminated\n")
 }
 
-func (S) TestSystem(c *C) {
-	p := pipe.System("echo out1; echo err1 1>&2; echo out2; echo err2 1>&2")
-	stdout, stderr, err := pipe.DividedOutput(p)
+func (S) TestParallel(c *C) {
+	dir := c.MkDir()
+	var p []pipe.Pipe
+	for i := 0; i < 6; i++ {
+		p = append(p, pipe.System(fmt.Sprintf("mkdir %d.lock || exit 1; ls -d *.lock | wc -l >> count; sleep 0.05; rmdir %d.lock; echo %d", i, i, i)))
+	}
+	output, err := pipe.Output(pipe.Script(pipe.ChDir(dir), pipe.Parallel(2, p...)))
 	c.Assert(err, IsNil)
-	c.Assert(string(stdout), Equals, "out1\nout2\n")
-	c.Assert(string(stderr), Equals, "err1\nerr2\n")
+	lines := strings.Fields(string(output))
+	sort.Strings(lines)
+	c.Assert(lines, DeepEquals, []string{"0", "1", "2", "3", "4", "5"})
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "count"))
+	c.Assert(err, IsNil)
+	for _, count := range strings.Fields(string(data)) {
+		c.Assert(count == "1" || count == "2", Equals, true, Commentf("running: %s", count))
+	}
 }
 
-func (S) TestLine(c *C) {
+func (S) TestParallelErrors(c *C) {
+	output, err := pipe.Output(pipe.Parallel(0,
+		pipe.Exec("sh", "-c", "exit 3"),
+		pipe.System("sleep 0.05; echo ok"),
+		pipe.Exec("sh", "-c", "exit 4"),
+	))
+	c.Assert(err, ErrorMatches, `command "sh" \["-c" "exit 3"\]: exit status 3; command "sh" \["-c" "exit 4"\]: exit status 4`)
+	c.Assert(string(output), Equals, "ok\n")
+}
+
+func (S) TestIf(c *C) {
+	isSet := func(s *pipe.State) bool {
+		for _, kv := range s.Env {
+			if strings.HasPrefix(kv, "FLAG=") {
+				return true
+			}
+		}
+		return false
+	}
+	p := pipe.Script(
+		pipe.If(isSet, pipe.Println("set"), pipe.Println("unset")),
+		pipe.SetEnvVar("FLAG", "1"),
+		pipe.If(isSet, pipe.Println("set"), pipe.Println("unset")),
+		pipe.If(isSet, pipe.Exec("sh", "-c", "echo $FLAG"), nil),
+		pipe.Unless(isSet, pipe.Println("unexpected")),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "unset\nset\n1\n")
+
+	err = pipe.Run(pipe.If(isSet, nil, pipe.Exec("false")))
+	c.Assert(err, ErrorMatches, `command "false": exit status 1`)
+}
+
+func (S) TestIfExists(c *C) {
+	dir := c.MkDir()
+	p := pipe.Script(
+		pipe.ChDir(dir),
+		pipe.IfExists("file", pipe.Println("before")),
+		pipe.Exec("touch", "file"),
+		pipe.IfExists("file", pipe.Println("after")),
+		pipe.IfExists(".", pipe.Println("dir")),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "after\ndir\n")
+}
+
+func (S) TestAndOr(c *C) {
+	output, err := pipe.Output(pipe.And(pipe.Println("a"), pipe.Exec("false"), pipe.Println("b")))
+	c.Assert(err, ErrorMatches, `command "false": exit status 1`)
+	c.Assert(string(output), Equals, "a\n")
+
+	output, err = pipe.Output(pipe.Or(pipe.Exec("false"), pipe.Println("a"), pipe.Println("b")))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "a\n")
+
+	output, err = pipe.Output(pipe.Or(pipe.Exec("false"), pipe.Exec("sh", "-c", "exit 3")))
+	c.Assert(err, ErrorMatches, `command "sh" \["-c" "exit 3"\]: exit status 3`)
+
+	output, err = pipe.Output(pipe.Or(
+		pipe.And(pipe.Println("build"), pipe.Exec("false"), pipe.Println("install")),
+		pipe.Println("failed"),
+	))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "build\nfailed\n")
+
+	output, err = pipe.Output(pipe.Line(
+		pipe.Println("input"),
+		pipe.And(pipe.Exec("cat"), pipe.Println("done")),
+	))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "input\ndone\n")
+}
+
+func (S) TestOrKill(c *C) {
+	started := time.Now()
+	err := pipe.RunTimeout(pipe.Or(pipe.Exec("sleep", "10"), pipe.Exec("sleep", "10")), 50*time.Millisecond)
+	c.Assert(err, ErrorMatches, "timeout")
+	c.Assert(time.Since(started) < 5*time.Second, Equals, true)
+}
+
+type recordingExecutor struct {
+	specs []pipe.CommandSpec
+}
+
+func (e *recordingExecutor) Start(spec pipe.CommandSpec, streams pipe.Streams) (pipe.Process, error) {
+	e.specs = append(e.specs, spec)
+	return pipe.LocalExecutor{}.Start(spec, streams)
+}
+
+func (S) TestWithExecutor(c *C) {
+	e := &recordingExecutor{}
+	output, err := pipe.Output(pipe.Script(
+		pipe.WithExecutor(e, pipe.Exec("echo", "one"), pipe.System("echo two")),
+		pipe.Exec("echo", "three"),
+	))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "one\ntwo\nthree\n")
+	c.Assert(e.specs, HasLen, 2)
+	c.Assert(e.specs[0].Name, Equals, "echo")
+	c.Assert(e.specs[0].Args, DeepEquals, []string{"one"})
+	c.Assert(e.specs[1].Name, Equals, "/bin/sh")
+}
+
+func (S) TestDockerExecutor(c *C) {
+	dir := c.MkDir()
+	docker := filepath.Join(dir, "docker")
+	err := ioutil.WriteFile(docker, []byte("#!/bin/sh\nfor arg; do echo \"$arg\"; done; echo \"MODE=$MODE\"; cat\n"), 0755)
+	c.Assert(err, IsNil)
+
+	output := &pipe.OutputBuffer{}
+	s := pipe.NewState(output, nil)
+	s.Executor = &pipe.DockerExecutor{Container: "web", Command: docker, Dir: "/srv"}
 	p := pipe.Line(
-		pipe.Exec("/bin/sh", "-c", "echo out1; echo err1 1>&2; echo out2; echo err2 1>&2"),
-		pipe.Exec("sed", `s/\(...\)\([12]\)/\1-\2/`),
+		pipe.Print("input\n"),
+		pipe.Script(
+			pipe.ChDir("/app"),
+			pipe.SetEnvVar("MODE", "test"),
+			pipe.Exec("make", "check"),
+		),
 	)
-	output, err := pipe.CombinedOutput(p)
+	c.Assert(p(s), IsNil)
+	c.Assert(s.RunTasks(), IsNil)
+	c.Assert(string(output.Bytes()), Equals, "exec\n-i\n-w\n/srv\n-e\nMODE\nweb\nmake\ncheck\nMODE=test\ninput\n")
+}
+
+func (S) TestDockerExec(c *C) {
+	dir := c.MkDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "docker"), []byte("#!/bin/sh\necho \"$@\"\n"), 0755)
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "err1\nerr2\nout-1\nout-2\n")
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", dir+":"+path)
+
+	output, err := pipe.Output(pipe.Script(
+		pipe.DockerExec("db", "pg_dump", "app"),
+		pipe.Exec("echo", "local"),
+	))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "exec -i db pg_dump app\nlocal\n")
 }
 
-func (S) TestLineTermination(c *C) {
-	// Shouldn't block waiting for a reader that won't read.
-	var b []byte
-	for i := 0; i < 256*1024/8; i++ {
-		b = append(b, "xxxxxxxx"...)
+type recordingObserver struct {
+	m           sync.Mutex
+	events      []string
+	transferred int
+}
+
+func (o *recordingObserver) TaskStarted(t *pipe.ObservedTask) {
+	o.m.Lock()
+	if t.Parent != nil {
+		o.events = append(o.events, "started "+t.Task+" within "+t.Parent.Task)
+	} else {
+		o.events = append(o.events, "started "+t.Task)
 	}
-	p := pipe.Line(
-		pipe.Print(string(b)),
+	o.m.Unlock()
+}
+
+func (o *recordingObserver) TaskTransferred(t *pipe.ObservedTask, read, written int) {
+	o.m.Lock()
+	o.transferred += read + written
+	o.m.Unlock()
+}
+
+func (o *recordingObserver) TaskEnded(t *pipe.ObservedTask, err error) {
+	o.m.Lock()
+	o.events = append(o.events, fmt.Sprintf("ended %s %q %q in %q: read %d, wrote %d, err %v", t.Task, t.Name, t.Args, t.Dir, t.BytesRead, t.BytesWritten, err))
+	o.m.Unlock()
+}
+
+func (S) TestObserver(c *C) {
+	o := &recordingObserver{}
+	s := pipe.NewState(nil, nil)
+	s.AddObserver(o)
+	p := pipe.Script(
+		pipe.ChDir("/"),
+		pipe.Line(
+			pipe.Exec("echo", "hello"),
+			pipe.Exec("tr", "a-z", "A-Z"),
+		),
+		pipe.Exec("false"),
+	)
+	c.Assert(p(s), IsNil)
+	c.Assert(s.RunTasks(), ErrorMatches, `script\[2\]: command "false" in "/": exit status 1`)
+
+	sort.Strings(o.events)
+	c.Assert(o.events, DeepEquals, []string{
+		`ended command "echo" ["hello"] "echo" ["hello"] in "/": read 0, wrote 6, err <nil>`,
+		`ended command "false" [] "false" [] in "/": read 0, wrote 0, err command "false" in "/": exit status 1`,
+		`ended command "tr" ["a-z" "A-Z"] "tr" ["a-z" "A-Z"] in "/": read 6, wrote 6, err <nil>`,
+		`started command "echo" ["hello"]`,
+		`started command "false" []`,
+		`started command "tr" ["a-z" "A-Z"]`,
+	})
+	c.Assert(o.transferred, Equals, 18)
+}
+
+func (S) TestObserve(c *C) {
+	o := &recordingObserver{}
+	p := pipe.Script(
+		pipe.Observe(o, pipe.Timeout(pipe.Exec("echo", "hello"), time.Minute)),
 		pipe.Exec("true"),
 	)
-	output, err := pipe.Output(p)
-	c.Assert(err, ErrorMatches, `command "true": write \|1: broken pipe`)
-	c.Assert(string(output), Equals, "")
+	c.Assert(pipe.Run(p), IsNil)
+
+	sort.Strings(o.events)
+	c.Assert(o.events, DeepEquals, []string{
+		`ended command "echo" ["hello"] "echo" ["hello"] in "": read 0, wrote 6, err <nil>`,
+		`ended task *pipe.subTask "" [] in "": read 0, wrote 6, err <nil>`,
+		`started command "echo" ["hello"] within task *pipe.subTask`,
+		`started task *pipe.subTask`,
+	})
 }
 
-func (S) TestScriptOutput(c *C) {
+func (S) TestCommandPolicy(c *C) {
+	var specs []pipe.CommandSpec
+	s := pipe.NewState(nil, nil)
+	s.Dir = "/"
+	s.CommandPolicy = func(spec pipe.CommandSpec) error {
+		specs = append(specs, spec)
+		if spec.Name == "rm" {
+			return fmt.Errorf("rm is forbidden")
+		}
+		return nil
+	}
 	p := pipe.Script(
-		pipe.System("echo out1; echo err1 1>&2; echo out2; echo err2 1>&2"),
-		pipe.System("echo out3; echo err3 1>&2; echo out4; echo err4 1>&2"),
+		pipe.Exec("true"),
+		pipe.Exec("rm", "-rf", "/"),
+	)
+	c.Assert(p(s), IsNil)
+	c.Assert(s.RunTasks(), ErrorMatches, `script\[1\]: command "rm" \["-rf" "/"\] in "/": rm is forbidden`)
+	c.Assert(specs, HasLen, 2)
+	c.Assert(specs[0].Name, Equals, "true")
+	c.Assert(specs[1].Args, DeepEquals, []string{"-rf", "/"})
+	c.Assert(specs[1].Dir, Equals, "/")
+	c.Assert(specs[1].Env, DeepEquals, s.Env)
+}
+
+func (S) TestExecHooks(c *C) {
+	var b bytes.Buffer
+	var ran []string
+	var errs []error
+	s := pipe.NewState(&b, nil)
+	s.BeforeExec = func(spec *pipe.CommandSpec) error {
+		if spec.Name == "forbidden" {
+			return fmt.Errorf("forbidden")
+		}
+		spec.Args = append([]string{"prefix", spec.Name}, spec.Args...)
+		spec.Name = "echo"
+		return nil
+	}
+	s.AfterExec = func(spec pipe.CommandSpec, err error, duration time.Duration) {
+		ran = append(ran, strings.Join(spec.Args, " "))
+		errs = append(errs, err)
+	}
+	p := pipe.Script(
+		pipe.Exec("true", "a"),
+		pipe.Exec("false", "b"),
+		pipe.Exec("forbidden"),
+	)
+	c.Assert(p(s), IsNil)
+	c.Assert(s.RunTasks(), ErrorMatches, `script\[2\]: command "forbidden": forbidden`)
+	c.Assert(b.String(), Equals, "prefix true a\nprefix false b\n")
+	c.Assert(ran, DeepEquals, []string{"prefix true a", "prefix false b"})
+	c.Assert(errs, DeepEquals, []error{nil, nil})
+}
+
+func (S) TestAllowCommands(c *C) {
+	s := pipe.NewState(nil, nil)
+	s.CommandPolicy = pipe.AllowCommands("true", "echo")
+	p := pipe.Script(
+		pipe.Exec("true"),
+		pipe.System("echo pwned"),
+	)
+	c.Assert(p(s), IsNil)
+	c.Assert(s.RunTasks(), ErrorMatches, `script\[1\]: command "/bin/sh" \["-c" "echo pwned"\]: command not allowed`)
+
+	s = pipe.NewState(nil, nil)
+	s.CommandPolicy = pipe.AllowCommands("true")
+	c.Assert(pipe.SourceScript("true")(s), ErrorMatches, `command "/bin/sh" .*: command not allowed`)
+}
+
+func (S) TestStateKill(c *C) {
+	started := time.Now()
+	p := pipe.Exec("sleep", "1")
+	s := pipe.NewState(nil, nil)
+	c.Assert(p(s), IsNil)
+	ch := make(chan error)
+	go func() {
+		ch <- s.RunTasks()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	s.Kill()
+	c.Assert(<-ch, ErrorMatches, "explicitly killed")
+	c.Assert(time.Since(started) < 2*time.Second, Equals, true)
+}
+
+func (S) TestStallDetection(c *C) {
+	reports := make(chan *pipe.StallReport, 10)
+	s := pipe.NewState(nil, nil)
+	s.StallTimeout = 100 * time.Millisecond
+	s.StallHandler = func(r *pipe.StallReport) { reports <- r }
+	p := pipe.Line(
+		pipe.Print("hello\n"),
+		pipe.System("read line; echo $line; sleep 0.5"),
+		pipe.Discard(),
+	)
+	c.Assert(p(s), IsNil)
+	c.Assert(s.RunTasks(), IsNil)
+	c.Assert(reports, HasLen, 1)
+
+	r := <-reports
+	c.Assert(r.Idle >= 100*time.Millisecond, Equals, true)
+	c.Assert(r.Tasks, HasLen, 2)
+	c.Assert(r.Tasks[0].Task, Equals, `command "/bin/sh" ["-c" "read line; echo $line; sleep 0.5"]`)
+	c.Assert(r.Tasks[0].PID > 0, Equals, true)
+	c.Assert(r.Tasks[0].Blocked, Equals, "")
+	c.Assert(r.Tasks[1].Task, Matches, "task .*")
+	c.Assert(r.Tasks[1].PID, Equals, 0)
+	c.Assert(r.Tasks[1].Blocked, Equals, "stdin")
+	c.Assert(r.String(), Matches, `(?s)pipe stalled for .* with 2 running tasks:\n  command "/bin/sh" .* \(pid [0-9]+\)\n  task .* blocked on stdin\n`)
+}
+
+func (S) TestSystem(c *C) {
+	p := pipe.System("echo out1; echo err1 1>&2; echo out2; echo err2 1>&2")
+	stdout, stderr, err := pipe.DividedOutput(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(stdout), Equals, "out1\nout2\n")
+	c.Assert(string(stderr), Equals, "err1\nerr2\n")
+}
+
+func (S) TestLine(c *C) {
+	p := pipe.Line(
+		pipe.Exec("/bin/sh", "-c", "echo out1; echo err1 1>&2; echo out2; echo err2 1>&2"),
+		pipe.Exec("sed", `s/\(...\)\([12]\)/\1-\2/`),
+	)
+	output, err := pipe.CombinedOutput(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "err1\nerr2\nout-1\nout-2\n")
+}
+
+func (S) TestLineTermination(c *C) {
+	// Shouldn't block waiting for a reader that won't read.
+	var b []byte
+	for i := 0; i < 256*1024/8; i++ {
+		b = append(b, "xxxxxxxx"...)
+	}
+	p := pipe.Line(
+		pipe.Print(string(b)),
+		pipe.Exec("true"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, ErrorMatches, `command "true": write \|1: broken pipe`)
+	c.Assert(string(output), Equals, "")
+}
+
+func (S) TestIgnoreBrokenPipe(c *C) {
+	p := pipe.Line(
+		pipe.IgnoreBrokenPipe(pipe.Print(strings.Repeat("x", 256*1024))),
+		pipe.Exec("true"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "")
+
+	p = pipe.IgnoreBrokenPipe(pipe.Line(
+		pipe.Exec("yes"),
+		pipe.Exec("head", "-n", "3"),
+	))
+	output, err = pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "y\ny\ny\n")
+}
+
+func (S) TestIgnoreBrokenPipeOtherErrors(c *C) {
+	p := pipe.IgnoreBrokenPipe(pipe.Line(
+		pipe.Print("hello"),
+		pipe.System("cat; exit 1"),
+	))
+	output, err := pipe.Output(p)
+	c.Assert(err, ErrorMatches, `line\[1\]: command "/bin/sh" \["-c" "cat; exit 1"\]: exit status 1`)
+	c.Assert(string(output), Equals, "hello")
+}
+
+func (S) TestNoPipefail(c *C) {
+	p := pipe.NoPipefail(pipe.Line(
+		pipe.System("echo hello; exit 3"),
+		pipe.Exec("sed", "s/l/k/g"),
+	))
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "hekko\n")
+
+	p = pipe.NoPipefail(pipe.Line(
+		pipe.System("echo hello; exit 3"),
+		pipe.System("cat; exit 1"),
+	))
+	output, err = pipe.Output(p)
+	c.Assert(err, ErrorMatches, `line\[0\]: command "/bin/sh" \["-c" "echo hello; exit 3"\]: exit status 3; line\[1\]: command "/bin/sh" \["-c" "cat; exit 1"\]: exit status 1`)
+	c.Assert(string(output), Equals, "hello\n")
+}
+
+func (S) TestNoPipefailState(c *C) {
+	s := pipe.NewState(nil, nil)
+	s.NoPipefail = true
+	p := pipe.Line(
+		pipe.TaskFunc(func(*pipe.State) error { return fmt.Errorf("boom") }),
+		pipe.Print("hello"),
+	)
+	c.Assert(p(s), IsNil)
+	c.Assert(s.RunTasks(), IsNil)
+
+	s.NoPipefail = false
+	c.Assert(p(s), IsNil)
+	c.Assert(s.RunTasks(), ErrorMatches, "line\\[0\\]: boom")
+}
+
+func (S) TestScriptOutput(c *C) {
+	p := pipe.Script(
+		pipe.System("echo out1; echo err1 1>&2; echo out2; echo err2 1>&2"),
+		pipe.System("echo out3; echo err3 1>&2; echo out4; echo err4 1>&2"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "out1\nout2\nout3\nout4\n")
+
+}
+
+func (S) TestScriptCombinedOutput(c *C) {
+	p := pipe.Script(
+		pipe.System("echo out1; echo err1 1>&2; echo out2; echo err2 1>&2"),
+		pipe.System("echo out3; echo err3 1>&2; echo out4; echo err4 1>&2"),
+	)
+	output, err := pipe.CombinedOutput(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "out1\nerr1\nout2\nerr2\nout3\nerr3\nout4\nerr4\n")
+}
+
+func (S) TestErrorHandling(c *C) {
+	sync := make(chan bool)
+	p := pipe.Script(
+		pipe.Line(
+			pipe.TaskFunc(func(*pipe.State) error {
+				sync <- true
+				return fmt.Errorf("err1")
+			}),
+			pipe.TaskFunc(func(*pipe.State) error {
+				<-sync
+				return fmt.Errorf("err2")
+			}),
+		),
+		pipe.Print("never happened"),
+	)
+	output, err := pipe.Output(p)
+	if err.Error() != "line[0]: err1; line[1]: err2" && err.Error() != "line[1]: err2; line[0]: err1" {
+		c.Fatalf(`want "line[0]: err1; line[1]: err2" or "line[1]: err2; line[0]: err1"; got %q`, err.Error())
+	}
+	c.Assert(string(output), Equals, "")
+}
+
+func (S) TestPanicRecovery(c *C) {
+	started := time.Now()
+	p := pipe.Script(
+		pipe.Line(
+			pipe.Exec("sleep", "1"),
+			pipe.Print("a\n"),
+			pipe.Filter(func(line []byte) bool { panic("boom") }),
+		),
+		pipe.Print("never happened"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, ErrorMatches, "line\\[2\\]: panic: boom")
+	c.Assert(string(output), Equals, "")
+	c.Assert(time.Since(started) < time.Second, Equals, true)
+
+	var perr *pipe.PanicError
+	c.Assert(errors.As(err, &perr), Equals, true)
+	c.Assert(perr.Value, Equals, "boom")
+	c.Assert(strings.Contains(string(perr.Stack), "pipe_test.go"), Equals, true)
+}
+
+func (S) TestPanicRecoveryAssembly(c *C) {
+	p := pipe.Script(
+		pipe.Exec("true"),
+		func(s *pipe.State) error { panic("boom") },
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, ErrorMatches, "panic: boom")
+	c.Assert(string(output), Equals, "")
+
+	perr, ok := err.(*pipe.PanicError)
+	c.Assert(ok, Equals, true)
+	c.Assert(perr.Value, Equals, "boom")
+	c.Assert(strings.Contains(string(perr.Stack), "pipe_test.go"), Equals, true)
+
+	_, err = pipe.Start(p)
+	c.Assert(err, ErrorMatches, "panic: boom")
+}
+
+func (S) TestSetEnvVar(c *C) {
+	os.Setenv("PIPE_NEW_VAR", "")
+	os.Setenv("PIPE_OLD_VAR", "old")
+	defer os.Setenv("PIPE_OLD_VAR", "")
+	p := pipe.Script(
+		pipe.SetEnvVar("PIPE_NEW_VAR", "new"),
+		pipe.System("echo $PIPE_OLD_VAR $PIPE_NEW_VAR"),
+		pipe.SetEnvVar("PIPE_NEW_VAR", "after"),
+		func(s *pipe.State) error {
+			count := 0
+			prefix := "PIPE_NEW_VAR="
+			for _, kv := range s.Env {
+				if strings.HasPrefix(kv, prefix) {
+					count++
+				}
+			}
+			if count != 1 {
+				return fmt.Errorf("found %d environment variables", count)
+			}
+			return nil
+		},
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "old new\n")
+	c.Assert(os.Getenv("PIPE_NEW_VAR"), Equals, "")
+}
+
+func (S) TestWithEnv(c *C) {
+	p := pipe.Script(
+		pipe.SetEnvVar("PIPE_VAR1", "outer1"),
+		pipe.SetEnvVar("PIPE_VAR2", "outer2"),
+		pipe.WithEnv(map[string]string{"PIPE_VAR1": "inner1", "PIPE_VAR3": "inner3"},
+			pipe.System("echo $PIPE_VAR1 $PIPE_VAR2 $PIPE_VAR3"),
+			pipe.SetEnvVar("PIPE_VAR2", "changed"),
+		),
+		pipe.System("echo $PIPE_VAR1 $PIPE_VAR2 $PIPE_VAR3"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "inner1 outer2 inner3\nouter1 outer2\n")
+}
+
+func (S) TestSourceScript(c *C) {
+	p := pipe.Script(
+		pipe.SetEnvVar("PIPE_OLD_VAR", "old"),
+		pipe.SetEnvVar("PIPE_GONE_VAR", "gone"),
+		pipe.SourceScript("echo ignored; export PIPE_NEW_VAR='new\nline'; PIPE_OLD_VAR=changed; unset PIPE_GONE_VAR"),
+		pipe.System(`echo "$PIPE_OLD_VAR $PIPE_NEW_VAR ${PIPE_GONE_VAR-unset}"`),
+		pipe.EnvSet("PIPE_GONE_VAR"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, ErrorMatches, "script\\[4\\]: environment variable PIPE_GONE_VAR is not set")
+	c.Assert(string(output), Equals, "changed new\nline unset\n")
+}
+
+func (S) TestSourceScriptError(c *C) {
+	p := pipe.SourceScript("echo oops 1>&2; false")
+	err := pipe.Run(p)
+	c.Assert(err, ErrorMatches, `command "/bin/sh" \["-c" ".*"\]: exit status 1: oops`)
+}
+
+func (S) TestSourceScriptExit(c *C) {
+	s := pipe.NewState(nil, nil)
+	s.SetEnvVar("PIPE_VAR", "kept")
+	err := pipe.SourceScript("PIPE_VAR=changed; export PIPE_VAR; exit 0")(s)
+	c.Assert(err, ErrorMatches, `command "/bin/sh" .*: script exited before its environment was read`)
+	c.Assert(s.EnvVar("PIPE_VAR"), Equals, "kept")
+	c.Assert(s.EnvVar("PATH"), Not(Equals), "")
+}
+
+func (S) TestSourceScriptSharedEnv(c *C) {
+	env := []string{"PIPE_VAR=shared", "PIPE_GONE_VAR=gone", "PATH=" + os.Getenv("PATH")}
+	s := pipe.NewState(nil, nil)
+	s.Env = env
+	c.Assert(pipe.SourceScript("unset PIPE_GONE_VAR; PIPE_VAR=changed")(s), IsNil)
+	c.Assert(s.EnvVar("PIPE_VAR"), Equals, "changed")
+	c.Assert(env, DeepEquals, []string{"PIPE_VAR=shared", "PIPE_GONE_VAR=gone", "PATH=" + os.Getenv("PATH")})
+}
+
+func (S) TestSourceScriptQuoting(c *C) {
+	value := "a b\nc$d\"e'f\\g\x01h\ti`j"
+	shells := []string{"/bin/sh"}
+	if _, err := exec.LookPath("bash"); err == nil {
+		shells = append(shells, "bash")
+	}
+	for _, shell := range shells {
+		s := pipe.NewState(nil, nil)
+		s.SetEnvVar("PIPE_SRC_VAR", value)
+		s.BeforeExec = func(spec *pipe.CommandSpec) error {
+			if shell == "bash" {
+				spec.Name = "bash"
+				spec.Args = append([]string{"--posix"}, spec.Args...)
+			}
+			return nil
+		}
+		err := pipe.SourceScript("PIPE_VAR=$PIPE_SRC_VAR; export PIPE_VAR; export PIPE_UNSET_VAR")(s)
+		c.Assert(err, IsNil, Commentf("shell %s", shell))
+		c.Assert(s.EnvVar("PIPE_VAR"), Equals, value, Commentf("shell %s", shell))
+		c.Assert(strings.Contains(strings.Join(s.Env, "\n"), "PIPE_UNSET_VAR"), Equals, false)
+	}
+}
+
+func (S) TestSourceScriptHooks(c *C) {
+	var ran []string
+	e := &recordingExecutor{}
+	s := pipe.NewState(nil, nil)
+	s.Executor = e
+	s.BeforeExec = func(spec *pipe.CommandSpec) error {
+		spec.Env = append(spec.Env, "PIPE_HOOK_VAR=hooked")
+		return nil
+	}
+	s.AfterExec = func(spec pipe.CommandSpec, err error, d time.Duration) {
+		ran = append(ran, spec.Name)
+	}
+	c.Assert(pipe.SourceScript("PIPE_VAR=$PIPE_HOOK_VAR; export PIPE_VAR")(s), IsNil)
+	c.Assert(s.EnvVar("PIPE_VAR"), Equals, "hooked")
+	c.Assert(e.specs, HasLen, 1)
+	c.Assert(e.specs[0].Name, Equals, "/bin/sh")
+	c.Assert(ran, DeepEquals, []string{"/bin/sh"})
+
+	s.CommandPolicy = func(spec pipe.CommandSpec) error { return fmt.Errorf("denied") }
+	err := pipe.SourceScript("PIPE_VAR=changed")(s)
+	c.Assert(err, ErrorMatches, `command "/bin/sh" .*: denied`)
+	c.Assert(e.specs, HasLen, 1)
+}
+
+func (S) TestSourceFile(c *C) {
+	dir := c.MkDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "env.sh"), []byte("PIPE_VAR=sourced; export PIPE_VAR\n"), 0644)
+	c.Assert(err, IsNil)
+	p := pipe.Script(
+		pipe.ChDir(dir),
+		pipe.SourceFile("env.sh"),
+		pipe.System("echo $PIPE_VAR"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "sourced\n")
+}
+
+func (S) TestScriptIsolatesEnv(c *C) {
+	p := pipe.Script(
+		pipe.SetEnvVar("PIPE_VAR", "outer"),
+		pipe.Script(
+			pipe.SetEnvVar("PIPE_VAR", "inner"),
+		),
+		pipe.System("echo $PIPE_VAR"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "outer\n")
+}
+
+func (S) TestScriptIsolatesDir(c *C) {
+	dir1 := c.MkDir()
+	dir2 := c.MkDir()
+	p := pipe.Script(
+		pipe.ChDir(dir1),
+		pipe.Script(
+			pipe.ChDir(dir2),
+		),
+		pipe.System("echo $PWD"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, dir1+"\n")
+}
+
+func (S) TestLineIsolatesEnv(c *C) {
+	p := pipe.Line(
+		pipe.SetEnvVar("PIPE_VAR", "outer"),
+		pipe.Line(
+			pipe.SetEnvVar("PIPE_VAR", "inner"),
+		),
+		pipe.System("echo $PIPE_VAR"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "outer\n")
+}
+
+func (S) TestLineIsolatesDir(c *C) {
+	dir1 := c.MkDir()
+	dir2 := c.MkDir()
+	p := pipe.Line(
+		pipe.ChDir(dir1),
+		pipe.Line(
+			pipe.ChDir(dir2),
+		),
+		pipe.System("echo $PWD"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, dir1+"\n")
+}
+
+func (S) TestLineNesting(c *C) {
+	b := &bytes.Buffer{}
+	p := pipe.Line(
+		pipe.Print("hello"),
+		pipe.Line(
+			pipe.Filter(func(line []byte) bool { return true }),
+			pipe.Exec("sed", "s/l/k/g"),
+		),
+		pipe.Write(b),
+	)
+	err := pipe.Run(p)
+	c.Assert(err, IsNil)
+	c.Assert(b.String(), Equals, "hekko")
+}
+
+func (S) TestScriptNesting(c *C) {
+	b := &bytes.Buffer{}
+	p := pipe.Line(
+		pipe.Print("hello"),
+		pipe.Script(
+			pipe.Print("world"),
+			pipe.Exec("sed", "s/l/k/g"),
+		),
+		pipe.Write(b),
+	)
+	err := pipe.Run(p)
+	c.Assert(err, IsNil)
+	c.Assert(b.String(), Equals, "worldhekko")
+}
+
+func (S) TestScriptPreservesStreams(c *C) {
+	p := pipe.Script(
+		pipe.Line(
+			pipe.Print("hello\n"),
+			pipe.Discard(),
+		),
+		pipe.Exec("echo", "world"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "world\n")
+}
+
+func (S) TestSubshell(c *C) {
+	p := pipe.Line(
+		pipe.Subshell(
+			func(s *pipe.State) error {
+				s.Stderr = s.Stdout
+				return nil
+			},
+			pipe.System("echo err1 1>&2"),
+		),
+		pipe.System("cat; echo err2 1>&2"),
+	)
+	stdout, stderr, err := pipe.DividedOutput(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(stdout), Equals, "err1\n")
+	c.Assert(string(stderr), Equals, "err2\n")
+}
+
+func (S) TestSubshellRestoresOnError(c *C) {
+	dir := c.MkDir()
+	s := pipe.NewState(nil, nil)
+	stdin, stdout, stderr := s.Stdin, s.Stdout, s.Stderr
+	p := pipe.Subshell(
+		pipe.ChDir(dir),
+		pipe.SetEnvVar("PIPE_VAR", "inner"),
+		func(s *pipe.State) error {
+			s.Stdin = strings.NewReader("other")
+			s.Stdout = &bytes.Buffer{}
+			s.Stderr = &bytes.Buffer{}
+			return fmt.Errorf("boom")
+		},
+	)
+	c.Assert(p(s), ErrorMatches, "boom")
+	c.Assert(s.Dir, Equals, "")
+	c.Assert(s.EnvVar("PIPE_VAR"), Equals, "")
+	c.Assert(s.Stdin, Equals, stdin)
+	c.Assert(s.Stdout, Equals, stdout)
+	c.Assert(s.Stderr, Equals, stderr)
+}
+
+func (S) TestNot(c *C) {
+	p := pipe.Script(
+		pipe.Not(pipe.Exec("false")),
+		pipe.Print("hello"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "hello")
+
+	p = pipe.Script(
+		pipe.Not(pipe.Line(
+			pipe.Print("hello\n"),
+			pipe.Exec("cat"),
+		)),
+		pipe.Print("never happened"),
+	)
+	output, err = pipe.Output(p)
+	c.Assert(err, ErrorMatches, "script\\[0\\]: negated pipe succeeded")
+	c.Assert(string(output), Equals, "hello\n")
+
+	// Failures of pipes other than commands are inverted too.
+	c.Assert(pipe.Run(pipe.Not(pipe.ReadFile("/non-existent/file"))), IsNil)
+	c.Assert(pipe.Run(pipe.Not(pipe.FileExists("/non-existent/file"))), IsNil)
+	c.Assert(pipe.Run(pipe.Not(pipe.EnvSet("PIPE_UNSET_VAR"))), IsNil)
+	p = pipe.Not(pipe.Line(
+		pipe.Print("hello\n"),
+		pipe.MustMatch(regexp.MustCompile("TODO")),
+	))
+	c.Assert(pipe.Run(p), IsNil)
+	p = pipe.Not(pipe.Line(
+		pipe.Print("TODO\n"),
+		pipe.MustMatch(regexp.MustCompile("TODO")),
+	))
+	c.Assert(pipe.Run(p), ErrorMatches, "negated pipe succeeded")
+
+	// Errors preventing the pipe from running aren't inverted.
+	err = pipe.Run(pipe.Not(pipe.Exec("/non-existent/command")))
+	c.Assert(err, ErrorMatches, `.*/non-existent/command.*`)
+
+	err = pipe.Run(pipe.Not(pipe.TaskFunc(func(*pipe.State) error { panic("boom") })))
+	c.Assert(err, ErrorMatches, `panic: boom`)
+
+	s := pipe.NewState(nil, nil)
+	s.CommandPolicy = func(spec pipe.CommandSpec) error {
+		return fmt.Errorf("%s is forbidden", spec.Name)
+	}
+	c.Assert(pipe.Not(pipe.Exec("false"))(s), IsNil)
+	c.Assert(s.RunTasks(), ErrorMatches, `command "false": false is forbidden`)
+}
+
+func (S) TestNotTimeout(c *C) {
+	started := time.Now()
+	p := pipe.Not(pipe.Exec("sleep", "1"))
+	err := pipe.RunTimeout(p, 100*time.Millisecond)
+	c.Assert(err, ErrorMatches, "timeout")
+	c.Assert(time.Since(started) < time.Second, Equals, true)
+}
+
+func (S) TestNotify(c *C) {
+	var summary *pipe.Summary
+	notify := func(s *pipe.Summary) error {
+		summary = s
+		return nil
+	}
+	p := pipe.Notify(pipe.System("echo out; echo err 1>&2"), notify)
+	output, err := pipe.CombinedOutput(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "out\nerr\n")
+	c.Assert(summary.Success, Equals, true)
+	c.Assert(summary.Output, Equals, "out\nerr")
+	c.Assert(summary.Duration > 0, Equals, true)
+	c.Assert(summary.Error, IsNil)
+
+	p = pipe.Notify(pipe.System("echo failing 1>&2; exit 3"), notify)
+	err = pipe.Run(p)
+	c.Assert(err, ErrorMatches, `command "/bin/sh" .*: exit status 3: failing`)
+	c.Assert(summary.Success, Equals, false)
+	c.Assert(summary.Output, Equals, "failing")
+	c.Assert(summary.Error.Errors[0].ExitCode, Equals, 3)
+
+	p = pipe.Notify(pipe.Exec("true"), func(*pipe.Summary) error { return fmt.Errorf("cannot notify") })
+	c.Assert(pipe.Run(p), ErrorMatches, "cannot notify")
+}
+
+func (S) TestNotifyTimeout(c *C) {
+	var summary *pipe.Summary
+	p := pipe.Notify(pipe.Exec("sleep", "1"), func(s *pipe.Summary) error {
+		summary = s
+		return nil
+	})
+	err := pipe.RunTimeout(p, 100*time.Millisecond)
+	c.Assert(err, ErrorMatches, "timeout")
+	c.Assert(summary, NotNil)
+	c.Assert(summary.Success, Equals, false)
+}
+
+func (S) TestNotifyNotStarted(c *C) {
+	var summary *pipe.Summary
+	slow := func(s *pipe.State) error {
+		time.Sleep(200 * time.Millisecond)
+		return pipe.Exec("true")(s)
+	}
+	p := pipe.Notify(slow, func(s *pipe.Summary) error {
+		summary = s
+		return nil
+	})
+	err := pipe.RunTimeout(p, 50*time.Millisecond)
+	c.Assert(err, ErrorMatches, "timeout")
+	c.Assert(summary, NotNil)
+	c.Assert(summary.Success, Equals, false)
+	c.Assert(summary.Duration, Equals, time.Duration(0))
+}
+
+func (S) TestWebhook(c *C) {
+	var summary pipe.Summary
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Header.Get("Content-Type"), Equals, "application/json")
+		c.Check(json.NewDecoder(r.Body).Decode(&summary), IsNil)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	err := pipe.Run(pipe.Notify(pipe.System("echo hello; exit 1"), pipe.Webhook(server.URL)))
+	c.Assert(err, ErrorMatches, ".*exit status 1")
+	c.Assert(summary.Success, Equals, false)
+	c.Assert(summary.Output, Equals, "hello")
+	c.Assert(summary.Error.Errors[0].Command, Equals, "/bin/sh")
+
+	status = http.StatusInternalServerError
+	err = pipe.Run(pipe.Notify(pipe.Exec("true"), pipe.Webhook(server.URL)))
+	c.Assert(err, ErrorMatches, "cannot notify webhook .*: 500 Internal Server Error")
+}
+
+func (S) TestIfStale(c *C) {
+	dir := c.MkDir()
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"a", "b"} {
+		path := filepath.Join(dir, name)
+		c.Assert(ioutil.WriteFile(path, nil, 0644), IsNil)
+		c.Assert(os.Chtimes(path, old, old), IsNil)
+	}
+	build := pipe.IfStale("target", []string{"a", "b"}, pipe.Script(
+		pipe.Print("built\n"),
+		pipe.Line(pipe.Print("output"), pipe.WriteFile("target", 0644)),
+	))
+
+	// Missing target.
+	output, err := pipe.Output(pipe.Script(pipe.ChDir(dir), build))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "built\n")
+
+	// Fresh target.
+	output, err = pipe.Output(pipe.Script(pipe.ChDir(dir), build))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "")
+
+	// Source changed by a preceding entry.
+	p := pipe.Script(
+		pipe.ChDir(dir),
+		pipe.Exec("sleep", "0.01"),
+		pipe.Exec("touch", "b"),
+		build,
+	)
+	output, err = pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "built\n")
+
+	// Missing source.
+	p = pipe.Script(
+		pipe.ChDir(dir),
+		pipe.IfStale("target", []string{"missing"}, pipe.Print("built\n")),
+	)
+	_, err = pipe.Output(p)
+	c.Assert(err, ErrorMatches, "script\\[1\\]: stat .*missing: no such file or directory")
+}
+
+func (S) TestCached(c *C) {
+	dir := c.MkDir()
+	counter := filepath.Join(dir, "counter")
+	key := func(s *pipe.State) string { return "key-" + s.EnvVar("PIPE_KEY") }
+	cached := func(keyValue string) pipe.Pipe {
+		return pipe.Script(
+			pipe.SetEnvVar("PIPE_KEY", keyValue),
+			pipe.Cached(key, filepath.Join(dir, "cache"),
+				pipe.System("echo run >> "+counter+"; echo err 1>&2; sed s/^/$PIPE_KEY:/"),
+			),
+		)
+	}
+	run := func(p pipe.Pipe) string {
+		p = pipe.Line(pipe.Print("input\n"), p)
+		output, err := pipe.CombinedOutput(p)
+		c.Assert(err, IsNil)
+		// The relative order of stdout and stderr is not preserved.
+		lines := strings.SplitAfter(string(output), "\n")
+		sort.Strings(lines)
+		return strings.Join(lines, "")
+	}
+
+	c.Assert(run(cached("a")), Equals, "a:input\nerr\n")
+	c.Assert(run(cached("a")), Equals, "a:input\n")
+	c.Assert(run(cached("b")), Equals, "b:input\nerr\n")
+	data, err := ioutil.ReadFile(counter)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "run\nrun\n")
+
+	// Failures are not cached.
+	failing := pipe.Cached(key, filepath.Join(dir, "cache"), pipe.System("echo partial; exit 1"))
+	_, err = pipe.Output(pipe.Script(pipe.SetEnvVar("PIPE_KEY", "c"), failing))
+	c.Assert(err, ErrorMatches, ".*exit status 1")
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "cache"))
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 2)
+}
+
+func (S) TestCheckpoint(c *C) {
+	dir := c.MkDir()
+	checkpoint := filepath.Join(dir, "checkpoint")
+	fail := true
+	p := pipe.Script(
+		pipe.Checkpoint("one", pipe.Print("one\n")),
+		pipe.Checkpoint("two", pipe.Print("two\n")),
+		pipe.Checkpoint("three", pipe.Test(func(s *pipe.State) error {
+			if fail {
+				return fmt.Errorf("three failed")
+			}
+			return nil
+		})),
+		pipe.Checkpoint("four", pipe.Print("four\n")),
+	)
+	run := func() (string, error) {
+		var out bytes.Buffer
+		s := pipe.NewState(&out, nil)
+		s.CheckpointFile = checkpoint
+		err := p(s)
+		if err == nil {
+			err = s.RunTasks()
+		}
+		return out.String(), err
+	}
+
+	output, err := run()
+	c.Assert(err, ErrorMatches, "script\\[2\\]: three failed")
+	c.Assert(output, Equals, "one\ntwo\n")
+	data, err := ioutil.ReadFile(checkpoint)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "one\ntwo\n")
+
+	fail = false
+	output, err = run()
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "four\n")
+	_, err = os.Stat(checkpoint)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// A successful run removed the file, so all entries run again.
+	output, err = run()
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "one\ntwo\nfour\n")
+
+	// Without a checkpoint file all entries run.
+	data, err = pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "one\ntwo\nfour\n")
+
+	err = pipe.Run(pipe.Checkpoint("a\nb", pipe.Print("")))
+	c.Assert(err, ErrorMatches, `invalid checkpoint name: "a\\nb"`)
+}
+
+func (S) TestCheckpointChDir(c *C) {
+	dir := c.MkDir()
+	wd, err := os.Getwd()
+	c.Assert(err, IsNil)
+	wd, err = filepath.EvalSymlinks(wd)
+	c.Assert(err, IsNil)
+	checkpoint, err := filepath.Rel(wd, filepath.Join(dir, "checkpoint"))
+	c.Assert(err, IsNil)
+	c.Assert(os.Mkdir(filepath.Join(dir, "sub"), 0755), IsNil)
+	s := pipe.NewState(nil, nil)
+	s.CheckpointFile = checkpoint
+	p := pipe.Script(
+		pipe.Checkpoint("one", pipe.Print("one\n")),
+		pipe.ChDir(filepath.Join(dir, "sub")),
+		pipe.Checkpoint("two", pipe.Print("two\n")),
+		pipe.Checkpoint("three", pipe.Exec("false")),
+	)
+	c.Assert(p(s), IsNil)
+	c.Assert(s.RunTasks(), ErrorMatches, `script\[3\]: command "false" in ".*": exit status 1`)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "checkpoint"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "one\ntwo\n")
+}
+
+func (S) TestTransaction(c *C) {
+	dir := c.MkDir()
+	log := filepath.Join(dir, "log")
+	step := func(name string, fail bool) pipe.Step {
+		do := "echo do " + name + " >> " + log
+		if fail {
+			do += "; exit 1"
+		}
+		return pipe.Step{
+			Do:   pipe.System(do),
+			Undo: pipe.System("echo undo " + name + " >> " + log),
+		}
+	}
+	readLog := func() string {
+		data, err := ioutil.ReadFile(log)
+		c.Assert(err, IsNil)
+		os.Remove(log)
+		return string(data)
+	}
+
+	err := pipe.Run(pipe.Transaction(step("a", false), step("b", false)))
+	c.Assert(err, IsNil)
+	c.Assert(readLog(), Equals, "do a\ndo b\n")
+
+	err = pipe.Run(pipe.Transaction(step("a", false), pipe.Step{Do: pipe.Print("")}, step("c", false), step("d", true), step("e", false)))
+	c.Assert(err, ErrorMatches, ".*exit status 1")
+	c.Assert(readLog(), Equals, "do a\ndo c\ndo d\nundo c\nundo a\n")
+
+	failingUndo := pipe.Step{Do: pipe.Print(""), Undo: pipe.System("exit 2")}
+	err = pipe.Run(pipe.Transaction(failingUndo, step("b", true)))
+	c.Assert(err, ErrorMatches, `.*exit status 1.*; cannot roll back step 1: .*exit status 2.*`)
+	c.Assert(readLog(), Equals, "do b\n")
+}
+
+func (S) TestTransactionTimeout(c *C) {
+	dir := c.MkDir()
+	log := filepath.Join(dir, "log")
+	p := pipe.Transaction(
+		pipe.Step{Do: pipe.Print(""), Undo: pipe.System("echo undo >> " + log)},
+		pipe.Step{Do: pipe.Exec("sleep", "1"), Undo: pipe.System("echo undo sleep >> " + log)},
+	)
+	started := time.Now()
+	err := pipe.RunTimeout(p, 100*time.Millisecond)
+	c.Assert(err, ErrorMatches, "timeout")
+	c.Assert(time.Since(started) < time.Second, Equals, true)
+	data, err := ioutil.ReadFile(log)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "undo\n")
+}
+
+func (S) TestWatchAndRun(c *C) {
+	dir := c.MkDir()
+	watched := filepath.Join(dir, "watched")
+	c.Assert(os.Mkdir(watched, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(watched, "file"), []byte("1"), 0644), IsNil)
+
+	results := make(chan error, 10)
+	var out pipe.OutputBuffer
+	s := pipe.NewState(&out, nil)
+	p := pipe.WatchAndRun([]string{"watched"}, pipe.Script(
+		pipe.ReadFile("watched/file"),
+		pipe.Print("\n"),
+	), pipe.WatchOptions{
+		Interval: 10 * time.Millisecond,
+		Debounce: 20 * time.Millisecond,
+		OnRun:    func(err error) { results <- err },
+	})
+	c.Assert(pipe.ChDir(dir)(s), IsNil)
+	c.Assert(p(s), IsNil)
+	done := make(chan error)
+	go func() { done <- s.RunTasks() }()
+
+	c.Assert(<-results, IsNil)
+	c.Assert(string(out.Bytes()), Equals, "1\n")
+
+	c.Assert(ioutil.WriteFile(filepath.Join(watched, "file"), []byte("22"), 0644), IsNil)
+	c.Assert(<-results, IsNil)
+	c.Assert(string(out.Bytes()), Equals, "1\n22\n")
+
+	c.Assert(ioutil.WriteFile(filepath.Join(watched, "new"), nil, 0644), IsNil)
+	c.Assert(<-results, IsNil)
+	c.Assert(string(out.Bytes()), Equals, "1\n22\n22\n")
+
+	s.Kill()
+	c.Assert(<-done, ErrorMatches, "explicitly killed")
+	c.Assert(results, HasLen, 0)
+}
+
+func (S) TestWatchAndRunKillsRun(c *C) {
+	dir := c.MkDir()
+	file := filepath.Join(dir, "file")
+	c.Assert(ioutil.WriteFile(file, []byte("1"), 0644), IsNil)
+
+	var out pipe.OutputBuffer
+	s := pipe.NewState(&out, nil)
+	p := pipe.WatchAndRun([]string{file}, pipe.Script(pipe.Print("started\n"), pipe.Exec("sleep", "10")), pipe.WatchOptions{
+		Interval: 10 * time.Millisecond,
+		Debounce: 20 * time.Millisecond,
+	})
+	c.Assert(p(s), IsNil)
+	done := make(chan error)
+	go func() { done <- s.RunTasks() }()
+
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(ioutil.WriteFile(file, []byte("22"), 0644), IsNil)
+	for i := 0; i < 100 && string(out.Bytes()) != "started\nstarted\n"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(string(out.Bytes()), Equals, "started\nstarted\n")
+
+	started := time.Now()
+	s.Kill()
+	c.Assert(<-done, ErrorMatches, "explicitly killed")
+	c.Assert(time.Since(started) < time.Second, Equals, true)
+}
+
+func (S) TestSupervise(c *C) {
+	dir := c.MkDir()
+	counter := filepath.Join(dir, "counter")
+	// Fails on the first two runs and succeeds afterwards.
+	worker := pipe.System("echo run >> " + counter + "; test $(wc -l < " + counter + ") -gt 2")
+
+	var restarts []int
+	p := pipe.Supervise(worker, pipe.SupervisePolicy{
+		Backoff:   time.Millisecond,
+		OnRestart: func(n int, err error) { restarts = append(restarts, n) },
+	})
+	c.Assert(pipe.Run(p), IsNil)
+	c.Assert(restarts, DeepEquals, []int{1, 2})
+
+	// Restarts are exhausted.
+	os.Remove(counter)
+	restarts = nil
+	p = pipe.Supervise(worker, pipe.SupervisePolicy{
+		Backoff:     time.Millisecond,
+		MaxRestarts: 1,
+		OnRestart:   func(n int, err error) { restarts = append(restarts, n) },
+	})
+	c.Assert(pipe.Run(p), ErrorMatches, ".*exit status 1")
+	c.Assert(restarts, DeepEquals, []int{1})
+
+	// Successful runs are restarted too.
+	os.Remove(counter)
+	p = pipe.Supervise(pipe.System("echo run >> "+counter), pipe.SupervisePolicy{
+		RestartOn:   pipe.RestartAlways,
+		Backoff:     time.Millisecond,
+		MaxRestarts: 3,
+	})
+	c.Assert(pipe.Run(p), IsNil)
+	data, err := ioutil.ReadFile(counter)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "run\nrun\nrun\nrun\n")
+}
+
+func (S) TestSuperviseTimeout(c *C) {
+	p := pipe.Supervise(pipe.Exec("sleep", "1"), pipe.SupervisePolicy{RestartOn: pipe.RestartAlways})
+	started := time.Now()
+	c.Assert(pipe.RunTimeout(p, 100*time.Millisecond), ErrorMatches, "timeout")
+	c.Assert(time.Since(started) < time.Second, Equals, true)
+}
+
+func (S) TestDetach(c *C) {
+	dir := c.MkDir()
+	p := pipe.Script(
+		pipe.ChDir(dir),
+		pipe.Detach(pipe.System("echo started; sleep 0.3; echo done >&2"), "out", "err"),
+	)
+	started := time.Now()
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(time.Since(started) < 300*time.Millisecond, Equals, true)
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(output)))
+	c.Assert(err, IsNil)
+	pgid, err := processGroup(pid)
+	c.Assert(err, IsNil)
+	c.Assert(pgid, Equals, pid)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if data, _ := ioutil.ReadFile(filepath.Join(dir, "err")); len(data) > 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "out"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "started\n")
+	data, err = ioutil.ReadFile(filepath.Join(dir, "err"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "done\n")
+}
+
+func (S) TestPIDFile(c *C) {
+	dir := c.MkDir()
+	pidFile := filepath.Join(dir, "pid")
+	p := pipe.Script(
+		pipe.Print("ignored"),
+		pipe.WritePIDFile(pidFile, pipe.Exec("sleep", "10")),
+	)
+	done := make(chan error)
+	go func() { done <- pipe.Run(p) }()
+
+	var data []byte
+	for i := 0; i < 100 && len(data) == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+		data, _ = ioutil.ReadFile(pidFile)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	c.Assert(err, IsNil)
+	c.Assert(pid, Not(Equals), os.Getpid())
+
+	c.Assert(pipe.Run(pipe.KillFromPIDFile(pidFile, syscall.SIGTERM)), IsNil)
+	c.Assert(<-done, ErrorMatches, `script\[1\]: command "sleep" \["10"\]: signal: terminated`)
+
+	// The file is removed when the process terminates.
+	_, err = os.Stat(pidFile)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// Missing files are ignored.
+	c.Assert(pipe.Run(pipe.KillFromPIDFile(pidFile, syscall.SIGTERM)), IsNil)
+
+	// Stale files are removed.
+	err = ioutil.WriteFile(pidFile, []byte(strconv.Itoa(pid)+"\n"), 0644)
+	c.Assert(err, IsNil)
+	c.Assert(pipe.Run(pipe.KillFromPIDFile(pidFile, syscall.SIGTERM)), IsNil)
+	_, err = os.Stat(pidFile)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	err = ioutil.WriteFile(pidFile, []byte("bogus"), 0644)
+	c.Assert(err, IsNil)
+	c.Assert(pipe.Run(pipe.KillFromPIDFile(pidFile, syscall.SIGTERM)), ErrorMatches, `invalid PID file .*/pid: "bogus"`)
+
+	// Only a single command may have its PID recorded.
+	err = pipe.Run(pipe.WritePIDFile(pidFile, pipe.Print("hello")))
+	c.Assert(err, ErrorMatches, `cannot write PID file of task of type .*`)
+	err = pipe.Run(pipe.WritePIDFile(pidFile, pipe.Line(pipe.Exec("true"), pipe.Exec("true"))))
+	c.Assert(err, ErrorMatches, `cannot write PID file of pipe with 2 tasks`)
+}
+
+func (S) TestExclusive(c *C) {
+	lock := filepath.Join(c.MkDir(), "lock")
+	started := make(chan bool)
+	release := make(chan bool)
+	first := pipe.Exclusive(lock, pipe.TaskFunc(func(s *pipe.State) error {
+		close(started)
+		<-release
+		return nil
+	}))
+	done := make(chan error)
+	go func() { done <- pipe.Run(first) }()
+	<-started
+
+	second := pipe.Exclusive(lock, pipe.Print("hello"))
+	_, err := pipe.Output(second)
+	c.Assert(err, ErrorMatches, "already running")
+	c.Assert(err.(pipe.Errors)[0], Equals, pipe.ErrAlreadyRunning)
+
+	close(release)
+	c.Assert(<-done, IsNil)
+
+	output, err := pipe.Output(second)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "hello")
+}
+
+type upperWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (w *upperWriter) Write(data []byte) (int, error) {
+	w.buf = append(w.buf, bytes.ToUpper(data)...)
+	return len(data), nil
+}
+
+func (w *upperWriter) Flush() error {
+	_, err := w.w.Write(w.buf)
+	return err
+}
+
+func (S) TestWrapStreams(c *C) {
+	p := pipe.Script(
+		pipe.Print("before "),
+		pipe.WrapStdout(func(w io.Writer) io.Writer { return &upperWriter{w: w} }),
+		pipe.WrapStderr(func(w io.Writer) io.Writer { return &upperWriter{w: w} }),
+		pipe.Script(
+			pipe.Print("after "),
+			pipe.System("echo stderr >&2"),
+		),
+		pipe.WrapStdin(func(r io.Reader) io.Reader { return io.MultiReader(strings.NewReader("prefix "), r) }),
+		pipe.Line(
+			pipe.Print("line\n"),
+			pipe.Exec("cat"),
+		),
+	)
+	stdout, stderr, err := pipe.DividedOutput(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(stdout), Equals, "before AFTER LINE\n")
+	c.Assert(string(stderr), Equals, "STDERR\n")
+
+	// Only the outer streams of a line are wrapped.
+	wrapped := 0
+	var out bytes.Buffer
+	s := pipe.NewState(&out, nil)
+	s.Stdin = strings.NewReader("input\n")
+	s.WrapStdin(func(r io.Reader) io.Reader { return io.MultiReader(strings.NewReader("prefix "), r) })
+	s.WrapStdout(func(w io.Writer) io.Writer {
+		wrapped++
+		return w
+	})
+	c.Assert(pipe.Line(pipe.Exec("cat"), pipe.Exec("cat"))(s), IsNil)
+	c.Assert(s.RunTasks(), IsNil)
+	c.Assert(out.String(), Equals, "prefix input\n")
+	c.Assert(wrapped, Equals, 1)
+
+	// Wrappers are scoped to the enclosing script.
+	p = pipe.Script(
+		pipe.Script(
+			pipe.WrapStdout(func(w io.Writer) io.Writer { return &upperWriter{w: w} }),
+			pipe.Print("inner "),
+		),
+		pipe.Print("outer"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "INNER outer")
+}
+
+func (S) TestGroup(c *C) {
+	p := pipe.Group(
+		pipe.System("sleep 0.1; echo first"),
+		pipe.Line(pipe.Print("second\n"), pipe.Exec("cat")),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "second\nfirst\n")
+
+	started := time.Now()
+	p = pipe.Group(
+		pipe.Exec("sleep", "5"),
+		pipe.System("sleep 0.05; exit 3"),
+		pipe.Exec("sleep", "5"),
+	)
+	err = pipe.Run(p)
+	c.Assert(err, ErrorMatches, `command "/bin/sh" \["-c" "sleep 0.05; exit 3"\]: exit status 3`)
+	c.Assert(time.Since(started) < 2*time.Second, Equals, true)
+}
+
+func (S) TestGroupKill(c *C) {
+	started := time.Now()
+	p := pipe.Group(pipe.Exec("sleep", "5"), pipe.Exec("sleep", "5"))
+	c.Assert(pipe.RunTimeout(p, 100*time.Millisecond), ErrorMatches, "timeout")
+	c.Assert(time.Since(started) < 2*time.Second, Equals, true)
+}
+
+func (S) TestFileIOKill(c *C) {
+	path := filepath.Join(c.MkDir(), "file")
+	for _, p := range []pipe.Pipe{
+		pipe.WriteFile(path, 0644),
+		pipe.AppendFile(path, 0644),
+		pipe.TeeWriteFile(path, 0644),
+		pipe.Write(ioutil.Discard),
+		pipe.Tee(ioutil.Discard),
+	} {
+		r, w := io.Pipe()
+		var stdout bytes.Buffer
+		s := pipe.NewState(&stdout, nil)
+		s.Stdin = r
+		s.Timeout = 100 * time.Millisecond
+		c.Assert(p(s), IsNil)
+		started := time.Now()
+		c.Assert(s.RunTasks(), ErrorMatches, "timeout")
+		c.Assert(time.Since(started) < time.Second, Equals, true)
+
+		// The copy no longer reads its input, nor writes its output.
+		_, err := w.Write([]byte("late"))
+		c.Assert(err, Equals, io.ErrClosedPipe)
+		c.Assert(stdout.String(), Equals, "")
+	}
+
+	r, w := io.Pipe()
+	started := time.Now()
+	p := pipe.Line(pipe.Read(r), pipe.WriteFile(path, 0644))
+	c.Assert(pipe.RunTimeout(p, 100*time.Millisecond), ErrorMatches, "timeout")
+	c.Assert(time.Since(started) < time.Second, Equals, true)
+	_, err := w.Write([]byte("late"))
+	c.Assert(err, Equals, io.ErrClosedPipe)
+}
+
+func (S) TestWriteQuota(c *C) {
+	dir := c.MkDir()
+	run := func(p pipe.Pipe) error {
+		s := pipe.NewState(nil, nil)
+		s.Dir = dir
+		s.WriteQuota = 10
+		err := p(s)
+		if err == nil {
+			err = s.RunTasks()
+		}
+		return err
+	}
+
+	p := pipe.Script(
+		pipe.Line(pipe.Print("12345"), pipe.WriteFile("a", 0644)),
+		pipe.Line(pipe.Print("12345"), pipe.AppendFile("a", 0644)),
+	)
+	c.Assert(run(p), IsNil)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "a"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "1234512345")
+
+	// The quota is shared by all entries of the pipe.
+	p = pipe.Script(
+		pipe.Line(pipe.Print("12345"), pipe.WriteFile("b", 0644)),
+		pipe.Line(pipe.Print("123456"), pipe.TeeWriteFile("c", 0644)),
+	)
+	err = run(p)
+	c.Assert(err, ErrorMatches, "line\\[1\\]: write quota exceeded")
+	c.Assert(errors.Is(err, pipe.ErrQuotaExceeded), Equals, true)
+
+	p = pipe.Line(pipe.Print("1\n2\n3\n4\n5\n6\n"), pipe.SplitFile("part", 2, 0644))
+	c.Assert(run(p), ErrorMatches, "line\\[1\\]: write quota exceeded")
+
+	// Data not written to files is not accounted.
+	c.Assert(run(pipe.Line(pipe.Print("12345678901"), pipe.Exec("cat"))), IsNil)
+
+	// Temporary files and downloads are accounted as well.
+	p = pipe.Line(pipe.Print("12345678901"), pipe.Buffer(1, dir), pipe.Discard())
+	c.Assert(run(p), ErrorMatches, "line\\[1\\]: write quota exceeded")
+	key := func(s *pipe.State) string { return "key" }
+	p = pipe.Cached(key, "cache", pipe.Print("12345678901"))
+	c.Assert(run(p), ErrorMatches, "write quota exceeded")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("12345678901"))
+	}))
+	defer server.Close()
+	p = pipe.Download(server.URL, pipe.DownloadOptions{Path: "download"})
+	c.Assert(run(p), ErrorMatches, "write quota exceeded")
+
+	// Nested pipes share the quota.
+	p = pipe.Script(
+		pipe.Line(pipe.Print("12345"), pipe.WriteFile("d", 0644)),
+		pipe.Line(
+			pipe.Print("a\n"),
+			pipe.Comm(pipe.Script(
+				pipe.Line(pipe.Print("123456"), pipe.WriteFile("e", 0644)),
+				pipe.Print("a\n"),
+			), pipe.CommBoth),
+		),
+	)
+	c.Assert(run(p), ErrorMatches, ".*write quota exceeded")
+}
+
+func (S) TestBuffer(c *C) {
+	dir := c.MkDir()
+	data := strings.Repeat("0123456789", 100000)
+	produced := make(chan bool)
+	var spilled []string
+	p := pipe.Line(
+		pipe.Script(
+			pipe.Print(data),
+			pipe.TaskFunc(func(s *pipe.State) error {
+				close(produced)
+				return nil
+			}),
+		),
+		pipe.Buffer(1000, dir),
+		pipe.TaskFunc(func(s *pipe.State) error {
+			// The producer must not block on the consumer.
+			<-produced
+			spilled, _ = filepath.Glob(filepath.Join(dir, "*"))
+			_, err := io.Copy(s.Stdout, s.Stdin)
+			return err
+		}),
+	)
+	output, err := pipe.OutputTimeout(p, 10*time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(string(output) == data, Equals, true)
+	c.Assert(spilled, HasLen, 1)
+	left, _ := filepath.Glob(filepath.Join(dir, "*"))
+	c.Assert(left, HasLen, 0)
+
+	// Data fitting in memory is not spilled.
+	output, err = pipe.Output(pipe.Line(pipe.Print("hello"), pipe.Buffer(1000, dir)))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "hello")
+}
+
+func (S) TestStatsHandler(c *C) {
+	var report *pipe.StatsReport
+	s := pipe.NewState(nil, nil)
+	s.StatsHandler = func(r *pipe.StatsReport) { report = r }
+	data := strings.Repeat("x", 1<<20)
+	p := pipe.Line(
+		pipe.Print(data),
+		pipe.System("sleep 0.2; cat"),
+		pipe.Discard(),
+	)
+	c.Assert(p(s), IsNil)
+	c.Assert(s.RunTasks(), IsNil)
+
+	c.Assert(report.Tasks, HasLen, 3)
+	print, slow, discard := report.Tasks[0], report.Tasks[1], report.Tasks[2]
+	c.Assert(print.BytesWritten, Equals, int64(len(data)))
+	c.Assert(print.WriteBlocked >= 150*time.Millisecond, Equals, true, Commentf("%v", print.WriteBlocked))
+	c.Assert(slow.BytesRead, Equals, int64(len(data)))
+	c.Assert(slow.BytesWritten, Equals, int64(len(data)))
+	c.Assert(discard.ReadBlocked >= 150*time.Millisecond, Equals, true, Commentf("%v", discard.ReadBlocked))
+	c.Assert(report.Bottleneck(), Equals, slow)
+	c.Assert(slow.Task, Equals, `command "/bin/sh" ["-c" "sleep 0.2; cat"]`)
+	c.Assert(report.String(), Matches, `(?s)task pipe.taskFunc: ran .*, busy .*, blocked reading .* \(0 bytes\), blocked writing .* \(1048576 bytes\)\n.*`)
+}
+
+func (S) TestInstrumentedFileStdin(c *C) {
+	// Commands get files as their stdin directly, so one that doesn't
+	// read a never-ending stdin terminates even when instrumented.
+	r, w, err := os.Pipe()
+	c.Assert(err, IsNil)
+	defer r.Close()
+	defer w.Close()
+	var report *pipe.StatsReport
+	s := pipe.NewState(nil, nil)
+	s.Stdin = r
+	s.StatsHandler = func(r *pipe.StatsReport) { report = r }
+	s.StallTimeout = time.Minute
+	s.AddObserver(&recordingObserver{})
+	c.Assert(pipe.Exec("true")(s), IsNil)
+	done := make(chan error, 1)
+	go func() { done <- s.RunTasks() }()
+	select {
+	case err := <-done:
+		c.Assert(err, IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("command blocked on its instrumented stdin")
+	}
+	c.Assert(report.Tasks, HasLen, 1)
+}
+
+func (S) TestParallelReplace(c *C) {
+	var input bytes.Buffer
+	var want bytes.Buffer
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&input, "%d\n", i)
+		fmt.Fprintf(&want, "<%d>\n", i)
+	}
+	replace := func(line []byte) []byte {
+		// Later lines complete first.
+		n, _ := strconv.Atoi(strings.TrimSpace(string(line)))
+		time.Sleep(time.Duration(10-n%10) * time.Millisecond)
+		return []byte(fmt.Sprintf("<%d>\n", n))
+	}
+	p := pipe.Line(
+		pipe.Read(&input),
+		pipe.ParallelReplace(pipe.ParallelOptions{Workers: 8, Ordered: true}, replace),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, want.String())
+
+	p = pipe.Line(
+		pipe.Print("3\n1\n2\n"),
+		pipe.ParallelReplace(pipe.ParallelOptions{Workers: 3}, replace),
+	)
+	output, err = pipe.Output(p)
+	c.Assert(err, IsNil)
+	lines := strings.SplitAfter(string(output), "\n")
+	sort.Strings(lines)
+	c.Assert(strings.Join(lines, ""), Equals, "<1>\n<2>\n<3>\n")
+}
+
+func (S) TestXargs(c *C) {
+	p := pipe.Line(
+		pipe.Print("0.2\n\n0.1\n0\n"),
+		pipe.Xargs(pipe.ParallelOptions{Workers: 3, Ordered: true}, func(arg string) pipe.Pipe {
+			return pipe.System("sleep " + arg + "; echo " + arg + "; echo done")
+		}),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "0.2\ndone\n0.1\ndone\n0\ndone\n")
+
+	started := time.Now()
+	p = pipe.Line(
+		pipe.Print("5\nfail\n5\n"),
+		pipe.Xargs(pipe.ParallelOptions{Workers: 2}, func(arg string) pipe.Pipe {
+			if arg == "fail" {
+				return pipe.Exec("false")
+			}
+			return pipe.Exec("sleep", arg)
+		}),
+	)
+	_, err = pipe.Output(p)
+	c.Assert(err, ErrorMatches, `line\[1\]: command "false": exit status 1`)
+	c.Assert(time.Since(started) < 2*time.Second, Equals, true)
+}
+
+func (S) TestBroadcastStdin(c *C) {
+	p := pipe.Line(
+		pipe.Print("hello\nworld\n"),
+		pipe.BroadcastStdin(
+			pipe.Exec("wc", "-l"),
+			pipe.Exec("cat"),
+			pipe.Exec("sed", "s/o/0/g"),
+		),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(strings.TrimLeft(string(output), " "), Equals, "2\nhello\nworld\nhell0\nw0rld\n")
+
+	p = pipe.Line(
+		pipe.Print("hello\n"),
+		pipe.BroadcastStdin(pipe.Exec("false"), pipe.Exec("cat")),
+	)
+	output, err = pipe.Output(p)
+	c.Assert(err, ErrorMatches, `line\[1\]: script\[0\]: command "false": exit status 1`)
+	c.Assert(string(output), Equals, "")
+}
+
+func (S) TestSetStdin(c *C) {
+	path := filepath.Join(c.MkDir(), "file")
+	c.Assert(ioutil.WriteFile(path, []byte("file\n"), 0644), IsNil)
+
+	p := pipe.Line(
+		pipe.Print("line\n"),
+		pipe.Script(
+			pipe.Script(
+				pipe.SetStdin(strings.NewReader("inner\n")),
+				pipe.Exec("cat"),
+			),
+			pipe.Exec("cat"),
+			pipe.StdinFromFile(path),
+			pipe.Exec("cat"),
+			pipe.Exec("cat"),
+		),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "inner\nline\nfile\n")
+
+	p = pipe.Script(
+		pipe.StdinFromFile("missing"),
+		pipe.Exec("cat"),
+	)
+	_, err = pipe.Output(p)
+	c.Assert(err, ErrorMatches, ".*no such file or directory")
+}
+
+func (S) TestClearEnv(c *C) {
+	os.Setenv("PIPE_HOST_VAR", "secret")
+	defer os.Unsetenv("PIPE_HOST_VAR")
+	p := pipe.Script(
+		pipe.Script(
+			pipe.ClearEnv(),
+			pipe.SetEnvVar("PIPE_VAR", "value"),
+			pipe.Exec("/usr/bin/env"),
+		),
+		pipe.Script(
+			pipe.ClearEnv(),
+			pipe.Exec("/usr/bin/env"),
+		),
+		pipe.System("echo $PIPE_HOST_VAR"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "PIPE_VAR=value\nsecret\n")
+
+	// A nil environment is still inherited by LocalExecutor.
+	var stdout bytes.Buffer
+	spec := pipe.CommandSpec{Name: "/bin/sh", Args: []string{"-c", "echo $PIPE_HOST_VAR"}}
+	proc, err := pipe.LocalExecutor{}.Start(spec, pipe.Streams{Stdout: &stdout})
+	c.Assert(err, IsNil)
+	c.Assert(proc.Wait(), IsNil)
+	c.Assert(stdout.String(), Equals, "secret\n")
+}
+
+func (S) TestClearEnvSpec(c *C) {
+	os.Setenv("PIPE_HOST_VAR", "secret")
+	defer os.Unsetenv("PIPE_HOST_VAR")
+	p := pipe.Script(
+		pipe.Script(
+			pipe.ClearEnv(),
+			pipe.SetEnvVar("PIPE_VAR", "value"),
+			pipe.Exec("/usr/bin/env"),
+		),
+		pipe.Script(
+			pipe.KeepEnv("PIPE_HOST_VAR", "PIPE_OTHER_VAR"),
+			pipe.KeepEnv("PIPE_HOST_VAR"),
+			pipe.Exec("/usr/bin/env"),
+		),
+		pipe.Exec("true"),
+	)
+	data, err := pipe.ToSpec(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, `{"script":[`+
+		`{"script":[{"exec":"/usr/bin/env","env":{"PIPE_VAR":"value"},"clearenv":true}]},`+
+		`{"script":[{"exec":"/usr/bin/env","keepenv":["PIPE_HOST_VAR"]}]},`+
+		`{"exec":"true"}]}`)
+
+	p, err = pipe.FromSpec(data)
+	c.Assert(err, IsNil)
+	data2, err := pipe.ToSpec(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(data2), Equals, string(data))
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "PIPE_VAR=value\nPIPE_HOST_VAR=secret\n")
+}
+
+func (S) TestKeepEnv(c *C) {
+	s := pipe.NewState(nil, nil)
+	s.Env = []string{"A=1", "B=2", "C=3"}
+	c.Assert(pipe.KeepEnv("A", "C", "D")(s), IsNil)
+	c.Assert(s.Env, DeepEquals, []string{"A=1", "C=3"})
+}
+
+func (S) TestExecIn(c *C) {
+	dir := c.MkDir()
+	c.Assert(os.Mkdir(filepath.Join(dir, "sub"), 0755), IsNil)
+	p := pipe.Script(
+		pipe.ChDir(dir),
+		pipe.ExecIn("sub", "pwd"),
+		pipe.SystemIn("/", "pwd"),
+		pipe.Exec("pwd"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, filepath.Join(dir, "sub")+"\n/\n"+dir+"\n")
+
+	_, err = pipe.Output(pipe.ExecIn("/", "false"))
+	c.Assert(err, ErrorMatches, `command "false" in "/": exit status 1`)
+
+	data, err := pipe.ToSpec(pipe.Script(pipe.ChDir("/tmp"), pipe.ExecIn("sub", "make")))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, `{"script":[{"exec":"make","dir":"/tmp/sub"}]}`)
+}
+
+func (S) TestToSpec(c *C) {
+	p := pipe.Script(
+		pipe.ChDir("/tmp"),
+		pipe.Line(
+			pipe.SetEnvVar("PIPE_VAR", "value"),
+			pipe.Exec("echo", "hello"),
+			pipe.System("sed s/l/k/g"),
+		),
+		pipe.Exec("true"),
+	)
+	data, err := pipe.ToSpec(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, `{"script":[{"line":[`+
+		`{"exec":"echo","args":["hello"],"dir":"/tmp","env":{"PIPE_VAR":"value"}},`+
+		`{"exec":"/bin/sh","args":["-c","sed s/l/k/g"],"dir":"/tmp","env":{"PIPE_VAR":"value"}}]},`+
+		`{"exec":"true","dir":"/tmp"}]}`)
+
+	_, err = pipe.ToSpec(pipe.Line(pipe.Print("hello"), pipe.Exec("cat")))
+	c.Assert(err, ErrorMatches, "cannot describe pipe with task of type .*")
+
+	p, err = pipe.FromSpec([]byte(`{"exec": "true", "stdout": "output"}`))
+	c.Assert(err, IsNil)
+	_, err = pipe.ToSpec(p)
+	c.Assert(err, ErrorMatches, "cannot describe pipe with task of type .*")
+}
+
+func (S) TestFromSpec(c *C) {
+	dir := c.MkDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "input"), []byte("hello\n"), 0644)
+	c.Assert(err, IsNil)
+	p, err := pipe.FromSpec([]byte(`{"script": [
+		{"line": [{"exec": "cat"}, {"exec": "sed", "args": ["s/l/k/g"]}], "stdin": "input", "stdout": "output"},
+		{"exec": "/bin/sh", "args": ["-c", "echo $PIPE_VAR; cat output"], "env": {"PIPE_VAR": "value"}}
+	], "dir": "` + dir + `"}`))
+	c.Assert(err, IsNil)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "value\nhekko\n")
+}
+
+func (S) TestFromSpecRoundTrip(c *C) {
+	p := pipe.Line(
+		pipe.Exec("echo", "hello"),
+		pipe.WithDir("/tmp", pipe.Exec("sed", "s/l/k/g")),
+	)
+	data, err := pipe.ToSpec(p)
+	c.Assert(err, IsNil)
+	p, err = pipe.FromSpec(data)
+	c.Assert(err, IsNil)
+	data2, err := pipe.ToSpec(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(data2), Equals, string(data))
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "hekko\n")
+}
+
+func (S) TestFromSpecErrors(c *C) {
+	_, err := pipe.FromSpec([]byte(`{"exec": "true", "line": []}`))
+	c.Assert(err, ErrorMatches, "pipe specification must have exactly one of line, script, exec, or stage")
+	_, err = pipe.FromSpec([]byte(`{"script": [null]}`))
+	c.Assert(err, ErrorMatches, "pipe specification has a null entry")
+	_, err = pipe.FromSpec([]byte(`{"exec": 1}`))
+	c.Assert(err, ErrorMatches, "invalid pipe specification: .*")
+	_, err = pipe.FromSpec([]byte(`{"stage": "unknown"}`))
+	c.Assert(err, ErrorMatches, `unknown pipe stage "unknown"`)
+}
+
+func init() {
+	pipe.Register("test-prefix", func(args ...string) (pipe.Pipe, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("want 1 argument, got %d", len(args))
+		}
+		return pipe.System("sed 's/^/" + args[0] + "/'"), nil
+	})
+}
+
+func (S) TestStage(c *C) {
+	p := pipe.Line(
+		pipe.Print("hello\n"),
+		pipe.Stage("test-prefix", "> "),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "> hello\n")
+
+	c.Assert(pipe.Stages(), DeepEquals, []string{"test-prefix"})
+
+	_, err = pipe.Output(pipe.Stage("test-prefix"))
+	c.Assert(err, ErrorMatches, `cannot create pipe stage "test-prefix": want 1 argument, got 0`)
+	_, err = pipe.Output(pipe.Stage("unknown"))
+	c.Assert(err, ErrorMatches, `unknown pipe stage "unknown"`)
+
+	register := func() { pipe.Register("test-prefix", func(args ...string) (pipe.Pipe, error) { return nil, nil }) }
+	c.Assert(register, PanicMatches, "pipe: Register called twice for stage test-prefix")
+}
+
+func (S) TestStageSpec(c *C) {
+	p := pipe.Line(
+		pipe.Exec("echo", "hello"),
+		pipe.WithDir("/tmp", pipe.Stage("test-prefix", "> ")),
+	)
+	data, err := pipe.ToSpec(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, `{"line":[{"exec":"echo","args":["hello"]},{"script":[{"stage":"test-prefix","args":["\u003e "],"dir":"/tmp"}]}]}`)
+	p, err = pipe.FromSpec(data)
+	c.Assert(err, IsNil)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "> hello\n")
+}
+
+func (S) TestChDir(c *C) {
+	wd1, err := os.Getwd()
+	c.Assert(err, IsNil)
+
+	dir := c.MkDir()
+	subdir := filepath.Join(dir, "subdir")
+	err = os.Mkdir(subdir, 0755)
+	p := pipe.Script(
+		pipe.ChDir(dir),
+		pipe.ChDir("subdir"),
+		pipe.System("echo $PWD"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, subdir+"\n")
+
+	wd2, err := os.Getwd()
+	c.Assert(err, IsNil)
+	c.Assert(wd2, Equals, wd1)
+}
+
+func (S) TestWithDir(c *C) {
+	dir1 := c.MkDir()
+	dir2 := filepath.Join(dir1, "subdir")
+	c.Assert(os.Mkdir(dir2, 0755), IsNil)
+	p := pipe.Script(
+		pipe.ChDir(dir1),
+		pipe.WithDir("subdir",
+			pipe.System("echo $PWD"),
+			pipe.ChDir(dir1),
+			pipe.System("echo $PWD"),
+		),
+		pipe.System("echo $PWD"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, dir2+"\n"+dir1+"\n"+dir1+"\n")
+}
+
+func (S) TestWithDirRestoresOnError(c *C) {
+	dir1 := c.MkDir()
+	dir2 := c.MkDir()
+	s := pipe.NewState(nil, nil)
+	s.Dir = dir1
+	p := pipe.WithDir(dir2, func(s *pipe.State) error { return fmt.Errorf("boom") })
+	c.Assert(p(s), ErrorMatches, "boom")
+	c.Assert(s.Dir, Equals, dir1)
+}
+
+func (S) TestMkDir(c *C) {
+	dir := c.MkDir()
+	subdir := filepath.Join(dir, "subdir")
+	subsubdir := filepath.Join(subdir, "subsubdir")
+	p := pipe.Script(
+		pipe.MkDir(subdir, 0755), // Absolute
+		pipe.ChDir(subdir),
+		pipe.MkDir("subsubdir", 0700), // Relative
+		pipe.ChDir("subsubdir"),
+		pipe.System("echo $PWD"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, subsubdir+"\n")
+
+	stat, err := os.Stat(subsubdir)
+	c.Assert(err, IsNil)
+	c.Assert(stat.Mode()&os.ModePerm, Equals, os.FileMode(0700))
+}
+
+func (S) TestMkDirAll(c *C) {
+	dir := c.MkDir()
+	subdir := filepath.Join(dir, "subdir")
+	subsubdir := filepath.Join(subdir, "subsubdir")
+	subsubsubdir := filepath.Join(subsubdir, "subsubsubdir")
+	p := pipe.Script(
+		pipe.MkDirAll(subsubdir, 0755), // Absolute
+		pipe.MkDirAll(subsubdir, 0755),
+		pipe.ChDir(subsubdir),
+		pipe.MkDirAll("subsubsubdir", 0700), // Relative
+		pipe.MkDirAll("subsubsubdir", 0755),
+		pipe.ChDir("subsubsubdir"),
+		pipe.System("echo $PWD"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, subsubsubdir+"\n")
+
+	stat, err := os.Stat(subsubsubdir)
+	c.Assert(err, IsNil)
+	c.Assert(stat.Mode()&os.ModePerm, Equals, os.FileMode(0700))
+}
+
+func (S) TestPrint(c *C) {
+	p := pipe.Line(
+		pipe.Print("hello:", 42),
+		pipe.Exec("sed", "s/l/k/g"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "hekko:42")
+}
+
+func (S) TestPrintln(c *C) {
+	p := pipe.Line(
+		pipe.Println("hello:", 42),
+		pipe.Exec("sed", "s/l/k/g"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "hekko: 42\n")
+}
+
+func (S) TestPrintf(c *C) {
+	p := pipe.Line(
+		pipe.Printf("hello:%d", 42),
+		pipe.Exec("sed", "s/l/k/g"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "hekko:42")
+}
+
+func (S) TestZeros(c *C) {
+	output, err := pipe.Output(pipe.Zeros(100000))
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(output, make([]byte, 100000)), Equals, true)
+}
+
+func (S) TestRandomBytes(c *C) {
+	output1, err := pipe.Output(pipe.RandomBytes(100000, 42))
+	c.Assert(err, IsNil)
+	c.Assert(output1, HasLen, 100000)
+	output2, err := pipe.Output(pipe.RandomBytes(100000, 42))
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(output1, output2), Equals, true)
+	output3, err := pipe.Output(pipe.RandomBytes(100000, 43))
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(output1, output3), Equals, false)
+	c.Assert(bytes.Count(output1, []byte{0}) < 1000, Equals, true)
+}
+
+func (S) TestYes(c *C) {
+	p := pipe.Line(
+		pipe.Yes("y"),
+		pipe.Exec("head", "-n", "3"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "y\ny\ny\n")
+
+	// Yes is stopped when killed.
+	_, err = pipe.OutputTimeout(pipe.Line(pipe.Yes("y"), pipe.Discard()), 100*time.Millisecond)
+	c.Assert(err, ErrorMatches, "timeout")
+}
+
+func (S) TestRepeatString(c *C) {
+	output, err := pipe.Output(pipe.RepeatString("ab", 3))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "ababab")
+
+	output, err = pipe.Output(pipe.RepeatString("0123456789", 10000))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, strings.Repeat("0123456789", 10000))
+
+	output, err = pipe.Output(pipe.RepeatString("ab", 0))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "")
+}
+
+func (S) TestSeq(c *C) {
+	tests := []struct {
+		first, last, step int
+		result            string
+	}{
+		{1, 3, 1, "1\n2\n3\n"},
+		{1, 6, 2, "1\n3\n5\n"},
+		{3, 1, -1, "3\n2\n1\n"},
+		{3, 1, 1, ""},
+		{5, 5, 1, "5\n"},
+	}
+	for _, test := range tests {
+		output, err := pipe.Output(pipe.Seq(test.first, test.last, test.step))
+		c.Assert(err, IsNil)
+		c.Assert(string(output), Equals, test.result)
+	}
+
+	output, err := pipe.Output(pipe.SeqFormat("file-%02d", 8, 10, 1))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "file-08\nfile-09\nfile-10\n")
+
+	output, err = pipe.Output(pipe.Seq(math.MaxInt-1, math.MaxInt, 1))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, fmt.Sprintf("%d\n%d\n", math.MaxInt-1, math.MaxInt))
+
+	_, err = pipe.Output(pipe.Seq(1, 2, 0))
+	c.Assert(err, ErrorMatches, "sequence step must not be zero")
+}
+
+func (S) TestPrintEnv(c *C) {
+	s := pipe.NewState(nil, nil)
+	s.Env = []string{"A=1"}
+	var out bytes.Buffer
+	s.Stdout = &out
+	p := pipe.Script(
+		pipe.SetEnvVar("B", "2"),
+		pipe.PrintEnv(),
+	)
+	c.Assert(p(s), IsNil)
+	c.Assert(s.RunTasks(), IsNil)
+	c.Assert(out.String(), Equals, "A=1\nB=2\n")
+}
+
+func (S) TestPrintState(c *C) {
+	dir := c.MkDir()
+	p := pipe.Script(
+		pipe.ChDir(dir),
+		pipe.SetEnvVar("PIPE_A", "1"),
+		pipe.Print("out"),
+		pipe.PrintState("PIPE_A", "PIPE_UNSET"),
+	)
+	stdout, stderr, err := pipe.DividedOutput(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(stdout), Equals, "out")
+	c.Assert(string(stderr), Equals, "dir: "+dir+"\nenv: PIPE_A=1\nenv: PIPE_UNSET is unset\n")
+}
+
+func (S) TestRead(c *C) {
+	p := pipe.Line(
+		pipe.Read(bytes.NewBufferString("hello")),
+		pipe.Exec("sed", "s/l/k/g"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "hekko")
+}
+
+func (S) TestWrite(c *C) {
+	var b bytes.Buffer
+	p := pipe.Line(
+		pipe.Print("hello"),
+		pipe.Exec("sed", "s/l/k/g"),
+		pipe.Write(&b),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "")
+	c.Assert(b.String(), Equals, "hekko")
+}
+
+func (S) TestDiscard(c *C) {
+	p := pipe.Line(
+		pipe.Print("hello"),
+		pipe.Discard(),
+		pipe.Print("world"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "world")
+}
+
+func (S) TestTee(c *C) {
+	var b bytes.Buffer
+	p := pipe.Line(
+		pipe.Print("hello"),
+		pipe.Exec("sed", "s/l/k/g"),
+		pipe.Tee(&b),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "hekko")
+	c.Assert(b.String(), Equals, "hekko")
+}
+
+func (S) TestHash(c *C) {
+	var sum []byte
+	output, err := pipe.Output(pipe.Line(pipe.Print("hello"), pipe.Hash(sha256.New, &sum)))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "hello")
+	c.Assert(hex.EncodeToString(sum), Equals, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824")
+}
+
+func (S) TestVerifyHash(c *C) {
+	expected, _ := hex.DecodeString("2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824")
+	output, err := pipe.Output(pipe.Line(pipe.Print("hello"), pipe.VerifyHash(expected, sha256.New)))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "hello")
+
+	_, err = pipe.Output(pipe.Line(pipe.Print("hellO"), pipe.VerifyHash(expected, sha256.New)))
+	c.Assert(err, ErrorMatches, "line\\[1\\]: data has checksum [0-9a-f]{64}, expected 2cf24dba.*")
+}
+
+func (S) TestSkipBytes(c *C) {
+	p := pipe.Line(
+		pipe.Print("hello world"),
+		pipe.SkipBytes(6),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "world")
+
+	p = pipe.Line(
+		pipe.Print("hello"),
+		pipe.SkipBytes(10),
+	)
+	output, err = pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "")
+}
+
+func (S) TestLimitBytes(c *C) {
+	p := pipe.Line(
+		pipe.Print(strings.Repeat("x", 256*1024)),
+		pipe.LimitBytes(5),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "xxxxx")
+
+	p = pipe.Line(
+		pipe.Print("hello"),
+		pipe.LimitBytes(10),
+	)
+	output, err = pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "hello")
+
+	// The preceding entries stop once the limit is reached.
+	p = pipe.Line(
+		pipe.Exec("yes"),
+		pipe.LimitBytes(4),
+	)
+	output, err = pipe.OutputTimeout(p, 5*time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "y\ny\n")
+}
+
+func (S) TestSkipLines(c *C) {
+	p := pipe.Line(
+		pipe.Print("header\nline1\nline2"),
+		pipe.SkipLines(1),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "line1\nline2")
+
+	p = pipe.Line(
+		pipe.Print("line1\nline2\n"),
+		pipe.SkipLines(3),
+	)
+	output, err = pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "")
+}
+
+func (S) TestLimitLines(c *C) {
+	p := pipe.Line(
+		pipe.System("for i in $(seq 1 10000); do echo line$i; done"),
+		pipe.LimitLines(2),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "line1\nline2\n")
+
+	p = pipe.Line(
+		pipe.Print("line1\nline2"),
+		pipe.LimitLines(3),
+	)
+	output, err = pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "line1\nline2")
+
+	// The preceding entries stop once the limit is reached.
+	for _, source := range []pipe.Pipe{pipe.Yes("y"), pipe.Exec("yes")} {
+		output, err = pipe.OutputTimeout(pipe.Line(source, pipe.LimitLines(2)), 5*time.Second)
+		c.Assert(err, IsNil)
+		c.Assert(string(output), Equals, "y\ny\n")
+	}
+
+	// Only the entry being read from is affected.
+	p = pipe.Line(
+		pipe.Exec("yes"),
+		pipe.LimitLines(2),
+		pipe.Exec("sh", "-c", "exec >&-; cat >/dev/null; exit 2"),
+	)
+	_, err = pipe.OutputTimeout(p, 5*time.Second)
+	c.Assert(err, ErrorMatches, `line\[2\]: command "sh" .*: exit status 2`)
+}
+
+func (S) TestReadFileAbsolute(c *C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "file")
+	err := ioutil.WriteFile(path, []byte("hello"), 0644)
+	c.Assert(err, IsNil)
+
+	p := pipe.Line(
+		pipe.ReadFile(path),
+		pipe.Exec("sed", "s/l/k/g"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "hekko")
+}
+
+func (S) TestReadFileRelative(c *C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "file")
+	err := ioutil.WriteFile(path, []byte("hello"), 0644)
+	c.Assert(err, IsNil)
+
+	p := pipe.Line(
+		pipe.ReadFile(path),
+		pipe.Exec("sed", "s/l/k/g"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "hekko")
+}
+
+func (S) TestReadFileNonExistent(c *C) {
+	path := filepath.Join(c.MkDir(), "file")
+	p := pipe.Line(
+		pipe.ReadFile(path),
+		pipe.Exec("cat"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, ErrorMatches, "line\\[0\\]: open .*/file: no such file or directory")
+	c.Assert(output, IsNil)
+}
+
+func (S) TestReadFileRange(c *C) {
+	path := filepath.Join(c.MkDir(), "file")
+	c.Assert(ioutil.WriteFile(path, []byte("0123456789"), 0644), IsNil)
+	tests := []struct {
+		offset, length int64
+		result         string
+	}{
+		{0, 3, "012"},
+		{3, 4, "3456"},
+		{8, 10, "89"},
+		{5, -1, "56789"},
+		{12, 2, ""},
+		{0, 0, ""},
+	}
+	for _, test := range tests {
+		output, err := pipe.Output(pipe.ReadFileRange(path, test.offset, test.length))
+		c.Assert(err, IsNil)
+		c.Assert(string(output), Equals, test.result, Commentf("offset %d, length %d", test.offset, test.length))
+	}
+	_, err := pipe.Output(pipe.ReadFileRange(path+".missing", 0, 1))
+	c.Assert(err, ErrorMatches, "open .*: no such file or directory")
+}
+
+func (S) TestReadFileLines(c *C) {
+	path := filepath.Join(c.MkDir(), "file")
+	long := strings.Repeat("x", 10000)
+	c.Assert(ioutil.WriteFile(path, []byte("1\n2\n"+long+"\n4\n5"), 0644), IsNil)
+	tests := []struct {
+		from, to int
+		result   string
+	}{
+		{1, 1, "1\n"},
+		{2, 4, "2\n" + long + "\n4\n"},
+		{4, 0, "4\n5"},
+		{5, 10, "5"},
+		{7, 9, ""},
+	}
+	for _, test := range tests {
+		output, err := pipe.Output(pipe.ReadFileLines(path, test.from, test.to))
+		c.Assert(err, IsNil)
+		c.Assert(string(output), Equals, test.result, Commentf("lines %d to %d", test.from, test.to))
+	}
+}
+
+func (S) TestDD(c *C) {
+	dir := c.MkDir()
+	input := filepath.Join(dir, "input")
+	c.Assert(ioutil.WriteFile(input, []byte("0123456789abcdef"), 0644), IsNil)
+
+	var progress []int64
+	p := pipe.Line(
+		pipe.Print("0123456789abcdef"),
+		pipe.DD(pipe.DDOptions{
+			BlockSize: 3,
+			Skip:      1,
+			Count:     2,
+			Progress:  func(n int64) { progress = append(progress, n) },
+		}),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "345678")
+	c.Assert(progress, DeepEquals, []int64{3, 6})
+
+	output, err = pipe.Output(pipe.DD(pipe.DDOptions{Input: input, BlockSize: 5, Skip: 2}))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "abcdef")
+
+	out := filepath.Join(dir, "output")
+	c.Assert(ioutil.WriteFile(out, []byte("ABCDEFGHIJKLMNOP"), 0644), IsNil)
+	err = pipe.Run(pipe.DD(pipe.DDOptions{Input: input, Output: out, BlockSize: 4, Seek: 1, Count: 2}))
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(out)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "ABCD01234567")
+
+	err = pipe.Run(pipe.DD(pipe.DDOptions{Seek: 1}))
+	c.Assert(err, ErrorMatches, "cannot seek in the pipe's stdout")
+
+	// The preceding entries stop once Count blocks are copied.
+	p = pipe.Line(
+		pipe.Exec("yes"),
+		pipe.DD(pipe.DDOptions{BlockSize: 2, Count: 3}),
+	)
+	output, err = pipe.OutputTimeout(p, 5*time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "y\ny\ny\n")
+}
+
+func (S) TestFollowFile(c *C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "log")
+	c.Assert(ioutil.WriteFile(path, []byte("one\n"), 0644), IsNil)
+
+	var out pipe.OutputBuffer
+	s := pipe.NewState(&out, nil)
+	c.Assert(pipe.FollowFile(path)(s), IsNil)
+	done := make(chan error)
+	go func() { done <- s.RunTasks() }()
+
+	waitOutput := func(expected string) {
+		for i := 0; i < 100 && string(out.Bytes()) != expected; i++ {
+			time.Sleep(20 * time.Millisecond)
+		}
+		c.Assert(string(out.Bytes()), Equals, expected)
+	}
+	waitOutput("one\n")
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	c.Assert(err, IsNil)
+	_, err = file.Write([]byte("two\n"))
+	c.Assert(err, IsNil)
+	waitOutput("one\ntwo\n")
+
+	// Truncation restarts from the beginning.
+	c.Assert(file.Truncate(0), IsNil)
+	time.Sleep(300 * time.Millisecond)
+	_, err = file.Write([]byte("three\n"))
+	c.Assert(err, IsNil)
+	file.Close()
+	waitOutput("one\ntwo\nthree\n")
+
+	// Rotation follows the new file.
+	c.Assert(os.Rename(path, path+".1"), IsNil)
+	c.Assert(ioutil.WriteFile(path, []byte("four\n"), 0644), IsNil)
+	waitOutput("one\ntwo\nthree\nfour\n")
+
+	s.Kill()
+	c.Assert(<-done, ErrorMatches, "explicitly killed")
+}
+
+func (S) TestWriteFileAbsolute(c *C) {
+	path := filepath.Join(c.MkDir(), "file")
+	p := pipe.Line(
+		pipe.Print("hello"),
+		pipe.Exec("sed", "s/l/k/g"),
+		pipe.WriteFile(path, 0600),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "")
+
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "hekko")
+}
+
+func (S) TestWriteFileRelative(c *C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "file")
+	p := pipe.Script(
+		pipe.ChDir(dir),
+		pipe.Line(
+			pipe.Print("hello"),
+			pipe.Exec("sed", "s/l/k/g"),
+			pipe.WriteFile("file", 0600),
+		),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "")
+
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "hekko")
+}
+
+func (S) TestWriteFileMode(c *C) {
+	path := filepath.Join(c.MkDir(), "file")
+	p := pipe.WriteFile(path, 0600)
+	_, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+
+	stat, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Assert(stat.Mode()&os.ModePerm, Equals, os.FileMode(0600))
+}
+
+type fakeFileInfo struct {
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi fakeFileInfo) Name() string       { return "fake" }
+func (fi fakeFileInfo) Size() int64        { return 0 }
+func (fi fakeFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi fakeFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi fakeFileInfo) IsDir() bool        { return false }
+func (fi fakeFileInfo) Sys() interface{}   { return nil }
+
+func (S) TestWriteFileWithInfo(c *C) {
+	path := filepath.Join(c.MkDir(), "file")
+	c.Assert(ioutil.WriteFile(path, []byte("old content"), 0600), IsNil)
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	info := fakeFileInfo{0751, modTime}
+	p := pipe.Line(
+		pipe.Print("hello"),
+		pipe.WriteFileWithInfo(path, info, pipe.PreserveMode|pipe.PreserveTimes),
+	)
+	c.Assert(pipe.Run(p), IsNil)
+
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "hello")
+	stat, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Assert(stat.Mode()&os.ModePerm, Equals, os.FileMode(0751))
+	c.Assert(stat.ModTime().Equal(modTime), Equals, true)
+
+	err = pipe.Run(pipe.WriteFileWithInfo(path, info, pipe.PreserveOwner))
+	c.Assert(err, ErrorMatches, "cannot preserve ownership of .*: owner unknown")
+}
+
+func (S) TestCopyFile(c *C) {
+	dir := c.MkDir()
+	from := filepath.Join(dir, "from")
+	c.Assert(ioutil.WriteFile(from, []byte("hello"), 0640), IsNil)
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	c.Assert(os.Chtimes(from, modTime, modTime), IsNil)
+
+	p := pipe.Script(
+		pipe.ChDir(dir),
+		pipe.CopyFile("from", "plain", 0),
+		pipe.CopyFile("from", "preserved", pipe.PreserveAll),
+	)
+	c.Assert(pipe.Run(p), IsNil)
+
+	for _, name := range []string{"plain", "preserved"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, "hello")
+	}
+	stat, err := os.Stat(filepath.Join(dir, "plain"))
+	c.Assert(err, IsNil)
+	c.Assert(stat.ModTime().Equal(modTime), Equals, false)
+	stat, err = os.Stat(filepath.Join(dir, "preserved"))
+	c.Assert(err, IsNil)
+	c.Assert(stat.Mode()&os.ModePerm, Equals, os.FileMode(0640))
+	c.Assert(stat.ModTime().Equal(modTime), Equals, true)
+}
+
+func (S) TestAppendFileAbsolute(c *C) {
+	path := filepath.Join(c.MkDir(), "file")
+	p := pipe.Script(
+		pipe.Line(
+			pipe.Print("hello "),
+			pipe.AppendFile(path, 0600),
+		),
+		pipe.Line(
+			pipe.Print("world!"),
+			pipe.AppendFile(path, 0600),
+		),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "")
+
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "hello world!")
+}
+
+func (S) TestAppendFileRelative(c *C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "file")
+	p := pipe.Script(
+		pipe.ChDir(dir),
+		pipe.Line(
+			pipe.Print("hello "),
+			pipe.AppendFile("file", 0600),
+		),
+		pipe.Line(
+			pipe.Print("world!"),
+			pipe.AppendFile("file", 0600),
+		),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "")
+
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "hello world!")
+}
+
+func (S) TestAppendFileMode(c *C) {
+	path := filepath.Join(c.MkDir(), "file")
+	p := pipe.AppendFile(path, 0600)
+	_, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+
+	stat, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Assert(stat.Mode()&os.ModePerm, Equals, os.FileMode(0600))
+}
+
+func (S) TestTeeWriteFileAbsolute(c *C) {
+	path := filepath.Join(c.MkDir(), "file")
+	p := pipe.Line(
+		pipe.Print("hello"),
+		pipe.Exec("sed", "s/l/k/g"),
+		pipe.TeeWriteFile(path, 0600),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "hekko")
+
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "hekko")
+
+	stat, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Assert(stat.Mode()&os.ModePerm, Equals, os.FileMode(0600))
+}
+
+func (S) TestTeeWriteFileRelative(c *C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "file")
+	p := pipe.Line(
+		pipe.ChDir(dir),
+		pipe.Print("hello"),
+		pipe.Exec("sed", "s/l/k/g"),
+		pipe.TeeWriteFile("file", 0600),
 	)
 	output, err := pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "out1\nout2\nout3\nout4\n")
+	c.Assert(string(output), Equals, "hekko")
 
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "hekko")
 }
 
-func (S) TestScriptCombinedOutput(c *C) {
-	p := pipe.Script(
-		pipe.System("echo out1; echo err1 1>&2; echo out2; echo err2 1>&2"),
-		pipe.System("echo out3; echo err3 1>&2; echo out4; echo err4 1>&2"),
+func (S) TestTeeWriteFileMode(c *C) {
+	path := filepath.Join(c.MkDir(), "file")
+	p := pipe.Line(
+		pipe.Print("hello"),
+		pipe.TeeWriteFile(path, 0600),
 	)
-	output, err := pipe.CombinedOutput(p)
+	err := pipe.Run(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "out1\nerr1\nout2\nerr2\nout3\nerr3\nout4\nerr4\n")
+
+	stat, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Assert(stat.Mode()&os.ModePerm, Equals, os.FileMode(0600))
 }
 
-func (S) TestErrorHandling(c *C) {
-	sync := make(chan bool)
+func (S) TestTeeAppendFileAbsolute(c *C) {
+	path := filepath.Join(c.MkDir(), "file")
 	p := pipe.Script(
 		pipe.Line(
-			pipe.TaskFunc(func(*pipe.State) error {
-				sync <- true
-				return fmt.Errorf("err1")
-			}),
-			pipe.TaskFunc(func(*pipe.State) error {
-				<-sync
-				return fmt.Errorf("err2")
-			}),
+			pipe.Print("hello "),
+			pipe.TeeAppendFile(path, 0600),
+		),
+		pipe.Line(
+			pipe.Print("world!"),
+			pipe.TeeAppendFile(path, 0600),
 		),
-		pipe.Print("never happened"),
 	)
 	output, err := pipe.Output(p)
-	if err.Error() != "err1; err2" && err.Error() != "err2; err1" {
-		c.Fatalf(`want "err1; err2" or "err2; err1"; got %q`, err.Error())
-	}
-	c.Assert(string(output), Equals, "")
-}
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "hello world!")
 
-func (S) TestSetEnvVar(c *C) {
-	os.Setenv("PIPE_NEW_VAR", "")
-	os.Setenv("PIPE_OLD_VAR", "old")
-	defer os.Setenv("PIPE_OLD_VAR", "")
-	p := pipe.Script(
-		pipe.SetEnvVar("PIPE_NEW_VAR", "new"),
-		pipe.System("echo $PIPE_OLD_VAR $PIPE_NEW_VAR"),
-		pipe.SetEnvVar("PIPE_NEW_VAR", "after"),
-		func(s *pipe.State) error {
-			count := 0
-			prefix := "PIPE_NEW_VAR="
-			for _, kv := range s.Env {
-				if strings.HasPrefix(kv, prefix) {
-					count++
-				}
-			}
-			if count != 1 {
-				return fmt.Errorf("found %d environment variables", count)
-			}
-			return nil
-		},
-	)
-	output, err := pipe.Output(p)
+	data, err := ioutil.ReadFile(path)
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "old new\n")
-	c.Assert(os.Getenv("PIPE_NEW_VAR"), Equals, "")
+	c.Assert(string(data), Equals, "hello world!")
+
+	stat, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Assert(stat.Mode()&os.ModePerm, Equals, os.FileMode(0600))
 }
 
-func (S) TestScriptIsolatesEnv(c *C) {
+func (S) TestTeeAppendFileRelative(c *C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "file")
 	p := pipe.Script(
-		pipe.SetEnvVar("PIPE_VAR", "outer"),
-		pipe.Script(
-			pipe.SetEnvVar("PIPE_VAR", "inner"),
+		pipe.ChDir(dir),
+		pipe.Line(
+			pipe.Print("hello "),
+			pipe.TeeAppendFile("file", 0600),
+		),
+		pipe.Line(
+			pipe.Print("world!"),
+			pipe.TeeAppendFile("file", 0600),
 		),
-		pipe.System("echo $PIPE_VAR"),
 	)
 	output, err := pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "outer\n")
+	c.Assert(string(output), Equals, "hello world!")
+
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "hello world!")
 }
 
-func (S) TestScriptIsolatesDir(c *C) {
-	dir1 := c.MkDir()
-	dir2 := c.MkDir()
+var downloadContent = bytes.Repeat([]byte("0123456789abcdef"), 4096)
+
+func downloadServer(handler func(w http.ResponseWriter, r *http.Request, n int) bool) (*httptest.Server, *int) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if handler == nil || handler(w, r, requests) {
+			http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(downloadContent))
+		}
+	}))
+	return server, &requests
+}
+
+func downloadSum() string {
+	sum := sha256.Sum256(downloadContent)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func (S) TestHTTPGet(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/data":
+			fmt.Fprintf(w, "token=%s\n", r.Header.Get("X-Token"))
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	header := http.Header{}
+	header.Set("X-Token", "secret")
+	output, err := pipe.Output(pipe.HTTPGet(server.URL+"/data", pipe.HTTPOptions{Header: header}))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "token=secret\n")
+
+	_, err = pipe.Output(pipe.HTTPGet(server.URL+"/missing", pipe.HTTPOptions{}))
+	c.Assert(err, ErrorMatches, `GET http://.*/missing: 404 Not Found`)
+
+	_, err = pipe.Output(pipe.HTTPGet(server.URL+"/slow", pipe.HTTPOptions{Timeout: 50 * time.Millisecond}))
+	c.Assert(err, ErrorMatches, `.*context deadline exceeded.*`)
+}
+
+func (S) TestHTTPPost(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/fail" {
+			http.Error(w, "denied", http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, "%s %s %q\n", r.Method, r.Header.Get("Content-Type"), data)
+	}))
+	defer server.Close()
+
+	output, err := pipe.Output(pipe.Line(
+		pipe.Print("hello"),
+		pipe.HTTPPost(server.URL+"/upload", "text/plain"),
+	))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "POST text/plain \"hello\"\n")
+
+	output, err = pipe.Output(pipe.Line(
+		pipe.Print("{}"),
+		pipe.HTTPPut(server.URL+"/upload", "application/json"),
+	))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "PUT application/json \"{}\"\n")
+
+	_, err = pipe.Output(pipe.Line(pipe.Print("hello"), pipe.HTTPPost(server.URL+"/fail", "text/plain")))
+	c.Assert(err, ErrorMatches, `line\[1\]: POST http://.*/fail: 403 Forbidden`)
+}
+
+func (S) TestDownload(c *C) {
+	server, _ := downloadServer(nil)
+	defer server.Close()
+	var done, total int64
+	output, err := pipe.Output(pipe.Download(server.URL, pipe.DownloadOptions{
+		Checksum: downloadSum(),
+		Progress: func(d, t int64) { done, total = d, t },
+	}))
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(output, downloadContent), Equals, true)
+	c.Assert(done, Equals, int64(len(downloadContent)))
+	c.Assert(total, Equals, int64(len(downloadContent)))
+}
+
+func (S) TestDownloadResumeFile(c *C) {
+	var ranges []string
+	server, _ := downloadServer(func(w http.ResponseWriter, r *http.Request, n int) bool {
+		ranges = append(ranges, r.Header.Get("Range"))
+		return true
+	})
+	defer server.Close()
+	dir := c.MkDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "file.part"), downloadContent[:1000], 0644)
+	c.Assert(err, IsNil)
 	p := pipe.Script(
-		pipe.ChDir(dir1),
-		pipe.Script(
-			pipe.ChDir(dir2),
-		),
-		pipe.System("echo $PWD"),
+		pipe.ChDir(dir),
+		pipe.Download(server.URL, pipe.DownloadOptions{Path: "file", Checksum: downloadSum()}),
 	)
-	output, err := pipe.Output(p)
+	c.Assert(pipe.Run(p), IsNil)
+	c.Assert(ranges, DeepEquals, []string{"bytes=1000-"})
+	data, err := ioutil.ReadFile(filepath.Join(dir, "file"))
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, dir1+"\n")
+	c.Assert(bytes.Equal(data, downloadContent), Equals, true)
+	_, err = os.Stat(filepath.Join(dir, "file.part"))
+	c.Assert(os.IsNotExist(err), Equals, true)
 }
 
-func (S) TestLineIsolatesEnv(c *C) {
-	p := pipe.Line(
-		pipe.SetEnvVar("PIPE_VAR", "outer"),
-		pipe.Line(
-			pipe.SetEnvVar("PIPE_VAR", "inner"),
-		),
-		pipe.System("echo $PIPE_VAR"),
-	)
-	output, err := pipe.Output(p)
+func (S) TestDownloadRetryResume(c *C) {
+	server, requests := downloadServer(func(w http.ResponseWriter, r *http.Request, n int) bool {
+		switch n {
+		case 1:
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return false
+		case 2:
+			// Fail midway through the response.
+			w.Header().Set("Content-Length", strconv.Itoa(len(downloadContent)))
+			w.Write(downloadContent[:5000])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		c.Check(r.Header.Get("Range"), Equals, "bytes=5000-")
+		return true
+	})
+	defer server.Close()
+	output, err := pipe.Output(pipe.Download(server.URL, pipe.DownloadOptions{
+		Retries:  2,
+		Backoff:  time.Millisecond,
+		Checksum: downloadSum(),
+	}))
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "outer\n")
+	c.Assert(*requests, Equals, 3)
+	c.Assert(bytes.Equal(output, downloadContent), Equals, true)
 }
 
-func (S) TestLineIsolatesDir(c *C) {
-	dir1 := c.MkDir()
-	dir2 := c.MkDir()
+func (S) TestDownloadRetriesExhausted(c *C) {
+	server, requests := downloadServer(func(w http.ResponseWriter, r *http.Request, n int) bool {
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+		return false
+	})
+	defer server.Close()
+	err := pipe.Run(pipe.Download(server.URL, pipe.DownloadOptions{Retries: 2, Backoff: time.Millisecond}))
+	c.Assert(err, ErrorMatches, "cannot download .*: 503 Service Unavailable")
+	c.Assert(*requests, Equals, 3)
+}
+
+func (S) TestDownloadNotFound(c *C) {
+	server, requests := downloadServer(func(w http.ResponseWriter, r *http.Request, n int) bool {
+		http.NotFound(w, r)
+		return false
+	})
+	defer server.Close()
+	err := pipe.Run(pipe.Download(server.URL, pipe.DownloadOptions{Retries: 2, Backoff: time.Millisecond}))
+	c.Assert(err, ErrorMatches, "cannot download .*: 404 Not Found")
+	c.Assert(*requests, Equals, 1)
+}
+
+func (S) TestDownloadChecksumMismatch(c *C) {
+	server, _ := downloadServer(nil)
+	defer server.Close()
+	dir := c.MkDir()
+	path := filepath.Join(dir, "file")
+	err := pipe.Run(pipe.Download(server.URL, pipe.DownloadOptions{
+		Path:     path,
+		Checksum: "md5:00000000000000000000000000000000",
+	}))
+	c.Assert(err, ErrorMatches, "download of .* has checksum [0-9a-f]+, expected 0+")
+	_, err = os.Stat(path)
+	c.Assert(os.IsNotExist(err), Equals, true)
+	_, err = os.Stat(path + ".part")
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	err = pipe.Run(pipe.Download(server.URL, pipe.DownloadOptions{Checksum: "crc:00"}))
+	c.Assert(err, ErrorMatches, `invalid checksum "crc:00": unsupported algorithm "crc"`)
+}
+
+type testSink struct {
+	msgs []string
+	fail string
+}
+
+func (s *testSink) Publish(msg []byte) error {
+	if s.fail != "" && string(msg) == s.fail {
+		return fmt.Errorf("cannot publish %q", msg)
+	}
+	s.msgs = append(s.msgs, string(msg))
+	return nil
+}
+
+type testSource struct {
+	msgs   chan []byte
+	err    error
+	closed chan bool
+}
+
+func newTestSource(msgs ...string) *testSource {
+	src := &testSource{msgs: make(chan []byte, len(msgs)), closed: make(chan bool)}
+	for _, msg := range msgs {
+		src.msgs <- []byte(msg)
+	}
+	return src
+}
+
+func (s *testSource) Next() ([]byte, error) {
+	select {
+	case msg := <-s.msgs:
+		return msg, nil
+	case <-s.closed:
+		return nil, fmt.Errorf("subscription closed")
+	default:
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	select {
+	case msg := <-s.msgs:
+		return msg, nil
+	case <-s.closed:
+		return nil, fmt.Errorf("subscription closed")
+	}
+}
+
+func (s *testSource) Close() error {
+	close(s.closed)
+	return nil
+}
+
+func (S) TestPublishTo(c *C) {
+	sink := &testSink{}
 	p := pipe.Line(
-		pipe.ChDir(dir1),
-		pipe.Line(
-			pipe.ChDir(dir2),
-		),
-		pipe.System("echo $PWD"),
+		pipe.Print("a\r\n\nb c\nd"),
+		pipe.PublishTo(sink),
 	)
-	output, err := pipe.Output(p)
+	c.Assert(pipe.Run(p), IsNil)
+	c.Assert(sink.msgs, DeepEquals, []string{"a", "", "b c", "d"})
+
+	sink = &testSink{fail: "b"}
+	p = pipe.Line(
+		pipe.Print("a\nb\nc\n"),
+		pipe.PublishTo(sink),
+	)
+	c.Assert(pipe.Run(p), ErrorMatches, `line\[1\]: cannot publish "b"`)
+	c.Assert(sink.msgs, DeepEquals, []string{"a"})
+}
+
+func (S) TestSubscribeFrom(c *C) {
+	src := newTestSource("a", "b\n", "")
+	src.err = io.EOF
+	output, err := pipe.Output(pipe.SubscribeFrom(src))
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, dir1+"\n")
+	c.Assert(string(output), Equals, "a\nb\n\n")
+	select {
+	case <-src.closed:
+	default:
+		c.Fatalf("source not closed")
+	}
+
+	src = newTestSource("a")
+	src.err = fmt.Errorf("connection lost")
+	_, err = pipe.Output(pipe.SubscribeFrom(src))
+	c.Assert(err, ErrorMatches, "connection lost")
 }
 
-func (S) TestLineNesting(c *C) {
-	b := &bytes.Buffer{}
+func (S) TestSubscribeFromKill(c *C) {
+	src := newTestSource("a", "b")
 	p := pipe.Line(
-		pipe.Print("hello"),
+		pipe.SubscribeFrom(src),
+		pipe.Exec("cat"),
+	)
+	output, err := pipe.OutputTimeout(p, 100*time.Millisecond)
+	c.Assert(err, ErrorMatches, "timeout")
+	c.Assert(string(output), Equals, "a\nb\n")
+}
+
+type memoryStore map[string]string
+
+func (m memoryStore) GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	data, ok := m[bucket+"/"+key]
+	if !ok {
+		return nil, fmt.Errorf("object %s/%s not found", bucket, key)
+	}
+	return ioutil.NopCloser(strings.NewReader(data)), nil
+}
+
+func (m memoryStore) PutObject(ctx context.Context, bucket, key string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	m[bucket+"/"+key] = string(data)
+	return err
+}
+
+func (S) TestObjects(c *C) {
+	store := memoryStore{}
+	var out bytes.Buffer
+	s := pipe.NewState(&out, nil)
+	s.ObjectStore = store
+	p := pipe.Script(
 		pipe.Line(
-			pipe.Filter(func(line []byte) bool { return true }),
+			pipe.Print("hello"),
+			pipe.WriteObject("bucket", "key"),
+		),
+		pipe.Line(
+			pipe.ReadObject("bucket", "key"),
 			pipe.Exec("sed", "s/l/k/g"),
 		),
-		pipe.Write(b),
 	)
-	err := pipe.Run(p)
-	c.Assert(err, IsNil)
-	c.Assert(b.String(), Equals, "hekko")
+	c.Assert(p(s), IsNil)
+	c.Assert(s.RunTasks(), IsNil)
+	c.Assert(store["bucket/key"], Equals, "hello")
+	c.Assert(out.String(), Equals, "hekko")
+
+	s = pipe.NewState(nil, nil)
+	s.ObjectStore = store
+	p = pipe.ReadObject("bucket", "missing")
+	c.Assert(p(s), IsNil)
+	c.Assert(s.RunTasks(), ErrorMatches, "object bucket/missing not found")
+
+	err := pipe.Run(pipe.ReadObject("bucket", "key"))
+	c.Assert(err, ErrorMatches, "no object store set in pipe state")
 }
 
-func (S) TestScriptNesting(c *C) {
-	b := &bytes.Buffer{}
+func (S) TestTeeAppendFileMode(c *C) {
+	path := filepath.Join(c.MkDir(), "file")
 	p := pipe.Line(
 		pipe.Print("hello"),
-		pipe.Script(
-			pipe.Print("world"),
-			pipe.Exec("sed", "s/l/k/g"),
-		),
-		pipe.Write(b),
+		pipe.TeeAppendFile(path, 0600),
 	)
 	err := pipe.Run(p)
 	c.Assert(err, IsNil)
-	c.Assert(b.String(), Equals, "worldhekko")
+
+	stat, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Assert(stat.Mode()&os.ModePerm, Equals, os.FileMode(0600))
 }
 
-func (S) TestScriptPreservesStreams(c *C) {
-	p := pipe.Script(
-		pipe.Line(
-			pipe.Print("hello\n"),
-			pipe.Discard(),
-		),
-		pipe.Exec("echo", "world"),
+func (S) TestGrep(c *C) {
+	p := pipe.Line(
+		pipe.Print("a1\nb2\na3\r\nc4"),
+		pipe.Grep(regexp.MustCompile("^a.$")),
 	)
 	output, err := pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "world\n")
-}
+	c.Assert(string(output), Equals, "a1\na3\r\n")
 
-func (S) TestChDir(c *C) {
-	wd1, err := os.Getwd()
+	p = pipe.Line(
+		pipe.Print("b2\n"),
+		pipe.Grep(regexp.MustCompile("^a")),
+	)
+	output, err = pipe.Output(p)
 	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "")
+}
 
-	dir := c.MkDir()
-	subdir := filepath.Join(dir, "subdir")
-	err = os.Mkdir(subdir, 0755)
-	p := pipe.Script(
-		pipe.ChDir(dir),
-		pipe.ChDir("subdir"),
-		pipe.System("echo $PWD"),
+func (S) TestGrepInvert(c *C) {
+	p := pipe.Line(
+		pipe.Print("a1\nb2\na3\r\nc4"),
+		pipe.GrepInvert(regexp.MustCompile("^a.$")),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "b2\nc4")
+}
+
+func (S) TestCount(c *C) {
+	var lines, words, size int64 = -1, -1, -1
+	p := pipe.Line(
+		pipe.Print("one two\n  three\t four\r\n\nfive"),
+		pipe.Count(&lines, &words, &size),
 	)
 	output, err := pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, subdir+"\n")
+	c.Assert(string(output), Equals, "one two\n  three\t four\r\n\nfive")
+	c.Assert(lines, Equals, int64(3))
+	c.Assert(words, Equals, int64(5))
+	c.Assert(size, Equals, int64(28))
 
-	wd2, err := os.Getwd()
+	output, err = pipe.Output(pipe.Line(pipe.Print("a\n"), pipe.Count(nil, nil, &size)))
 	c.Assert(err, IsNil)
-	c.Assert(wd2, Equals, wd1)
+	c.Assert(size, Equals, int64(2))
 }
 
-func (S) TestMkDir(c *C) {
-	dir := c.MkDir()
-	subdir := filepath.Join(dir, "subdir")
-	subsubdir := filepath.Join(subdir, "subsubdir")
-	p := pipe.Script(
-		pipe.MkDir(subdir, 0755), // Absolute
-		pipe.ChDir(subdir),
-		pipe.MkDir("subsubdir", 0700), // Relative
-		pipe.ChDir("subsubdir"),
-		pipe.System("echo $PWD"),
-	)
-	output, err := pipe.Output(p)
+func (S) TestWC(c *C) {
+	output, err := pipe.Output(pipe.Line(pipe.Print("one two\n  three\t four\r\n\nfive"), pipe.WC()))
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, subsubdir+"\n")
+	c.Assert(string(output), Equals, "3 5 28\n")
 
-	stat, err := os.Stat(subsubdir)
+	output, err = pipe.Output(pipe.Line(pipe.Print(""), pipe.WC()))
 	c.Assert(err, IsNil)
-	c.Assert(stat.Mode()&os.ModePerm, Equals, os.FileMode(0700))
+	c.Assert(string(output), Equals, "0 0 0\n")
 }
 
-func (S) TestMkDirAll(c *C) {
-	dir := c.MkDir()
-	subdir := filepath.Join(dir, "subdir")
-	subsubdir := filepath.Join(subdir, "subsubdir")
-	subsubsubdir := filepath.Join(subsubdir, "subsubsubdir")
-	p := pipe.Script(
-		pipe.MkDirAll(subsubdir, 0755), // Absolute
-		pipe.MkDirAll(subsubdir, 0755),
-		pipe.ChDir(subsubdir),
-		pipe.MkDirAll("subsubsubdir", 0700), // Relative
-		pipe.MkDirAll("subsubsubdir", 0755),
-		pipe.ChDir("subsubsubdir"),
-		pipe.System("echo $PWD"),
+func (S) TestMatchCount(c *C) {
+	n := -1
+	p := pipe.Line(
+		pipe.Print("a1\nb2\na3\r\nc4"),
+		pipe.MatchCount(regexp.MustCompile("^a.$"), &n),
 	)
 	output, err := pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, subsubsubdir+"\n")
+	c.Assert(string(output), Equals, "a1\na3\r\n")
+	c.Assert(n, Equals, 2)
 
-	stat, err := os.Stat(subsubsubdir)
+	p = pipe.Line(
+		pipe.Print("b2\n"),
+		pipe.MatchCount(regexp.MustCompile("^a"), &n),
+	)
+	output, err = pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(stat.Mode()&os.ModePerm, Equals, os.FileMode(0700))
+	c.Assert(string(output), Equals, "")
+	c.Assert(n, Equals, 0)
 }
 
-func (S) TestPrint(c *C) {
+func (S) TestMustMatch(c *C) {
 	p := pipe.Line(
-		pipe.Print("hello:", 42),
-		pipe.Exec("sed", "s/l/k/g"),
+		pipe.Print("a1\nb2\n"),
+		pipe.MustMatch(regexp.MustCompile("^b")),
 	)
 	output, err := pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "hekko:42")
+	c.Assert(string(output), Equals, "b2\n")
+
+	p = pipe.Script(
+		pipe.Line(
+			pipe.Print("a1\nb2\n"),
+			pipe.MustMatch(regexp.MustCompile("^c")),
+		),
+		pipe.Print("never happened"),
+	)
+	output, err = pipe.Output(p)
+	c.Assert(err, ErrorMatches, "line\\[1\\]: no lines matched")
+	c.Assert(errors.Is(err, pipe.ErrNoMatch), Equals, true)
+	c.Assert(string(output), Equals, "")
 }
 
-func (S) TestPrintln(c *C) {
-	p := pipe.Line(
-		pipe.Println("hello:", 42),
-		pipe.Exec("sed", "s/l/k/g"),
+func (S) TestGrepContext(c *C) {
+	input := "a\nb\nX1\nc\nd\ne\nf\nX2\nX3\ng\nh\n"
+	tests := []struct {
+		before, after int
+		result        string
+	}{
+		{0, 0, "X1\n--\nX2\nX3\n"},
+		{1, 0, "b\nX1\n--\nf\nX2\nX3\n"},
+		{0, 1, "X1\nc\n--\nX2\nX3\ng\n"},
+		{2, 2, "a\nb\nX1\nc\nd\ne\nf\nX2\nX3\ng\nh\n"},
+		{5, 0, "a\nb\nX1\nc\nd\ne\nf\nX2\nX3\n"},
+	}
+	for _, t := range tests {
+		p := pipe.Line(
+			pipe.Print(input),
+			pipe.GrepContext(regexp.MustCompile("^X"), t.before, t.after),
+		)
+		output, err := pipe.Output(p)
+		c.Assert(err, IsNil)
+		c.Assert(string(output), Equals, t.result, Commentf("before=%d after=%d", t.before, t.after))
+	}
+}
+
+func (S) TestSplitFile(c *C) {
+	dir := c.MkDir()
+	p := pipe.Script(
+		pipe.ChDir(dir),
+		pipe.Line(
+			pipe.Print("line1\nline2\nline3\nline4\nline5"),
+			pipe.SplitFile("part", 2, 0600),
+		),
 	)
-	output, err := pipe.Output(p)
+	err := pipe.Run(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "hekko: 42\n")
+
+	for i, content := range []string{"line1\nline2\n", "line3\nline4\n", "line5"} {
+		path := filepath.Join(dir, fmt.Sprintf("part%03d", i))
+		data, err := ioutil.ReadFile(path)
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, content)
+
+		stat, err := os.Stat(path)
+		c.Assert(err, IsNil)
+		c.Assert(stat.Mode()&os.ModePerm, Equals, os.FileMode(0600))
+	}
+	_, err = os.Stat(filepath.Join(dir, "part003"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	for _, n := range []int{0, -1} {
+		prefix := filepath.Join(c.MkDir(), "part")
+		s := pipe.NewState(nil, nil)
+		err = pipe.SplitFile(prefix, n, 0644)(s)
+		c.Assert(err, ErrorMatches, fmt.Sprintf("cannot split data into files of %d lines", n))
+		err = pipe.Run(pipe.Line(pipe.Print("data\n"), pipe.SplitFile(prefix, n, 0644)))
+		c.Assert(err, ErrorMatches, fmt.Sprintf("cannot split data into files of %d lines", n))
+		_, err = os.Stat(prefix + "000")
+		c.Assert(os.IsNotExist(err), Equals, true)
+	}
 }
 
-func (S) TestPrintf(c *C) {
+func (S) TestSplitFileBytes(c *C) {
+	prefix := filepath.Join(c.MkDir(), "part")
 	p := pipe.Line(
-		pipe.Printf("hello:%d", 42),
-		pipe.Exec("sed", "s/l/k/g"),
+		pipe.Print("0123456789"),
+		pipe.SplitFileBytes(prefix, 4, 0644),
 	)
-	output, err := pipe.Output(p)
+	err := pipe.Run(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "hekko:42")
+
+	for i, content := range []string{"0123", "4567", "89"} {
+		data, err := ioutil.ReadFile(fmt.Sprintf("%s%03d", prefix, i))
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, content)
+	}
+	_, err = os.Stat(prefix + "003")
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	for _, n := range []int64{0, -1} {
+		prefix := filepath.Join(c.MkDir(), "part")
+		s := pipe.NewState(nil, nil)
+		err = pipe.SplitFileBytes(prefix, n, 0644)(s)
+		c.Assert(err, ErrorMatches, fmt.Sprintf("cannot split data into files of %d bytes", n))
+		err = pipe.Run(pipe.Line(pipe.Print("data"), pipe.SplitFileBytes(prefix, n, 0644)))
+		c.Assert(err, ErrorMatches, fmt.Sprintf("cannot split data into files of %d bytes", n))
+		_, err = os.Stat(prefix + "000")
+		c.Assert(os.IsNotExist(err), Equals, true)
+	}
 }
 
-func (S) TestRead(c *C) {
+func (S) TestFilter(c *C) {
 	p := pipe.Line(
-		pipe.Read(bytes.NewBufferString("hello")),
-		pipe.Exec("sed", "s/l/k/g"),
+		pipe.System("echo out1; echo err1 1>&2; echo out2; echo err2 1>&2; echo out3"),
+		pipe.Filter(func(line []byte) bool { return string(line) != "out2" }),
 	)
 	output, err := pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "hekko")
+	c.Assert(string(output), Equals, "out1\nout3\n")
 }
 
-func (S) TestWrite(c *C) {
-	var b bytes.Buffer
+func (S) TestFilterNoNewLine(c *C) {
 	p := pipe.Line(
-		pipe.Print("hello"),
-		pipe.Exec("sed", "s/l/k/g"),
-		pipe.Write(&b),
+		pipe.Print("out1\nout2\nout3"),
+		pipe.Filter(func(line []byte) bool { return string(line) != "out2" }),
 	)
 	output, err := pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "")
-	c.Assert(b.String(), Equals, "hekko")
+	c.Assert(string(output), Equals, "out1\nout3")
 }
 
-func (S) TestDiscard(c *C) {
+func (S) TestReplace(c *C) {
 	p := pipe.Line(
-		pipe.Print("hello"),
-		pipe.Discard(),
-		pipe.Print("world"),
+		pipe.System("echo out1; echo err1 1>&2; echo out2; echo err2 1>&2; echo out3"),
+		pipe.Replace(func(line []byte) []byte {
+			if bytes.HasPrefix(line, []byte("out")) {
+				if line[3] == '3' {
+					return nil
+				}
+				return []byte{'l', line[3], ','}
+			}
+			return line
+		}),
 	)
 	output, err := pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "world")
+	c.Assert(string(output), Equals, "l1,l2,")
 }
 
-func (S) TestTee(c *C) {
-	var b bytes.Buffer
+func (S) TestReplaceRegexp(c *C) {
 	p := pipe.Line(
-		pipe.Print("hello"),
-		pipe.Exec("sed", "s/l/k/g"),
-		pipe.Tee(&b),
+		pipe.Print("joe@example.com, ann@example.com\r\nnone\nbob@example.com"),
+		pipe.ReplaceRegexp(regexp.MustCompile(`(\w+)@example\.com`), []byte("${1}@example.org")),
 	)
 	output, err := pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "hekko")
-	c.Assert(b.String(), Equals, "hekko")
-}
+	c.Assert(string(output), Equals, "joe@example.org, ann@example.org\r\nnone\nbob@example.org")
 
-func (S) TestReadFileAbsolute(c *C) {
-	dir := c.MkDir()
-	path := filepath.Join(dir, "file")
-	err := ioutil.WriteFile(path, []byte("hello"), 0644)
+	p = pipe.Line(
+		pipe.Print("a$b\n"),
+		pipe.ReplaceRegexp(regexp.MustCompile(`\$|$`), []byte("$$")),
+	)
+	output, err = pipe.Output(p)
 	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "a$b$\n")
+}
 
+func (S) TestReplaceNoNewLine(c *C) {
 	p := pipe.Line(
-		pipe.ReadFile(path),
-		pipe.Exec("sed", "s/l/k/g"),
+		pipe.Print("out1\nout2\nout3"),
+		pipe.Replace(func(line []byte) []byte {
+			if bytes.HasPrefix(line, []byte("out")) {
+				if line[3] == '2' {
+					return nil
+				}
+				return []byte{'l', line[3], ','}
+			}
+			return line
+		}),
 	)
 	output, err := pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "hekko")
+	c.Assert(string(output), Equals, "l1,l3,")
 }
 
-func (S) TestReadFileRelative(c *C) {
-	dir := c.MkDir()
-	path := filepath.Join(dir, "file")
-	err := ioutil.WriteFile(path, []byte("hello"), 0644)
-	c.Assert(err, IsNil)
+// chunkReader returns its data one byte at a time, to exercise
+// stream processing that must be safe across chunk boundaries.
+type chunkReader struct {
+	data []byte
+}
+
+func (r *chunkReader) Read(b []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	b[0] = r.data[0]
+	r.data = r.data[1:]
+	return 1, nil
+}
 
+func (S) TestToLF(c *C) {
+	input := "a\r\nb\rc\r\r\nd\n\r"
 	p := pipe.Line(
-		pipe.ReadFile(path),
-		pipe.Exec("sed", "s/l/k/g"),
+		pipe.Print(input),
+		pipe.ToLF(),
 	)
 	output, err := pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "hekko")
-}
+	c.Assert(string(output), Equals, "a\nb\rc\r\nd\n\r")
 
-func (S) TestReadFileNonExistent(c *C) {
-	path := filepath.Join(c.MkDir(), "file")
-	p := pipe.Line(
-		pipe.ReadFile(path),
-		pipe.Exec("cat"),
+	p = pipe.Line(
+		pipe.Read(&chunkReader{[]byte(input)}),
+		pipe.ToLF(),
 	)
-	output, err := pipe.Output(p)
-	c.Assert(err, ErrorMatches, "open .*/file: no such file or directory")
-	c.Assert(output, IsNil)
+	output, err = pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "a\nb\rc\r\nd\n\r")
 }
 
-func (S) TestWriteFileAbsolute(c *C) {
-	path := filepath.Join(c.MkDir(), "file")
+func (S) TestToCRLF(c *C) {
+	input := "a\nb\r\nc\rd\n"
 	p := pipe.Line(
-		pipe.Print("hello"),
-		pipe.Exec("sed", "s/l/k/g"),
-		pipe.WriteFile(path, 0600),
+		pipe.Print(input),
+		pipe.ToCRLF(),
 	)
 	output, err := pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "")
+	c.Assert(string(output), Equals, "a\r\nb\r\nc\rd\r\n")
 
-	data, err := ioutil.ReadFile(path)
+	p = pipe.Line(
+		pipe.Read(&chunkReader{[]byte(input)}),
+		pipe.ToCRLF(),
+	)
+	output, err = pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(data), Equals, "hekko")
+	c.Assert(string(output), Equals, "a\r\nb\r\nc\rd\r\n")
 }
 
-func (S) TestWriteFileRelative(c *C) {
-	dir := c.MkDir()
-	path := filepath.Join(dir, "file")
-	p := pipe.Script(
-		pipe.ChDir(dir),
-		pipe.Line(
-			pipe.Print("hello"),
-			pipe.Exec("sed", "s/l/k/g"),
-			pipe.WriteFile("file", 0600),
-		),
+func (S) TestConvertCharset(c *C) {
+	p := pipe.Line(
+		pipe.Print("caf\xe9\n"),
+		pipe.ConvertCharset("latin1", "UTF-8"),
 	)
 	output, err := pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "")
+	c.Assert(string(output), Equals, "café\n")
 
-	data, err := ioutil.ReadFile(path)
+	p = pipe.Line(
+		pipe.Print("h\x00\xe9\x00\n\x00"),
+		pipe.ConvertCharset("UTF-16LE", "utf-8"),
+	)
+	output, err = pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(data), Equals, "hekko")
-}
+	c.Assert(string(output), Equals, "hé\n")
 
-func (S) TestWriteFileMode(c *C) {
-	path := filepath.Join(c.MkDir(), "file")
-	p := pipe.WriteFile(path, 0600)
-	_, err := pipe.Output(p)
+	p = pipe.Line(
+		pipe.Print("café\n"),
+		pipe.ConvertCharset("UTF-8", "ISO-8859-1"),
+	)
+	output, err = pipe.Output(p)
 	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "caf\xe9\n")
+}
 
-	stat, err := os.Stat(path)
-	c.Assert(err, IsNil)
-	c.Assert(stat.Mode()&os.ModePerm, Equals, os.FileMode(0600))
+func (S) TestConvertCharsetUnknown(c *C) {
+	p := pipe.Line(
+		pipe.Print("hello"),
+		pipe.ConvertCharset("klingon", "UTF-8"),
+	)
+	_, err := pipe.Output(p)
+	c.Assert(err, ErrorMatches, `unsupported character set: "klingon"`)
 }
 
-func (S) TestAppendFileAbsolute(c *C) {
-	path := filepath.Join(c.MkDir(), "file")
-	p := pipe.Script(
-		pipe.Line(
-			pipe.Print("hello "),
-			pipe.AppendFile(path, 0600),
-		),
-		pipe.Line(
-			pipe.Print("world!"),
-			pipe.AppendFile(path, 0600),
-		),
+func (S) TestFilterRecordsParagraphs(c *C) {
+	p := pipe.Line(
+		pipe.Print("\n[a]\nkey=1\n\n[b]\nkey=2\n \n\n[c]\nkey=1"),
+		pipe.FilterRecords(pipe.ScanParagraphs, func(record []byte) bool {
+			return bytes.HasSuffix(record, []byte("key=1"))
+		}),
 	)
 	output, err := pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "")
+	c.Assert(string(output), Equals, "\n[a]\nkey=1\n\n[c]\nkey=1")
 
-	data, err := ioutil.ReadFile(path)
-	c.Assert(err, IsNil)
-	c.Assert(string(data), Equals, "hello world!")
+	// Records may span many reads, and the pipe may be run again.
+	large := strings.Repeat("line\n", 200000)
+	p = pipe.Line(
+		pipe.Exec("sh", "-c", "printf 'a\\n\\n'; cat; printf '\\nb\\n'"),
+		pipe.ReplaceRecords(pipe.ScanParagraphs, func(record []byte) []byte {
+			return []byte(fmt.Sprintf("%d\n", len(record)))
+		}),
+	)
+	for i := 0; i < 2; i++ {
+		output, err = pipe.Output(pipe.Line(pipe.Print(large), p))
+		c.Assert(err, IsNil)
+		c.Assert(string(output), Equals, fmt.Sprintf("3\n%d\n2\n", len(large)+1))
+	}
 }
 
-func (S) TestAppendFileRelative(c *C) {
-	dir := c.MkDir()
-	path := filepath.Join(dir, "file")
-	p := pipe.Script(
-		pipe.ChDir(dir),
-		pipe.Line(
-			pipe.Print("hello "),
-			pipe.AppendFile("file", 0600),
-		),
-		pipe.Line(
-			pipe.Print("world!"),
-			pipe.AppendFile("file", 0600),
-		),
+func (S) TestReplaceRecordsLineRecords(c *C) {
+	p := pipe.Line(
+		pipe.Print("commit 1\n\n  one\n\ncommit 2\n\n  two\n"),
+		pipe.ReplaceRecords(pipe.ScanLineRecords(regexp.MustCompile("^commit ")), func(record []byte) []byte {
+			return []byte(fmt.Sprintf("%q\n", record))
+		}),
 	)
 	output, err := pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "")
+	c.Assert(string(output), Equals, `"commit 1\n\n  one\n\n"`+"\n"+`"commit 2\n\n  two\n"`+"\n")
+}
 
-	data, err := ioutil.ReadFile(path)
+func (S) TestSortLines(c *C) {
+	tests := []struct {
+		opts   pipe.SortOptions
+		input  string
+		result string
+	}{
+		{pipe.SortOptions{}, "b\na\r\n\nc", "\na\nb\nc\n"},
+		{pipe.SortOptions{Reverse: true}, "b\na\nc\n", "c\nb\na\n"},
+		{pipe.SortOptions{Numeric: true}, "10\n9\n-1\nx\n1.5\n", "-1\nx\n1.5\n9\n10\n"},
+		{pipe.SortOptions{Numeric: true, Reverse: true}, "10\n9\n100\n", "100\n10\n9\n"},
+		{pipe.SortOptions{Human: true}, "1G\n2K\n512\n3M\n1k\n", "512\n1k\n2K\n3M\n1G\n"},
+		{pipe.SortOptions{Key: 2}, "x  c\ny b\nz\ta\nw\n", "w\nz\ta\ny b\nx  c\n"},
+		{pipe.SortOptions{Key: 3, Separator: ":", Numeric: true}, "a:b:10\nc:d:2\ne:f:33\n", "c:d:2\na:b:10\ne:f:33\n"},
+	}
+	for _, t := range tests {
+		p := pipe.Line(
+			pipe.Print(t.input),
+			pipe.SortLines(t.opts),
+		)
+		output, err := pipe.Output(p)
+		c.Assert(err, IsNil)
+		c.Assert(string(output), Equals, t.result, Commentf("options: %#v", t.opts))
+	}
+}
+
+func (S) TestSort(c *C) {
+	output, err := pipe.Output(pipe.Line(pipe.Print("b\na\r\nc\nab"), pipe.Sort(nil)))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "a\nab\nb\nc\n")
+
+	byLen := func(a, b []byte) bool { return len(a) < len(b) }
+	output, err = pipe.Output(pipe.Line(pipe.Print("ccc\nb\naa\nd\n"), pipe.Sort(byLen)))
 	c.Assert(err, IsNil)
-	c.Assert(string(data), Equals, "hello world!")
+	c.Assert(string(output), Equals, "b\nd\naa\nccc\n")
 }
 
-func (S) TestAppendFileMode(c *C) {
-	path := filepath.Join(c.MkDir(), "file")
-	p := pipe.AppendFile(path, 0600)
-	_, err := pipe.Output(p)
+func (S) TestUniq(c *C) {
+	output, err := pipe.Output(pipe.Line(pipe.Print("a\na\r\nb\na\nc\nc"), pipe.Uniq()))
 	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "a\nb\na\nc\n")
 
-	stat, err := os.Stat(path)
+	output, err = pipe.Output(pipe.Line(pipe.Print("b\na\nb\na\n"), pipe.Sort(nil), pipe.Uniq()))
 	c.Assert(err, IsNil)
-	c.Assert(stat.Mode()&os.ModePerm, Equals, os.FileMode(0600))
+	c.Assert(string(output), Equals, "a\nb\n")
 }
 
-func (S) TestTeeWriteFileAbsolute(c *C) {
-	path := filepath.Join(c.MkDir(), "file")
+func (S) TestJoinLines(c *C) {
 	p := pipe.Line(
-		pipe.Print("hello"),
-		pipe.Exec("sed", "s/l/k/g"),
-		pipe.TeeWriteFile(path, 0600),
+		pipe.Print("a\nb\r\n\nc"),
+		pipe.JoinLines(","),
 	)
 	output, err := pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "hekko")
-
-	data, err := ioutil.ReadFile(path)
-	c.Assert(err, IsNil)
-	c.Assert(string(data), Equals, "hekko")
+	c.Assert(string(output), Equals, "a,b,,c\n")
 
-	stat, err := os.Stat(path)
+	p = pipe.Line(
+		pipe.Print(""),
+		pipe.JoinLines(","),
+	)
+	output, err = pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(stat.Mode()&os.ModePerm, Equals, os.FileMode(0600))
+	c.Assert(string(output), Equals, "")
 }
 
-func (S) TestTeeWriteFileRelative(c *C) {
-	dir := c.MkDir()
-	path := filepath.Join(dir, "file")
+func (S) TestSplitWords(c *C) {
 	p := pipe.Line(
-		pipe.ChDir(dir),
-		pipe.Print("hello"),
-		pipe.Exec("sed", "s/l/k/g"),
-		pipe.TeeWriteFile("file", 0600),
+		pipe.Print("  the quick\tbrown\n\nfox  jumps\r\n"),
+		pipe.SplitWords(),
 	)
 	output, err := pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "hekko")
-
-	data, err := ioutil.ReadFile(path)
-	c.Assert(err, IsNil)
-	c.Assert(string(data), Equals, "hekko")
+	c.Assert(string(output), Equals, "the\nquick\nbrown\nfox\njumps\n")
 }
 
-func (S) TestTeeWriteFileMode(c *C) {
-	path := filepath.Join(c.MkDir(), "file")
+func (S) TestReverseLines(c *C) {
 	p := pipe.Line(
-		pipe.Print("hello"),
-		pipe.TeeWriteFile(path, 0600),
+		pipe.Print("line1\nline2\n\nline3"),
+		pipe.ReverseLines(),
 	)
-	err := pipe.Run(p)
-	c.Assert(err, IsNil)
-
-	stat, err := os.Stat(path)
+	output, err := pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(stat.Mode()&os.ModePerm, Equals, os.FileMode(0600))
+	c.Assert(string(output), Equals, "line3\n\nline2\nline1\n")
 }
 
-func (S) TestTeeAppendFileAbsolute(c *C) {
-	path := filepath.Join(c.MkDir(), "file")
-	p := pipe.Script(
-		pipe.Line(
-			pipe.Print("hello "),
-			pipe.TeeAppendFile(path, 0600),
-		),
-		pipe.Line(
-			pipe.Print("world!"),
-			pipe.TeeAppendFile(path, 0600),
-		),
+func (S) TestReverseLinesLarge(c *C) {
+	line := strings.Repeat("x", 1023) + "\n"
+	p := pipe.Line(
+		pipe.Print("first\n", strings.Repeat(line, 40*1024), "last\n"),
+		pipe.ReverseLines(),
 	)
 	output, err := pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "hello world!")
+	c.Assert(len(output), Equals, 40*1024*1024+11)
+	c.Assert(string(output[:5]), Equals, "last\n")
+	c.Assert(string(output[len(output)-6:]), Equals, "first\n")
+}
 
-	data, err := ioutil.ReadFile(path)
+func (S) TestReverseEachLine(c *C) {
+	p := pipe.Line(
+		pipe.Print("abc\r\nçãé\n\nxy"),
+		pipe.ReverseEachLine(),
+	)
+	output, err := pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(data), Equals, "hello world!")
+	c.Assert(string(output), Equals, "cba\r\néãç\n\nyx")
+}
 
-	stat, err := os.Stat(path)
-	c.Assert(err, IsNil)
-	c.Assert(stat.Mode()&os.ModePerm, Equals, os.FileMode(0600))
+func (S) TestComm(c *C) {
+	tests := []struct {
+		mode   pipe.CommMode
+		result string
+	}{
+		{pipe.CommOnlyStdin, "a\nd\n"},
+		{pipe.CommOnlyOther, "b\nf\n"},
+		{pipe.CommBoth, "c\ne\n"},
+		{pipe.CommOnlyStdin | pipe.CommOnlyOther, "a\nb\nd\nf\n"},
+	}
+	for _, t := range tests {
+		p := pipe.Line(
+			pipe.Print("a\nc\nd\ne"),
+			pipe.Comm(pipe.System("echo b; echo c; echo e; echo f"), t.mode),
+		)
+		output, err := pipe.Output(p)
+		c.Assert(err, IsNil)
+		c.Assert(string(output), Equals, t.result)
+	}
 }
 
-func (S) TestTeeAppendFileRelative(c *C) {
-	dir := c.MkDir()
-	path := filepath.Join(dir, "file")
-	p := pipe.Script(
-		pipe.ChDir(dir),
-		pipe.Line(
-			pipe.Print("hello "),
-			pipe.TeeAppendFile("file", 0600),
-		),
-		pipe.Line(
-			pipe.Print("world!"),
-			pipe.TeeAppendFile("file", 0600),
-		),
+func (S) TestCommOtherError(c *C) {
+	p := pipe.Line(
+		pipe.Print("a\n"),
+		pipe.Comm(pipe.System("echo a; exit 1"), pipe.CommBoth),
 	)
 	output, err := pipe.Output(p)
-	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "hello world!")
+	c.Assert(err, ErrorMatches, `line\[1\]: command "/bin/sh" \["-c" "echo a; exit 1"\]: exit status 1`)
+	c.Assert(string(output), Equals, "a\n")
+}
 
-	data, err := ioutil.ReadFile(path)
-	c.Assert(err, IsNil)
-	c.Assert(string(data), Equals, "hello world!")
+func (S) TestCommOtherCommandPolicy(c *C) {
+	var stdout bytes.Buffer
+	s := pipe.NewState(&stdout, nil)
+	s.CommandPolicy = func(spec pipe.CommandSpec) error {
+		if spec.Name == "false" {
+			return fmt.Errorf("false is forbidden")
+		}
+		return nil
+	}
+	p := pipe.Line(
+		pipe.Print("a\n"),
+		pipe.Comm(pipe.Exec("false"), pipe.CommBoth),
+	)
+	c.Assert(p(s), IsNil)
+	c.Assert(s.RunTasks(), ErrorMatches, `line\[1\]: command "false": false is forbidden`)
+	c.Assert(stdout.String(), Equals, "")
 }
 
-func (S) TestTeeAppendFileMode(c *C) {
-	path := filepath.Join(c.MkDir(), "file")
+func (S) TestCommTimeout(c *C) {
+	started := time.Now()
 	p := pipe.Line(
-		pipe.Print("hello"),
-		pipe.TeeAppendFile(path, 0600),
+		pipe.Print("a\n"),
+		pipe.Comm(pipe.Exec("sleep", "1"), pipe.CommBoth),
 	)
-	err := pipe.Run(p)
+	err := pipe.RunTimeout(p, 100*time.Millisecond)
+	c.Assert(err, ErrorMatches, "timeout")
+	c.Assert(time.Since(started) < time.Second, Equals, true)
+}
+
+func (S) TestPaste(c *C) {
+	p := pipe.Line(
+		pipe.Print("a\nb\r\nc"),
+		pipe.Paste(pipe.System("echo 1; echo 2; echo 3; echo 4"), ":"),
+	)
+	output, err := pipe.Output(p)
 	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "a:1\nb:2\nc:3\n:4\n")
 
-	stat, err := os.Stat(path)
+	p = pipe.Line(
+		pipe.Print("a\nb\n"),
+		pipe.Paste(pipe.Print("1"), "\t"),
+	)
+	output, err = pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(stat.Mode()&os.ModePerm, Equals, os.FileMode(0600))
+	c.Assert(string(output), Equals, "a\t1\nb\t\n")
 }
 
-func (S) TestFilter(c *C) {
+func (S) TestWrap(c *C) {
 	p := pipe.Line(
-		pipe.System("echo out1; echo err1 1>&2; echo out2; echo err2 1>&2; echo out3"),
-		pipe.Filter(func(line []byte) bool { return string(line) != "out2" }),
+		pipe.Print("abcdefghij\nabc\nçãé ôõ úü\n\nabcdefg"),
+		pipe.Wrap(4),
 	)
 	output, err := pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "out1\nout3\n")
+	c.Assert(string(output), Equals, "abcd\nefgh\nij\nabc\nçãé \nôõ ú\nü\n\nabcd\nefg")
 }
 
-func (S) TestFilterNoNewLine(c *C) {
+func (S) TestWrapWords(c *C) {
 	p := pipe.Line(
-		pipe.Print("out1\nout2\nout3"),
-		pipe.Filter(func(line []byte) bool { return string(line) != "out2" }),
+		pipe.Print("the quick brown fox\njumps over\nabcdefghijkl mn\n"),
+		pipe.WrapWords(10),
 	)
 	output, err := pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "out1\nout3")
+	c.Assert(string(output), Equals, "the quick \nbrown fox\njumps over\nabcdefghij\nkl mn\n")
 }
 
-func (S) TestReplace(c *C) {
-	p := pipe.Line(
-		pipe.System("echo out1; echo err1 1>&2; echo out2; echo err2 1>&2; echo out3"),
-		pipe.Replace(func(line []byte) []byte {
-			if bytes.HasPrefix(line, []byte("out")) {
-				if line[3] == '3' {
-					return nil
-				}
-				return []byte{'l', line[3], ','}
-			}
-			return line
-		}),
+func (S) TestKillAbortedExecTask(c *C) {
+	p := pipe.Script(
+		pipe.TaskFunc(func(*pipe.State) error { return fmt.Errorf("boom") }),
+		pipe.Exec("will-not-run"),
+	)
+	_, err := pipe.Output(p)
+	c.Assert(err, ErrorMatches, "script\\[0\\]: boom")
+}
+
+func (S) TestAssert(c *C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "file")
+	p := pipe.Script(
+		pipe.Line(
+			pipe.Print("hello"),
+			pipe.WriteFile(path, 0644),
+		),
+		pipe.ChDir("/"),
+		pipe.Assert(func(s *pipe.State) bool { return s.Dir != "/" }, "refusing to run in %s", "/"),
+		pipe.Print("never happened"),
 	)
 	output, err := pipe.Output(p)
+	c.Assert(err, ErrorMatches, "refusing to run in /")
+	c.Assert(string(output), Equals, "")
+	_, err = os.Stat(path)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	p = pipe.Script(
+		pipe.ChDir(dir),
+		pipe.Assert(func(s *pipe.State) bool { return s.Dir != "/" }, "refusing to run in %s", "/"),
+		pipe.Print("hello"),
+	)
+	output, err = pipe.Output(p)
 	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "l1,l2,")
+	c.Assert(string(output), Equals, "hello")
 }
 
-func (S) TestReplaceNoNewLine(c *C) {
-	p := pipe.Line(
-		pipe.Print("out1\nout2\nout3"),
-		pipe.Replace(func(line []byte) []byte {
-			if bytes.HasPrefix(line, []byte("out")) {
-				if line[3] == '2' {
-					return nil
-				}
-				return []byte{'l', line[3], ','}
+func (S) TestTest(c *C) {
+	p := pipe.Script(
+		pipe.ChDir("/tmp"),
+		pipe.Test(func(s *pipe.State) error {
+			if s.Dir != "/tmp" {
+				return fmt.Errorf("unexpected dir: %s", s.Dir)
 			}
-			return line
+			return nil
 		}),
+		pipe.Test(func(s *pipe.State) error { return fmt.Errorf("boom") }),
+		pipe.Print("never happened"),
 	)
 	output, err := pipe.Output(p)
-	c.Assert(err, IsNil)
-	c.Assert(string(output), Equals, "l1,l3,")
+	c.Assert(err, ErrorMatches, "script\\[2\\]: boom")
+	c.Assert(string(output), Equals, "")
 }
 
-func (S) TestKillAbortedExecTask(c *C) {
+func (S) TestFileExists(c *C) {
+	dir := c.MkDir()
 	p := pipe.Script(
-		pipe.TaskFunc(func(*pipe.State) error { return fmt.Errorf("boom") }),
-		pipe.Exec("will-not-run"),
+		pipe.ChDir(dir),
+		pipe.Line(
+			pipe.Print("hello"),
+			pipe.WriteFile("file", 0644),
+		),
+		pipe.FileExists("file"),
 	)
-	_, err := pipe.Output(p)
-	c.Assert(err, ErrorMatches, "boom")
+	c.Assert(pipe.Run(p), IsNil)
+
+	err := pipe.Run(pipe.FileExists(filepath.Join(dir, "missing")))
+	c.Assert(err, ErrorMatches, "stat .*/missing: no such file or directory")
+
+	err = pipe.Run(pipe.FileExists(dir))
+	c.Assert(err, ErrorMatches, "not a regular file: "+dir)
+}
+
+func (S) TestDirExists(c *C) {
+	dir := c.MkDir()
+	c.Assert(pipe.Run(pipe.DirExists(dir)), IsNil)
+
+	err := pipe.Run(pipe.DirExists(filepath.Join(dir, "missing")))
+	c.Assert(err, ErrorMatches, "stat .*/missing: no such file or directory")
+
+	path := filepath.Join(dir, "file")
+	c.Assert(ioutil.WriteFile(path, nil, 0644), IsNil)
+	err = pipe.Run(pipe.DirExists(path))
+	c.Assert(err, ErrorMatches, "not a directory: "+path)
+}
+
+func (S) TestEnvSet(c *C) {
+	p := pipe.Script(
+		pipe.SetEnvVar("PIPE_VAR", ""),
+		pipe.EnvSet("PIPE_VAR"),
+	)
+	c.Assert(pipe.Run(p), IsNil)
+
+	err := pipe.Run(pipe.EnvSet("PIPE_UNSET_VAR"))
+	c.Assert(err, ErrorMatches, "environment variable PIPE_UNSET_VAR is not set")
 }
 
 func (S) TestRenameFileAbsolute(c *C) {
@@ -845,3 +4412,203 @@ func (S) TestRenameFileRelative(c *C) {
 	_, err = os.Stat(to)
 	c.Assert(err, IsNil)
 }
+
+func (S) TestMoveFile(c *C) {
+	dir := c.MkDir()
+	p := pipe.Script(
+		pipe.ChDir(dir),
+		pipe.Line(pipe.Print("hello"), pipe.WriteFile("from", 0644)),
+		pipe.MoveFile("from", "to"),
+	)
+	c.Assert(pipe.Run(p), IsNil)
+	_, err := os.Stat(filepath.Join(dir, "from"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "to"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "hello")
+}
+
+func (S) TestMoveFileAcrossDevices(c *C) {
+	dir := c.MkDir()
+	other, err := ioutil.TempDir("/dev/shm", "pipe-test")
+	if err != nil {
+		c.Skip("no /dev/shm to move files across devices")
+	}
+	defer os.RemoveAll(other)
+	if sameDevice(dir, other) {
+		c.Skip("/dev/shm is not on a different device")
+	}
+
+	from := filepath.Join(other, "from")
+	to := filepath.Join(dir, "to")
+	c.Assert(ioutil.WriteFile(from, []byte("hello"), 0640), IsNil)
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	c.Assert(os.Chtimes(from, modTime, modTime), IsNil)
+
+	c.Assert(pipe.Run(pipe.RenameFile(from, to)), ErrorMatches, ".*invalid cross-device link")
+	c.Assert(pipe.Run(pipe.MoveFile(from, to)), IsNil)
+
+	_, err = os.Stat(from)
+	c.Assert(os.IsNotExist(err), Equals, true)
+	data, err := ioutil.ReadFile(to)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "hello")
+	stat, err := os.Stat(to)
+	c.Assert(err, IsNil)
+	c.Assert(stat.Mode()&os.ModePerm, Equals, os.FileMode(0640))
+	c.Assert(stat.ModTime().Equal(modTime), Equals, true)
+	entries, err := ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+}
+
+func (S) TestList(c *C) {
+	dir := c.MkDir()
+	files := []struct {
+		name string
+		size int
+		hour int
+	}{
+		{"b", 3, 2},
+		{"a", 1, 3},
+		{"c", 2, 1},
+		{".hidden", 0, 4},
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		c.Assert(ioutil.WriteFile(path, make([]byte, f.size), 0644), IsNil)
+		c.Assert(os.Chmod(path, 0644), IsNil)
+		mtime := time.Date(2020, 1, 2, f.hour, 0, 0, 0, time.UTC)
+		c.Assert(os.Chtimes(path, mtime, mtime), IsNil)
+	}
+	tests := []struct {
+		opts   pipe.ListOptions
+		result string
+	}{
+		{pipe.ListOptions{}, "a\nb\nc\n"},
+		{pipe.ListOptions{All: true}, ".hidden\na\nb\nc\n"},
+		{pipe.ListOptions{Reverse: true}, "c\nb\na\n"},
+		{pipe.ListOptions{Order: pipe.ListBySize}, "b\nc\na\n"},
+		{pipe.ListOptions{Order: pipe.ListByTime}, "a\nb\nc\n"},
+		{pipe.ListOptions{Order: pipe.ListByTime, Reverse: true}, "c\nb\na\n"},
+		{pipe.ListOptions{Long: true, Order: pipe.ListBySize}, "" +
+			"-rw-r--r--\t3\t2020-01-02T02:00:00Z\tb\n" +
+			"-rw-r--r--\t2\t2020-01-02T01:00:00Z\tc\n" +
+			"-rw-r--r--\t1\t2020-01-02T03:00:00Z\ta\n"},
+	}
+	for _, test := range tests {
+		p := pipe.Script(
+			pipe.ChDir(dir),
+			pipe.List(".", test.opts),
+		)
+		output, err := pipe.Output(p)
+		c.Assert(err, IsNil)
+		c.Assert(string(output), Equals, test.result, Commentf("options: %#v", test.opts))
+	}
+
+	_, err := pipe.Output(pipe.List(filepath.Join(dir, "missing"), pipe.ListOptions{}))
+	c.Assert(err, ErrorMatches, "open .*: no such file or directory")
+}
+
+func (S) TestStat(c *C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "file")
+	c.Assert(ioutil.WriteFile(path, []byte("hello"), 0644), IsNil)
+	c.Assert(os.Chmod(path, 0640), IsNil)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	c.Assert(os.Chtimes(path, mtime, mtime), IsNil)
+	c.Assert(os.Symlink("file", filepath.Join(dir, "link")), IsNil)
+
+	p := pipe.Script(
+		pipe.ChDir(dir),
+		pipe.Stat("link"),
+	)
+	output, err := pipe.Output(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "path: "+dir+"/link\nsize: 5\nmode: -rw-r-----\n"+
+		"mod_time: 2020-01-02T03:04:05Z\nis_dir: false\nis_link: true\nperm: 640\n")
+
+	output, err = pipe.Output(pipe.StatJSON(dir))
+	c.Assert(err, IsNil)
+	var st pipe.FileStat
+	c.Assert(json.Unmarshal(output, &st), IsNil)
+	c.Assert(st.Path, Equals, dir)
+	c.Assert(st.IsDir, Equals, true)
+	c.Assert(strings.HasSuffix(string(output), "}\n"), Equals, true)
+
+	var small bool
+	p = pipe.Script(
+		pipe.StatTo(path, &st),
+		pipe.Test(func(s *pipe.State) error {
+			small = st.Size < 10
+			return nil
+		}),
+	)
+	c.Assert(pipe.Run(p), IsNil)
+	c.Assert(st.Size, Equals, int64(5))
+	c.Assert(st.Perm, Equals, os.FileMode(0640))
+	c.Assert(st.ModTime.Equal(mtime), Equals, true)
+	c.Assert(small, Equals, true)
+
+	err = pipe.Run(pipe.Stat(filepath.Join(dir, "missing")))
+	c.Assert(err, ErrorMatches, "stat .*: no such file or directory")
+}
+
+func (S) TestDiskUsage(c *C) {
+	dir := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(dir, "a", "b"), 0755), IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(dir, "c"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "top"), make([]byte, 1), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "a", "f"), make([]byte, 10), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "a", "b", "f"), make([]byte, 100), 0644), IsNil)
+	c.Assert(os.Link(filepath.Join(dir, "a", "b", "f"), filepath.Join(dir, "c", "f")), IsNil)
+
+	tests := []struct {
+		depth  int
+		result string
+	}{
+		{-1, "100\tx/a/b\n110\tx/a\n0\tx/c\n111\tx\n"},
+		{0, "111\tx\n"},
+		{1, "110\tx/a\n0\tx/c\n111\tx\n"},
+	}
+	for _, test := range tests {
+		p := pipe.Script(
+			pipe.ChDir(filepath.Dir(dir)),
+			pipe.DiskUsage(filepath.Base(dir), test.depth),
+		)
+		output, err := pipe.Output(p)
+		c.Assert(err, IsNil)
+		result := strings.Replace(test.result, "x", filepath.Base(dir), -1)
+		c.Assert(string(output), Equals, result, Commentf("depth %d", test.depth))
+	}
+}
+
+func (S) TestWasmBuild(c *C) {
+	processPipes := map[string]bool{"Exec": true, "System": true, "Detach": true, "KillFromPIDFile": true}
+	for _, goos := range []string{"js", "wasip1"} {
+		ctx := build.Default
+		ctx.GOOS, ctx.GOARCH = goos, "wasm"
+		pkg, err := ctx.ImportDir(".", 0)
+		c.Assert(err, IsNil)
+		for _, name := range pkg.GoFiles {
+			file, err := parser.ParseFile(token.NewFileSet(), name, nil, 0)
+			c.Assert(err, IsNil)
+			for _, decl := range file.Decls {
+				if f, ok := decl.(*ast.FuncDecl); ok && f.Recv == nil && processPipes[f.Name.Name] {
+					c.Errorf("%s is built on %s/wasm by %s", f.Name.Name, goos, name)
+				}
+			}
+		}
+
+		if _, err := exec.LookPath("go"); err != nil {
+			continue
+		}
+		p := pipe.Script(
+			pipe.SetEnvVar("GOOS", ctx.GOOS),
+			pipe.SetEnvVar("GOARCH", ctx.GOARCH),
+			pipe.Exec("go", "build", "./..."),
+		)
+		output, err := pipe.CombinedOutput(p)
+		c.Assert(err, IsNil, Commentf("%s/wasm: %s", goos, output))
+	}
+}
@@ -0,0 +1,100 @@
+// pipe - Unix-like pipelines for Go
+//
+// Copyright (c) 2013 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build !windows && !wasm
+// +build !windows,!wasm
+
+package pipe
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+type localProcess struct {
+	cmd *exec.Cmd
+}
+
+func (p *localProcess) start() error { return p.cmd.Start() }
+func (p *localProcess) Wait() error  { return p.cmd.Wait() }
+func (p *localProcess) Kill() error  { return p.cmd.Process.Kill() }
+
+func (p *localProcess) Signal(sig os.Signal) error { return p.cmd.Process.Signal(sig) }
+
+const sigPIPE = syscall.SIGPIPE
+
+var (
+	errNoProcess = errors.New("no such process")
+	errLocked    = errors.New("file is locked")
+)
+
+// detachedAttr returns the attributes for starting a process
+// detached from the current one, in a new session.
+func detachedAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
+
+// signalPID sends sig to the process with the given pid, and
+// returns errNoProcess if the process does not exist.
+func signalPID(pid int, sig syscall.Signal) error {
+	err := syscall.Kill(pid, sig)
+	if err == syscall.ESRCH {
+		return errNoProcess
+	}
+	return err
+}
+
+// lockFile takes an exclusive lock on file without blocking, and
+// returns errLocked if the lock is held elsewhere. The lock is
+// released when the file is closed.
+func lockFile(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return errLocked
+	}
+	return err
+}
+
+// fileOwner returns the user and group owning the file described by info.
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
+
+// hardLinkID returns an identifier shared by all the hard links to the
+// file described by info, if the file has more than one of them.
+func hardLinkID(info os.FileInfo) (id [2]uint64, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink <= 1 {
+		return id, false
+	}
+	return [2]uint64{uint64(st.Dev), uint64(st.Ino)}, true
+}
@@ -0,0 +1,69 @@
+// pipe - Unix-like pipelines for Go
+//
+// Copyright (c) 2013 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package pipe
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// WebAssembly has no processes, so the pipes that run commands as
+// local processes, such as Exec and System, are not available, while
+// the remaining pipes work as usual. Commands described by a Spec may
+// still be run via a custom Executor.
+
+const sigPIPE = syscall.Signal(13)
+
+var (
+	errNoProcesses = errors.New("processes are not supported on wasm")
+	errLocked      = errors.New("file is locked")
+)
+
+// noExecutor fails to start any command.
+type noExecutor struct{}
+
+func (noExecutor) Start(spec CommandSpec, streams Streams) (Process, error) {
+	return nil, errNoProcesses
+}
+
+// localExecutor returns the Executor used when the State has none.
+func localExecutor() Executor {
+	return noExecutor{}
+}
+
+func lockFile(file *os.File) error {
+	return errors.New("file locking is not supported on wasm")
+}
+
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+func hardLinkID(info os.FileInfo) (id [2]uint64, ok bool) {
+	return id, false
+}
@@ -0,0 +1,192 @@
+// pipe - Unix-like pipelines for Go
+//
+// Copyright (c) 2013 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package pipe
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32                     = syscall.NewLazyDLL("kernel32.dll")
+	procCreateJobObjectW         = kernel32.NewProc("CreateJobObjectW")
+	procAssignProcessToJobObject = kernel32.NewProc("AssignProcessToJobObject")
+	procTerminateJobObject       = kernel32.NewProc("TerminateJobObject")
+	procLockFileEx               = kernel32.NewProc("LockFileEx")
+
+	ntdll               = syscall.NewLazyDLL("ntdll.dll")
+	procNtResumeProcess = ntdll.NewProc("NtResumeProcess")
+)
+
+const (
+	processSetQuota      = 0x0100
+	processTerminate     = 0x0001
+	processSuspendResume = 0x0800
+
+	createSuspended = 0x00000004
+
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+	errorLockViolation      = syscall.Errno(33)
+
+	detachedProcessFlag = 0x00000008
+)
+
+// localProcess runs the command in a job object, so that killing it
+// also terminates any processes it started, as happens with process
+// trees on Unix when their parent dies holding the pipe streams.
+type localProcess struct {
+	cmd *exec.Cmd
+
+	m   sync.Mutex
+	job syscall.Handle
+}
+
+func (p *localProcess) start() error {
+	// The process is started suspended and only resumed once it's in
+	// the job, so that processes it starts right away are in it too.
+	if p.cmd.SysProcAttr == nil {
+		p.cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	p.cmd.SysProcAttr.CreationFlags |= createSuspended
+	if err := p.cmd.Start(); err != nil {
+		return err
+	}
+	h, err := syscall.OpenProcess(processSetQuota|processTerminate|processSuspendResume, false, uint32(p.cmd.Process.Pid))
+	if err != nil {
+		p.abort()
+		return fmt.Errorf("cannot resume process: %v", err)
+	}
+	defer syscall.CloseHandle(h)
+	// If the job object can't be set up, the process is killed alone.
+	if job, _, _ := procCreateJobObjectW.Call(0, 0); job != 0 {
+		if ok, _, _ := procAssignProcessToJobObject.Call(job, uintptr(h)); ok != 0 {
+			p.job = syscall.Handle(job)
+		} else {
+			syscall.CloseHandle(syscall.Handle(job))
+		}
+	}
+	if status, _, _ := procNtResumeProcess.Call(uintptr(h)); status != 0 {
+		p.abort()
+		return fmt.Errorf("cannot resume process: NTSTATUS 0x%x", status)
+	}
+	return nil
+}
+
+// abort kills the process after it failed to be set up.
+func (p *localProcess) abort() {
+	p.Kill()
+	p.Wait()
+}
+
+func (p *localProcess) Wait() error {
+	err := p.cmd.Wait()
+	p.m.Lock()
+	if p.job != 0 {
+		syscall.CloseHandle(p.job)
+		p.job = 0
+	}
+	p.m.Unlock()
+	return err
+}
+
+func (p *localProcess) Kill() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.job != 0 {
+		if ok, _, err := procTerminateJobObject.Call(uintptr(p.job), 1); ok == 0 {
+			return err
+		}
+		return nil
+	}
+	return p.cmd.Process.Kill()
+}
+
+const sigPIPE = syscall.SIGPIPE
+
+var (
+	errNoProcess = errors.New("no such process")
+	errLocked    = errors.New("file is locked")
+)
+
+// detachedAttr returns the attributes for starting a process
+// detached from the current one and from its console.
+func detachedAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP | detachedProcessFlag,
+	}
+}
+
+// signalPID terminates the process with the given pid, as Windows has
+// no signals, and returns errNoProcess if the process does not exist.
+func signalPID(pid int, sig syscall.Signal) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		if errors.Is(err, syscall.ERROR_ACCESS_DENIED) {
+			return err
+		}
+		return errNoProcess
+	}
+	defer p.Release()
+	err = p.Kill()
+	if err == os.ErrProcessDone {
+		return errNoProcess
+	}
+	return err
+}
+
+// lockFile takes an exclusive lock on file without blocking, and
+// returns errLocked if the lock is held elsewhere. The lock is
+// released when the file is closed.
+func lockFile(file *os.File) error {
+	var ol syscall.Overlapped
+	ok, _, err := procLockFileEx.Call(file.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if ok == 0 {
+		if err == errorLockViolation {
+			return errLocked
+		}
+		return err
+	}
+	return nil
+}
+
+// fileOwner returns the user and group owning the file described by
+// info, which are not available on Windows.
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+// hardLinkID returns an identifier shared by all the hard links to the
+// file described by info, which is not available on Windows.
+func hardLinkID(info os.FileInfo) (id [2]uint64, ok bool) {
+	return id, false
+}
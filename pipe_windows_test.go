@@ -0,0 +1,69 @@
+// pipe - Unix-like pipelines for Go
+//
+// Copyright (c) 2013 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package pipe_test
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/pipe.v2"
+)
+
+// processGroup returns pid, as processes started in a new process
+// group on Windows have the group id of their own process id.
+func processGroup(pid int) (int, error) {
+	return pid, nil
+}
+
+func sameDevice(path1, path2 string) bool {
+	return strings.EqualFold(filepath.VolumeName(path1), filepath.VolumeName(path2))
+}
+
+func (S) TestWindowsExec(c *C) {
+	output, err := pipe.Output(pipe.Exec("cmd", "/c", "echo hello"))
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "hello\r\n")
+}
+
+func (S) TestWindowsKillProcessTree(c *C) {
+	// The child keeps the stdout pipe open, so the pipe is only done
+	// before it exits if killing the command kills the child as well.
+	p := pipe.Exec("cmd", "/c", "ping -n 30 127.0.0.1")
+	started := time.Now()
+	_, err := pipe.OutputTimeout(p, 500*time.Millisecond)
+	c.Assert(err, ErrorMatches, "timeout")
+	c.Assert(time.Since(started) < 10*time.Second, Equals, true)
+
+	// Children started right away are killed as well.
+	p = pipe.Exec("cmd", "/c", "start /b ping -n 30 127.0.0.1 & ping -n 30 127.0.0.1")
+	started = time.Now()
+	_, err = pipe.OutputTimeout(p, 500*time.Millisecond)
+	c.Assert(err, ErrorMatches, "timeout")
+	c.Assert(time.Since(started) < 10*time.Second, Equals, true)
+}
@@ -0,0 +1,512 @@
+// pipe - Unix-like pipelines for Go
+//
+// Copyright (c) 2013 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package pipetest offers helpers for testing and benchmarking pipes.
+package pipetest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"gopkg.in/pipe.v2"
+)
+
+// GenerateLines returns size bytes of deterministic text organized
+// in lines, suitable as input for pipes that process lines.
+func GenerateLines(size int) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, size+64))
+	for i := 1; buf.Len() < size; i++ {
+		fmt.Fprintf(buf, "line %08d the quick brown fox jumps over the lazy dog\n", i)
+	}
+	return buf.Bytes()[:size]
+}
+
+// Benchmark runs p b.N times with size bytes of text generated by
+// GenerateLines as its stdin, reporting the throughput and allocations
+// of each run. The output of p is discarded.
+//
+// For example:
+//
+//    func BenchmarkFilter(b *testing.B) {
+//        pipetest.Benchmark(b, pipe.Filter(isValid), 1024*1024)
+//    }
+//
+func Benchmark(b *testing.B, p pipe.Pipe, size int) {
+	BenchmarkInput(b, p, GenerateLines(size))
+}
+
+// BenchmarkInput works like Benchmark, but provides input as
+// the stdin of each run of p.
+func BenchmarkInput(b *testing.B, p pipe.Pipe, input []byte) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(input)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := pipe.NewState(nil, nil)
+		s.Stdin = bytes.NewReader(input)
+		if err := p(s); err != nil {
+			b.Fatal(err)
+		}
+		if err := s.RunTasks(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Record describes a command executed by a Recorder.
+type Record struct {
+	Name     string   `json:"name"`
+	Args     []string `json:"args,omitempty"`
+	Dir      string   `json:"dir,omitempty"`
+	Stdin    string   `json:"stdin-sha256"`
+	Stdout   []byte   `json:"stdout,omitempty"`
+	Stderr   []byte   `json:"stderr,omitempty"`
+	ExitCode int      `json:"exit-code"`
+}
+
+// Recorder is a pipe.Executor that runs commands via another executor
+// and records their arguments, the digest of the data they read from
+// stdin, their output, and their exit status. The recorded commands may
+// be saved as a fixture file to be served by a Replayer.
+//
+// For example:
+//
+//    recorder := &pipetest.Recorder{}
+//    s := pipe.NewState(os.Stdout, os.Stderr)
+//    s.Executor = recorder
+//    ...
+//    err = recorder.Save("testdata/fixture.json")
+//
+type Recorder struct {
+	// Executor runs the recorded commands. If nil,
+	// pipe.DefaultExecutor is used.
+	Executor pipe.Executor
+
+	m       sync.Mutex
+	records []Record
+}
+
+// Records returns the commands recorded so far,
+// in the order they terminated.
+func (r *Recorder) Records() []Record {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return append([]Record(nil), r.records...)
+}
+
+// Save writes the commands recorded so far to the fixture file at path.
+func (r *Recorder) Save(path string) error {
+	data, err := json.MarshalIndent(r.Records(), "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Start starts the command described by spec via the underlying
+// executor, recording its execution.
+func (r *Recorder) Start(spec pipe.CommandSpec, streams pipe.Streams) (pipe.Process, error) {
+	executor := r.Executor
+	if executor == nil {
+		executor = pipe.DefaultExecutor()
+	}
+	p := &recordedProcess{r: r, stdin: sha256.New()}
+	p.record = Record{Name: spec.Name, Args: spec.Args, Dir: spec.Dir}
+	wrapped := pipe.Streams{
+		Stdin:  io.TeeReader(streams.Stdin, p.stdin),
+		Stdout: &recordWriter{streams.Stdout, &p.m, &p.record.Stdout},
+		Stderr: &recordWriter{streams.Stderr, &p.m, &p.record.Stderr},
+	}
+	if sameWriter(streams.Stdout, streams.Stderr) {
+		wrapped.Stderr = wrapped.Stdout
+	}
+	process, err := executor.Start(spec, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	p.Process = process
+	return p, nil
+}
+
+// sameWriter reports whether a and b are the same writer,
+// without panicking on writers of uncomparable types.
+func sameWriter(a, b io.Writer) (same bool) {
+	defer func() {
+		if recover() != nil {
+			same = false
+		}
+	}()
+	return a == b
+}
+
+type recordedProcess struct {
+	pipe.Process
+	r      *Recorder
+	m      sync.Mutex
+	stdin  hash.Hash
+	record Record
+}
+
+func (p *recordedProcess) Wait() error {
+	err := p.Process.Wait()
+	p.m.Lock()
+	record := p.record
+	p.m.Unlock()
+	record.Stdin = hex.EncodeToString(p.stdin.Sum(nil))
+	record.ExitCode = exitCode(err)
+	p.r.m.Lock()
+	p.r.records = append(p.r.records, record)
+	p.r.m.Unlock()
+	return err
+}
+
+type recordWriter struct {
+	w   io.Writer
+	m   *sync.Mutex
+	buf *[]byte
+}
+
+func (w *recordWriter) Write(b []byte) (int, error) {
+	w.m.Lock()
+	*w.buf = append(*w.buf, b...)
+	w.m.Unlock()
+	return w.w.Write(b)
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if e, ok := err.(interface{ ExitCode() int }); ok {
+		return e.ExitCode()
+	}
+	return -1
+}
+
+// Replayer is a pipe.Executor that serves commands from the records
+// in a fixture file saved by a Recorder, without running them.
+// Each record is served once, to the first started command with the
+// same name and arguments. The data read from stdin by the command
+// must match the recorded digest.
+type Replayer struct {
+	m       sync.Mutex
+	records []Record
+	used    []bool
+}
+
+// LoadReplayer returns a Replayer serving the
+// records in the fixture file at path.
+func LoadReplayer(path string) (*Replayer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var records []Record
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("cannot parse fixture file %s: %v", path, err)
+	}
+	return NewReplayer(records), nil
+}
+
+// NewReplayer returns a Replayer serving the provided records.
+func NewReplayer(records []Record) *Replayer {
+	return &Replayer{records: records, used: make([]bool, len(records))}
+}
+
+// Unused returns the records that weren't served so far.
+func (r *Replayer) Unused() []Record {
+	r.m.Lock()
+	defer r.m.Unlock()
+	var unused []Record
+	for i, record := range r.records {
+		if !r.used[i] {
+			unused = append(unused, record)
+		}
+	}
+	return unused
+}
+
+// Fixture returns an executor for tests that replays the commands in
+// the fixture file at path, along with a function to be called once
+// the test is done, which fails if any of the records wasn't served.
+// If the PIPETEST_RECORD environment variable is set, the commands are
+// instead run and recorded, and the done function saves them to path,
+// so that fixtures may be refreshed by running the tests again.
+//
+// For example:
+//
+//    func (s *S) TestSync(c *C) {
+//        executor, done, err := pipetest.Fixture("testdata/sync.json")
+//        c.Assert(err, IsNil)
+//        st := pipe.NewState(nil, nil)
+//        st.Executor = executor
+//        ...
+//        c.Assert(done(), IsNil)
+//    }
+//
+func Fixture(path string) (executor pipe.Executor, done func() error, err error) {
+	if os.Getenv("PIPETEST_RECORD") != "" {
+		r := &Recorder{}
+		return r, func() error { return r.Save(path) }, nil
+	}
+	r, err := LoadReplayer(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r, func() error {
+		if unused := r.Unused(); len(unused) > 0 {
+			return fmt.Errorf("fixture %s has %d unused records, starting with command %q %q", path, len(unused), unused[0].Name, unused[0].Args)
+		}
+		return nil
+	}, nil
+}
+
+// Start serves the command described by spec from the next
+// unused record with the same name and arguments.
+func (r *Replayer) Start(spec pipe.CommandSpec, streams pipe.Streams) (pipe.Process, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	for i, record := range r.records {
+		if !r.used[i] && record.Name == spec.Name && reflect.DeepEqual(record.Args, spec.Args) {
+			r.used[i] = true
+			return startCanned(streams, func(stdin []byte) (Result, error) {
+				sum := sha256.Sum256(stdin)
+				if digest := hex.EncodeToString(sum[:]); digest != record.Stdin {
+					return Result{}, fmt.Errorf("stdin digest %s does not match recorded digest %s", digest, record.Stdin)
+				}
+				return Result{Stdout: string(record.Stdout), Stderr: string(record.Stderr), ExitCode: record.ExitCode}, nil
+			}), nil
+		}
+	}
+	return nil, fmt.Errorf("no recorded execution for command %q %q", spec.Name, spec.Args)
+}
+
+// cannedProcess is a pipe.Process serving a command without running
+// it, as done by Replayer and FakeExec. It reads the command's stdin until EOF, and then writes to the
+// command's stdout and stderr the result computed from that data.
+type cannedProcess struct {
+	streams pipe.Streams
+	result  func(stdin []byte) (Result, error)
+	done    chan bool
+	err     error
+
+	m      sync.Mutex
+	killed bool
+}
+
+// startCanned starts serving a command with the provided streams
+// and the result computed by calling result with its stdin data.
+func startCanned(streams pipe.Streams, result func(stdin []byte) (Result, error)) *cannedProcess {
+	p := &cannedProcess{streams: streams, result: result, done: make(chan bool)}
+	go func() {
+		err := p.run()
+		if p.isKilled() {
+			err = errKilled
+		}
+		p.err = err
+		close(p.done)
+	}()
+	return p
+}
+
+func (p *cannedProcess) isKilled() bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.killed
+}
+
+func (p *cannedProcess) run() error {
+	var stdin bytes.Buffer
+	buf := make([]byte, 32*1024)
+	for {
+		if p.isKilled() {
+			return errKilled
+		}
+		n, err := p.streams.Stdin.Read(buf)
+		stdin.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	result, err := p.result(stdin.Bytes())
+	if err != nil {
+		return err
+	}
+	if p.isKilled() {
+		return errKilled
+	}
+	if _, err := io.WriteString(p.streams.Stdout, result.Stdout); err != nil {
+		return err
+	}
+	if p.isKilled() {
+		return errKilled
+	}
+	if _, err := io.WriteString(p.streams.Stderr, result.Stderr); err != nil {
+		return err
+	}
+	if result.ExitCode != 0 {
+		return &ExitError{result.ExitCode}
+	}
+	return nil
+}
+
+// Wait waits for the command to be served, so that its streams
+// aren't used anymore once it returns.
+func (p *cannedProcess) Wait() error {
+	<-p.done
+	return p.err
+}
+
+// Kill stops serving the command as soon as possible. As done for
+// a killed process, a pipe feeding its stdin is closed, so that
+// neither side stays blocked on it.
+func (p *cannedProcess) Kill() error {
+	p.m.Lock()
+	p.killed = true
+	p.m.Unlock()
+	if r, ok := p.streams.Stdin.(*io.PipeReader); ok {
+		r.Close()
+	}
+	return nil
+}
+
+// ExitError is returned by commands served by a Replayer that were
+// recorded as failing, and by commands served by a FakeExec with
+// a non-zero exit status.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// ExitCode returns the recorded exit status.
+func (e *ExitError) ExitCode() int {
+	return e.Code
+}
+
+// Result defines the outcome of a command served by a FakeExec.
+type Result struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+// Call describes a command started via a FakeExec.
+type Call struct {
+	Name string
+	Args []string
+	Dir  string
+	Env  []string
+
+	// Stdin holds the data read by the command from its stdin.
+	Stdin string
+}
+
+// FakeExec is a pipe.Executor that serves commands from canned results
+// registered by command name, without running them, and records how
+// the commands were started. Commands run via pipe.System are named
+// "/bin/sh", with the script following the "-c" argument. A command
+// without a registered result fails to start.
+//
+// For example:
+//
+//    fake := &pipetest.FakeExec{}
+//    fake.Stub("git", pipetest.Result{Stdout: "main\n"})
+//    s := pipe.NewState(&stdout, nil)
+//    s.Executor = fake
+//    ...
+//    calls := fake.Calls()
+//
+type FakeExec struct {
+	m       sync.Mutex
+	results map[string]func(call Call) Result
+	calls   []*Call
+}
+
+// Stub registers result as the outcome of commands with the given name.
+func (f *FakeExec) Stub(name string, result Result) {
+	f.StubFunc(name, func(Call) Result { return result })
+}
+
+// StubFunc registers fn for computing the outcome of commands with
+// the given name, once the data they read from stdin is known.
+func (f *FakeExec) StubFunc(name string, fn func(call Call) Result) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if f.results == nil {
+		f.results = make(map[string]func(call Call) Result)
+	}
+	f.results[name] = fn
+}
+
+// Calls returns the commands started so far, in the order they started.
+// The Stdin field is only set for commands that already terminated.
+func (f *FakeExec) Calls() []Call {
+	f.m.Lock()
+	defer f.m.Unlock()
+	calls := make([]Call, len(f.calls))
+	for i, call := range f.calls {
+		calls[i] = *call
+	}
+	return calls
+}
+
+// Start serves the command described by spec from its registered result.
+func (f *FakeExec) Start(spec pipe.CommandSpec, streams pipe.Streams) (pipe.Process, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	fn, ok := f.results[spec.Name]
+	if !ok {
+		return nil, fmt.Errorf("no stub for command %q", spec.Name)
+	}
+	call := &Call{Name: spec.Name, Args: spec.Args, Dir: spec.Dir, Env: spec.Env}
+	f.calls = append(f.calls, call)
+	return startCanned(streams, func(stdin []byte) (Result, error) {
+		f.m.Lock()
+		call.Stdin = string(stdin)
+		c := *call
+		f.m.Unlock()
+		return fn(c), nil
+	}), nil
+}
+
+var errKilled = errors.New("signal: killed")
@@ -0,0 +1,321 @@
+// pipe - Unix-like pipelines for Go
+//
+// Copyright (c) 2013 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package pipetest_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/pipe.v2"
+	"gopkg.in/pipe.v2/pipetest"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type S struct{}
+
+var _ = Suite(S{})
+
+func (S) TestGenerateLines(c *C) {
+	data := pipetest.GenerateLines(1000)
+	c.Assert(data, HasLen, 1000)
+	c.Assert(strings.HasPrefix(string(data), "line 00000001 the quick"), Equals, true)
+	c.Assert(bytes.Equal(data, pipetest.GenerateLines(1000)), Equals, true)
+}
+
+func (S) TestRecordReplay(c *C) {
+	recorder := &pipetest.Recorder{}
+	p := pipe.Script(
+		pipe.Line(
+			pipe.Print("hello\n"),
+			pipe.Exec("sed", "s/l/k/g"),
+		),
+		pipe.System("echo out; echo err 1>&2; exit 3"),
+	)
+	s := pipe.NewState(&bytes.Buffer{}, &bytes.Buffer{})
+	s.Executor = recorder
+	c.Assert(p(s), IsNil)
+	c.Assert(s.RunTasks(), ErrorMatches, `script\[1\]: command "/bin/sh" .*: exit status 3: err`)
+
+	records := recorder.Records()
+	c.Assert(records, HasLen, 2)
+	c.Assert(records[0].Name, Equals, "sed")
+	c.Assert(records[0].Args, DeepEquals, []string{"s/l/k/g"})
+	c.Assert(records[0].Stdin, Equals, "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03")
+	c.Assert(string(records[0].Stdout), Equals, "hekko\n")
+	c.Assert(records[0].ExitCode, Equals, 0)
+	c.Assert(records[1].Name, Equals, "/bin/sh")
+	c.Assert(string(records[1].Stdout), Equals, "out\n")
+	c.Assert(string(records[1].Stderr), Equals, "err\n")
+	c.Assert(records[1].ExitCode, Equals, 3)
+
+	path := filepath.Join(c.MkDir(), "fixture.json")
+	c.Assert(recorder.Save(path), IsNil)
+	replayer, err := pipetest.LoadReplayer(path)
+	c.Assert(err, IsNil)
+
+	var stdout, stderr bytes.Buffer
+	s = pipe.NewState(&stdout, &stderr)
+	s.Executor = replayer
+	c.Assert(p(s), IsNil)
+	c.Assert(s.RunTasks(), ErrorMatches, `script\[1\]: command "/bin/sh" .*: exit status 3: err`)
+	c.Assert(stdout.String(), Equals, "hekko\nout\n")
+	c.Assert(stderr.String(), Equals, "err\n")
+
+	// Records are only served once.
+	s = pipe.NewState(nil, nil)
+	s.Executor = replayer
+	c.Assert(p(s), IsNil)
+	c.Assert(s.RunTasks(), ErrorMatches, `line\[1\]: no recorded execution for command "sed" \["s/l/k/g"\]`)
+}
+
+func (S) TestFixture(c *C) {
+	path := filepath.Join(c.MkDir(), "fixture.json")
+	p := pipe.Line(
+		pipe.Print("hello\n"),
+		pipe.Exec("sed", "s/l/k/g"),
+	)
+
+	_, _, err := pipetest.Fixture(path)
+	c.Assert(err, ErrorMatches, "open .*fixture.json: no such file or directory")
+
+	os.Setenv("PIPETEST_RECORD", "1")
+	executor, done, err := pipetest.Fixture(path)
+	os.Unsetenv("PIPETEST_RECORD")
+	c.Assert(err, IsNil)
+	var stdout bytes.Buffer
+	s := pipe.NewState(&stdout, nil)
+	s.Executor = executor
+	c.Assert(p(s), IsNil)
+	c.Assert(s.RunTasks(), IsNil)
+	c.Assert(done(), IsNil)
+	c.Assert(stdout.String(), Equals, "hekko\n")
+
+	executor, done, err = pipetest.Fixture(path)
+	c.Assert(err, IsNil)
+	_, ok := executor.(*pipetest.Replayer)
+	c.Assert(ok, Equals, true)
+	c.Assert(done(), ErrorMatches, `fixture .*fixture.json has 1 unused records, starting with command "sed" \["s/l/k/g"\]`)
+	stdout.Reset()
+	s = pipe.NewState(&stdout, nil)
+	s.Executor = executor
+	c.Assert(p(s), IsNil)
+	c.Assert(s.RunTasks(), IsNil)
+	c.Assert(done(), IsNil)
+	c.Assert(stdout.String(), Equals, "hekko\n")
+}
+
+func (S) TestReplayStdinMismatch(c *C) {
+	replayer := pipetest.NewReplayer([]pipetest.Record{{Name: "cat", Stdin: "bad", Stdout: []byte("x")}})
+	s := pipe.NewState(nil, nil)
+	s.Executor = replayer
+	c.Assert(pipe.Line(pipe.Print("hello"), pipe.Exec("cat"))(s), IsNil)
+	c.Assert(s.RunTasks(), ErrorMatches, `line\[1\]: command "cat": stdin digest [0-9a-f]+ does not match recorded digest bad`)
+}
+
+func (S) TestReplayKill(c *C) {
+	replayer := pipetest.NewReplayer([]pipetest.Record{{Name: "cat"}})
+	r, w := io.Pipe()
+	defer w.Close()
+	s := pipe.NewState(nil, nil)
+	s.Executor = replayer
+	s.Stdin = r
+	s.Timeout = 50 * time.Millisecond
+	c.Assert(pipe.Exec("cat")(s), IsNil)
+	c.Assert(s.RunTasks(), ErrorMatches, "timeout")
+}
+
+// blockingReader reports on reading when a read starts, and blocks
+// the read until release is closed, reporting EOF then.
+type blockingReader struct {
+	reading chan bool
+	release chan bool
+}
+
+func (r *blockingReader) Read([]byte) (int, error) {
+	r.reading <- true
+	<-r.release
+	return 0, io.EOF
+}
+
+func (S) TestReplayKillWaits(c *C) {
+	replayer := pipetest.NewReplayer([]pipetest.Record{{Name: "echo", Stdout: []byte("hello")}, {Name: "cat"}})
+	stdin := &blockingReader{make(chan bool, 1), make(chan bool)}
+	var stdout bytes.Buffer
+	p, err := replayer.Start(pipe.CommandSpec{Name: "echo"}, pipe.Streams{Stdin: stdin, Stdout: &stdout, Stderr: &stdout})
+	c.Assert(err, IsNil)
+	<-stdin.reading
+	c.Assert(p.Kill(), IsNil)
+	waited := make(chan error, 1)
+	go func() { waited <- p.Wait() }()
+	select {
+	case <-waited:
+		c.Fatalf("Wait returned while the command was still reading its stdin")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(stdin.release)
+	c.Assert(<-waited, ErrorMatches, "signal: killed")
+	c.Assert(stdout.String(), Equals, "")
+
+	// A pipe feeding the stdin is closed so that neither side blocks.
+	r, w := io.Pipe()
+	p, err = replayer.Start(pipe.CommandSpec{Name: "cat"}, pipe.Streams{Stdin: r, Stdout: &stdout, Stderr: &stdout})
+	c.Assert(err, IsNil)
+	c.Assert(p.Kill(), IsNil)
+	c.Assert(p.Wait(), ErrorMatches, "signal: killed")
+	_, err = w.Write([]byte("data"))
+	c.Assert(err, Equals, io.ErrClosedPipe)
+}
+
+// uncomparableWriter discards the data written to it,
+// and panics if compared with another of its kind.
+type uncomparableWriter struct {
+	data []byte
+}
+
+func (w uncomparableWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (S) TestRecordUncomparableWriters(c *C) {
+	fake := &pipetest.FakeExec{}
+	fake.Stub("echo", pipetest.Result{Stdout: "hello"})
+	recorder := &pipetest.Recorder{Executor: fake}
+	streams := pipe.Streams{Stdin: strings.NewReader(""), Stdout: uncomparableWriter{}, Stderr: uncomparableWriter{}}
+	p, err := recorder.Start(pipe.CommandSpec{Name: "echo"}, streams)
+	c.Assert(err, IsNil)
+	c.Assert(p.Wait(), IsNil)
+	c.Assert(recorder.Records(), HasLen, 1)
+	c.Assert(string(recorder.Records()[0].Stdout), Equals, "hello")
+}
+
+func (S) TestFakeExec(c *C) {
+	fake := &pipetest.FakeExec{}
+	fake.Stub("git", pipetest.Result{Stdout: "main\n"})
+	fake.StubFunc("tr", func(call pipetest.Call) pipetest.Result {
+		return pipetest.Result{Stdout: strings.ToUpper(call.Stdin)}
+	})
+	fake.Stub("/bin/sh", pipetest.Result{Stderr: "failed\n", ExitCode: 3})
+
+	p := pipe.Script(
+		pipe.ChDir("/repo"),
+		pipe.SetEnvVar("MODE", "test"),
+		pipe.Line(
+			pipe.Exec("git", "branch", "--show-current"),
+			pipe.Exec("tr", "a-z", "A-Z"),
+		),
+		pipe.System("make deploy"),
+	)
+	var stdout, stderr bytes.Buffer
+	s := pipe.NewState(&stdout, &stderr)
+	s.Executor = fake
+	c.Assert(p(s), IsNil)
+	err := s.RunTasks()
+	c.Assert(err, ErrorMatches, `script\[3\]: command "/bin/sh" \["-c" "make deploy"\] in "/repo": exit status 3: failed`)
+	status, ok := pipe.ExitStatus(err)
+	c.Assert(ok, Equals, true)
+	c.Assert(status, Equals, 3)
+	c.Assert(stdout.String(), Equals, "MAIN\n")
+	c.Assert(stderr.String(), Equals, "failed\n")
+
+	calls := fake.Calls()
+	c.Assert(calls, HasLen, 3)
+	// The entries of the line start concurrently.
+	if calls[0].Name == "tr" {
+		calls[0], calls[1] = calls[1], calls[0]
+	}
+	c.Assert(calls[0].Name, Equals, "git")
+	c.Assert(calls[0].Args, DeepEquals, []string{"branch", "--show-current"})
+	c.Assert(calls[0].Dir, Equals, "/repo")
+	c.Assert(calls[1].Name, Equals, "tr")
+	c.Assert(calls[1].Stdin, Equals, "main\n")
+	c.Assert(calls[2].Args, DeepEquals, []string{"-c", "make deploy"})
+	c.Assert(calls[2].Env[len(calls[2].Env)-1], Equals, "MODE=test")
+
+	s = pipe.NewState(nil, nil)
+	s.Executor = fake
+	c.Assert(pipe.Exec("rm", "-rf", "/")(s), IsNil)
+	c.Assert(s.RunTasks(), ErrorMatches, `no stub for command "rm"`)
+}
+
+func (S) TestFakeExecKill(c *C) {
+	fake := &pipetest.FakeExec{}
+	fake.Stub("cat", pipetest.Result{})
+	r, w := io.Pipe()
+	defer w.Close()
+	s := pipe.NewState(nil, nil)
+	s.Executor = fake
+	s.Stdin = r
+	s.Timeout = 50 * time.Millisecond
+	c.Assert(pipe.Exec("cat")(s), IsNil)
+	c.Assert(s.RunTasks(), ErrorMatches, "timeout")
+
+	// The streams aren't used anymore once Wait returns.
+	fake.Stub("echo", pipetest.Result{Stdout: "hello"})
+	stdin := &blockingReader{make(chan bool, 1), make(chan bool)}
+	var stdout bytes.Buffer
+	p, err := fake.Start(pipe.CommandSpec{Name: "echo"}, pipe.Streams{Stdin: stdin, Stdout: &stdout, Stderr: &stdout})
+	c.Assert(err, IsNil)
+	<-stdin.reading
+	c.Assert(p.Kill(), IsNil)
+	waited := make(chan error, 1)
+	go func() { waited <- p.Wait() }()
+	select {
+	case <-waited:
+		c.Fatalf("Wait returned while the command was still reading its stdin")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(stdin.release)
+	c.Assert(<-waited, ErrorMatches, "signal: killed")
+	c.Assert(stdout.String(), Equals, "")
+}
+
+func BenchmarkFilter(b *testing.B) {
+	p := pipe.Filter(func(line []byte) bool { return bytes.Contains(line, []byte("7")) })
+	pipetest.Benchmark(b, p, 1024*1024)
+}
+
+func BenchmarkExecGrep(b *testing.B) {
+	pipetest.Benchmark(b, pipe.Exec("grep", "7"), 1024*1024)
+}
+
+func BenchmarkLine(b *testing.B) {
+	p := pipe.Line(
+		pipe.Filter(func(line []byte) bool { return bytes.Contains(line, []byte("7")) }),
+		pipe.Exec("cat"),
+		pipe.Discard(),
+	)
+	pipetest.Benchmark(b, p, 1024*1024)
+}
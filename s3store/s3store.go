@@ -0,0 +1,357 @@
+// pipe - Unix-like pipelines for Go
+//
+// Copyright (c) 2013 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package s3store implements pipe.ObjectStore for S3-compatible
+// object storage services.
+//
+// For example, this streams a backup to a bucket:
+//
+//    s := pipe.NewState(nil, os.Stderr)
+//    s.ObjectStore = &s3store.Store{
+//        Endpoint:  "https://s3.eu-west-1.amazonaws.com",
+//        Region:    "eu-west-1",
+//        AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+//        SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+//    }
+//    p := pipe.Line(
+//        pipe.Exec("tar", "cz", "/home"),
+//        pipe.WriteObject("backups", "home.tar.gz"),
+//    )
+//
+package s3store
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultPartSize is the default size of the parts in which
+// large objects are uploaded.
+const DefaultPartSize = 16 << 20
+
+// Store is an object store accessed via the S3 API. Requests are
+// authenticated with AWS Signature Version 4 and buckets are addressed
+// in the path of requests, as supported by most S3-compatible services.
+type Store struct {
+	// Endpoint is the base URL of the service,
+	// such as "https://s3.amazonaws.com".
+	Endpoint string
+
+	// Region is the region requests are signed for.
+	// It defaults to "us-east-1".
+	Region string
+
+	// AccessKey and SecretKey are the credentials requests are
+	// signed with, and SessionToken is the security token of
+	// temporary credentials, if any.
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+
+	// PartSize is the size of the parts in which objects larger than
+	// it are uploaded via multipart uploads. It defaults to
+	// DefaultPartSize, and is used as is otherwise. It must be within
+	// the limits of the service, which for Amazon S3 accepts parts of
+	// 5 MiB to 5 GiB, failing uploads with smaller ones.
+	PartSize int
+
+	// Client is the HTTP client used for requests.
+	// It defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// Error reports a failed request to the service.
+type Error struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s %s: %d %s", e.Method, e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Code != "" {
+		msg += ": " + e.Code
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// GetObject returns a reader for the content of the object at key in bucket.
+func (st *Store) GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	resp, err := st.do(ctx, "GET", bucket, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// PutObject stores the data read from r until io.EOF as the content of
+// the object at key in bucket. Objects larger than the part size are
+// uploaded in parts, so data of arbitrary size may be streamed without
+// being held in memory at once.
+func (st *Store) PutObject(ctx context.Context, bucket, key string, r io.Reader) error {
+	partSize := st.PartSize
+	if partSize <= 0 {
+		partSize = DefaultPartSize
+	}
+	part := make([]byte, partSize)
+	n, err := io.ReadFull(r, part)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		resp, err := st.do(ctx, "PUT", bucket, key, nil, part[:n])
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := st.do(ctx, "POST", bucket, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return err
+	}
+	var upload struct {
+		UploadId string
+	}
+	err = decodeBody(resp, &upload)
+	if err != nil {
+		return err
+	}
+	uploadQuery := url.Values{"uploadId": {upload.UploadId}}
+
+	type completedPart struct {
+		PartNumber int
+		ETag       string
+	}
+	var complete struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}
+	for number := 1; n > 0; number++ {
+		query := url.Values{"partNumber": {fmt.Sprint(number)}, "uploadId": {upload.UploadId}}
+		resp, err = st.do(ctx, "PUT", bucket, key, query, part[:n])
+		if err != nil {
+			break
+		}
+		resp.Body.Close()
+		complete.Parts = append(complete.Parts, completedPart{number, resp.Header.Get("ETag")})
+		n, err = io.ReadFull(r, part)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		var data []byte
+		data, err = xml.Marshal(&complete)
+		if err == nil {
+			resp, err = st.do(ctx, "POST", bucket, key, uploadQuery, data)
+		}
+		if err == nil {
+			// The service may report errors after the
+			// request itself is acknowledged.
+			var result struct {
+				XMLName xml.Name
+				Code    string
+				Message string
+			}
+			err = decodeBody(resp, &result)
+			if err == nil && result.XMLName.Local == "Error" {
+				err = &Error{"POST", resp.Request.URL.String(), resp.StatusCode, result.Code, result.Message}
+			}
+		}
+	}
+	if err != nil {
+		// Release the parts uploaded so far.
+		resp, aerr := st.do(context.Background(), "DELETE", bucket, key, uploadQuery, nil)
+		if aerr == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+func decodeBody(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	if err := xml.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("cannot decode response to %s %s: %v", resp.Request.Method, resp.Request.URL, err)
+	}
+	return nil
+}
+
+// do sends an authenticated request for the object at key in bucket,
+// and returns the response if the request succeeded.
+func (st *Store) do(ctx context.Context, method, bucket, key string, query url.Values, body []byte) (*http.Response, error) {
+	u, err := url.Parse(st.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	setPath(u, strings.TrimRight(u.Path, "/")+"/"+bucket+"/"+key)
+	u.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = int64(len(body))
+	if st.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", st.SessionToken)
+	}
+	st.sign(req, body, time.Now())
+
+	client := st.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		e := &Error{Method: method, URL: req.URL.String(), StatusCode: resp.StatusCode}
+		var result struct {
+			Code    string
+			Message string
+		}
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		if xml.Unmarshal(data, &result) == nil {
+			e.Code, e.Message = result.Code, result.Message
+		}
+		return nil, e
+	}
+	return resp, nil
+}
+
+const timeFormat = "20060102T150405Z"
+
+// sign adds to req the headers authenticating it with AWS Signature
+// Version 4, signing the host and all headers already set in req.
+func (st *Store) sign(req *http.Request, body []byte, now time.Time) {
+	region := st.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	amzDate := now.UTC().Format(timeFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	date := amzDate[:8]
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+st.SecretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+st.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// setPath sets the path of u, escaped as required by signatures.
+func setPath(u *url.URL, path string) {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = escape(segment)
+	}
+	u.Path = path
+	u.RawPath = strings.Join(segments, "/")
+}
+
+func canonicalQuery(query url.Values) string {
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, escape(name)+"="+escape(value))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func escape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}